@@ -79,6 +79,25 @@ func TestMountStores(t *testing.T) {
 	require.NotNil(t, store2)
 }
 
+func TestMountNamespacedStores(t *testing.T) {
+	app := newBaseApp(t.Name())
+	reg := sdk.NewStoreKeyRegistry()
+	app.cms.(interface {
+		SetKeyRegistry(*sdk.StoreKeyRegistry)
+	}).SetKeyRegistry(reg)
+
+	// namespaced keys are KVStoreKeys, and claim their module ID on mount
+	bankKey := sdk.NewNamespacedKVStoreKey("bank", 0x01)
+	app.MountStoresIAVL(capKey1, bankKey)
+	owner, ok := reg.Owner(0x01)
+	require.True(t, ok)
+	require.Equal(t, "bank", owner)
+	require.Panics(t, func() { app.MountStoresIAVL(sdk.NewNamespacedKVStoreKey("gov", 0x01)) })
+
+	require.Nil(t, app.LoadLatestVersion(capKey1))
+	require.NotNil(t, app.cms.GetCommitKVStore(bankKey))
+}
+
 // Test that we can make commits and then reload old versions.
 // Test that LoadLatestVersion actually does.
 func TestLoadVersion(t *testing.T) {
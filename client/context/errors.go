@@ -3,6 +3,7 @@ package context
 import (
 	sdk "github.com/cosmos/cosmos-sdk/types"
 	"github.com/pkg/errors"
+	abci "github.com/tendermint/tendermint/abci/types"
 )
 
 // ErrInvalidAccount returns a standardized error reflecting that a given
@@ -19,3 +20,14 @@ func ErrVerifyCommit(height int64) error {
 	return errors.Errorf(`The height of base truststore in gaia-lite is higher than height %d. 
 Can't verify blockchain proof at this height. Please set --trust-node to true and try again`, height)
 }
+
+// QueryError is returned by queries the node answered with a non-OK code. It
+// holds the response, so that callers can tell errors apart by their code or
+// info rather than by their log.
+type QueryError struct {
+	Response abci.ResponseQuery
+}
+
+func (err QueryError) Error() string {
+	return err.Response.Log
+}
@@ -74,6 +74,14 @@ func (ms multiStore) LoadVersion(ver int64) error {
 	panic("not implemented")
 }
 
+func (ms multiStore) RollbackToVersion(ver int64) error {
+	panic("not implemented")
+}
+
+func (ms multiStore) ApproxKeyCount() map[string]int64 {
+	panic("not implemented")
+}
+
 func (ms multiStore) GetKVStore(key sdk.StoreKey) sdk.KVStore {
 	return ms.kv[key]
 }
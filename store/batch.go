@@ -0,0 +1,69 @@
+package store
+
+import (
+	dbm "github.com/tendermint/tendermint/libs/db"
+)
+
+// defaultFlushEvery is the number of operations after which a flushingBatch
+// writes its pending operations.
+const defaultFlushEvery = 10000
+
+var _ dbm.Batch = (*flushingBatch)(nil)
+
+// flushingBatch is a dbm.Batch which writes its pending operations every
+// flushEvery operations, so that deleting or moving all keys of a large
+// store doesn't hold them all in memory. Unlike a single dbm.Batch, the
+// operations are not applied atomically, so callers must be resumable.
+type flushingBatch struct {
+	db         dbm.DB
+	batch      dbm.Batch
+	pending    int
+	flushEvery int
+}
+
+func newFlushingBatch(db dbm.DB, flushEvery int) *flushingBatch {
+	if flushEvery <= 0 {
+		flushEvery = defaultFlushEvery
+	}
+	return &flushingBatch{
+		db:         db,
+		batch:      db.NewBatch(),
+		flushEvery: flushEvery,
+	}
+}
+
+// Implements dbm.Batch.
+func (b *flushingBatch) Set(key, value []byte) {
+	b.batch.Set(key, value)
+	b.added()
+}
+
+// Implements dbm.Batch.
+func (b *flushingBatch) Delete(key []byte) {
+	b.batch.Delete(key)
+	b.added()
+}
+
+// Implements dbm.Batch. It writes the pending operations.
+func (b *flushingBatch) Write() {
+	b.batch.Write()
+	b.renew()
+}
+
+// Implements dbm.Batch. It writes the pending operations and syncs.
+func (b *flushingBatch) WriteSync() {
+	b.batch.WriteSync()
+	b.renew()
+}
+
+func (b *flushingBatch) added() {
+	b.pending++
+	if b.pending >= b.flushEvery {
+		b.Write()
+	}
+}
+
+func (b *flushingBatch) renew() {
+	b.batch = b.db.NewBatch()
+	b.pending = 0
+}
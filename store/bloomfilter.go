@@ -0,0 +1,57 @@
+package store
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// bloomFilter is a set of keys which may report keys as members which were
+// never added, but never misses a key which was added.
+type bloomFilter struct {
+	bits   []uint64
+	hashes uint64
+}
+
+// newBloomFilter returns a bloomFilter sized for a false positive rate of
+// about 1% once expectedKeys keys are added.
+func newBloomFilter(expectedKeys int) *bloomFilter {
+	if expectedKeys < 1 {
+		expectedKeys = 1
+	}
+	// m = -n*ln(p)/ln(2)^2 bits and k = m/n*ln(2) hashes for p = 0.01.
+	m := uint64(math.Ceil(float64(expectedKeys) * 9.6))
+	return &bloomFilter{
+		bits:   make([]uint64, (m+63)/64),
+		hashes: 7,
+	}
+}
+
+// positions derives the bit positions of key from two halves of its hash
+// by double hashing.
+func (bf *bloomFilter) positions(key []byte, fn func(pos uint64) bool) bool {
+	h := fnv.New64a()
+	h.Write(key) // nolint: errcheck
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	m := uint64(len(bf.bits)) * 64
+	for i := uint64(0); i < bf.hashes; i++ {
+		if !fn((h1 + i*h2) % m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (bf *bloomFilter) add(key []byte) {
+	bf.positions(key, func(pos uint64) bool {
+		bf.bits[pos/64] |= 1 << (pos % 64)
+		return true
+	})
+}
+
+// mayContain returns false only if key was definitely never added.
+func (bf *bloomFilter) mayContain(key []byte) bool {
+	return bf.positions(key, func(pos uint64) bool {
+		return bf.bits[pos/64]&(1<<(pos%64)) != 0
+	})
+}
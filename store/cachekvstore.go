@@ -2,36 +2,333 @@ package store
 
 import (
 	"bytes"
+	"container/list"
+	"fmt"
 	"io"
 	"sort"
 	"sync"
 
 	cmn "github.com/tendermint/tendermint/libs/common"
+	dbm "github.com/tendermint/tendermint/libs/db"
+	"github.com/tendermint/tendermint/libs/log"
 )
 
-// If value is nil but deleted is false, it means the parent doesn't have the
-// key.  (No need to delete upon Write())
+// If present and deleted are both false, it means the parent doesn't have the
+// key.  (No need to delete upon Write()) A present key may hold an empty value.
 type cValue struct {
 	value   []byte
+	present bool
 	deleted bool
 	dirty   bool
+
+	// unknown is set for a nil value read from the parent by Get, which may
+	// be a missing key or an empty value. Has resolves it.
+	unknown bool
 }
 
 // cacheKVStore wraps an in-memory cache around an underlying KVStore.
 type cacheKVStore struct {
-	mtx    sync.Mutex
+	mtx    sync.RWMutex
 	cache  map[string]cValue
 	parent KVStore
+
+	// If maxEntries is non-zero, clean entries are evicted in least
+	// recently used order once the cache holds more than maxEntries.
+	// Dirty entries are never evicted.
+	maxEntries int
+	lru        *list.List
+	lruElems   map[string]*list.Element
+
+	// If cacheResident is true, iterators are served from the cache alone
+	// without scanning the parent.
+	cacheResident bool
+
+	// If noCopyOnRead is true, Get and iterators return the cached values
+	// themselves instead of copies.
+	noCopyOnRead bool
+
+	// If prefetchChunkSize is non-zero, iterators read the parent range in
+	// chunks of that many items, see NewCacheKVStoreWithPrefetch.
+	prefetchChunkSize int
+
+	// If maxDirty is non-zero, the cache is flushed to the parent once it
+	// holds more than maxDirty dirty entries, see
+	// NewCacheKVStoreWithAutoFlush. dirtyCount counts the dirty entries.
+	maxDirty   int
+	dirtyCount int
+
+	// parentKeys, if set, holds every key which may exist in the parent,
+	// see NewCacheKVStoreWithNegativeCache.
+	parentKeys *bloomFilter
+
+	// keyValidator, if set, rejects keys in addition to nil keys, see
+	// NewCacheKVStoreWithKeyValidator.
+	keyValidator func(key []byte) error
+
+	// If verifyIteration is true, iterators check their output against the
+	// range computed independently, see NewCacheKVStoreVerified.
+	verifyIteration bool
+
+	// deletedRanges holds the ranges deleted with DeleteRange, in which all
+	// keys of the parent are treated as deleted.
+	deletedRanges []keyRange
+
+	// leakLogger, if set, receives the iterators garbage collected without
+	// being closed, see DetectIteratorLeaks.
+	leakLogger log.Logger
+
+	// traceContext holds the context of the traces set up by
+	// CacheWrapWithTrace on this store or the stores it wraps, which is
+	// merged into the context of further traced wraps.
+	traceContext TraceContext
+
+	// depth is the number of cacheKVStores in the wrap chain, including
+	// this one. Wrapping beyond maxDepth panics.
+	depth    int
+	maxDepth int
+}
+
+// DefaultMaxCacheWrapDepth is the maximum number of nested cacheKVStores
+// unless configured otherwise with MaxCacheWrapDepth.
+const DefaultMaxCacheWrapDepth = 256
+
+// CacheKVStoreOption configures a cacheKVStore on construction.
+type CacheKVStoreOption func(*cacheKVStore)
+
+// CacheResidentIteration makes iterators skip the parent scan and iterate
+// over the cached writes alone.
+// CONTRACT: Only use this if every key in any iterated range is known to be
+// written to the cache, otherwise the parent's keys are silently missed.
+func CacheResidentIteration() CacheKVStoreOption {
+	return func(ci *cacheKVStore) {
+		ci.cacheResident = true
+	}
+}
+
+// NoCopyOnRead makes Get and iterators return the cached values themselves,
+// saving the copy made on every read.
+// CONTRACT: Only use this if no caller modifies the returned values, as that
+// silently modifies the cache.
+func NoCopyOnRead() CacheKVStoreOption {
+	return func(ci *cacheKVStore) {
+		ci.noCopyOnRead = true
+	}
+}
+
+// MaxCacheWrapDepth sets the maximum number of nested cacheKVStores for this
+// store and all stores wrapping it. A maxDepth of zero or less disables the
+// limit.
+func MaxCacheWrapDepth(maxDepth int) CacheKVStoreOption {
+	return func(ci *cacheKVStore) {
+		ci.maxDepth = maxDepth
+	}
+}
+
+// DetectIteratorLeaks makes iterators which are garbage collected without
+// being closed log the stack they were created at to logger. Stores
+// cache-wrapping the store inherit the detection. Capturing the stacks is
+// expensive, so this is meant for tests and debugging, not production.
+func DetectIteratorLeaks(logger log.Logger) CacheKVStoreOption {
+	return func(ci *cacheKVStore) {
+		ci.leakLogger = logger
+	}
 }
 
 var _ CacheKVStore = (*cacheKVStore)(nil)
 
+// BatchWriter is implemented by parent stores which can apply a set of
+// writes atomically. If the parent of a cacheKVStore implements it, Write()
+// flushes all pending operations through a single batch.
+type BatchWriter interface {
+	NewBatch() dbm.Batch
+}
+
+// NamedStore is implemented by stores which carry the name they are
+// mounted under. The rootMultiStore names the IAVL and transient stores it
+// mounts, and the KVStores wrapping other KVStores forward the name of their
+// parent. An empty name means the store carries none.
+type NamedStore interface {
+	StoreName() string
+}
+
+// storeName returns the name store carries, or an empty string if it
+// carries none.
+func storeName(store KVStore) string {
+	switch store := store.(type) {
+	case *cacheKVStore:
+		name, _ := store.StoreName()
+		return name
+	case NamedStore:
+		return store.StoreName()
+	}
+	return ""
+}
+
 // nolint
-func NewCacheKVStore(parent KVStore) *cacheKVStore {
-	return &cacheKVStore{
-		cache:  make(map[string]cValue),
-		parent: parent,
+func NewCacheKVStore(parent KVStore, opts ...CacheKVStoreOption) *cacheKVStore {
+	ci := &cacheKVStore{
+		cache:    make(map[string]cValue),
+		parent:   parent,
+		depth:    1,
+		maxDepth: DefaultMaxCacheWrapDepth,
+	}
+	if depth, maxDepth, ok := storeCacheDepth(parent); ok {
+		ci.depth, ci.maxDepth = depth+1, maxDepth
+	}
+	ci.keyValidator = storeKeyValidator(parent)
+	if wrapped := parentCacheKVStore(parent); wrapped != nil {
+		ci.traceContext = wrapped.traceContext
+		ci.leakLogger = wrapped.leakLogger
+	}
+	for _, opt := range opts {
+		opt(ci)
+	}
+	if ci.maxDepth > 0 && ci.depth > ci.maxDepth {
+		panic(fmt.Sprintf("cache-wrap depth %d exceeds the maximum of %d", ci.depth, ci.maxDepth))
+	}
+	return ci
+}
+
+// parentCacheKVStore returns the closest cacheKVStore wrapped by parent,
+// looking through trace wrappers, or nil if there is none.
+func parentCacheKVStore(parent KVStore) *cacheKVStore {
+	for {
+		switch store := parent.(type) {
+		case *cacheKVStore:
+			return store
+		case *TraceKVStore:
+			parent = store.parent
+		default:
+			return nil
+		}
+	}
+}
+
+// cacheDepthStore is implemented by cacheKVStores and by the KVStores
+// wrapping other KVStores, so that the depth of a cache-wrap is counted
+// through wrappers such as prefix or gas stores.
+type cacheDepthStore interface {
+	// cacheDepth returns the depth and the maximum depth of the closest
+	// cacheKVStore wrapped, and false if there is none.
+	cacheDepth() (depth, maxDepth int, ok bool)
+}
+
+// storeCacheDepth returns the cacheDepth of store if it implements
+// cacheDepthStore.
+func storeCacheDepth(store KVStore) (depth, maxDepth int, ok bool) {
+	if ds, isDepthStore := store.(cacheDepthStore); isDepthStore {
+		return ds.cacheDepth()
+	}
+	return 0, 0, false
+}
+
+// cacheDepth implements cacheDepthStore.
+func (ci *cacheKVStore) cacheDepth() (int, int, bool) {
+	return ci.depth, ci.maxDepth, true
+}
+
+// keyValidatorStore is implemented by cacheKVStores and by the KVStores
+// wrapping other KVStores, so that a key validator is inherited through
+// wrappers like the cache-wrap depth, see cacheDepthStore.
+type keyValidatorStore interface {
+	// cacheKeyValidator returns the key validator of the closest cacheKVStore
+	// wrapped, applied to the keys of this store, or nil if there is none.
+	cacheKeyValidator() func(key []byte) error
+}
+
+// storeKeyValidator returns the cacheKeyValidator of store if it implements
+// keyValidatorStore.
+func storeKeyValidator(store KVStore) func(key []byte) error {
+	if vs, ok := store.(keyValidatorStore); ok {
+		return vs.cacheKeyValidator()
+	}
+	return nil
+}
+
+// cacheKeyValidator implements keyValidatorStore.
+func (ci *cacheKVStore) cacheKeyValidator() func(key []byte) error {
+	return ci.keyValidator
+}
+
+// NewCacheKVStoreWithSize returns a cacheKVStore which holds at most
+// maxEntries clean entries, evicting the least recently used ones first.
+// A maxEntries of zero leaves the cache unbounded.
+func NewCacheKVStoreWithSize(parent KVStore, maxEntries int) *cacheKVStore {
+	ci := NewCacheKVStore(parent)
+	if maxEntries > 0 {
+		ci.maxEntries = maxEntries
+		ci.lru = list.New()
+		ci.lruElems = make(map[string]*list.Element)
+	}
+	return ci
+}
+
+// NewCacheKVStoreWithPrefetch returns a cacheKVStore whose iterators read the
+// parent range in chunks of chunkSize items into memory, instead of stepping
+// the parent's iterator item by item. This trades memory for fewer round
+// trips to parents with high latency, e.g. remote DBs.
+func NewCacheKVStoreWithPrefetch(parent KVStore, chunkSize int) *cacheKVStore {
+	ci := NewCacheKVStore(parent)
+	if chunkSize > 0 {
+		ci.prefetchChunkSize = chunkSize
+	}
+	return ci
+}
+
+// NewCacheKVStoreWithKeyValidator returns a cacheKVStore which rejects keys
+// for which validator returns an error, e.g. keys the parent can't store.
+// Get, Set, Has and Delete panic with the offending key and the error. Stores
+// cache-wrapping the returned store inherit the validator.
+func NewCacheKVStoreWithKeyValidator(parent KVStore, validator func(key []byte) error) *cacheKVStore {
+	ci := NewCacheKVStore(parent)
+	ci.keyValidator = validator
+	return ci
+}
+
+// NewCacheKVStoreWithAutoFlush returns a cacheKVStore which writes its
+// pending operations to the parent as soon as more than maxDirty keys are
+// dirty, to bound the memory used by e.g. streaming ingests.
+// CONTRACT: Use this only if the writes need not be atomic. The parent sees
+// the operations of each flush right away, and a later failure leaves the
+// operations flushed so far applied, so a Write is no longer all-or-nothing.
+func NewCacheKVStoreWithAutoFlush(parent KVStore, maxDirty int) *cacheKVStore {
+	ci := NewCacheKVStore(parent)
+	if maxDirty > 0 {
+		ci.maxDirty = maxDirty
+	}
+	return ci
+}
+
+// NewCacheKVStoreVerified returns a cacheKVStore whose iterators check every
+// item they return against the expected range, computed by reading the whole
+// parent range up front and applying the cached writes to it, and panic
+// naming the first diverging key. This is a debugging aid for the merge of
+// the cache and the parent, and far too expensive for production use.
+func NewCacheKVStoreVerified(parent KVStore) *cacheKVStore {
+	ci := NewCacheKVStore(parent)
+	ci.verifyIteration = true
+	return ci
+}
+
+// NewCacheKVStoreWithNegativeCache returns a cacheKVStore which answers Get
+// and Has for keys definitely absent from the parent without reading the
+// parent, which pays off for stores where most reads miss, e.g. uniqueness
+// indexes. The parent's keys are scanned once into a bloom filter sized for
+// expectedKeys keys. As a bloom filter only answers "definitely not added"
+// reliably, it holds the keys the parent may have rather than the missing
+// ones, so a false positive costs a parent read but never hides a key. Keys
+// set through the store are added to the filter.
+// CONTRACT: The parent must not be written to except through this store.
+func NewCacheKVStoreWithNegativeCache(parent KVStore, expectedKeys int) *cacheKVStore {
+	ci := NewCacheKVStore(parent)
+	ci.parentKeys = newBloomFilter(expectedKeys)
+
+	iter := parent.Iterator(nil, nil)
+	defer iter.Close()
+	for ; iter.Valid(); iter.Next() {
+		ci.parentKeys.add(iter.Key())
 	}
+	return ci
 }
 
 // Implements Store.
@@ -39,20 +336,21 @@ func (ci *cacheKVStore) GetStoreType() StoreType {
 	return ci.parent.GetStoreType()
 }
 
-// Implements KVStore.
+// StoreName returns the name of the parent store, propagating through any
+// further cache-wraps. It returns false if the parent carries no name.
+func (ci *cacheKVStore) StoreName() (string, bool) {
+	name := storeName(ci.parent)
+	return name, name != ""
+}
+
+// Get implements KVStore. Unless NoCopyOnRead is set, it returns a copy of
+// the cached value, so callers may modify it freely.
 func (ci *cacheKVStore) Get(key []byte) (value []byte) {
-	ci.mtx.Lock()
-	defer ci.mtx.Unlock()
 	ci.assertValidKey(key)
-
-	cacheValue, ok := ci.cache[string(key)]
-	if !ok {
-		value = ci.parent.Get(key)
-		ci.setCacheValue(key, value, false, false)
-	} else {
-		value = cacheValue.value
+	value = ci.getCacheValue(key, false).value
+	if !ci.noCopyOnRead {
+		value = cp(value)
 	}
-
 	return value
 }
 
@@ -63,13 +361,72 @@ func (ci *cacheKVStore) Set(key []byte, value []byte) {
 	ci.assertValidKey(key)
 	ci.assertValidValue(value)
 
-	ci.setCacheValue(key, value, false, true)
+	if ci.parentKeys != nil {
+		ci.parentKeys.add(key)
+	}
+	ci.setCacheValue(key, value, true, false, true)
+	ci.autoFlush()
+}
+
+// SetBatch sets all of the pairs, e.g. to load genesis state. Unlike calling
+// Set for each pair, the cache is locked only once. Pairs with a nil value
+// are skipped. All keys are validated before any pair is set, so an invalid
+// key panics without setting anything.
+func (ci *cacheKVStore) SetBatch(pairs []cmn.KVPair) {
+	ci.mtx.Lock()
+	defer ci.mtx.Unlock()
+	for _, pair := range pairs {
+		if pair.Value != nil {
+			ci.assertValidKey(pair.Key)
+		}
+	}
+
+	for _, pair := range pairs {
+		if pair.Value == nil {
+			continue
+		}
+		if ci.parentKeys != nil {
+			ci.parentKeys.add(pair.Key)
+		}
+		ci.setCacheValue(pair.Key, pair.Value, true, false, true)
+		ci.autoFlush()
+	}
 }
 
 // Implements KVStore.
 func (ci *cacheKVStore) Has(key []byte) bool {
-	value := ci.Get(key)
-	return value != nil
+	ci.assertValidKey(key)
+	return ci.getCacheValue(key, true).present
+}
+
+// HasAll returns whether all of the keys exist. Unlike calling Has for each
+// key, the cache is locked only once.
+func (ci *cacheKVStore) HasAll(keys [][]byte) bool {
+	ci.mtx.Lock()
+	defer ci.mtx.Unlock()
+
+	for _, key := range keys {
+		ci.assertValidKey(key)
+		if !ci.getCacheValueLocked(key, true).present {
+			return false
+		}
+	}
+	return true
+}
+
+// HasAny returns whether any of the keys exists. Unlike calling Has for each
+// key, the cache is locked only once.
+func (ci *cacheKVStore) HasAny(keys [][]byte) bool {
+	ci.mtx.Lock()
+	defer ci.mtx.Unlock()
+
+	for _, key := range keys {
+		ci.assertValidKey(key)
+		if ci.getCacheValueLocked(key, true).present {
+			return true
+		}
+	}
+	return false
 }
 
 // Implements KVStore.
@@ -78,7 +435,97 @@ func (ci *cacheKVStore) Delete(key []byte) {
 	defer ci.mtx.Unlock()
 	ci.assertValidKey(key)
 
-	ci.setCacheValue(key, nil, true, true)
+	ci.setCacheValue(key, nil, false, true, true)
+	ci.autoFlush()
+}
+
+// DeleteRange deletes all keys in [start, end), where a nil start or end
+// leaves the range unbounded on that side. Unlike calling Delete for each
+// key, neither the parent is scanned nor an entry cached per key: the range
+// is recorded as a tombstone hiding the parent's keys in it, until Write()
+// deletes them from the parent, through its DeleteRange if the parent is a
+// RangeDeleter. Keys set after the range was deleted are kept.
+// NOTE: IterateDirty doesn't report the keys deleted by ranges.
+func (ci *cacheKVStore) DeleteRange(start, end []byte) {
+	ci.mtx.Lock()
+	defer ci.mtx.Unlock()
+
+	kr := keyRange{start: cp(start), end: cp(end)}
+	ci.deletedRanges = append(ci.deletedRanges, kr)
+
+	// Drop the cached entries in the range, the tombstone hides the parent.
+	for key, cacheValue := range ci.cache {
+		if !kr.contains([]byte(key)) {
+			continue
+		}
+		if cacheValue.dirty {
+			ci.dirtyCount--
+		}
+		delete(ci.cache, key)
+		if ci.lru != nil {
+			if elem, ok := ci.lruElems[key]; ok {
+				ci.lru.Remove(elem)
+				delete(ci.lruElems, key)
+			}
+		}
+	}
+}
+
+// getCacheValue returns the cached value for key, reading it through from
+// the parent on a cache miss. Unless withPresence is set, the presence of
+// the key is unknown if its value is nil.
+func (ci *cacheKVStore) getCacheValue(key []byte, withPresence bool) cValue {
+	ci.mtx.RLock()
+	cacheValue, ok := ci.cache[string(key)]
+	ci.mtx.RUnlock()
+	if ok && ci.lru == nil && !(withPresence && cacheValue.unknown) {
+		return cacheValue
+	}
+
+	// Cache miss or LRU update, upgrade to the write lock.
+	ci.mtx.Lock()
+	defer ci.mtx.Unlock()
+
+	// Another writer may have populated the key while we were unlocked.
+	return ci.getCacheValueLocked(key, withPresence)
+}
+
+// getCacheValueLocked is getCacheValue for callers holding the write lock.
+func (ci *cacheKVStore) getCacheValueLocked(key []byte, withPresence bool) cValue {
+	cacheValue, ok := ci.cache[string(key)]
+	if ok && !(withPresence && cacheValue.unknown) {
+		if !cacheValue.dirty {
+			ci.touchLRU(string(key))
+		}
+		return cacheValue
+	}
+
+	if !ok && (ci.inDeletedRange(key) || (ci.parentKeys != nil && !ci.parentKeys.mayContain(key))) {
+		ci.setCacheValue(key, nil, false, false, false)
+		return cValue{}
+	}
+
+	// The parent may not tell a missing key from an empty value on Get, so
+	// a nil value is only checked with Has when the presence is asked for.
+	var value []byte
+	if !ok {
+		value = ci.parent.Get(key)
+	}
+	present := value != nil
+	if !present && !withPresence {
+		ci.setCacheValue(key, nil, false, false, false)
+		if cacheValue, ok := ci.cache[string(key)]; ok {
+			cacheValue.unknown = true
+			ci.cache[string(key)] = cacheValue
+		}
+		return cValue{unknown: true}
+	}
+	if !present && ci.parent.Has(key) {
+		value, present = []byte{}, true
+	}
+	ci.setCacheValue(key, value, present, false, false)
+
+	return cValue{value: value, present: present}
 }
 
 // Implements KVStore
@@ -93,9 +540,119 @@ func (ci *cacheKVStore) Gas(meter GasMeter, config GasConfig) KVStore {
 
 // Implements CacheKVStore.
 func (ci *cacheKVStore) Write() {
+	if _, err := ci.Flush(); err != nil {
+		panic(err)
+	}
+}
+
+// Flush writes the cached operations to the parent like Write, and returns
+// the number of operations applied. The store stays usable afterwards. If
+// the parent is a BatchWriter and writing the batch fails, the error is
+// returned and the cache is kept, so the flush can be retried.
+func (ci *cacheKVStore) Flush() (keysWritten int, err error) {
 	ci.mtx.Lock()
 	defer ci.mtx.Unlock()
 
+	return ci.flushLocked()
+}
+
+// autoFlush flushes the cache if it holds more dirty entries than allowed by
+// NewCacheKVStoreWithAutoFlush. The caller must hold the write lock.
+func (ci *cacheKVStore) autoFlush() {
+	if ci.maxDirty == 0 || ci.dirtyCount <= ci.maxDirty {
+		return
+	}
+	if _, err := ci.flushLocked(); err != nil {
+		panic(err)
+	}
+}
+
+// flushLocked is Flush for callers holding the write lock.
+func (ci *cacheKVStore) flushLocked() (keysWritten int, err error) {
+	// Use a batch if the parent supports it so the write happens atomically.
+	if bw, ok := ci.parent.(BatchWriter); ok {
+		batch := bw.NewBatch()
+		keysWritten = ci.writeDeletedRanges(batch)
+		keysWritten += ci.writeKeys(batch, ci.sortedDirtyKeys())
+		if err := writeBatch(batch); err != nil {
+			return 0, err
+		}
+	} else {
+		keysWritten = ci.writeDeletedRanges(ci.parent)
+		keysWritten += ci.writeKeys(ci.parent, ci.sortedDirtyKeys())
+	}
+
+	// Clear the cache
+	ci.clearCache()
+	return keysWritten, nil
+}
+
+// writeBatch writes the batch, returning the panic dbm backends raise on
+// write failures as error.
+func writeBatch(batch dbm.Batch) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("failed to write batch: %v", r)
+		}
+	}()
+	batch.Write()
+	return nil
+}
+
+// WriteToBatch adds the cached operations to the given batch in key order
+// instead of applying them to the parent, and clears the cache. This lets the
+// changes of several stores be committed atomically.
+// The batch operates on the parent's key space, so the parent must be the
+// DB-backed store the batch belongs to, and WriteToBatch panics if the parent
+// is not a BatchWriter.
+// CONTRACT: The caller is responsible for writing the batch. Until it does,
+// the parent doesn't reflect the changes.
+func (ci *cacheKVStore) WriteToBatch(batch dbm.Batch) {
+	if _, ok := ci.parent.(BatchWriter); !ok {
+		panic("cacheKVStore parent doesn't support batches")
+	}
+
+	ci.mtx.Lock()
+	defer ci.mtx.Unlock()
+
+	ci.writeDeletedRanges(batch)
+	ci.writeKeys(batch, ci.sortedDirtyKeys())
+	ci.clearCache()
+}
+
+// IterateDirty calls fn in key order for each operation the next Write
+// would apply to the parent, with deleted telling deletes from sets. Deletes
+// have a nil value. Iteration stops when fn returns true. The operations are
+// collected before calling fn, so fn may use the store.
+func (ci *cacheKVStore) IterateDirty(fn func(key, value []byte, deleted bool) (stop bool)) {
+	ci.mtx.RLock()
+	keys := ci.sortedDirtyKeys()
+	values := make([]cValue, len(keys))
+	for i, key := range keys {
+		values[i] = ci.cache[key]
+	}
+	ci.mtx.RUnlock()
+
+	for i, key := range keys {
+		cacheValue := values[i]
+		if !cacheValue.deleted && !cacheValue.present {
+			// Write skips it, it already doesn't exist in parent.
+			continue
+		}
+
+		value := cacheValue.value
+		if !ci.noCopyOnRead {
+			value = cp(value)
+		}
+		if fn([]byte(key), value, cacheValue.deleted) {
+			return
+		}
+	}
+}
+
+// sortedDirtyKeys returns the keys of all dirty cache entries in order.
+// CONTRACT: The caller must hold the lock.
+func (ci *cacheKVStore) sortedDirtyKeys() []string {
 	// We need a copy of all of the keys.
 	// Not the best, but probably not a bottleneck depending.
 	keys := make([]string, 0, len(ci.cache))
@@ -106,22 +663,35 @@ func (ci *cacheKVStore) Write() {
 	}
 
 	sort.Strings(keys)
+	return keys
+}
 
-	// TODO: Consider allowing usage of Batch, which would allow the write to
-	// at least happen atomically.
+// Reset discards all cached changes without writing them to the parent, so
+// the store can be reused as a clean cache-wrap of its parent.
+// NOTE: Outstanding iterators are invalidated by a Reset.
+func (ci *cacheKVStore) Reset() {
+	ci.mtx.Lock()
+	defer ci.mtx.Unlock()
+
+	ci.clearCache()
+}
+
+// writeKeys applies the cached operations for the given sorted keys and
+// returns the number of operations applied.
+func (ci *cacheKVStore) writeKeys(sd dbm.SetDeleter, keys []string) (n int) {
 	for _, key := range keys {
 		cacheValue := ci.cache[key]
 		if cacheValue.deleted {
-			ci.parent.Delete([]byte(key))
-		} else if cacheValue.value == nil {
+			sd.Delete([]byte(key))
+		} else if !cacheValue.present {
 			// Skip, it already doesn't exist in parent.
+			continue
 		} else {
-			ci.parent.Set([]byte(key), cacheValue.value)
+			sd.Set([]byte(key), cacheValue.value)
 		}
+		n++
 	}
-
-	// Clear the cache
-	ci.cache = make(map[string]cValue)
+	return n
 }
 
 //----------------------------------------
@@ -132,9 +702,24 @@ func (ci *cacheKVStore) CacheWrap() CacheWrap {
 	return NewCacheKVStore(ci)
 }
 
-// CacheWrapWithTrace implements the CacheWrapper interface.
+// CacheWrapWithTrace implements the CacheWrapper interface. The context of
+// the traces set up further up the wrap chain is carried down, so the traces
+// include the fields of tc merged over the fields of the outer contexts.
 func (ci *cacheKVStore) CacheWrapWithTrace(w io.Writer, tc TraceContext) CacheWrap {
-	return NewCacheKVStore(NewTraceKVStore(ci, w, tc))
+	merged := tc
+	if len(ci.traceContext) > 0 {
+		merged = make(TraceContext, len(ci.traceContext)+len(tc))
+		for k, v := range ci.traceContext {
+			merged[k] = v
+		}
+		for k, v := range tc {
+			merged[k] = v
+		}
+	}
+
+	wrap := NewCacheKVStore(NewTraceKVStore(ci, w, merged))
+	wrap.traceContext = merged
+	return wrap
 }
 
 //----------------------------------------
@@ -153,20 +738,48 @@ func (ci *cacheKVStore) ReverseIterator(start, end []byte) Iterator {
 func (ci *cacheKVStore) iterator(start, end []byte, ascending bool) Iterator {
 	var parent, cache Iterator
 
-	if ascending {
+	var expected []cmn.KVPair
+	if ci.verifyIteration {
+		expected = ci.expectedRange(start, end, ascending)
+	}
+
+	if ci.cacheResident {
+		// The range is cache-resident, merge against an empty parent so
+		// deletes are still skipped.
+		parent = newMemIterator(start, end, nil, ascending)
+	} else if ci.prefetchChunkSize > 0 {
+		parent = newPrefetchIterator(ci.parent, start, end, ascending, ci.prefetchChunkSize)
+	} else if ascending {
 		parent = ci.parent.Iterator(start, end)
 	} else {
 		parent = ci.parent.ReverseIterator(start, end)
 	}
 
+	ci.mtx.RLock()
+	deletedRanges := ci.deletedRanges
+	ci.mtx.RUnlock()
+	if len(deletedRanges) > 0 {
+		parent = newTombstoneIterator(parent, deletedRanges)
+	}
+
 	items := ci.dirtyItems(ascending)
-	cache = newMemIterator(start, end, items)
+	cache = newMemIterator(start, end, items, ascending)
 
-	return newCacheMergeIterator(parent, cache, ascending)
+	var iter Iterator = newCacheMergeIterator(parent, cache, ascending)
+	if ci.verifyIteration {
+		iter = newVerifiedIterator(iter, expected)
+	}
+	if ci.leakLogger != nil {
+		iter = newLeakCheckedIterator(iter, ci.leakLogger)
+	}
+	return iter
 }
 
 // Constructs a slice of dirty items, to use w/ memIterator.
 func (ci *cacheKVStore) dirtyItems(ascending bool) []cmn.KVPair {
+	ci.mtx.RLock()
+	defer ci.mtx.RUnlock()
+
 	items := make([]cmn.KVPair, 0, len(ci.cache))
 
 	for key, cacheValue := range ci.cache {
@@ -174,7 +787,11 @@ func (ci *cacheKVStore) dirtyItems(ascending bool) []cmn.KVPair {
 			continue
 		}
 
-		items = append(items, cmn.KVPair{Key: []byte(key), Value: cacheValue.value})
+		value := cacheValue.value
+		if !ci.noCopyOnRead {
+			value = cp(value)
+		}
+		items = append(items, cmn.KVPair{Key: []byte(key), Value: value})
 	}
 
 	sort.Slice(items, func(i, j int) bool {
@@ -195,6 +812,11 @@ func (ci *cacheKVStore) assertValidKey(key []byte) {
 	if key == nil {
 		panic("key is nil")
 	}
+	if ci.keyValidator != nil {
+		if err := ci.keyValidator(key); err != nil {
+			panic(fmt.Sprintf("invalid key %X: %v", key, err))
+		}
+	}
 }
 
 func (ci *cacheKVStore) assertValidValue(value []byte) {
@@ -204,10 +826,65 @@ func (ci *cacheKVStore) assertValidValue(value []byte) {
 }
 
 // Only entrypoint to mutate ci.cache.
-func (ci *cacheKVStore) setCacheValue(key, value []byte, deleted bool, dirty bool) {
+func (ci *cacheKVStore) setCacheValue(key, value []byte, present bool, deleted bool, dirty bool) {
+	if dirty && !ci.cache[string(key)].dirty {
+		ci.dirtyCount++
+	}
 	ci.cache[string(key)] = cValue{
 		value:   value,
+		present: present,
 		deleted: deleted,
 		dirty:   dirty,
 	}
+
+	if ci.lru == nil {
+		return
+	}
+
+	if dirty {
+		// Dirty entries must survive until Write, stop tracking them.
+		if elem, ok := ci.lruElems[string(key)]; ok {
+			ci.lru.Remove(elem)
+			delete(ci.lruElems, string(key))
+		}
+	} else {
+		ci.touchLRU(string(key))
+	}
+
+	ci.evict()
+}
+
+// clearCache drops all cached entries.
+func (ci *cacheKVStore) clearCache() {
+	ci.cache = make(map[string]cValue)
+	ci.deletedRanges = nil
+	ci.dirtyCount = 0
+	if ci.lru != nil {
+		ci.lru.Init()
+		ci.lruElems = make(map[string]*list.Element)
+	}
+}
+
+// touchLRU marks a clean entry as most recently used.
+func (ci *cacheKVStore) touchLRU(key string) {
+	if ci.lru == nil {
+		return
+	}
+	if elem, ok := ci.lruElems[key]; ok {
+		ci.lru.MoveToFront(elem)
+		return
+	}
+	ci.lruElems[key] = ci.lru.PushFront(key)
+}
+
+// evict drops least recently used clean entries while the cache is over
+// its limit.
+func (ci *cacheKVStore) evict() {
+	for len(ci.cache) > ci.maxEntries && ci.lru.Len() > 0 {
+		elem := ci.lru.Back()
+		key := elem.Value.(string)
+		ci.lru.Remove(elem)
+		delete(ci.lruElems, key)
+		delete(ci.cache, key)
+	}
 }
@@ -1,12 +1,20 @@
 package store
 
 import (
+	"bytes"
 	"fmt"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/tendermint/iavl"
 	cmn "github.com/tendermint/tendermint/libs/common"
 	dbm "github.com/tendermint/tendermint/libs/db"
+	"github.com/tendermint/tendermint/libs/log"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
 )
 
 func newCacheKVStore() CacheKVStore {
@@ -89,6 +97,809 @@ func TestCacheKVStoreNested(t *testing.T) {
 	require.Equal(t, valFmt(3), mem.Get(keyFmt(1)))
 }
 
+type namedKVStore struct {
+	KVStore
+	name string
+}
+
+func (s namedKVStore) StoreName() string { return s.name }
+
+func TestCacheKVStoreIntrospection(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := iavl.NewMutableTree(db, cacheSize)
+	parent := newIAVLStore(tree, numRecent, storeEvery)
+
+	// store type propagates through the wrap chain
+	st := NewCacheKVStore(parent)
+	st2 := st.CacheWrap().(*cacheKVStore)
+	require.Equal(t, StoreTypeIAVL, st.GetStoreType())
+	require.Equal(t, StoreTypeIAVL, st2.GetStoreType())
+
+	// an unnamed parent has no name
+	_, ok := st2.StoreName()
+	require.False(t, ok)
+
+	// a named parent is found however deeply it is wrapped
+	named := NewCacheKVStore(namedKVStore{parent, "store1"})
+	nested := NewCacheKVStore(NewCacheKVStore(named))
+	name, ok := nested.StoreName()
+	require.True(t, ok)
+	require.Equal(t, "store1", name)
+}
+
+func TestCacheKVStoreMaxDepth(t *testing.T) {
+	mem := dbStoreAdapter{dbm.NewMemDB()}
+	st := NewCacheKVStore(mem, MaxCacheWrapDepth(3))
+	st2 := st.CacheWrap().(*cacheKVStore)
+	st3 := st2.CacheWrapWithTrace(&bytes.Buffer{}, nil).(*cacheKVStore)
+	require.Equal(t, 3, st3.depth)
+	require.Panics(t, func() { st3.CacheWrap() })
+
+	// discarding the top layer frees its depth
+	st3.Set(keyFmt(1), valFmt(1))
+	st3.Write()
+	st3 = st2.CacheWrap().(*cacheKVStore)
+	require.Equal(t, 3, st3.depth)
+
+	// the default limit applies unless configured
+	var wrapped CacheWrap = NewCacheKVStore(mem)
+	for i := 1; i < DefaultMaxCacheWrapDepth; i++ {
+		wrapped = wrapped.CacheWrap()
+	}
+	require.Panics(t, func() { wrapped.CacheWrap() })
+
+	// a limit of zero disables the check
+	wrapped = NewCacheKVStore(mem, MaxCacheWrapDepth(0))
+	for i := 0; i < DefaultMaxCacheWrapDepth; i++ {
+		wrapped = wrapped.CacheWrap()
+	}
+
+	// the depth is counted through gas and prefix stores
+	var kv KVStore = NewCacheKVStore(mem, MaxCacheWrapDepth(3))
+	kv = kv.Gas(sdk.NewInfiniteGasMeter(), sdk.KVGasConfig()).CacheWrap().(KVStore)
+	kv = kv.Prefix([]byte("prefix")).CacheWrap().(KVStore)
+	require.Equal(t, 3, kv.(*cacheKVStore).depth)
+	require.Panics(t, func() { kv.Gas(sdk.NewInfiniteGasMeter(), sdk.KVGasConfig()).CacheWrap() })
+	require.Panics(t, func() { kv.Prefix([]byte("prefix")).CacheWrap() })
+	require.Panics(t, func() { readOnlyKVStore{NewValueLimitKVStore(kv, 10)}.CacheWrap() })
+}
+
+func TestCacheKVStoreEmptyValue(t *testing.T) {
+	mem := dbStoreAdapter{dbm.NewMemDB()}
+	mem.Set(keyFmt(1), []byte{})
+	st := NewCacheKVStore(mem)
+
+	// empty value in parent, Get then Has
+	require.Equal(t, []byte{}, st.Get(keyFmt(1)))
+	require.True(t, st.Has(keyFmt(1)))
+
+	// missing key
+	require.Nil(t, st.Get(keyFmt(2)))
+	require.False(t, st.Has(keyFmt(2)))
+
+	// set an empty value in the cache
+	st.Set(keyFmt(3), []byte{})
+	require.Equal(t, []byte{}, st.Get(keyFmt(3)))
+	require.True(t, st.Has(keyFmt(3)))
+
+	// iteration includes empty-valued keys
+	itr := st.Iterator(nil, nil)
+	keys := [][]byte{}
+	for ; itr.Valid(); itr.Next() {
+		require.Empty(t, itr.Value())
+		keys = append(keys, itr.Key())
+	}
+	itr.Close()
+	require.Equal(t, [][]byte{keyFmt(1), keyFmt(3)}, keys)
+
+	// deleted empty value is no longer present
+	st.Delete(keyFmt(1))
+	require.False(t, st.Has(keyFmt(1)))
+
+	st.Write()
+	require.False(t, mem.Has(keyFmt(1)))
+	require.True(t, mem.Has(keyFmt(3)))
+	require.False(t, mem.Has(keyFmt(2)))
+}
+
+func TestCacheKVStoreCopyOnRead(t *testing.T) {
+	mem := dbStoreAdapter{dbm.NewMemDB()}
+	mem.Set(keyFmt(1), valFmt(1))
+	st := NewCacheKVStore(mem)
+	st.Set(keyFmt(2), valFmt(2))
+
+	for _, key := range [][]byte{keyFmt(1), keyFmt(2)} {
+		value := st.Get(key)
+		value[0] = 'x'
+		_ = append(value[:1], 'y')
+	}
+	require.Equal(t, valFmt(1), st.Get(keyFmt(1)))
+	require.Equal(t, valFmt(2), st.Get(keyFmt(2)))
+
+	itr := st.Iterator(nil, nil)
+	for ; itr.Valid(); itr.Next() {
+		itr.Value()[0] = 'x'
+	}
+	itr.Close()
+	require.Equal(t, valFmt(1), st.Get(keyFmt(1)))
+	require.Equal(t, valFmt(2), st.Get(keyFmt(2)))
+
+	st.Write()
+	require.Equal(t, valFmt(2), mem.Get(keyFmt(2)))
+}
+
+func TestCacheKVStoreHasAllHasAny(t *testing.T) {
+	mem := dbStoreAdapter{dbm.NewMemDB()}
+	mem.Set(keyFmt(0), valFmt(0))
+	mem.Set(keyFmt(1), valFmt(1))
+	st := NewCacheKVStore(mem)
+	st.Set(keyFmt(2), valFmt(2))
+	st.Delete(keyFmt(1))
+
+	keys := func(is ...int) [][]byte {
+		keys := make([][]byte, len(is))
+		for i, k := range is {
+			keys[i] = keyFmt(k)
+		}
+		return keys
+	}
+	require.True(t, st.HasAll(keys(0, 2)))
+	require.False(t, st.HasAll(keys(0, 1)))
+	require.False(t, st.HasAll(keys(0, 3)))
+	require.True(t, st.HasAll(nil))
+
+	require.True(t, st.HasAny(keys(1, 2)))
+	require.True(t, st.HasAny(keys(3, 0)))
+	require.False(t, st.HasAny(keys(1, 3)))
+	require.False(t, st.HasAny(nil))
+
+	require.Panics(t, func() { st.HasAll([][]byte{nil}) })
+}
+
+func TestCacheKVStoreIterateDirty(t *testing.T) {
+	mem := dbStoreAdapter{dbm.NewMemDB()}
+	mem.Set(keyFmt(0), valFmt(0))
+	mem.Set(keyFmt(1), valFmt(1))
+	st := NewCacheKVStore(mem)
+	st.Get(keyFmt(0))
+	st.Set(keyFmt(3), valFmt(3))
+	st.Delete(keyFmt(1))
+	st.Set(keyFmt(2), valFmt(2))
+
+	type op struct {
+		key, value []byte
+		deleted    bool
+	}
+	var ops []op
+	st.IterateDirty(func(key, value []byte, deleted bool) bool {
+		ops = append(ops, op{key, value, deleted})
+		return false
+	})
+	require.Equal(t, []op{
+		{keyFmt(1), nil, true},
+		{keyFmt(2), valFmt(2), false},
+		{keyFmt(3), valFmt(3), false},
+	}, ops)
+
+	// iteration stops when fn returns true
+	ops = nil
+	st.IterateDirty(func(key, value []byte, deleted bool) bool {
+		ops = append(ops, op{key, value, deleted})
+		return true
+	})
+	require.Len(t, ops, 1)
+
+	// nothing is written
+	require.Equal(t, valFmt(1), mem.Get(keyFmt(1)))
+	require.Nil(t, mem.Get(keyFmt(2)))
+}
+
+func TestCacheKVStoreKeyValidator(t *testing.T) {
+	mem := dbStoreAdapter{dbm.NewMemDB()}
+	maxKeyLen := func(key []byte) error {
+		if len(key) > 4 {
+			return fmt.Errorf("key longer than 4 bytes")
+		}
+		return nil
+	}
+	st := NewCacheKVStoreWithKeyValidator(mem, maxKeyLen)
+
+	st.Set([]byte("key"), []byte("value"))
+	require.Equal(t, []byte("value"), st.Get([]byte("key")))
+
+	long := []byte("longkey")
+	require.PanicsWithValue(t, "invalid key 6C6F6E676B6579: key longer than 4 bytes", func() { st.Set(long, []byte("value")) })
+	require.Panics(t, func() { st.Get(long) })
+	require.Panics(t, func() { st.Has(long) })
+	require.Panics(t, func() { st.Delete(long) })
+	require.Panics(t, func() { st.Get(nil) })
+
+	// cache-wraps inherit the validator
+	require.Panics(t, func() { st.CacheWrap().(KVStore).Set(long, []byte("value")) })
+
+	// also through gas stores, and through prefix stores on the prefixed key
+	gas := st.Gas(sdk.NewInfiniteGasMeter(), sdk.KVGasConfig())
+	require.Panics(t, func() { gas.CacheWrap().(KVStore).Set(long, []byte("value")) })
+	prefixed := gas.Prefix([]byte("pr")).CacheWrap().(KVStore)
+	require.NotPanics(t, func() { prefixed.Set([]byte("ke"), []byte("value")) })
+	require.Panics(t, func() { prefixed.Set([]byte("key"), []byte("value")) })
+
+	// the default only rejects nil keys
+	require.NotPanics(t, func() { newCacheKVStore().Set(long, []byte("value")) })
+}
+
+func TestCacheKVStoreNegativeCache(t *testing.T) {
+	mem := readCountingKVStore{dbStoreAdapter{dbm.NewMemDB()}, new(int)}
+	for i := 0; i < 100; i++ {
+		mem.Set(keyFmt(i), valFmt(i))
+	}
+	st := NewCacheKVStoreWithNegativeCache(mem, 100)
+
+	// every existing key is found
+	for i := 0; i < 100; i++ {
+		require.Equal(t, valFmt(i), st.Get(keyFmt(i)))
+	}
+
+	// most missing keys don't reach the parent
+	*mem.reads = 0
+	for i := 100; i < 1100; i++ {
+		require.Nil(t, st.Get(keyFmt(i)))
+		require.False(t, st.Has(keyFmt(i)))
+	}
+	require.True(t, *mem.reads < 100, "%d parent reads for 1000 missing keys", *mem.reads)
+
+	// keys set later are found, also once written and evicted from the cache
+	st.Set(keyFmt(100), valFmt(100))
+	require.Equal(t, valFmt(100), st.Get(keyFmt(100)))
+	st.Write()
+	require.Equal(t, valFmt(100), st.Get(keyFmt(100)))
+	require.True(t, st.Has(keyFmt(100)))
+
+	// keys set through cache-wraps are found too
+	wrap := st.CacheWrap().(KVStore)
+	wrap.Set(keyFmt(101), valFmt(101))
+	wrap.(CacheKVStore).Write()
+	st.Write()
+	require.Equal(t, valFmt(101), st.Get(keyFmt(101)))
+}
+
+// readCountingKVStore counts the Get and Has calls.
+type readCountingKVStore struct {
+	dbStoreAdapter
+	reads *int
+}
+
+func (s readCountingKVStore) Get(key []byte) []byte {
+	*s.reads++
+	return s.dbStoreAdapter.Get(key)
+}
+
+func (s readCountingKVStore) Has(key []byte) bool {
+	*s.reads++
+	return s.dbStoreAdapter.Has(key)
+}
+
+func TestCacheKVStoreSingleParentReadOnGet(t *testing.T) {
+	reads := 0
+	parent := readCountingKVStore{dbStoreAdapter{dbm.NewMemDB()}, &reads}
+	parent.dbStoreAdapter.Set(keyFmt(1), valFmt(1))
+	parent.dbStoreAdapter.Set(keyFmt(2), []byte{})
+	st := NewCacheKVStore(parent)
+
+	// Gets read the parent once, whether the key exists or not, and are
+	// cached.
+	require.Equal(t, valFmt(1), st.Get(keyFmt(1)))
+	require.Nil(t, st.Get(keyFmt(3)))
+	require.Nil(t, st.Get(keyFmt(3)))
+	require.Equal(t, 2, reads)
+
+	// Has resolves a nil value once.
+	require.False(t, st.Has(keyFmt(3)))
+	require.False(t, st.Has(keyFmt(3)))
+	require.True(t, st.Has(keyFmt(1)))
+	require.Equal(t, 3, reads)
+
+	// Has on a miss reads the value, and checks the presence of a nil one.
+	require.True(t, st.Has(keyFmt(2)))
+	require.Equal(t, []byte{}, st.Get(keyFmt(2)))
+	require.False(t, st.Has(keyFmt(4)))
+	require.Equal(t, 6, reads)
+}
+
+func TestCacheKVStoreTraceContextPropagation(t *testing.T) {
+	var buf bytes.Buffer
+	st := newCacheKVStore()
+	top := st.CacheWrapWithTrace(&buf, TraceContext{"blockHeight": 64, "layer": "block"})
+	mid := top.CacheWrap()
+	deep := mid.CacheWrapWithTrace(&buf, TraceContext{"layer": "tx"}).(KVStore)
+
+	deep.Set([]byte("key"), []byte("value"))
+	deep.(CacheKVStore).Write()
+	require.Equal(t,
+		"{\"operation\":\"write\",\"key\":\"a2V5\",\"value\":\"dmFsdWU=\",\"metadata\":{\"blockHeight\":64,\"layer\":\"tx\"}}\n",
+		buf.String())
+
+	// the outer contexts are not modified
+	buf.Reset()
+	mid.Write()
+	top.Write()
+	require.Equal(t,
+		"{\"operation\":\"write\",\"key\":\"a2V5\",\"value\":\"dmFsdWU=\",\"metadata\":{\"blockHeight\":64,\"layer\":\"block\"}}\n",
+		buf.String())
+}
+
+func TestCacheKVStoreAutoFlush(t *testing.T) {
+	mem := dbStoreAdapter{dbm.NewMemDB()}
+	st := NewCacheKVStoreWithAutoFlush(mem, 3)
+
+	// rewriting a dirty key doesn't count twice
+	st.Set(keyFmt(0), valFmt(0))
+	st.Set(keyFmt(0), valFmt(0))
+	st.Set(keyFmt(1), valFmt(1))
+	st.Delete(keyFmt(2))
+	require.Nil(t, mem.Get(keyFmt(0)))
+
+	// exceeding the threshold flushes the earlier batch
+	st.Set(keyFmt(3), valFmt(3))
+	for i := 0; i < 4; i++ {
+		if i == 2 {
+			continue
+		}
+		require.Equal(t, valFmt(i), mem.Get(keyFmt(i)))
+	}
+	require.Equal(t, valFmt(3), st.Get(keyFmt(3)))
+
+	// reads don't count as dirty
+	for i := 4; i < 10; i++ {
+		st.Get(keyFmt(i))
+	}
+	st.Set(keyFmt(4), valFmt(4))
+	require.Nil(t, mem.Get(keyFmt(4)))
+	st.Write()
+	require.Equal(t, valFmt(4), mem.Get(keyFmt(4)))
+}
+
+func TestCacheKVStoreSetBatch(t *testing.T) {
+	mem := dbStoreAdapter{dbm.NewMemDB()}
+	mem.Set(keyFmt(0), valFmt(0))
+	st := NewCacheKVStore(mem)
+
+	st.SetBatch([]cmn.KVPair{
+		{Key: keyFmt(0), Value: valFmt(10)},
+		{Key: keyFmt(1), Value: valFmt(1)},
+		{Key: keyFmt(2), Value: nil},
+		{Key: keyFmt(3), Value: []byte{}},
+	})
+	require.Equal(t, valFmt(10), st.Get(keyFmt(0)))
+	require.Equal(t, valFmt(1), st.Get(keyFmt(1)))
+	require.False(t, st.Has(keyFmt(2)))
+	require.True(t, st.Has(keyFmt(3)))
+	require.Equal(t, 3, st.dirtyCount)
+
+	// an invalid key sets nothing
+	require.Panics(t, func() {
+		st.SetBatch([]cmn.KVPair{{Key: keyFmt(4), Value: valFmt(4)}, {Key: nil, Value: valFmt(5)}})
+	})
+	require.False(t, st.Has(keyFmt(4)))
+
+	st.Write()
+	require.Equal(t, valFmt(10), mem.Get(keyFmt(0)))
+	require.Equal(t, valFmt(1), mem.Get(keyFmt(1)))
+}
+
+// leakLogger sends the messages logged as errors to a channel.
+type leakLogger struct {
+	log.Logger
+	errors chan string
+}
+
+func (l leakLogger) Error(msg string, keyvals ...interface{}) {
+	l.errors <- fmt.Sprint(append([]interface{}{msg}, keyvals...)...)
+}
+
+func TestCacheKVStoreDetectIteratorLeaks(t *testing.T) {
+	logger := leakLogger{log.NewNopLogger(), make(chan string, 10)}
+	st := NewCacheKVStore(dbStoreAdapter{dbm.NewMemDB()}, DetectIteratorLeaks(logger))
+	st.Set(keyFmt(1), valFmt(1))
+
+	// Closed iterators, also of wrapping stores, aren't reported.
+	st.Iterator(nil, nil).Close()
+	NewCacheKVStore(st).ReverseIterator(nil, nil).Close()
+
+	leak := func() {
+		iter := NewCacheKVStore(st).Iterator(nil, nil)
+		require.True(t, iter.Valid())
+	}
+	leak()
+
+	deadline := time.After(5 * time.Second)
+	for {
+		runtime.GC()
+		select {
+		case msg := <-logger.errors:
+			require.Contains(t, msg, "without Close")
+			require.Contains(t, msg, "TestCacheKVStoreDetectIteratorLeaks")
+			select {
+			case msg = <-logger.errors:
+				t.Fatalf("unexpected report: %s", msg)
+			case <-time.After(100 * time.Millisecond):
+			}
+			return
+		case <-deadline:
+			t.Fatal("leaked iterator not reported")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestCacheKVStoreDeleteRange(t *testing.T) {
+	mem := dbStoreAdapter{dbm.NewMemDB()}
+	for i := 0; i < 10; i++ {
+		mem.Set(keyFmt(i), valFmt(i))
+	}
+	st := NewCacheKVStoreVerified(mem)
+	st.Set(keyFmt(3), valFmt(30))
+	require.Equal(t, valFmt(4), st.Get(keyFmt(4)))
+
+	st.DeleteRange(keyFmt(2), keyFmt(6))
+	st.Set(keyFmt(5), valFmt(50))
+	require.Nil(t, st.Get(keyFmt(2)))
+	require.False(t, st.Has(keyFmt(3)))
+	require.Nil(t, st.Get(keyFmt(4)))
+	require.Equal(t, valFmt(50), st.Get(keyFmt(5)))
+	require.Equal(t, valFmt(6), st.Get(keyFmt(6)))
+	require.Equal(t, 1, st.dirtyCount)
+
+	expected := []cmn.KVPair{
+		{Key: keyFmt(0), Value: valFmt(0)},
+		{Key: keyFmt(1), Value: valFmt(1)},
+		{Key: keyFmt(5), Value: valFmt(50)},
+		{Key: keyFmt(6), Value: valFmt(6)},
+		{Key: keyFmt(7), Value: valFmt(7)},
+	}
+	require.Equal(t, expected, collectKVs(st.Iterator(nil, keyFmt(8))))
+	reversed := []cmn.KVPair{expected[4], expected[3], expected[2], expected[1], expected[0]}
+	require.Equal(t, reversed, collectKVs(st.ReverseIterator(nil, keyFmt(8))))
+
+	// The parent is untouched until written.
+	require.Equal(t, valFmt(3), mem.Get(keyFmt(3)))
+	st.Write()
+	require.Equal(t, expected, collectKVs(mem.Iterator(nil, keyFmt(8))))
+
+	// Ranges are handed to parents which delete ranges themselves.
+	parent := NewCacheKVStore(mem)
+	child := NewCacheKVStore(parent)
+	child.DeleteRange(nil, keyFmt(6))
+	require.Equal(t, expected[3:], collectKVs(child.Iterator(nil, keyFmt(8))))
+	child.Write()
+	require.Len(t, parent.deletedRanges, 1)
+	require.Empty(t, parent.cache)
+	require.Equal(t, valFmt(0), mem.Get(keyFmt(0)))
+	parent.Write()
+	require.Equal(t, expected[3:], collectKVs(mem.Iterator(nil, keyFmt(8))))
+
+	// Reset drops the ranges.
+	st = NewCacheKVStore(mem)
+	st.DeleteRange(nil, nil)
+	require.False(t, st.Has(keyFmt(6)))
+	st.Reset()
+	require.True(t, st.Has(keyFmt(6)))
+}
+
+func TestCacheKVStoreDirtyShadowsParentAtBounds(t *testing.T) {
+	mem := dbStoreAdapter{dbm.NewMemDB()}
+	for i := 1; i <= 5; i++ {
+		mem.Set(keyFmt(i), valFmt(i))
+	}
+	st := NewCacheKVStore(mem)
+
+	// Dirty keys coinciding with parent keys at the bounds and inside.
+	st.Set(keyFmt(1), valFmt(10))
+	st.Delete(keyFmt(3))
+	st.Set(keyFmt(5), valFmt(50))
+
+	kvs := func(keys ...int) []cmn.KVPair {
+		values := map[int][]byte{1: valFmt(10), 2: valFmt(2), 4: valFmt(4), 5: valFmt(50)}
+		pairs := make([]cmn.KVPair, len(keys))
+		for i, k := range keys {
+			pairs[i] = cmn.KVPair{Key: keyFmt(k), Value: values[k]}
+		}
+		return pairs
+	}
+
+	// The end is exclusive for both the dirty and the parent key.
+	require.Equal(t, kvs(1, 2, 4), collectKVs(st.Iterator(keyFmt(1), keyFmt(5))))
+	require.Equal(t, kvs(1, 2, 4, 5), collectKVs(st.Iterator(keyFmt(1), keyFmt(6))))
+	require.Equal(t, kvs(5), collectKVs(st.Iterator(keyFmt(5), nil)))
+	require.Equal(t, kvs(4, 2, 1), collectKVs(st.ReverseIterator(keyFmt(4), nil)))
+	require.Equal(t, kvs(5, 4, 2), collectKVs(st.ReverseIterator(keyFmt(5), keyFmt(1))))
+	require.Empty(t, collectKVs(st.Iterator(keyFmt(3), keyFmt(4))))
+}
+
+func TestCacheKVStoreReset(t *testing.T) {
+	mem := dbStoreAdapter{dbm.NewMemDB()}
+	mem.Set(keyFmt(1), valFmt(1))
+	st := NewCacheKVStore(mem)
+
+	st.Set(keyFmt(1), valFmt(2))
+	st.Set(keyFmt(2), valFmt(2))
+	require.Equal(t, valFmt(2), st.Get(keyFmt(1)))
+
+	// reset discards the changes without touching the parent
+	st.Reset()
+	require.Equal(t, valFmt(1), st.Get(keyFmt(1)))
+	require.Nil(t, st.Get(keyFmt(2)))
+	require.Equal(t, valFmt(1), mem.Get(keyFmt(1)))
+	require.Nil(t, mem.Get(keyFmt(2)))
+
+	// the store is still usable afterwards
+	st.Delete(keyFmt(1))
+	st.Write()
+	require.Nil(t, mem.Get(keyFmt(1)))
+}
+
+func TestCacheKVStoreCacheResidentIteration(t *testing.T) {
+	mem := dbStoreAdapter{dbm.NewMemDB()}
+	mem.Set(keyFmt(10), valFmt(10))
+	st := NewCacheKVStore(mem, CacheResidentIteration())
+
+	for i := 0; i < 5; i++ {
+		st.Set(keyFmt(i), valFmt(i))
+	}
+	st.Set(keyFmt(5), valFmt(5))
+	st.Delete(keyFmt(5))
+
+	// only cached writes are iterated, deletes are skipped
+	assertIterateDomain(t, st, 5)
+
+	itr := st.ReverseIterator(nil, nil)
+	for i := 4; i >= 0; i-- {
+		require.True(t, itr.Valid())
+		require.Equal(t, keyFmt(i), itr.Key())
+		itr.Next()
+	}
+	require.False(t, itr.Valid())
+	itr.Close()
+}
+
+func TestCacheKVStorePrefetchIteration(t *testing.T) {
+	mem := dbStoreAdapter{dbm.NewMemDB()}
+	for i := 0; i < 20; i++ {
+		mem.Set(keyFmt(i), valFmt(i))
+	}
+
+	ops := func(st CacheKVStore) {
+		st.Delete(keyFmt(0))
+		st.Delete(keyFmt(7))
+		st.Delete(keyFmt(8))
+		st.Set(keyFmt(9), valFmt(90))
+		st.Set(keyFmt(25), valFmt(25))
+		st.Delete(keyFmt(19))
+	}
+	expected := NewCacheKVStore(mem)
+	ops(expected)
+
+	ranges := [][2][]byte{
+		{nil, nil},
+		{keyFmt(3), keyFmt(12)},
+		{keyFmt(7), keyFmt(9)},
+		{keyFmt(12), nil},
+		{nil, keyFmt(5)},
+	}
+	for _, chunkSize := range []int{1, 2, 3, 7, 100} {
+		st := NewCacheKVStoreWithPrefetch(mem, chunkSize)
+		ops(st)
+		for _, r := range ranges {
+			require.Equal(t, collectKVs(expected.Iterator(r[0], r[1])),
+				collectKVs(st.Iterator(r[0], r[1])), "chunk size %d, range %v", chunkSize, r)
+			require.Equal(t, collectKVs(expected.ReverseIterator(r[1], r[0])),
+				collectKVs(st.ReverseIterator(r[1], r[0])), "chunk size %d, range %v", chunkSize, r)
+		}
+	}
+}
+
+type batchCountingDB struct {
+	dbm.DB
+	batches int
+}
+
+func (db *batchCountingDB) NewBatch() dbm.Batch {
+	db.batches++
+	return db.DB.NewBatch()
+}
+
+func TestCacheKVStoreWriteBatch(t *testing.T) {
+	db := &batchCountingDB{DB: dbm.NewMemDB()}
+	mem := dbStoreAdapter{db}
+	mem.Set(keyFmt(0), valFmt(0))
+
+	st := NewCacheKVStore(mem)
+	st.Set(keyFmt(1), valFmt(1))
+	st.Set(keyFmt(2), valFmt(2))
+	st.Delete(keyFmt(0))
+
+	// nothing is written before Write
+	require.Nil(t, mem.Get(keyFmt(1)))
+	require.Equal(t, valFmt(0), mem.Get(keyFmt(0)))
+
+	st.Write()
+	require.Equal(t, 1, db.batches)
+	require.Nil(t, mem.Get(keyFmt(0)))
+	require.Equal(t, valFmt(1), mem.Get(keyFmt(1)))
+	require.Equal(t, valFmt(2), mem.Get(keyFmt(2)))
+
+	// parents without batch support are written key by key
+	tree := iavl.NewMutableTree(dbm.NewMemDB(), cacheSize)
+	iavlStore := newIAVLStore(tree, numRecent, storeEvery)
+	st = NewCacheKVStore(iavlStore)
+	st.Set(keyFmt(1), valFmt(1))
+	st.Write()
+	require.Equal(t, valFmt(1), iavlStore.Get(keyFmt(1)))
+}
+
+func TestCacheKVStoreWriteToBatch(t *testing.T) {
+	db := dbm.NewMemDB()
+	mem := dbStoreAdapter{db}
+	mem.Set(keyFmt(0), valFmt(0))
+	mem.Set(keyFmt(3), valFmt(3))
+
+	st := NewCacheKVStore(mem)
+	st.Set(keyFmt(1), valFmt(1))
+	st.Delete(keyFmt(0))
+	st2 := NewCacheKVStore(mem)
+	st2.Set(keyFmt(2), valFmt(2))
+	st2.Delete(keyFmt(3))
+
+	// both stores go into one batch, nothing is written before it is
+	batch := db.NewBatch()
+	st.WriteToBatch(batch)
+	st2.WriteToBatch(batch)
+	require.Equal(t, valFmt(0), mem.Get(keyFmt(0)))
+	require.Nil(t, mem.Get(keyFmt(1)))
+
+	// the caches were cleared
+	require.Equal(t, valFmt(0), st.Get(keyFmt(0)))
+	require.Nil(t, st2.Get(keyFmt(2)))
+
+	batch.Write()
+	require.Nil(t, mem.Get(keyFmt(0)))
+	require.Equal(t, valFmt(1), mem.Get(keyFmt(1)))
+	require.Equal(t, valFmt(2), mem.Get(keyFmt(2)))
+	require.Nil(t, mem.Get(keyFmt(3)))
+
+	// parents without batch support are rejected
+	st = NewCacheKVStore(NewCacheKVStore(mem))
+	require.Panics(t, func() { st.WriteToBatch(db.NewBatch()) })
+}
+
+func TestCacheKVStoreFlush(t *testing.T) {
+	mem := dbStoreAdapter{dbm.NewMemDB()}
+	mem.Set(keyFmt(0), valFmt(0))
+
+	st := NewCacheKVStore(mem)
+	st.Set(keyFmt(1), valFmt(1))
+	st.Set(keyFmt(2), valFmt(2))
+	st.Delete(keyFmt(0))
+	st.Set(keyFmt(3), valFmt(3))
+	st.Delete(keyFmt(3))
+
+	n, err := st.Flush()
+	require.Nil(t, err)
+	require.Equal(t, 4, n)
+	require.Nil(t, mem.Get(keyFmt(0)))
+	require.Equal(t, valFmt(1), mem.Get(keyFmt(1)))
+
+	// the store stays usable
+	st.Set(keyFmt(4), valFmt(4))
+	n, err = st.Flush()
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, valFmt(4), mem.Get(keyFmt(4)))
+
+	// batch failures are returned and the cache is kept
+	failing := failingBatchStore{mem}
+	st = NewCacheKVStore(failing)
+	st.Set(keyFmt(5), valFmt(5))
+	_, err = st.Flush()
+	require.NotNil(t, err)
+	require.Nil(t, mem.Get(keyFmt(5)))
+	require.Equal(t, valFmt(5), st.Get(keyFmt(5)))
+	require.Panics(t, st.Write)
+}
+
+// failingBatchStore is a store whose batches fail to write.
+type failingBatchStore struct {
+	dbStoreAdapter
+}
+
+func (s failingBatchStore) NewBatch() dbm.Batch {
+	return failingBatch{s.dbStoreAdapter.NewBatch()}
+}
+
+type failingBatch struct {
+	dbm.Batch
+}
+
+func (failingBatch) Write() {
+	panic("disk full")
+}
+
+func TestCacheKVStoreConcurrentAccess(t *testing.T) {
+	mem := dbStoreAdapter{dbm.NewMemDB()}
+	for i := 0; i < 100; i++ {
+		mem.Set(keyFmt(i), valFmt(i))
+	}
+	st := NewCacheKVStore(mem)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if i%8 == g {
+					st.Set(keyFmt(i), valFmt(i))
+				}
+				require.Equal(t, valFmt(i), st.Get(keyFmt(i)))
+				require.True(t, st.Has(keyFmt(i)))
+			}
+			itr := st.Iterator(nil, nil)
+			for ; itr.Valid(); itr.Next() {
+			}
+			itr.Close()
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestCacheKVStoreWithSize(t *testing.T) {
+	mem := dbStoreAdapter{dbm.NewMemDB()}
+	for i := 0; i < 5; i++ {
+		mem.Set(keyFmt(i), valFmt(i))
+	}
+	st := NewCacheKVStoreWithSize(mem, 2)
+
+	// clean entries are evicted in LRU order
+	require.Equal(t, valFmt(0), st.Get(keyFmt(0)))
+	require.Equal(t, valFmt(1), st.Get(keyFmt(1)))
+	require.Equal(t, valFmt(0), st.Get(keyFmt(0)))
+	require.Equal(t, valFmt(2), st.Get(keyFmt(2)))
+	require.Len(t, st.cache, 2)
+	require.Contains(t, st.cache, string(keyFmt(0)))
+	require.NotContains(t, st.cache, string(keyFmt(1)))
+
+	// dirty entries are never evicted
+	st.Set(keyFmt(1), valFmt(11))
+	st.Set(keyFmt(3), valFmt(13))
+	st.Delete(keyFmt(4))
+	require.Equal(t, valFmt(2), st.Get(keyFmt(2)))
+	require.Len(t, st.cache, 3)
+
+	expected := [][]byte{valFmt(0), valFmt(11), valFmt(2), valFmt(13)}
+	itr := st.Iterator(nil, nil)
+	var i = 0
+	for ; itr.Valid(); itr.Next() {
+		require.Equal(t, keyFmt(i), itr.Key())
+		require.Equal(t, expected[i], itr.Value())
+		i++
+	}
+	itr.Close()
+	require.Equal(t, len(expected), i)
+
+	st.Write()
+	require.Equal(t, valFmt(11), mem.Get(keyFmt(1)))
+	require.Equal(t, valFmt(13), mem.Get(keyFmt(3)))
+	require.Nil(t, mem.Get(keyFmt(4)))
+	require.Empty(t, st.cache)
+
+	// zero size is unbounded
+	st = NewCacheKVStoreWithSize(mem, 0)
+	for i := 0; i < 4; i++ {
+		st.Get(keyFmt(i))
+	}
+	require.Len(t, st.cache, 4)
+}
+
 func TestCacheKVIteratorBounds(t *testing.T) {
 	st := newCacheKVStore()
 
@@ -294,6 +1105,31 @@ func TestCacheKVMergeIteratorRandom(t *testing.T) {
 	}
 }
 
+func TestCacheKVStoreVerifiedIteration(t *testing.T) {
+	st := NewCacheKVStoreVerified(dbStoreAdapter{dbm.NewMemDB()})
+	truth := dbm.NewMemDB()
+
+	setRange(st, truth, 25, 75)
+	for i := 0; i < 500; i++ {
+		doRandomOp(st, truth, 100)
+		require.NotPanics(t, func() {
+			collectKVs(st.Iterator(nil, nil))
+			collectKVs(st.Iterator(keyFmt(20), keyFmt(60)))
+			collectKVs(st.ReverseIterator(nil, nil))
+			collectKVs(st.ReverseIterator(keyFmt(60), keyFmt(20)))
+		})
+	}
+
+	// a diverging merge is caught
+	items := []cmn.KVPair{{Key: keyFmt(1), Value: valFmt(1)}, {Key: keyFmt(2), Value: valFmt(2)}}
+	skipped := newVerifiedIterator(newMemIterator(nil, nil, items[1:], true), items)
+	require.Panics(t, func() { collectKVs(skipped) })
+	extra := newVerifiedIterator(newMemIterator(nil, nil, items, true), items[:1])
+	require.Panics(t, func() { collectKVs(extra) })
+	changed := []cmn.KVPair{items[0], {Key: keyFmt(2), Value: valFmt(3)}}
+	require.Panics(t, func() { collectKVs(newVerifiedIterator(newMemIterator(nil, nil, changed, true), items)) })
+}
+
 //-------------------------------------------------------------------------------------------
 // do some random ops
 
@@ -312,6 +1148,80 @@ func randInt(n int) int {
 }
 
 // useful for replaying a error case if we find one
+func TestCacheKVMergeIteratorReverseBoundaries(t *testing.T) {
+	type op struct {
+		op, key int
+	}
+	cases := []struct {
+		name string
+		ops  []op
+	}{
+		{"delete upper", []op{{opDel, 5}}},
+		{"delete lower", []op{{opDel, 0}}},
+		{"delete inner", []op{{opDel, 3}}},
+		{"delete then set", []op{{opDel, 5}, {opSet, 5}}},
+		{"set then delete", []op{{opSet, 6}, {opDel, 6}}},
+		{"set beyond parent", []op{{opSet, 7}, {opDel, 5}}},
+		{"delete all", []op{{opDel, 0}, {opDel, 1}, {opDel, 2}, {opDel, 3}, {opDel, 4}, {opDel, 5}}},
+		{"delete, write, set", []op{{opDel, 5}, {opWrite, 0}, {opSet, 5}, {opDel, 4}}},
+	}
+
+	// range bounds, nil meaning unbounded
+	bounds := [][]byte{nil}
+	for i := 0; i < 9; i++ {
+		bounds = append(bounds, keyFmt(i))
+	}
+
+	for _, tc := range cases {
+		parent := dbm.NewMemDB()
+		truth := dbm.NewMemDB()
+		for i := 0; i < 6; i++ {
+			parent.Set(keyFmt(i), valFmt(i))
+			truth.Set(keyFmt(i), valFmt(i))
+		}
+		st := NewCacheKVStore(dbStoreAdapter{parent})
+		for _, o := range tc.ops {
+			doOp(st, truth, o.op, o.key)
+		}
+
+		for _, lo := range bounds {
+			for _, hi := range bounds {
+				if lo != nil && hi != nil && bytes.Compare(lo, hi) >= 0 {
+					continue
+				}
+				msg := fmt.Sprintf("%s: (%s, %s]", tc.name, lo, hi)
+
+				// the reverse iterator covers (lo, hi], like the ground truth
+				reverse := collectKVs(st.ReverseIterator(hi, lo))
+				require.Equal(t, collectKVs(truth.ReverseIterator(hi, lo)), reverse, msg)
+
+				// and yields the forward iteration over (lo, hi] reversed
+				var fwdStart, fwdEnd []byte
+				if lo != nil {
+					fwdStart = append(cp(lo), 0x00)
+				}
+				if hi != nil {
+					fwdEnd = append(cp(hi), 0x00)
+				}
+				forward := collectKVs(st.Iterator(fwdStart, fwdEnd))
+				for i, j := 0, len(forward)-1; i < j; i, j = i+1, j-1 {
+					forward[i], forward[j] = forward[j], forward[i]
+				}
+				require.Equal(t, forward, reverse, msg)
+			}
+		}
+	}
+}
+
+func collectKVs(itr Iterator) []cmn.KVPair {
+	defer itr.Close()
+	var kvs []cmn.KVPair
+	for ; itr.Valid(); itr.Next() {
+		kvs = append(kvs, cmn.KVPair{Key: itr.Key(), Value: itr.Value()})
+	}
+	return kvs
+}
+
 func doOp(st CacheKVStore, truth dbm.DB, op int, args ...int) {
 	switch op {
 	case opSet:
@@ -516,3 +1426,138 @@ func BenchmarkCacheKVStoreGetKeyFound(b *testing.B) {
 		st.Get([]byte{byte((i & 0xFF0000) >> 16), byte((i & 0xFF00) >> 8), byte(i & 0xFF)})
 	}
 }
+
+func benchmarkCacheKVStoreGetMissing(b *testing.B, negativeCache bool) {
+	mem := dbStoreAdapter{dbm.NewMemDB()}
+	for i := 0; i < 10000; i++ {
+		mem.Set(keyFmt(i), valFmt(i))
+	}
+	st := NewCacheKVStore(mem)
+	if negativeCache {
+		st = NewCacheKVStoreWithNegativeCache(mem, 10000)
+	}
+
+	b.ResetTimer()
+	// assumes b.N < 2**24
+	for i := 0; i < b.N; i++ {
+		st.Get([]byte{byte((i & 0xFF0000) >> 16), byte((i & 0xFF00) >> 8), byte(i & 0xFF)})
+	}
+}
+
+func BenchmarkCacheKVStoreGetMissing(b *testing.B) {
+	benchmarkCacheKVStoreGetMissing(b, false)
+}
+
+func BenchmarkCacheKVStoreGetMissingNegativeCache(b *testing.B) {
+	benchmarkCacheKVStoreGetMissing(b, true)
+}
+
+func benchmarkCacheKVStoreIterator(b *testing.B, opts ...CacheKVStoreOption) {
+	mem := dbStoreAdapter{dbm.NewMemDB()}
+	for i := 0; i < 1000; i++ {
+		mem.Set(keyFmt(i), valFmt(i))
+	}
+	st := NewCacheKVStore(mem, opts...)
+	for i := 0; i < 1000; i++ {
+		st.Set(keyFmt(i), valFmt(i))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		itr := st.Iterator(keyFmt(100), keyFmt(200))
+		for ; itr.Valid(); itr.Next() {
+		}
+		itr.Close()
+	}
+}
+
+func BenchmarkCacheKVStoreIteratorMerged(b *testing.B) {
+	benchmarkCacheKVStoreIterator(b)
+}
+
+func BenchmarkCacheKVStoreIteratorCacheResident(b *testing.B) {
+	benchmarkCacheKVStoreIterator(b, CacheResidentIteration())
+}
+
+// latencyKVStore simulates a remote parent store, where every call on an
+// iterator is a round trip.
+type latencyKVStore struct {
+	dbStoreAdapter
+	latency time.Duration
+}
+
+func (s latencyKVStore) Iterator(start, end []byte) Iterator {
+	time.Sleep(s.latency)
+	return latencyIterator{s.dbStoreAdapter.Iterator(start, end), s.latency}
+}
+
+func (s latencyKVStore) ReverseIterator(start, end []byte) Iterator {
+	time.Sleep(s.latency)
+	return latencyIterator{s.dbStoreAdapter.ReverseIterator(start, end), s.latency}
+}
+
+type latencyIterator struct {
+	Iterator
+	latency time.Duration
+}
+
+func (it latencyIterator) Valid() bool   { time.Sleep(it.latency); return it.Iterator.Valid() }
+func (it latencyIterator) Next()         { time.Sleep(it.latency); it.Iterator.Next() }
+func (it latencyIterator) Key() []byte   { time.Sleep(it.latency); return it.Iterator.Key() }
+func (it latencyIterator) Value() []byte { time.Sleep(it.latency); return it.Iterator.Value() }
+
+func benchmarkCacheKVStorePrefetch(b *testing.B, chunkSize int) {
+	mem := latencyKVStore{dbStoreAdapter{dbm.NewMemDB()}, 10 * time.Microsecond}
+	for i := 0; i < 200; i++ {
+		mem.Set(keyFmt(i), valFmt(i))
+	}
+	st := NewCacheKVStoreWithPrefetch(mem, chunkSize)
+	for i := 0; i < 200; i += 10 {
+		st.Delete(keyFmt(i))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		itr := st.Iterator(nil, nil)
+		for ; itr.Valid(); itr.Next() {
+			itr.Key()
+			itr.Value()
+		}
+		itr.Close()
+	}
+}
+
+func BenchmarkCacheKVStoreIteratorSlowParent(b *testing.B) {
+	benchmarkCacheKVStorePrefetch(b, 0)
+}
+
+func BenchmarkCacheKVStoreIteratorSlowParentPrefetch(b *testing.B) {
+	benchmarkCacheKVStorePrefetch(b, 64)
+}
+
+func benchmarkCacheKVStoreSetGenesis(b *testing.B, batched bool) {
+	pairs := make([]cmn.KVPair, 10000)
+	for i := range pairs {
+		pairs[i] = cmn.KVPair{Key: keyFmt(i), Value: valFmt(i)}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		st := NewCacheKVStore(dbStoreAdapter{dbm.NewMemDB()})
+		if batched {
+			st.SetBatch(pairs)
+			continue
+		}
+		for _, pair := range pairs {
+			st.Set(pair.Key, pair.Value)
+		}
+	}
+}
+
+func BenchmarkCacheKVStoreSetLoop(b *testing.B) {
+	benchmarkCacheKVStoreSetGenesis(b, false)
+}
+
+func BenchmarkCacheKVStoreSetBatch(b *testing.B) {
+	benchmarkCacheKVStoreSetGenesis(b, true)
+}
@@ -197,6 +197,10 @@ func (iter *cacheMergeIterator) skipUntilExistsOrInvalid() bool {
 
 		case 0: // parent == cache.
 
+			// The cache item shadows the parent item, whatever their values.
+			// Both iterators share the bounds, so this also holds at the
+			// start, and neither returns a key at the exclusive end.
+
 			// Skip over if cache item is a delete.
 			valueC := iter.cache.Value()
 			if valueC == nil {
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	cmn "github.com/tendermint/tendermint/libs/common"
+)
+
+func TestCacheMergeIteratorCacheShadowsParent(t *testing.T) {
+	kv := func(k int, v []byte) cmn.KVPair { return cmn.KVPair{Key: keyFmt(k), Value: v} }
+	parent := []cmn.KVPair{kv(1, valFmt(1)), kv(2, valFmt(2)), kv(3, valFmt(3)), kv(4, valFmt(4))}
+
+	cases := []struct {
+		name       string
+		cache      []cmn.KVPair
+		start, end []byte
+		ascending  bool
+		want       []cmn.KVPair
+	}{
+		{"no cache items", nil, nil, nil, true, parent},
+		{"cache value wins",
+			[]cmn.KVPair{kv(2, valFmt(20))}, nil, nil, true,
+			[]cmn.KVPair{kv(1, valFmt(1)), kv(2, valFmt(20)), kv(3, valFmt(3)), kv(4, valFmt(4))}},
+		{"cache value wins over a smaller parent value",
+			[]cmn.KVPair{kv(2, []byte{0})}, nil, nil, true,
+			[]cmn.KVPair{kv(1, valFmt(1)), kv(2, []byte{0}), kv(3, valFmt(3)), kv(4, valFmt(4))}},
+		{"cache delete hides parent",
+			[]cmn.KVPair{kv(2, nil), kv(3, nil)}, nil, nil, true,
+			[]cmn.KVPair{kv(1, valFmt(1)), kv(4, valFmt(4))}},
+		{"cache wins at the start",
+			[]cmn.KVPair{kv(2, valFmt(20))}, keyFmt(2), nil, true,
+			[]cmn.KVPair{kv(2, valFmt(20)), kv(3, valFmt(3)), kv(4, valFmt(4))}},
+		{"neither returns the end",
+			[]cmn.KVPair{kv(2, valFmt(20)), kv(3, valFmt(30))}, keyFmt(2), keyFmt(3), true,
+			[]cmn.KVPair{kv(2, valFmt(20))}},
+		{"cache wins descending",
+			[]cmn.KVPair{kv(4, valFmt(40)), kv(1, nil)}, nil, nil, false,
+			[]cmn.KVPair{kv(4, valFmt(40)), kv(3, valFmt(3)), kv(2, valFmt(2))}},
+		{"cache wins at the descending start",
+			[]cmn.KVPair{kv(3, valFmt(30)), kv(1, valFmt(10))}, keyFmt(3), keyFmt(1), false,
+			[]cmn.KVPair{kv(3, valFmt(30)), kv(2, valFmt(2))}},
+	}
+	for _, tc := range cases {
+		parentItems := parent
+		if !tc.ascending {
+			parentItems = reversedKVs(parent)
+		}
+		iter := newCacheMergeIterator(
+			newMemIterator(tc.start, tc.end, parentItems, tc.ascending),
+			newMemIterator(tc.start, tc.end, tc.cache, tc.ascending),
+			tc.ascending)
+		require.Equal(t, tc.want, collectKVs(iter), tc.name)
+	}
+}
+
+func reversedKVs(kvs []cmn.KVPair) []cmn.KVPair {
+	reversed := make([]cmn.KVPair, len(kvs))
+	for i, kv := range kvs {
+		reversed[len(kvs)-1-i] = kv
+	}
+	return reversed
+}
@@ -18,6 +18,9 @@ type cacheMultiStore struct {
 
 	traceWriter  io.Writer
 	traceContext TraceContext
+
+	readOnly      map[StoreKey]bool
+	maxValueSizes map[StoreKey]int
 }
 
 var _ CacheMultiStore = cacheMultiStore{}
@@ -29,9 +32,19 @@ func newCacheMultiStoreFromRMS(rms *rootMultiStore) cacheMultiStore {
 		keysByName:   rms.keysByName,
 		traceWriter:  rms.traceWriter,
 		traceContext: rms.traceContext,
+
+		readOnly:      rms.readOnly,
+		maxValueSizes: rms.maxValueSizes,
 	}
 
-	for key, store := range rms.stores {
+	for key, commitStore := range rms.stores {
+		var store CacheWrapper = commitStore
+		if listener, ok := rms.listeners[key]; ok {
+			if kvStore, ok := commitStore.(KVStore); ok {
+				store = listenKVStore{kvStore, listener}
+			}
+		}
+
 		if cms.TracingEnabled() {
 			cms.stores[key] = store.CacheWrapWithTrace(cms.traceWriter, cms.traceContext)
 		} else {
@@ -48,6 +61,9 @@ func newCacheMultiStoreFromCMS(cms cacheMultiStore) cacheMultiStore {
 		stores:       make(map[StoreKey]CacheWrap, len(cms.stores)),
 		traceWriter:  cms.traceWriter,
 		traceContext: cms.traceContext,
+
+		readOnly:      cms.readOnly,
+		maxValueSizes: cms.maxValueSizes,
 	}
 
 	for key, store := range cms.stores {
@@ -125,12 +141,16 @@ func (cms cacheMultiStore) CacheMultiStore() CacheMultiStore {
 
 // Implements MultiStore.
 func (cms cacheMultiStore) GetStore(key StoreKey) Store {
+	if store, ok := cms.stores[key].(KVStore); ok {
+		return wrapReadOnly(store, key, cms.readOnly)
+	}
 	return cms.stores[key].(Store)
 }
 
 // Implements MultiStore.
 func (cms cacheMultiStore) GetKVStore(key StoreKey) KVStore {
-	return cms.stores[key].(KVStore)
+	store := wrapValueLimit(cms.stores[key].(KVStore), key, cms.maxValueSizes)
+	return wrapReadOnly(store, key, cms.readOnly)
 }
 
 // Implements MultiStore.
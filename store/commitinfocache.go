@@ -0,0 +1,83 @@
+package store
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultCommitInfoCacheSize is the number of decoded commit infos a
+// rootMultiStore caches unless configured otherwise with
+// SetCommitInfoCacheSize.
+const DefaultCommitInfoCacheSize = 16
+
+// commitInfoCache holds the decoded commit infos of up to size versions,
+// evicting the least recently used ones first, so proved queries at recent
+// heights don't decode the same commit info over and over.
+type commitInfoCache struct {
+	mtx     sync.Mutex
+	size    int
+	lru     *list.List // of commitInfo, most recently used first
+	entries map[int64]*list.Element
+}
+
+func newCommitInfoCache(size int) *commitInfoCache {
+	return &commitInfoCache{
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[int64]*list.Element),
+	}
+}
+
+// get returns the cached commit info of the version.
+func (c *commitInfoCache) get(ver int64) (commitInfo, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	elem, ok := c.entries[ver]
+	if !ok {
+		return commitInfo{}, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(commitInfo), true
+}
+
+// add caches the commit info of its version, evicting the least recently
+// used one if the cache is full.
+func (c *commitInfoCache) add(cInfo commitInfo) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if elem, ok := c.entries[cInfo.Version]; ok {
+		elem.Value = cInfo
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[cInfo.Version] = c.lru.PushFront(cInfo)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(commitInfo).Version)
+	}
+}
+
+// removeFrom drops the commit infos of all versions from ver on, whose
+// commit infos are about to be rewritten or deleted.
+func (c *commitInfoCache) removeFrom(ver int64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for cached, elem := range c.entries {
+		if cached >= ver {
+			c.lru.Remove(elem)
+			delete(c.entries, cached)
+		}
+	}
+}
+
+// len returns the number of cached commit infos.
+func (c *commitInfoCache) len() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.lru.Len()
+}
@@ -16,9 +16,14 @@ type gasKVStore struct {
 	parent    sdk.KVStore
 }
 
-// NewGasKVStore returns a reference to a new GasKVStore.
+// NewGasKVStore returns a reference to a new GasKVStore. The flat costs are
+// consumed on every operation, even if the parent serves it from a cache.
+// Panics if the gas config has negative costs.
 // nolint
 func NewGasKVStore(gasMeter sdk.GasMeter, gasConfig sdk.GasConfig, parent sdk.KVStore) *gasKVStore {
+	if err := gasConfig.Validate(); err != nil {
+		panic(err)
+	}
 	kvs := &gasKVStore{
 		gasMeter:  gasMeter,
 		gasConfig: gasConfig,
@@ -32,6 +37,21 @@ func (gs *gasKVStore) GetStoreType() sdk.StoreType {
 	return gs.parent.GetStoreType()
 }
 
+// StoreName implements NamedStore.
+func (gs *gasKVStore) StoreName() string {
+	return storeName(gs.parent)
+}
+
+// cacheDepth implements cacheDepthStore.
+func (gs *gasKVStore) cacheDepth() (int, int, bool) {
+	return storeCacheDepth(gs.parent)
+}
+
+// cacheKeyValidator implements keyValidatorStore.
+func (gs *gasKVStore) cacheKeyValidator() func(key []byte) error {
+	return storeKeyValidator(gs.parent)
+}
+
 // Implements KVStore.
 func (gs *gasKVStore) Get(key []byte) (value []byte) {
 	gs.gasMeter.ConsumeGas(gs.gasConfig.ReadCostFlat, sdk.GasReadCostFlatDesc)
@@ -103,3 +103,62 @@ func TestGasKVStoreWrap(t *testing.T) {
 	testGasKVStoreWrap(t, ts)
 
 }
+
+func TestGasKVStoreFlatCostOnCacheHits(t *testing.T) {
+	mem := dbStoreAdapter{dbm.NewMemDB()}
+	mem.Set(keyFmt(1), valFmt(1))
+	config := sdk.GasConfig{
+		HasCost:          3,
+		DeleteCost:       5,
+		ReadCostFlat:     7,
+		ReadCostPerByte:  2,
+		WriteCostFlat:    11,
+		WriteCostPerByte: 13,
+		ValueCostPerByte: 1,
+		IterNextCostFlat: 17,
+	}
+	meter := sdk.NewGasMeter(10000)
+	st := NewGasKVStore(meter, config, NewCacheKVStore(mem))
+	valueLen := int64(len(valFmt(1)))
+
+	// The first read misses the cache, the second hits it at the same cost.
+	st.Get(keyFmt(1))
+	require.Equal(t, 7+2*valueLen, meter.GasConsumed())
+	st.Get(keyFmt(1))
+	require.Equal(t, 2*(7+2*valueLen), meter.GasConsumed())
+
+	gas := meter.GasConsumed()
+	st.Has(keyFmt(1))
+	require.Equal(t, gas+3, meter.GasConsumed())
+
+	gas = meter.GasConsumed()
+	st.Get(keyFmt(2))
+	st.Get(keyFmt(2))
+	require.Equal(t, gas+2*7, meter.GasConsumed())
+
+	gas = meter.GasConsumed()
+	st.Set(keyFmt(2), valFmt(2))
+	require.Equal(t, gas+11+13*valueLen, meter.GasConsumed())
+
+	gas = meter.GasConsumed()
+	st.Delete(keyFmt(2))
+	require.Equal(t, gas+5, meter.GasConsumed())
+
+	// Seeking to the only key and stepping past it.
+	gas = meter.GasConsumed()
+	iter := st.Iterator(nil, nil)
+	require.Equal(t, gas+17+valueLen, meter.GasConsumed())
+	iter.Next()
+	require.False(t, iter.Valid())
+	require.Equal(t, gas+2*(17+valueLen), meter.GasConsumed())
+	iter.Close()
+}
+
+func TestGasKVStoreInvalidConfig(t *testing.T) {
+	mem := dbStoreAdapter{dbm.NewMemDB()}
+	meter := sdk.NewGasMeter(1000)
+	config := sdk.KVGasConfig()
+	config.IterNextCostFlat = -1
+	require.Panics(t, func() { NewGasKVStore(meter, config, mem) })
+	require.Panics(t, func() { mem.Gas(meter, config) })
+}
@@ -0,0 +1,42 @@
+package store
+
+import (
+	"github.com/tendermint/tendermint/crypto/merkle"
+	"github.com/tendermint/tendermint/crypto/tmhash"
+)
+
+// Hasher computes the commit hash of a rootMultiStore from the commits of its
+// stores.
+type Hasher interface {
+	// HashStore returns the leaf hash of a store given its amino encoded
+	// commit info.
+	HashStore(core []byte) []byte
+
+	// HashStores returns the root hash over the leaf hashes of all stores,
+	// keyed by store name.
+	HashStores(leaves map[string][]byte) []byte
+}
+
+// DefaultHasher hashes the store commits with tmhash into a simple merkle
+// tree. Query proofs are only verifiable for commit hashes computed by it.
+var DefaultHasher Hasher = defaultHasher{}
+
+type defaultHasher struct{}
+
+// Implements Hasher.
+func (defaultHasher) HashStore(core []byte) []byte {
+	hasher := tmhash.New()
+
+	_, err := hasher.Write(core)
+	if err != nil {
+		// TODO: Handle with #870
+		panic(err)
+	}
+
+	return hasher.Sum(nil)
+}
+
+// Implements Hasher.
+func (defaultHasher) HashStores(leaves map[string][]byte) []byte {
+	return merkle.SimpleHashFromMap(leaves)
+}
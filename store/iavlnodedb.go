@@ -0,0 +1,383 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	amino "github.com/tendermint/go-amino"
+	"github.com/tendermint/iavl"
+	dbm "github.com/tendermint/tendermint/libs/db"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+)
+
+// iavl has no API to build a tree from its nodes, nor to delete its latest
+// versions, so snapshot imports and rollbacks write the db of an IAVL tree
+// directly. This depends on the key layout and node encoding of the iavl
+// nodedb, which are private to iavl and only known to match those of
+// iavlFormatRevision. checkIAVLFormat verifies them against the linked iavl
+// before any tree is written.
+
+// iavlFormatRevision is the iavl revision the nodedb format below is taken
+// from, as pinned in Gopkg.toml.
+const iavlFormatRevision = "v0.11.1"
+
+// The prefixes of the nodes, orphans and roots in the db of an IAVL tree,
+// matching the key formats of the iavl nodedb.
+var (
+	iavlNodePrefix   = []byte("n") // n<hash>
+	iavlOrphanPrefix = []byte("o") // o<last version><first version><hash>
+	iavlRootPrefix   = []byte("r") // r<version>
+)
+
+// iavlVersionKey returns the key of the version under the prefix in the db
+// of an IAVL tree.
+func iavlVersionKey(prefix []byte, version int64) []byte {
+	key := make([]byte, len(prefix)+8)
+	copy(key, prefix)
+	binary.BigEndian.PutUint64(key[len(prefix):], uint64(version))
+	return key
+}
+
+// iavlNodeBytes encodes a node as the iavl nodedb persists it, followed by
+// its value for leaves or the hashes of its children for inner nodes.
+func iavlNodeBytes(height int8, size, version int64, key []byte, data ...[]byte) []byte {
+	var buf bytes.Buffer
+	// Writing to a bytes.Buffer doesn't fail.
+	_ = amino.EncodeInt8(&buf, height)
+	_ = amino.EncodeVarint(&buf, size)
+	_ = amino.EncodeVarint(&buf, version)
+	_ = amino.EncodeByteSlice(&buf, key)
+	for _, bz := range data {
+		_ = amino.EncodeByteSlice(&buf, bz)
+	}
+	return buf.Bytes()
+}
+
+// decodeIAVLNode decodes the version of a node persisted by the iavl nodedb,
+// and the hashes of its children if it is an inner node.
+func decodeIAVLNode(bz []byte) (version int64, children [][]byte, err error) {
+	height, n, err := amino.DecodeInt8(bz)
+	if err != nil {
+		return 0, nil, err
+	}
+	bz = bz[n:]
+	if _, n, err = amino.DecodeVarint(bz); err != nil {
+		return 0, nil, err
+	}
+	bz = bz[n:]
+	if version, n, err = amino.DecodeVarint(bz); err != nil {
+		return 0, nil, err
+	}
+	bz = bz[n:]
+	if height == 0 {
+		return version, nil, nil
+	}
+
+	// The key is followed by the hashes of the children.
+	for i := 0; i < 3; i++ {
+		var field []byte
+		if field, n, err = amino.DecodeByteSlice(bz); err != nil {
+			return 0, nil, err
+		}
+		bz = bz[n:]
+		if i > 0 {
+			children = append(children, field)
+		}
+	}
+	return version, children, nil
+}
+
+// deleteIAVLVersionsAfter permanently deletes all versions of the IAVL tree
+// persisted in db above version, so that the tree can save different data at
+// those versions again; iavl refuses to save a version again with a
+// different hash, and can't delete its latest version. It drops the roots
+// of the versions, every node created in them and the orphan entries of
+// nodes which are live again in version, leaving the db as if the versions
+// were never saved. Deleting the same versions again is a no-op, so an
+// interrupted deletion completes when repeated.
+func deleteIAVLVersionsAfter(db dbm.DB, version int64) error {
+	batch := newFlushingBatch(db, defaultFlushEvery)
+
+	// The nodes created after version are reachable from the roots of the
+	// deleted versions through nodes created after version only, as nodes
+	// are never newer than their children. The roots are deleted last, so
+	// that they are still found if this is interrupted.
+	var roots, rootHashes [][]byte
+	iter := db.Iterator(iavlVersionKey(iavlRootPrefix, version+1), sdk.PrefixEndBytes(iavlRootPrefix))
+	for ; iter.Valid(); iter.Next() {
+		roots = append(roots, cp(iter.Key()))
+		rootHashes = append(rootHashes, cp(iter.Value()))
+	}
+	iter.Close()
+	for _, hash := range rootHashes {
+		if len(hash) == 0 {
+			continue
+		}
+		if err := deleteIAVLNodesAfter(db, batch, hash, version); err != nil {
+			return err
+		}
+	}
+
+	// Orphan entries are sorted by the last version their node was live in,
+	// which is at least the first version. Entries of nodes live in version
+	// itself are dropped as well, as the nodes are live again.
+	iter = db.Iterator(iavlVersionKey(iavlOrphanPrefix, version), sdk.PrefixEndBytes(iavlOrphanPrefix))
+	for ; iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if len(key) <= 17 {
+			continue
+		}
+		firstVersion := int64(binary.BigEndian.Uint64(key[9:17]))
+		if firstVersion > version {
+			batch.Delete(append(cp(iavlNodePrefix), key[17:]...))
+		}
+		batch.Delete(cp(key))
+	}
+	iter.Close()
+
+	for _, root := range roots {
+		batch.Delete(root)
+	}
+	batch.Write()
+	return nil
+}
+
+// hasIAVLVersionsAfter returns whether the IAVL tree persisted in db has
+// saved any version above version.
+func hasIAVLVersionsAfter(db dbm.DB, version int64) bool {
+	iter := db.Iterator(iavlVersionKey(iavlRootPrefix, version+1), sdk.PrefixEndBytes(iavlRootPrefix))
+	defer iter.Close()
+	return iter.Valid()
+}
+
+// deleteIAVLNodesAfter deletes the node with the given hash and all nodes
+// below it which were created after version. Nodes deleted before are
+// skipped.
+func deleteIAVLNodesAfter(db dbm.DB, batch *flushingBatch, hash []byte, version int64) error {
+	stack := [][]byte{hash}
+	for len(stack) > 0 {
+		hash, stack = stack[len(stack)-1], stack[:len(stack)-1]
+		key := append(cp(iavlNodePrefix), hash...)
+		bz := db.Get(key)
+		if bz == nil {
+			continue
+		}
+		nodeVersion, children, err := decodeIAVLNode(bz)
+		if err != nil {
+			return fmt.Errorf("failed to decode node %X: %v", hash, err)
+		}
+		if nodeVersion <= version {
+			continue
+		}
+		batch.Delete(key)
+		stack = append(stack, children...)
+	}
+	return nil
+}
+
+// snapshotTreeWriter persists the nodes of an IAVL tree in the format of the
+// iavl nodedb, given the proven paths to its leaves in key order.
+type snapshotTreeWriter struct {
+	batch *flushingBatch
+}
+
+func newSnapshotTreeWriter(db dbm.DB) *snapshotTreeWriter {
+	return &snapshotTreeWriter{batch: newFlushingBatch(db, defaultFlushEvery)}
+}
+
+// writeLeaf writes the leaf holding key and value, which must be the first
+// leaf of proof, along with the inner nodes of which it is the leftmost leaf
+// of the right subtree. As every inner node has exactly one such leaf,
+// writing all leaves writes every inner node once. Inner nodes are keyed by
+// the leftmost key of their right subtree.
+func (w *snapshotTreeWriter) writeLeaf(proof *iavl.RangeProof, key, value []byte) error {
+	if len(proof.Leaves) == 0 || !bytes.Equal(proof.Leaves[0].Key, key) {
+		return fmt.Errorf("proof doesn't start at key %X", key)
+	}
+	leaf := proof.Leaves[0]
+	hash := leaf.Hash()
+	w.batch.Set(append(cp(iavlNodePrefix), hash...), iavlNodeBytes(0, 1, leaf.Version, key, value))
+
+	// The path starts at the root.
+	path := proof.LeftPath
+	leftmost := true
+	for i := len(path) - 1; i >= 0; i-- {
+		node := path[i]
+		child := hash
+		hash = node.Hash(child)
+		if len(node.Left) == 0 || !leftmost {
+			continue
+		}
+		leftmost = false
+		w.batch.Set(append(cp(iavlNodePrefix), hash...),
+			iavlNodeBytes(node.Height, node.Size, node.Version, key, node.Left, child))
+	}
+	return nil
+}
+
+// writeRoot writes the root of the tree at the version of id and flushes
+// the tree. Trees which were never committed have no root.
+func (w *snapshotTreeWriter) writeRoot(id CommitID) {
+	if id.Version > 0 {
+		root := id.Hash
+		if root == nil {
+			root = []byte{}
+		}
+		w.batch.Set(iavlVersionKey(iavlRootPrefix, id.Version), root)
+	}
+	w.batch.Write()
+}
+
+// verifyIAVLTree loads the tree written to db at the version of id through
+// the iavl API, and checks that it holds size pairs and proves its first
+// pair against the hash of id. This fails if the nodes weren't written in a
+// format the linked iavl reads.
+func verifyIAVLTree(db dbm.DB, id CommitID, size int64) (err error) {
+	defer func() {
+		// iavl panics on nodes it can't decode.
+		if r := recover(); r != nil {
+			err = fmt.Errorf("failed to load tree: %v", r)
+		}
+	}()
+
+	tree := iavl.NewMutableTree(db, 0)
+	if _, err := tree.LoadVersion(id.Version); err != nil {
+		return err
+	}
+	if !bytes.Equal(tree.Hash(), id.Hash) {
+		return fmt.Errorf("loaded root %X, expected %X", tree.Hash(), id.Hash)
+	}
+	if tree.Size() != size {
+		return fmt.Errorf("loaded %d pairs, expected %d", tree.Size(), size)
+	}
+	if size == 0 {
+		return nil
+	}
+	_, _, proof, err := tree.GetVersionedRangeWithProof(nil, nil, 1, id.Version)
+	if err != nil {
+		return err
+	}
+	return proof.Verify(id.Hash)
+}
+
+var (
+	iavlFormatOnce sync.Once
+	iavlFormatErr  error
+)
+
+// checkIAVLFormat checks once that the linked iavl persists trees in the
+// format of iavlFormatRevision, and returns an error otherwise.
+func checkIAVLFormat() error {
+	iavlFormatOnce.Do(func() {
+		if err := verifyIAVLFormat(); err != nil {
+			iavlFormatErr = fmt.Errorf("iavl nodedb format differs from that of iavl %s: %v",
+				iavlFormatRevision, err)
+		}
+	})
+	return iavlFormatErr
+}
+
+// verifyIAVLFormat saves a small tree through the iavl API, and checks that
+// rebuilding it from its proofs writes the same nodes and root, and that
+// its orphans are keyed as expected.
+func verifyIAVLFormat() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	db := dbm.NewMemDB()
+	tree := iavl.NewMutableTree(db, 0)
+	for i := 0; i < 8; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i), byte(i)})
+	}
+	if _, _, err := tree.SaveVersion(); err != nil {
+		return err
+	}
+	tree.Remove([]byte{3})
+	tree.Set([]byte{5}, []byte("updated"))
+	hash, version, err := tree.SaveVersion()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := exportSnapshotItems(&buf, "", tree, version); err != nil {
+		return err
+	}
+	rebuilt := dbm.NewMemDB()
+	w := newSnapshotTreeWriter(rebuilt)
+	var prev, prevValue []byte
+	for {
+		var item snapshotItem
+		if _, err := cdc.UnmarshalBinaryLengthPrefixedReader(&buf, &item, maxSnapshotItemSize); err != nil {
+			return err
+		}
+		if prev != nil {
+			if err := w.writeLeaf(item.Proof, prev, prevValue); err != nil {
+				return err
+			}
+		}
+		if item.End {
+			break
+		}
+		prev, prevValue = item.Key, item.Value
+	}
+	w.writeRoot(CommitID{Version: version, Hash: hash})
+
+	// A tree of n leaves has 2n-1 nodes, plus its root entry.
+	written := int64(0)
+	iter := rebuilt.Iterator(nil, nil)
+	for ; iter.Valid(); iter.Next() {
+		if !bytes.Equal(db.Get(iter.Key()), iter.Value()) {
+			iter.Close()
+			return fmt.Errorf("rebuilt entry %X differs from the saved one", iter.Key())
+		}
+		written++
+	}
+	iter.Close()
+	if written != 2*tree.Size() {
+		return fmt.Errorf("rebuilt %d entries of a tree of size %d", written, tree.Size())
+	}
+
+	// The nodes replaced in the second version were live in the first only.
+	orphans := 0
+	iter = dbm.IteratePrefix(db, iavlOrphanPrefix)
+	for ; iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if len(key) <= 17 {
+			iter.Close()
+			return fmt.Errorf("invalid orphan key %X", key)
+		}
+		last := int64(binary.BigEndian.Uint64(key[1:9]))
+		first := int64(binary.BigEndian.Uint64(key[9:17]))
+		if last != version-1 || first != version-1 || !db.Has(append(cp(iavlNodePrefix), key[17:]...)) {
+			iter.Close()
+			return fmt.Errorf("invalid orphan key %X", key)
+		}
+		orphans++
+	}
+	iter.Close()
+	if orphans == 0 {
+		return fmt.Errorf("no orphans saved")
+	}
+
+	// The root is of the latest version, with both children saved.
+	rootVersion, children, err := decodeIAVLNode(db.Get(append(cp(iavlNodePrefix), hash...)))
+	if err != nil {
+		return err
+	}
+	if rootVersion != version || len(children) != 2 {
+		return fmt.Errorf("root decoded at version %d with %d children", rootVersion, len(children))
+	}
+	for _, child := range children {
+		if !db.Has(append(cp(iavlNodePrefix), child...)) {
+			return fmt.Errorf("child %X of the root not saved", child)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/iavl"
+	dbm "github.com/tendermint/tendermint/libs/db"
+)
+
+func TestIAVLFormat(t *testing.T) {
+	require.Nil(t, verifyIAVLFormat())
+	require.Nil(t, checkIAVLFormat())
+}
+
+// Nodes encoded as iavl v0.11.1 persists them, with zigzag varints.
+func TestIAVLNodeBytes(t *testing.T) {
+	leaf := iavlNodeBytes(0, 1, 3, []byte("key"), []byte("value"))
+	require.Equal(t, []byte{0x00, 0x02, 0x06, 0x03, 'k', 'e', 'y', 0x05, 'v', 'a', 'l', 'u', 'e'}, leaf)
+
+	inner := iavlNodeBytes(1, 2, 300, []byte{0x01}, []byte{0xaa}, []byte{0xbb})
+	require.Equal(t, []byte{0x02, 0x04, 0xd8, 0x04, 0x01, 0x01, 0x01, 0xaa, 0x01, 0xbb}, inner)
+
+	require.Equal(t, []byte{'r', 0, 0, 0, 0, 0, 0, 0x01, 0x02}, iavlVersionKey(iavlRootPrefix, 258))
+}
+
+func TestSnapshotTreeWriterRoundTrip(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := iavl.NewMutableTree(db, 0)
+	for i := 0; i < 20; i++ {
+		tree.Set(keyFmt(i), valFmt(i))
+	}
+	_, _, err := tree.SaveVersion()
+	require.Nil(t, err)
+	for i := 0; i < 20; i += 3 {
+		tree.Remove(keyFmt(i))
+	}
+	tree.Set(keyFmt(7), valFmt(70))
+	hash, version, err := tree.SaveVersion()
+	require.Nil(t, err)
+
+	var buf bytes.Buffer
+	require.Nil(t, exportSnapshotItems(&buf, "store", tree, version))
+	rebuilt := dbm.NewMemDB()
+	w := newSnapshotTreeWriter(rebuilt)
+	var prev, prevValue []byte
+	for {
+		var item snapshotItem
+		_, err := cdc.UnmarshalBinaryLengthPrefixedReader(&buf, &item, maxSnapshotItemSize)
+		require.Nil(t, err)
+		if prev != nil {
+			require.Nil(t, w.writeLeaf(item.Proof, prev, prevValue))
+		}
+		if item.End {
+			break
+		}
+		prev, prevValue = item.Key, item.Value
+	}
+	id := CommitID{Version: version, Hash: hash}
+	w.writeRoot(id)
+	require.Nil(t, verifyIAVLTree(rebuilt, id, tree.Size()))
+	require.Error(t, verifyIAVLTree(rebuilt, id, tree.Size()+1))
+
+	// The rebuilt tree loads through iavl, reads the same pairs and saves the
+	// next version with the same hash as the original.
+	loaded := iavl.NewMutableTree(rebuilt, 0)
+	_, err = loaded.LoadVersion(version)
+	require.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		_, want := tree.Get(keyFmt(i))
+		_, got := loaded.Get(keyFmt(i))
+		require.Equal(t, want, got)
+	}
+	tree.Set(keyFmt(3), valFmt(30))
+	loaded.Set(keyFmt(3), valFmt(30))
+	wantHash, _, err := tree.SaveVersion()
+	require.Nil(t, err)
+	gotHash, _, err := loaded.SaveVersion()
+	require.Nil(t, err)
+	require.Equal(t, wantHash, gotHash)
+}
+
+// saveIAVLVersions saves versions of a tree in db, each updating and
+// removing some of the keys of the previous one.
+func saveIAVLVersions(t *testing.T, tree *iavl.MutableTree, from, to int) {
+	for v := from; v <= to; v++ {
+		for i := 0; i < 10; i++ {
+			tree.Set(keyFmt(v*3+i), valFmt(v))
+		}
+		tree.Remove(keyFmt(v*3 - 1))
+		_, _, err := tree.SaveVersion()
+		require.Nil(t, err)
+	}
+}
+
+func TestDeleteIAVLVersionsAfter(t *testing.T) {
+	db := dbm.NewMemDB()
+	saveIAVLVersions(t, iavl.NewMutableTree(db, 0), 1, 5)
+
+	// The same versions saved without the deleted ones.
+	expected := dbm.NewMemDB()
+	expectedTree := iavl.NewMutableTree(expected, 0)
+	saveIAVLVersions(t, expectedTree, 1, 2)
+
+	// No roots, nodes or orphans of the deleted versions are left behind.
+	require.Nil(t, deleteIAVLVersionsAfter(db, 2))
+	require.Equal(t, collectKVs(expected.Iterator(nil, nil)), collectKVs(db.Iterator(nil, nil)))
+	require.Nil(t, deleteIAVLVersionsAfter(db, 2))
+	require.Equal(t, collectKVs(expected.Iterator(nil, nil)), collectKVs(db.Iterator(nil, nil)))
+
+	// The tree reloads at the remaining version and saves the next version
+	// again, with other data.
+	tree := iavl.NewMutableTree(db, 0)
+	version, err := tree.LoadVersion(0)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), version)
+	tree.Set([]byte("other"), []byte("value"))
+	expectedTree.Set([]byte("other"), []byte("value"))
+	hash, version, err := tree.SaveVersion()
+	require.Nil(t, err)
+	require.Equal(t, int64(3), version)
+	expectedHash, _, err := expectedTree.SaveVersion()
+	require.Nil(t, err)
+	require.Equal(t, expectedHash, hash)
+
+	tree = iavl.NewMutableTree(db, 0)
+	version, err = tree.LoadVersion(0)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), version)
+	_, value := tree.Get([]byte("other"))
+	require.Equal(t, []byte("value"), value)
+
+	// Deleting all versions leaves an empty db.
+	require.Nil(t, deleteIAVLVersionsAfter(db, 0))
+	require.Empty(t, collectKVs(db.Iterator(nil, nil)))
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"sync"
@@ -35,6 +36,7 @@ func LoadIAVLStore(db dbm.DB, id CommitID, pruning sdk.PruningStrategy) (CommitS
 var _ KVStore = (*iavlStore)(nil)
 var _ CommitStore = (*iavlStore)(nil)
 var _ Queryable = (*iavlStore)(nil)
+var _ KeyCounter = (*iavlStore)(nil)
 
 // iavlStore Implements KVStore and CommitStore.
 type iavlStore struct {
@@ -53,6 +55,9 @@ type iavlStore struct {
 	// By default this value should be set the same across all nodes,
 	// so that nodes can know the waypoints their peers store.
 	storeEvery int64
+
+	// The name the store is mounted under, if any.
+	name string
 }
 
 // CONTRACT: tree should be fully loaded.
@@ -66,6 +71,11 @@ func newIAVLStore(tree *iavl.MutableTree, numRecent int64, storeEvery int64) *ia
 	return st
 }
 
+// StoreName implements NamedStore.
+func (st *iavlStore) StoreName() string {
+	return st.name
+}
+
 // Implements Committer.
 func (st *iavlStore) Commit() CommitID {
 	// Save a new version.
@@ -101,6 +111,25 @@ func (st *iavlStore) LastCommitID() CommitID {
 	}
 }
 
+// Implements CommitHasher. It returns the root hash of the working tree,
+// which is the hash the next Commit() will save.
+func (st *iavlStore) ComputeCommitHash() ([]byte, error) {
+	return st.tree.WorkingHash(), nil
+}
+
+// Implements KeyCounter. It returns the number of leaves of the working
+// tree, which is known without traversing it.
+func (st *iavlStore) ApproxKeyCount() int64 {
+	return st.tree.Size()
+}
+
+// The versions kept by sdk.PruneSyncable: the latest syncableKeepRecent ones
+// and every syncableKeepEvery-th.
+const (
+	syncableKeepRecent = 100
+	syncableKeepEvery  = 10000
+)
+
 // Implements Committer.
 func (st *iavlStore) SetPruning(pruning sdk.PruningStrategy) {
 	switch pruning {
@@ -110,8 +139,8 @@ func (st *iavlStore) SetPruning(pruning sdk.PruningStrategy) {
 	case sdk.PruneNothing:
 		st.storeEvery = 1
 	case sdk.PruneSyncable:
-		st.numRecent = 100
-		st.storeEvery = 10000
+		st.numRecent = syncableKeepRecent
+		st.storeEvery = syncableKeepEvery
 	}
 }
 
@@ -176,6 +205,76 @@ func (st *iavlStore) ReverseIterator(start, end []byte) Iterator {
 	return newIAVLIterator(st.tree.ImmutableTree, start, end, false)
 }
 
+// committedView returns a read-only KVStore over the latest committed
+// version of the tree, which doesn't see uncommitted writes.
+func (st *iavlStore) committedView() (KVStore, error) {
+	tree, err := st.treeAt(st.tree.Version())
+	if err != nil {
+		return nil, err
+	}
+	return immutableIAVLStore{tree}, nil
+}
+
+// treeAt returns the immutable tree of the given committed version, which is
+// empty for version 0.
+func (st *iavlStore) treeAt(version int64) (*iavl.ImmutableTree, error) {
+	if version == 0 {
+		return iavl.NewImmutableTree(dbm.NewMemDB(), 0), nil
+	}
+	return st.tree.GetImmutable(version)
+}
+
+// diffVersions returns the sorted keys which were set, changed or deleted
+// between the two committed versions. Trees with equal root hashes are known
+// to hold the same data without traversal, otherwise both trees are
+// traversed in key order.
+func (st *iavlStore) diffVersions(from, to int64) ([][]byte, error) {
+	fromTree, err := st.treeAt(from)
+	if err != nil {
+		return nil, fmt.Errorf("version %d is not available: %v", from, err)
+	}
+	toTree, err := st.treeAt(to)
+	if err != nil {
+		return nil, fmt.Errorf("version %d is not available: %v", to, err)
+	}
+	if bytes.Equal(fromTree.Hash(), toTree.Hash()) {
+		return nil, nil
+	}
+
+	fromIter := newIAVLIterator(fromTree, nil, nil, true)
+	defer fromIter.Close()
+	toIter := newIAVLIterator(toTree, nil, nil, true)
+	defer toIter.Close()
+
+	var changed [][]byte
+	for fromIter.Valid() || toIter.Valid() {
+		switch {
+		case !toIter.Valid():
+			changed = append(changed, fromIter.Key())
+			fromIter.Next()
+		case !fromIter.Valid():
+			changed = append(changed, toIter.Key())
+			toIter.Next()
+		default:
+			switch cmp := bytes.Compare(fromIter.Key(), toIter.Key()); {
+			case cmp < 0:
+				changed = append(changed, fromIter.Key())
+				fromIter.Next()
+			case cmp > 0:
+				changed = append(changed, toIter.Key())
+				toIter.Next()
+			default:
+				if !bytes.Equal(fromIter.Value(), toIter.Value()) {
+					changed = append(changed, fromIter.Key())
+				}
+				fromIter.Next()
+				toIter.Next()
+			}
+		}
+	}
+	return changed, nil
+}
+
 // Handle gatest the latest height, if height is 0
 func getHeight(tree *iavl.MutableTree, req abci.RequestQuery) int64 {
 	height := req.Height
@@ -268,6 +367,72 @@ func (st *iavlStore) Query(req abci.RequestQuery) (res abci.ResponseQuery) {
 
 //----------------------------------------
 
+var _ KVStore = immutableIAVLStore{}
+
+// immutableIAVLStore is a read-only KVStore over a fixed version of an IAVL
+// tree. Set and Delete panic.
+type immutableIAVLStore struct {
+	tree *iavl.ImmutableTree
+}
+
+// Implements Store.
+func (st immutableIAVLStore) GetStoreType() StoreType {
+	return sdk.StoreTypeIAVL
+}
+
+// Implements Store.
+func (st immutableIAVLStore) CacheWrap() CacheWrap {
+	return NewCacheKVStore(st)
+}
+
+// CacheWrapWithTrace implements the Store interface.
+func (st immutableIAVLStore) CacheWrapWithTrace(w io.Writer, tc TraceContext) CacheWrap {
+	return NewCacheKVStore(NewTraceKVStore(st, w, tc))
+}
+
+// Implements KVStore.
+func (st immutableIAVLStore) Get(key []byte) []byte {
+	_, v := st.tree.Get(key)
+	return v
+}
+
+// Implements KVStore.
+func (st immutableIAVLStore) Has(key []byte) bool {
+	return st.tree.Has(key)
+}
+
+// Implements KVStore.
+func (st immutableIAVLStore) Set(key, value []byte) {
+	panic("cannot Set on an immutable IAVL store")
+}
+
+// Implements KVStore.
+func (st immutableIAVLStore) Delete(key []byte) {
+	panic("cannot Delete on an immutable IAVL store")
+}
+
+// Implements KVStore
+func (st immutableIAVLStore) Prefix(prefix []byte) KVStore {
+	return prefixStore{st, prefix}
+}
+
+// Implements KVStore
+func (st immutableIAVLStore) Gas(meter GasMeter, config GasConfig) KVStore {
+	return NewGasKVStore(meter, config, st)
+}
+
+// Implements KVStore.
+func (st immutableIAVLStore) Iterator(start, end []byte) Iterator {
+	return newIAVLIterator(st.tree, start, end, true)
+}
+
+// Implements KVStore.
+func (st immutableIAVLStore) ReverseIterator(start, end []byte) Iterator {
+	return newIAVLIterator(st.tree, start, end, false)
+}
+
+//----------------------------------------
+
 // Implements Iterator.
 type iavlIterator struct {
 	// Underlying store
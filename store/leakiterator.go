@@ -0,0 +1,31 @@
+package store
+
+import (
+	"runtime"
+	"runtime/debug"
+
+	"github.com/tendermint/tendermint/libs/log"
+)
+
+// leakCheckedIterator logs the stack it was created at if it is garbage
+// collected without being closed, which leaks the iterator of the parent.
+type leakCheckedIterator struct {
+	Iterator
+	stack []byte
+}
+
+var _ Iterator = (*leakCheckedIterator)(nil)
+
+func newLeakCheckedIterator(iter Iterator, logger log.Logger) *leakCheckedIterator {
+	li := &leakCheckedIterator{Iterator: iter, stack: debug.Stack()}
+	runtime.SetFinalizer(li, func(li *leakCheckedIterator) {
+		logger.Error("Iterator garbage collected without Close", "stack", string(li.stack))
+	})
+	return li
+}
+
+// Implements Iterator.
+func (li *leakCheckedIterator) Close() {
+	runtime.SetFinalizer(li, nil)
+	li.Iterator.Close()
+}
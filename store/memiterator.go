@@ -15,10 +15,12 @@ type memIterator struct {
 	items      []cmn.KVPair
 }
 
-func newMemIterator(start, end []byte, items []cmn.KVPair) *memIterator {
+// The direction must be passed in, it can't be told from start and end as
+// either may be nil. For a descending iterator start is the inclusive upper
+// bound and end the exclusive lower bound.
+func newMemIterator(start, end []byte, items []cmn.KVPair, ascending bool) *memIterator {
 	itemsInDomain := make([]cmn.KVPair, 0)
 	for _, item := range items {
-		ascending := keyCompare(start, end) < 0
 		if dbm.IsKeyInDomain(item.Key, start, end, !ascending) {
 			itemsInDomain = append(itemsInDomain, item)
 		}
@@ -0,0 +1,17 @@
+package store
+
+import (
+	"time"
+)
+
+// Metrics receives observations from rootMultiStore.Commit. It is optional;
+// no observations are made unless one is set with SetMetrics.
+type Metrics interface {
+	// ObserveCommitDuration is called with the time taken to commit all
+	// substores.
+	ObserveCommitDuration(d time.Duration)
+
+	// ObserveStoreCount is called with the number of substores which
+	// committed a non-zero CommitID.
+	ObserveStoreCount(n int)
+}
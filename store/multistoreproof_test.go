@@ -1,10 +1,12 @@
 package store
 
 import (
+	"fmt"
 	"testing"
 
 	sdk "github.com/cosmos/cosmos-sdk/types"
 	"github.com/stretchr/testify/require"
+	"github.com/tendermint/iavl"
 	abci "github.com/tendermint/tendermint/abci/types"
 	dbm "github.com/tendermint/tendermint/libs/db"
 )
@@ -107,6 +109,60 @@ func TestVerifyMultiStoreQueryProof(t *testing.T) {
 	require.NotNil(t, err)
 }
 
+func TestMultiStoreQueryWithProofOps(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := NewCommitMultiStore(db)
+	iavlStoreKey := sdk.NewKVStoreKey("iavlStoreKey")
+
+	store.MountStoreWithDB(iavlStoreKey, sdk.StoreTypeIAVL, nil)
+	store.LoadVersion(0)
+
+	iavlStore := store.GetCommitStore(iavlStoreKey).(*iavlStore)
+	iavlStore.Set([]byte("MYKEY"), []byte("MYVALUE"))
+	cid := store.Commit()
+
+	req := abci.RequestQuery{
+		Path:  "/iavlStoreKey/key",
+		Data:  []byte("MYKEY"),
+		Prove: true,
+	}
+	res, ops, err := store.QueryWithProofOps(req)
+	require.Nil(t, err)
+	require.Nil(t, res.Proof)
+	require.Equal(t, []byte("MYVALUE"), res.Value)
+	require.Len(t, ops, 2)
+	require.Equal(t, iavl.ProofOpIAVLValue, ops[0].Type)
+	require.Equal(t, ProofOpMultiStore, ops[1].Type)
+
+	// Verify each layer on its own.
+	prt := DefaultProofRuntime()
+	substoreOp, err := prt.Decode(ops[0])
+	require.Nil(t, err)
+	substoreRoot, err := substoreOp.Run([][]byte{[]byte("MYVALUE")})
+	require.Nil(t, err)
+	require.Equal(t, iavlStore.LastCommitID().Hash, substoreRoot[0])
+
+	multiStoreOp, err := prt.Decode(ops[1])
+	require.Nil(t, err)
+	root, err := multiStoreOp.Run(substoreRoot)
+	require.Nil(t, err)
+	require.Equal(t, cid.Hash, root[0])
+
+	// The ops match the proof embedded by Query.
+	require.Equal(t, ops, store.Query(req).Proof.Ops)
+
+	// No proof requested.
+	req.Prove = false
+	_, ops, err = store.QueryWithProofOps(req)
+	require.Nil(t, err)
+	require.Nil(t, ops)
+
+	// Failing query.
+	req.Path = "/unknown/key"
+	_, _, err = store.QueryWithProofOps(req)
+	require.NotNil(t, err)
+}
+
 func TestVerifyMultiStoreQueryProofEmptyStore(t *testing.T) {
 	// Create main tree for testing.
 	db := dbm.NewMemDB()
@@ -172,3 +228,178 @@ func TestVerifyMultiStoreQueryProofAbsence(t *testing.T) {
 	err = prt.VerifyValue(res.Proof, cid.Hash, "/iavlStoreKey/MYABSENTKEY", []byte(""))
 	require.NotNil(t, err)
 }
+
+func TestVerifyMultiStoreQueryBatchProof(t *testing.T) {
+	// Create main tree for testing.
+	db := dbm.NewMemDB()
+	store := NewCommitMultiStore(db)
+	key1 := sdk.NewKVStoreKey("store1")
+	key2 := sdk.NewKVStoreKey("store2")
+
+	store.MountStoreWithDB(key1, sdk.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(key2, sdk.StoreTypeIAVL, nil)
+	store.LoadVersion(0)
+
+	store.GetKVStore(key1).Set([]byte("MYKEY"), []byte("MYVALUE1"))
+	store.GetKVStore(key2).Set([]byte("MYKEY"), []byte("MYVALUE2"))
+	cid := store.Commit()
+
+	// Get Proofs
+	reqs := []abci.RequestQuery{
+		{Path: "/store2/key", Data: []byte("MYKEY"), Prove: true},
+		{Path: "/store1/key", Data: []byte("MYKEY"), Prove: true},
+		{Path: "/store1/key", Data: []byte("MYABSENTKEY"), Prove: true},
+	}
+	res, err := store.QueryBatch(reqs)
+	require.Nil(t, err)
+	require.Len(t, res, 3)
+
+	// Verify proofs.
+	prt := DefaultProofRuntime()
+	verr := prt.VerifyValue(res[0].Proof, cid.Hash, "/store2/MYKEY", []byte("MYVALUE2"))
+	require.Nil(t, verr)
+	verr = prt.VerifyValue(res[1].Proof, cid.Hash, "/store1/MYKEY", []byte("MYVALUE1"))
+	require.Nil(t, verr)
+	verr = prt.VerifyAbsence(res[2].Proof, cid.Hash, "/store1/MYABSENTKEY")
+	require.Nil(t, verr)
+
+	// A missing store fails the whole batch.
+	reqs = append(reqs, abci.RequestQuery{Path: "/store3/key", Data: []byte("MYKEY"), Prove: true})
+	res, err = store.QueryBatch(reqs)
+	require.NotNil(t, err)
+	require.Nil(t, res)
+
+	// So do requests at different heights.
+	store.Commit()
+	reqs = []abci.RequestQuery{
+		{Path: "/store1/key", Data: []byte("MYKEY"), Height: 1},
+		{Path: "/store2/key", Data: []byte("MYKEY"), Height: 2},
+	}
+	_, err = store.QueryBatch(reqs)
+	require.NotNil(t, err)
+}
+
+func TestVerifyMultiStoreQueryProofZeroHeight(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := NewCommitMultiStore(db)
+	iavlStoreKey := sdk.NewKVStoreKey("iavlStoreKey")
+	store.MountStoreWithDB(iavlStoreKey, sdk.StoreTypeIAVL, nil)
+	store.LoadVersion(0)
+
+	req := abci.RequestQuery{Path: "/iavlStoreKey/key", Data: []byte("MYKEY"), Prove: true}
+
+	// Nothing to prove against before the first commit.
+	res := store.Query(req)
+	require.Equal(t, sdk.ToABCICode(sdk.CodespaceRoot, sdk.CodeUnknownRequest), sdk.ABCICodeType(res.Code))
+
+	store.GetKVStore(iavlStoreKey).Set([]byte("MYKEY"), []byte("MYVALUE"))
+	cid := store.Commit()
+
+	// Height zero is answered at the latest committed version.
+	res = store.Query(req)
+	require.True(t, res.IsOK(), res.Log)
+	require.Equal(t, cid.Version, res.Height)
+	prt := DefaultProofRuntime()
+	err := prt.VerifyValue(res.Proof, cid.Hash, "/iavlStoreKey/MYKEY", []byte("MYVALUE"))
+	require.Nil(t, err)
+
+	// Later on, the proof matches the root of the height answered at.
+	store.GetKVStore(iavlStoreKey).Set([]byte("MYKEY"), []byte("MYVALUE2"))
+	store.Commit()
+	res = store.Query(req)
+	require.True(t, res.IsOK(), res.Log)
+	cInfo, cerr := getCommitInfo(db, res.Height)
+	require.Nil(t, cerr)
+	err = prt.VerifyValue(res.Proof, cInfo.CommitID().Hash, "/iavlStoreKey/MYKEY", res.Value)
+	require.Nil(t, err)
+}
+
+func TestAppendMultiStoreProofChecksCommitInfo(t *testing.T) {
+	iStore, err := LoadIAVLStore(dbm.NewMemDB(), CommitID{}, sdk.PruneNothing)
+	require.Nil(t, err)
+	store := iStore.(*iavlStore)
+	store.Set([]byte("MYKEY"), []byte("MYVALUE"))
+	cid := store.Commit()
+	query := func() abci.ResponseQuery {
+		res := store.Query(abci.RequestQuery{Path: "/key", Data: []byte("MYKEY"), Prove: true})
+		require.NotNil(t, res.Proof)
+		return res
+	}
+
+	si := storeInfo{Name: "iavlStoreKey"}
+	si.Core.CommitID = cid
+	res := query()
+	require.Nil(t, appendMultiStoreProof(&res, "iavlStoreKey", newCommitInfo(1, []storeInfo{si})))
+
+	// the store must be part of the commit info
+	res = query()
+	err = appendMultiStoreProof(&res, "otherStoreKey", newCommitInfo(1, []storeInfo{si}))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "store otherStoreKey is not part of the commit info")
+
+	// the number of store infos is bounded
+	infos := make([]storeInfo, maxProofStoreInfos+1)
+	for i := range infos {
+		infos[i].Name = fmt.Sprintf("store%d", i)
+	}
+	infos[0] = si
+	res = query()
+	err = appendMultiStoreProof(&res, "iavlStoreKey", newCommitInfo(1, infos))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "more than the maximum")
+}
+
+func TestVerifyMultiStoreQueryProofAbsenceNested(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithNestedMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	nested := store.getStoreByName("nested").(*rootMultiStore)
+	nested.getStoreByName("inner1").(KVStore).Set([]byte("MYKEY"), []byte("MYVALUE"))
+	cid := store.Commit()
+
+	res := store.Query(abci.RequestQuery{
+		Path:   "/nested/inner1/key",
+		Data:   []byte("MYABSENTKEY"),
+		Height: cid.Version,
+		Prove:  true,
+	})
+	require.True(t, res.IsOK(), res.Log)
+	require.Nil(t, res.Value)
+	require.Len(t, res.Proof.Ops, 3)
+
+	prt := DefaultProofRuntime()
+	err := prt.VerifyAbsence(res.Proof, cid.Hash, "/nested/inner1/MYABSENTKEY")
+	require.Nil(t, err)
+	err = prt.VerifyValue(res.Proof, cid.Hash, "/nested/inner1/MYABSENTKEY", []byte("MYVALUE"))
+	require.NotNil(t, err)
+}
+
+func TestAppendMultiStoreProofChecksLeafOp(t *testing.T) {
+	iStore, err := LoadIAVLStore(dbm.NewMemDB(), CommitID{}, sdk.PruneNothing)
+	require.Nil(t, err)
+	store := iStore.(*iavlStore)
+	store.Set([]byte("MYKEY"), []byte("MYVALUE"))
+	cid := store.Commit()
+	si := storeInfo{Name: "iavlStoreKey"}
+	si.Core.CommitID = cid
+	cInfo := newCommitInfo(1, []storeInfo{si})
+
+	// a value proof can't stand in for an absence proof
+	res := store.Query(abci.RequestQuery{Path: "/key", Data: []byte("MYKEY"), Prove: true})
+	res.Value = nil
+	err = appendMultiStoreProof(&res, "iavlStoreKey", cInfo)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "cannot prove absence")
+
+	// nor the other way around
+	res = store.Query(abci.RequestQuery{Path: "/key", Data: []byte("MYABSENTKEY"), Prove: true})
+	res.Value = []byte("MYVALUE")
+	err = appendMultiStoreProof(&res, "iavlStoreKey", cInfo)
+	require.NotNil(t, err)
+
+	// substore failures are surfaced
+	res = abci.ResponseQuery{Log: "version does not exist"}
+	err = appendMultiStoreProof(&res, "iavlStoreKey", cInfo)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "store iavlStoreKey returned no proof: version does not exist")
+}
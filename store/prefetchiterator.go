@@ -0,0 +1,116 @@
+package store
+
+import (
+	"bytes"
+
+	cmn "github.com/tendermint/tendermint/libs/common"
+)
+
+// prefetchIterator iterates over a range of a KVStore by reading it in chunks
+// of up to chunkSize items, each through a short-lived iterator on the store.
+// Implements Iterator.
+type prefetchIterator struct {
+	parent     KVStore
+	start, end []byte
+	ascending  bool
+	chunkSize  int
+
+	// items holds the current chunk, pos the position within it.
+	items []cmn.KVPair
+	pos   int
+
+	// cursor is the start of the next chunk. Descending chunks can't
+	// exclude their start, so their first item is skipped if it equals
+	// the cursor.
+	cursor     []byte
+	skipCursor bool
+	exhausted  bool
+}
+
+var _ Iterator = (*prefetchIterator)(nil)
+
+func newPrefetchIterator(parent KVStore, start, end []byte, ascending bool, chunkSize int) *prefetchIterator {
+	pi := &prefetchIterator{
+		parent:    parent,
+		start:     start,
+		end:       end,
+		ascending: ascending,
+		chunkSize: chunkSize,
+		cursor:    start,
+	}
+	pi.fill()
+	return pi
+}
+
+// fill reads the next chunk if the current one is used up.
+func (pi *prefetchIterator) fill() {
+	for pi.pos == len(pi.items) && !pi.exhausted {
+		var iter Iterator
+		if pi.ascending {
+			iter = pi.parent.Iterator(pi.cursor, pi.end)
+		} else {
+			iter = pi.parent.ReverseIterator(pi.cursor, pi.end)
+		}
+
+		pi.items, pi.pos = pi.items[:0], 0
+		for ; iter.Valid() && len(pi.items) < pi.chunkSize; iter.Next() {
+			key := iter.Key()
+			if pi.skipCursor && bytes.Equal(key, pi.cursor) {
+				continue
+			}
+			pi.items = append(pi.items, cmn.KVPair{Key: cp(key), Value: cp(iter.Value())})
+		}
+		pi.exhausted = !iter.Valid()
+		iter.Close()
+
+		if len(pi.items) > 0 {
+			last := pi.items[len(pi.items)-1].Key
+			if pi.ascending {
+				pi.cursor = append(cp(last), 0x00)
+			} else {
+				pi.cursor = last
+				pi.skipCursor = true
+			}
+		}
+	}
+}
+
+// Implements Iterator.
+func (pi *prefetchIterator) Domain() ([]byte, []byte) {
+	return pi.start, pi.end
+}
+
+// Implements Iterator.
+func (pi *prefetchIterator) Valid() bool {
+	return pi.pos < len(pi.items)
+}
+
+func (pi *prefetchIterator) assertValid() {
+	if !pi.Valid() {
+		panic("prefetchIterator is invalid")
+	}
+}
+
+// Implements Iterator.
+func (pi *prefetchIterator) Next() {
+	pi.assertValid()
+	pi.pos++
+	pi.fill()
+}
+
+// Implements Iterator.
+func (pi *prefetchIterator) Key() []byte {
+	pi.assertValid()
+	return pi.items[pi.pos].Key
+}
+
+// Implements Iterator.
+func (pi *prefetchIterator) Value() []byte {
+	pi.assertValid()
+	return pi.items[pi.pos].Value
+}
+
+// Implements Iterator.
+func (pi *prefetchIterator) Close() {
+	pi.items = nil
+}
@@ -38,6 +38,28 @@ func (s prefixStore) GetStoreType() StoreType {
 	return s.parent.GetStoreType()
 }
 
+// StoreName implements NamedStore.
+func (s prefixStore) StoreName() string {
+	return storeName(s.parent)
+}
+
+// cacheDepth implements cacheDepthStore.
+func (s prefixStore) cacheDepth() (int, int, bool) {
+	return storeCacheDepth(s.parent)
+}
+
+// cacheKeyValidator implements keyValidatorStore. The parent's validator is
+// applied to the prefixed keys.
+func (s prefixStore) cacheKeyValidator() func(key []byte) error {
+	validator := storeKeyValidator(s.parent)
+	if validator == nil {
+		return nil
+	}
+	return func(key []byte) error {
+		return validator(cloneAppend(s.prefix, key))
+	}
+}
+
 // Implements CacheWrap
 func (s prefixStore) CacheWrap() CacheWrap {
 	return NewCacheKVStore(s)
@@ -0,0 +1,97 @@
+package store
+
+import (
+	dbm "github.com/tendermint/tendermint/libs/db"
+)
+
+// RangeDeleter is implemented by parent stores and batches which can delete
+// a range of keys without the caller listing them. If the parent of a
+// cacheKVStore, or the batch it writes through, implements it, Write()
+// hands the ranges deleted with DeleteRange to it.
+type RangeDeleter interface {
+	// DeleteRange deletes all keys in [start, end). A nil start or end
+	// leaves the range unbounded on that side.
+	DeleteRange(start, end []byte)
+}
+
+// keyRange is the range [start, end) of keys deleted by DeleteRange.
+type keyRange struct {
+	start, end []byte
+}
+
+func (kr keyRange) contains(key []byte) bool {
+	return dbm.IsKeyInDomain(key, kr.start, kr.end, false)
+}
+
+// inDeletedRange returns whether key is in a range deleted with
+// DeleteRange. The caller must hold the lock.
+func (ci *cacheKVStore) inDeletedRange(key []byte) bool {
+	return inKeyRanges(ci.deletedRanges, key)
+}
+
+func inKeyRanges(ranges []keyRange, key []byte) bool {
+	for _, kr := range ranges {
+		if kr.contains(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeDeletedRanges deletes the ranges deleted with DeleteRange from the
+// parent through sd, which is the parent or a batch of it. If sd is a
+// RangeDeleter, e.g. a parent cacheKVStore or the batch of a backend
+// supporting range deletes, the ranges are handed to it, otherwise each key
+// of the ranges in the parent is deleted. It returns the number of
+// operations applied. The caller must hold the lock.
+func (ci *cacheKVStore) writeDeletedRanges(sd dbm.SetDeleter) (n int) {
+	if rd, ok := sd.(RangeDeleter); ok {
+		for _, kr := range ci.deletedRanges {
+			rd.DeleteRange(kr.start, kr.end)
+			n++
+		}
+		return n
+	}
+
+	for _, kr := range ci.deletedRanges {
+		// Collect the keys first, the parent can't be written while
+		// iterated.
+		var keys [][]byte
+		iter := ci.parent.Iterator(kr.start, kr.end)
+		for ; iter.Valid(); iter.Next() {
+			keys = append(keys, iter.Key())
+		}
+		iter.Close()
+
+		for _, key := range keys {
+			sd.Delete(key)
+			n++
+		}
+	}
+	return n
+}
+
+// tombstoneIterator skips the keys of the wrapped parent iterator which are
+// in a range deleted with DeleteRange.
+// Implements Iterator.
+type tombstoneIterator struct {
+	Iterator
+	ranges []keyRange
+}
+
+func newTombstoneIterator(parent Iterator, ranges []keyRange) *tombstoneIterator {
+	ti := &tombstoneIterator{Iterator: parent, ranges: ranges}
+	ti.skipDeleted()
+	return ti
+}
+
+func (ti *tombstoneIterator) skipDeleted() {
+	for ti.Iterator.Valid() && inKeyRanges(ti.ranges, ti.Iterator.Key()) {
+		ti.Iterator.Next()
+	}
+}
+
+func (ti *tombstoneIterator) Next() {
+	ti.Iterator.Next()
+	ti.skipDeleted()
+}
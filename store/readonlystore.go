@@ -0,0 +1,141 @@
+package store
+
+import (
+	"fmt"
+	"io"
+)
+
+var _ KVStore = readOnlyKVStore{}
+
+// readOnlyKVStore rejects all writes to the underlying KVStore. It implements
+// the KVStore interface.
+type readOnlyKVStore struct {
+	parent KVStore
+}
+
+// Implements Store.
+func (ro readOnlyKVStore) GetStoreType() StoreType {
+	return ro.parent.GetStoreType()
+}
+
+// StoreName implements NamedStore.
+func (ro readOnlyKVStore) StoreName() string {
+	return storeName(ro.parent)
+}
+
+// cacheDepth implements cacheDepthStore.
+func (ro readOnlyKVStore) cacheDepth() (int, int, bool) {
+	return storeCacheDepth(ro.parent)
+}
+
+// cacheKeyValidator implements keyValidatorStore.
+func (ro readOnlyKVStore) cacheKeyValidator() func(key []byte) error {
+	return storeKeyValidator(ro.parent)
+}
+
+// Implements KVStore.
+func (ro readOnlyKVStore) Get(key []byte) []byte {
+	return ro.parent.Get(key)
+}
+
+// Implements KVStore.
+func (ro readOnlyKVStore) Has(key []byte) bool {
+	return ro.parent.Has(key)
+}
+
+// Set implements KVStore. It always panics.
+func (ro readOnlyKVStore) Set(key, value []byte) {
+	panic(fmt.Sprintf("cannot set key %X on a read-only store", key))
+}
+
+// Delete implements KVStore. It always panics.
+func (ro readOnlyKVStore) Delete(key []byte) {
+	panic(fmt.Sprintf("cannot delete key %X on a read-only store", key))
+}
+
+// Implements KVStore.
+func (ro readOnlyKVStore) Prefix(prefix []byte) KVStore {
+	return readOnlyKVStore{prefixStore{ro.parent, prefix}}
+}
+
+// Implements KVStore.
+func (ro readOnlyKVStore) Gas(meter GasMeter, config GasConfig) KVStore {
+	return NewGasKVStore(meter, config, ro)
+}
+
+// Implements KVStore.
+func (ro readOnlyKVStore) Iterator(start, end []byte) Iterator {
+	return ro.parent.Iterator(start, end)
+}
+
+// Implements KVStore.
+func (ro readOnlyKVStore) ReverseIterator(start, end []byte) Iterator {
+	return ro.parent.ReverseIterator(start, end)
+}
+
+// CacheWrap implements KVStore. Writing a cache-wrap with changes panics.
+func (ro readOnlyKVStore) CacheWrap() CacheWrap {
+	return NewCacheKVStore(ro)
+}
+
+// CacheWrapWithTrace implements the KVStore interface.
+func (ro readOnlyKVStore) CacheWrapWithTrace(w io.Writer, tc TraceContext) CacheWrap {
+	return NewCacheKVStore(NewTraceKVStore(ro, w, tc))
+}
+
+// wrapReadOnly wraps store in a readOnlyKVStore if key is in readOnly.
+func wrapReadOnly(store KVStore, key StoreKey, readOnly map[StoreKey]bool) KVStore {
+	if readOnly[key] {
+		return readOnlyKVStore{store}
+	}
+	return store
+}
+
+//----------------------------------------
+
+var _ CommitKVStore = readOnlyCommitKVStore{}
+
+// readOnlyCommitKVStore rejects all writes to the underlying CommitKVStore
+// like readOnlyKVStore. It implements the CommitKVStore interface.
+type readOnlyCommitKVStore struct {
+	CommitKVStore
+}
+
+// Set implements KVStore. It always panics.
+func (ro readOnlyCommitKVStore) Set(key, value []byte) {
+	readOnlyKVStore{ro.CommitKVStore}.Set(key, value)
+}
+
+// Delete implements KVStore. It always panics.
+func (ro readOnlyCommitKVStore) Delete(key []byte) {
+	readOnlyKVStore{ro.CommitKVStore}.Delete(key)
+}
+
+// Implements KVStore.
+func (ro readOnlyCommitKVStore) Prefix(prefix []byte) KVStore {
+	return readOnlyKVStore{ro.CommitKVStore}.Prefix(prefix)
+}
+
+// Implements KVStore.
+func (ro readOnlyCommitKVStore) Gas(meter GasMeter, config GasConfig) KVStore {
+	return readOnlyKVStore{ro.CommitKVStore}.Gas(meter, config)
+}
+
+// CacheWrap implements KVStore. Writing a cache-wrap with changes panics.
+func (ro readOnlyCommitKVStore) CacheWrap() CacheWrap {
+	return readOnlyKVStore{ro.CommitKVStore}.CacheWrap()
+}
+
+// CacheWrapWithTrace implements the KVStore interface.
+func (ro readOnlyCommitKVStore) CacheWrapWithTrace(w io.Writer, tc TraceContext) CacheWrap {
+	return readOnlyKVStore{ro.CommitKVStore}.CacheWrapWithTrace(w, tc)
+}
+
+// wrapReadOnlyCommit wraps store in a readOnlyCommitKVStore if it is a
+// CommitKVStore and key is in readOnly.
+func wrapReadOnlyCommit(store CommitStore, key StoreKey, readOnly map[StoreKey]bool) CommitStore {
+	if kv, ok := store.(CommitKVStore); ok && readOnly[key] {
+		return readOnlyCommitKVStore{kv}
+	}
+	return store
+}
@@ -1,21 +1,74 @@
 package store
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/tendermint/iavl"
 	abci "github.com/tendermint/tendermint/abci/types"
 	"github.com/tendermint/tendermint/crypto/merkle"
-	"github.com/tendermint/tendermint/crypto/tmhash"
+	cmn "github.com/tendermint/tendermint/libs/common"
 	dbm "github.com/tendermint/tendermint/libs/db"
+	"github.com/tendermint/tendermint/libs/log"
 
 	sdk "github.com/cosmos/cosmos-sdk/types"
 )
 
 const (
-	latestVersionKey = "s/latest"
-	commitInfoKeyFmt = "s/%d" // s/<version>
+	latestVersionKey    = "s/latest"
+	commitInfoKeyPrefix = "s/v/" // s/v/<big-endian version>
+	renamesKey          = "s/renames"
+
+	// legacyMigrationKeyPrefix prefixes the markers of the stores whose
+	// data is being moved from their legacy prefix, see
+	// migrateLegacyPrefixes.
+	legacyMigrationKeyPrefix = "s/migrating/"
+
+	// renameMigrationKeyPrefix prefixes the markers of the renamed stores
+	// whose data is being moved to their new prefix, see
+	// LoadVersionWithRenames.
+	renameMigrationKeyPrefix = "s/renaming/"
+
+	// legacyCommitInfoKeyFmt is the former key of commit infos, whose
+	// decimal versions don't sort in numeric order. They are still read,
+	// see MigrateCommitInfoKeys.
+	legacyCommitInfoKeyFmt = "s/%d"
+
+	// compressedCommitInfoPrefix prefixes snappy compressed commit infos.
+	// Uncompressed ones never start with it, as their length prefix is
+	// never zero.
+	compressedCommitInfoPrefix byte = 0x00
+
+	// storeQueryRoute is reserved for queries about the mounted stores
+	// themselves, ie. `/store/<name>/type`. No store may use it as name.
+	storeQueryRoute = "store"
+)
+
+// Errors returned when loading, which callers can distinguish with
+// IsErrNoData, IsErrCommitInfoDecode and IsErrStoreLoad, e.g. to retry a
+// load failing on a transient db error but fail fast on corrupted data.
+var (
+	// ErrNoData is returned when no commit info is persisted for a version.
+	ErrNoData = errors.New("no data")
+
+	// ErrCommitInfoDecode is returned when a persisted commit info can't be
+	// decoded.
+	ErrCommitInfoDecode = errors.New("failed to decode commit info")
+
+	// ErrStoreLoad is returned when a substore fails to load.
+	ErrStoreLoad = errors.New("failed to load store")
 )
 
 // rootMultiStore is composed of many CommitStores. Name contrasts with
@@ -29,12 +82,101 @@ type rootMultiStore struct {
 	stores       map[StoreKey]CommitStore
 	keysByName   map[string]StoreKey
 
+	// mtx keeps SnapshotView from pinning versions, and queries from
+	// reading the commit state, while committing.
+	mtx sync.RWMutex
+
+	// queryHeight is the height queries without an explicit height are
+	// answered at, see defaultQueryHeight.
+	queryHeight int64
+
 	traceWriter  io.Writer
 	traceContext TraceContext
+
+	metrics Metrics
+
+	// commitWorkers is the number of substores committed concurrently.
+	// Zero means runtime.GOMAXPROCS(0).
+	commitWorkers int
+
+	// commitBatchWindow is the number of versions whose commit info is
+	// buffered in pendingCommits before it is written, see
+	// SetCommitBatchWindow.
+	commitBatchWindow int
+	pendingCommits    []commitInfo
+
+	// memCommitInfos, if not nil, holds the decoded commit info of versions
+	// read or committed, of which those in unserialized are not written to
+	// the db yet, see EnableMemoryCommitCache.
+	memCommitInfos map[int64]commitInfo
+	unserialized   []int64
+
+	// memMtx guards memCommitInfos against concurrent queries, which fill
+	// it while holding only a read lock on mtx.
+	memMtx sync.Mutex
+
+	// commitInfoCache, if set, holds the recently read commit infos, see
+	// SetCommitInfoCacheSize.
+	commitInfoCache *commitInfoCache
+
+	// verifyOnLoad makes LoadVersion check the loaded stores against the
+	// persisted commit info, see SetLoadVerification.
+	verifyOnLoad bool
+
+	// loadLogger, if set, receives the inconsistencies LoadLatestVersion
+	// finds, and loadFallback makes it load the highest consistent version
+	// instead of failing, see SetLoadRecovery.
+	loadLogger   log.Logger
+	loadFallback bool
+
+	// listeners holds the write listeners of the stores, see
+	// SetWriteListener.
+	listeners map[StoreKey]*writeListener
+
+	// readOnly holds the keys of the stores set read-only, see
+	// SetReadOnly.
+	readOnly map[StoreKey]bool
+
+	// maxValueSizes holds the value size limits of the stores, see
+	// SetMaxValueSize.
+	maxValueSizes map[StoreKey]int
+
+	// hasher computes the commit hash, see SetHasher.
+	hasher Hasher
+
+	// strictLogger, if set, receives determinism violations found while
+	// committing, see SetStrictDeterminism.
+	strictLogger log.Logger
+
+	// compressCommitInfo makes commit infos be written compressed, see
+	// SetCommitInfoCompression.
+	compressCommitInfo bool
+
+	// queryTraceWriter, if set, receives a record of every query, see
+	// SetQueryTracer.
+	queryTraceWriter io.Writer
+
+	// keyRegistry, if set, records the module IDs of the namespaced
+	// store keys mounted, see SetKeyRegistry.
+	keyRegistry *sdk.StoreKeyRegistry
 }
 
 var _ CommitMultiStore = (*rootMultiStore)(nil)
 var _ Queryable = (*rootMultiStore)(nil)
+var _ CommitHasher = (*rootMultiStore)(nil)
+
+// CommitHasher is implemented by CommitStores which can compute the hash
+// their next Commit() would return, without writing anything or advancing
+// their version.
+type CommitHasher interface {
+	ComputeCommitHash() ([]byte, error)
+}
+
+// KeyCounter is implemented by stores which can tell their number of keys
+// without iterating them.
+type KeyCounter interface {
+	ApproxKeyCount() int64
+}
 
 // nolint
 func NewCommitMultiStore(db dbm.DB) *rootMultiStore {
@@ -43,6 +185,12 @@ func NewCommitMultiStore(db dbm.DB) *rootMultiStore {
 		storesParams: make(map[StoreKey]storeParams),
 		stores:       make(map[StoreKey]CommitStore),
 		keysByName:   make(map[string]StoreKey),
+
+		listeners:     make(map[StoreKey]*writeListener),
+		readOnly:      make(map[StoreKey]bool),
+		maxValueSizes: make(map[StoreKey]int),
+
+		commitInfoCache: newCommitInfoCache(DefaultCommitInfoCacheSize),
 	}
 }
 
@@ -54,6 +202,280 @@ func (rs *rootMultiStore) SetPruning(pruning sdk.PruningStrategy) {
 	}
 }
 
+// SetCommitConcurrency sets the number of substores committed concurrently.
+// A value of zero or less uses runtime.GOMAXPROCS(0).
+func (rs *rootMultiStore) SetCommitConcurrency(workers int) {
+	rs.commitWorkers = workers
+}
+
+// SetLoadVerification makes LoadVersion check that the commit IDs of the
+// loaded stores hash to the commit hash persisted for the version, which
+// detects corruption of the db at load time rather than on a later failing
+// proof. This is expensive, so it is off by default. It is recommended after
+// an unclean shutdown.
+func (rs *rootMultiStore) SetLoadVerification(verify bool) {
+	rs.verifyOnLoad = verify
+}
+
+// SetLoadRecovery sets how LoadLatestVersion handles a latest version
+// whose commit info is missing or undecodable, which happens when the write
+// of the commit info is lost after an unclean shutdown. The inconsistency
+// and the highest version with a valid commit info are logged to logger,
+// which may be nil. If fallback is set, that version is loaded and the
+// later blocks have to be replayed, otherwise loading fails.
+func (rs *rootMultiStore) SetLoadRecovery(logger log.Logger, fallback bool) {
+	rs.loadLogger = logger
+	rs.loadFallback = fallback
+}
+
+// SetWriteListener records every Set and Delete applied to the store for key
+// to w, whether through GetKVStore or by writing a cache-wrap of the
+// rootMultiStore. Writes to cache-wraps are only recorded once the cache-wrap
+// is written. The records are buffered and flushed to w on Commit, before
+// the new version is persisted. See ReadStoreWrite for the record format. A
+// nil w removes the listener. It fails if the key isn't mounted as a
+// CommitKVStore.
+func (rs *rootMultiStore) SetWriteListener(key StoreKey, w io.Writer) error {
+	if w == nil {
+		delete(rs.listeners, key)
+		return nil
+	}
+	if _, ok := rs.GetCommitKVStoreSafe(key); !ok {
+		return errors.New(rs.notKVStoreMsg(key))
+	}
+	rs.listeners[key] = newWriteListener(w)
+	return nil
+}
+
+// SetReadOnly makes the store for key read-only: The stores returned for it
+// by GetKVStore, GetStore, GetCommitStore, GetCommitKVStore and the
+// cache-wraps of the rootMultiStore panic on writes, and Commit leaves it at
+// its last committed version instead of committing it. Stores are set up
+// before they are made read-only.
+func (rs *rootMultiStore) SetReadOnly(key StoreKey) {
+	if _, ok := rs.storesParams[key]; !ok {
+		panic(fmt.Sprintf("rootMultiStore store key %v not mounted", key))
+	}
+	rs.readOnly[key] = true
+}
+
+// SetMaxValueSize limits the size of the values which can be set through the
+// KVStore returned for key by GetKVStore, or by the cache-wraps of the
+// rootMultiStore. Setting a larger value panics. A max of zero removes the
+// limit, a negative max is rejected.
+// NOTE: This is a safety rail, not a consensus rule. Values rejected on one
+// node are accepted on another which doesn't configure the limit, so all
+// validators must configure it identically.
+func (rs *rootMultiStore) SetMaxValueSize(key StoreKey, max int) error {
+	if max < 0 {
+		return fmt.Errorf("invalid max value size %d for store %s", max, key.Name())
+	}
+	if max == 0 {
+		delete(rs.maxValueSizes, key)
+		return nil
+	}
+	rs.maxValueSizes[key] = max
+	return nil
+}
+
+// SetHasher sets the hasher the commit hash is computed by, DefaultHasher
+// unless set. It must be set before loading a version, and is inherited by
+// nested multistores.
+// NOTE: The commit hash is the app hash, so the hasher is a decision made at
+// chain launch which all validators must agree on. Query proofs are only
+// verifiable with the DefaultHasher.
+func (rs *rootMultiStore) SetHasher(hasher Hasher) {
+	rs.hasher = hasher
+}
+
+// SetStrictDeterminism enables checking on every Commit that the store
+// infos going into the commit hash are ordered by store name, independent
+// of the order the substores were committed in. Violations are logged as
+// errors to logger. A nil logger disables the checks.
+func (rs *rootMultiStore) SetStrictDeterminism(logger log.Logger) {
+	rs.strictLogger = logger
+}
+
+// SetKeyRegistry makes mounting a store with a sdk.NamespacedStoreKey claim
+// the module ID of the key in reg, so mounting two keys with the same module
+// ID panics. Set it before mounting stores.
+func (rs *rootMultiStore) SetKeyRegistry(reg *sdk.StoreKeyRegistry) {
+	rs.keyRegistry = reg
+}
+
+// SetCommitInfoCompression sets whether the commit info written for each
+// version is compressed with snappy, which saves space with many stores at
+// the expense of decoding it at query time. Commit infos are read whether
+// they are compressed or not, so this can be changed at any time.
+func (rs *rootMultiStore) SetCommitInfoCompression(compress bool) {
+	rs.compressCommitInfo = compress
+}
+
+// SetCommitBatchWindow makes Commit buffer the commit info of up to n
+// versions and write them to the db in a single batch, instead of writing
+// one batch per version. The latest version persisted in the db only
+// advances when the buffered versions are written, so after a crash the
+// store loads the last written version and the later blocks have to be
+// replayed. This is meant for replaying blocks while catching up, not for
+// live consensus. A window of one or less writes every version right away.
+// Call FlushPending before shutting down.
+//
+// The buffered versions are served from memory until they are written. The
+// IAVL substores persist every version right away though, so after a crash
+// they are ahead of the last written version. LoadLatestVersion deletes
+// their versions beyond it, so the blocks replayed may commit different
+// data. Other persisted substores can't be reconciled like this, so a window
+// larger than one fails if any store mounted is neither an IAVL nor a
+// transient store. Mount all stores first.
+func (rs *rootMultiStore) SetCommitBatchWindow(n int) error {
+	if n > 1 {
+		for key, params := range rs.storesParams {
+			if params.typ != sdk.StoreTypeIAVL && params.typ != sdk.StoreTypeTransient {
+				return fmt.Errorf("cannot batch commits with store %s of type %v mounted", key.Name(), params.typ)
+			}
+		}
+	}
+	rs.commitBatchWindow = n
+	if len(rs.pendingCommits) >= n {
+		rs.FlushPending()
+	}
+	return nil
+}
+
+// EnableMemoryCommitCache makes the store keep the commit info of every
+// version decoded in memory, and defer encoding it until the db is read
+// directly, e.g. by a store loading from the same db. This speeds up tests
+// committing thousands of versions, while the persisted data and commit
+// hashes stay the same. It only takes effect on a *dbm.MemDB, for other dbs
+// it returns false. Call FlushPending before reading the db directly.
+func (rs *rootMultiStore) EnableMemoryCommitCache() bool {
+	if _, ok := rs.db.(*dbm.MemDB); !ok {
+		return false
+	}
+	if rs.memCommitInfos == nil {
+		rs.memCommitInfos = make(map[int64]commitInfo)
+	}
+	return true
+}
+
+// SetCommitInfoCacheSize sets the number of decoded commit infos cached for
+// the versions read most recently, DefaultCommitInfoCacheSize unless set,
+// which saves decoding the commit info on every proved query at the same
+// height. A size of zero or less disables the cache.
+func (rs *rootMultiStore) SetCommitInfoCacheSize(size int) {
+	if size <= 0 {
+		rs.commitInfoCache = nil
+		return
+	}
+	rs.commitInfoCache = newCommitInfoCache(size)
+}
+
+// getCommitInfo returns the commit info of the given version, from memory if
+// it is buffered due to SetCommitBatchWindow, or if the memory commit cache
+// or the commit info cache holds it.
+func (rs *rootMultiStore) getCommitInfo(ver int64) (commitInfo, error) {
+	if cInfo, ok := rs.pendingCommitInfo(ver); ok {
+		return cInfo, nil
+	}
+	if rs.memCommitInfos != nil {
+		rs.memMtx.Lock()
+		cInfo, ok := rs.memCommitInfos[ver]
+		rs.memMtx.Unlock()
+		if ok {
+			return cInfo, nil
+		}
+	}
+	if rs.commitInfoCache != nil {
+		if cInfo, ok := rs.commitInfoCache.get(ver); ok {
+			return cInfo, nil
+		}
+	}
+	cInfo, err := getCommitInfo(rs.db, ver)
+	if err != nil {
+		return commitInfo{}, err
+	}
+	if rs.memCommitInfos != nil {
+		rs.memMtx.Lock()
+		rs.memCommitInfos[ver] = cInfo
+		rs.memMtx.Unlock()
+	} else if rs.commitInfoCache != nil {
+		rs.commitInfoCache.add(cInfo)
+	}
+	return cInfo, nil
+}
+
+// pendingCommitInfo returns the commit info of the given version if it is
+// buffered due to SetCommitBatchWindow. The buffered versions are
+// consecutive.
+func (rs *rootMultiStore) pendingCommitInfo(ver int64) (commitInfo, bool) {
+	if len(rs.pendingCommits) == 0 {
+		return commitInfo{}, false
+	}
+	i := ver - rs.pendingCommits[0].Version
+	if i < 0 || i >= int64(len(rs.pendingCommits)) || rs.pendingCommits[i].Version != ver {
+		return commitInfo{}, false
+	}
+	return rs.pendingCommits[i], true
+}
+
+// latestVersion returns the latest version committed, including the versions
+// buffered due to SetCommitBatchWindow.
+func (rs *rootMultiStore) latestVersion() int64 {
+	if n := len(rs.pendingCommits); n > 0 {
+		return rs.pendingCommits[n-1].Version
+	}
+	return getLatestVersion(rs.db)
+}
+
+// invalidateCommitInfos drops the cached commit infos of all versions from
+// ver on, before their commit infos are rewritten or deleted.
+func (rs *rootMultiStore) invalidateCommitInfos(ver int64) {
+	if rs.commitInfoCache != nil {
+		rs.commitInfoCache.removeFrom(ver)
+	}
+}
+
+// FlushPending writes the commit info buffered due to SetCommitBatchWindow
+// and advances the persisted latest version in a single synced batch. It
+// also writes the commit info not encoded yet due to
+// EnableMemoryCommitCache.
+func (rs *rootMultiStore) FlushPending() {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+	rs.flushPending()
+}
+
+func (rs *rootMultiStore) flushPending() {
+	if len(rs.unserialized) > 0 {
+		batch := rs.db.NewBatch()
+		for _, ver := range rs.unserialized {
+			setCommitInfo(batch, ver, rs.memCommitInfos[ver], rs.compressCommitInfo)
+		}
+		batch.Write()
+		rs.unserialized = nil
+	}
+
+	if len(rs.pendingCommits) == 0 {
+		return
+	}
+
+	batch := rs.db.NewBatch()
+	for _, commitInfo := range rs.pendingCommits {
+		setCommitInfo(batch, commitInfo.Version, commitInfo, rs.compressCommitInfo)
+	}
+	setLatestVersion(batch, rs.pendingCommits[len(rs.pendingCommits)-1].Version)
+	batch.WriteSync()
+
+	rs.pendingCommits = nil
+	rs.updateQueryHeight()
+}
+
+// SetMetrics sets the Metrics which Commit reports to. A nil Metrics disables
+// reporting.
+func (rs *rootMultiStore) SetMetrics(metrics Metrics) {
+	rs.metrics = metrics
+}
+
 // Implements Store.
 func (rs *rootMultiStore) GetStoreType() StoreType {
 	return sdk.StoreTypeMulti
@@ -70,81 +492,763 @@ func (rs *rootMultiStore) MountStoreWithDB(key StoreKey, typ StoreType, db dbm.D
 	if _, ok := rs.keysByName[key.Name()]; ok {
 		panic(fmt.Sprintf("rootMultiStore duplicate store key name %v", key))
 	}
+	if key.Name() == storeQueryRoute {
+		panic(fmt.Sprintf("rootMultiStore reserved store key name %v", key))
+	}
+	if nsKey, ok := key.(sdk.NamespacedStoreKey); ok && rs.keyRegistry != nil {
+		if moduleID, ok := nsKey.ModuleID(); ok {
+			rs.keyRegistry.Claim(moduleID, key.Name())
+		}
+	}
 	rs.storesParams[key] = storeParams{
 		key: key,
 		typ: typ,
 		db:  db,
 	}
-	rs.keysByName[key.Name()] = key
-}
-
-// Implements CommitMultiStore.
-func (rs *rootMultiStore) GetCommitStore(key StoreKey) CommitStore {
-	return rs.stores[key]
+	rs.keysByName[key.Name()] = key
+}
+
+// MountSubStore mounts a store of the given type inside the nested
+// CommitMultiStore mounted at parent. The parent must have been mounted with
+// StoreTypeMulti, and the substore will use the parent's prefixed db.
+func (rs *rootMultiStore) MountSubStore(parent StoreKey, key StoreKey, typ StoreType) {
+	if key == nil {
+		panic("MountSubStore() key cannot be nil")
+	}
+	params, ok := rs.storesParams[parent]
+	if !ok {
+		panic(fmt.Sprintf("rootMultiStore parent store key %v not mounted", parent))
+	}
+	if params.typ != sdk.StoreTypeMulti {
+		panic(fmt.Sprintf("rootMultiStore parent store key %v is not a multistore", parent))
+	}
+	for _, sub := range params.substores {
+		if sub.key == key || sub.key.Name() == key.Name() {
+			panic(fmt.Sprintf("rootMultiStore duplicate substore key %v", key))
+		}
+	}
+	params.substores = append(params.substores, storeParams{
+		key: key,
+		typ: typ,
+	})
+	rs.storesParams[parent] = params
+}
+
+// DeleteStore unmounts the store for the given key and removes all of its
+// persisted data, including data left under its legacy prefix, along with
+// its write listener, limits, key registry claim and persisted renames.
+// Subsequent commits no longer include the store. The data is removed in
+// batches, which is not atomic but safe to retry by mounting the store and
+// deleting it again. Deleting a store which is not mounted is a no-op.
+func (rs *rootMultiStore) DeleteStore(key StoreKey) error {
+	params, ok := rs.storesParams[key]
+	if !ok {
+		return nil
+	}
+
+	deleteAllKeys(rs.storeDB(params), defaultFlushEvery)
+	name := key.Name()
+	if params.db == nil {
+		batch := newFlushingBatch(rs.db, defaultFlushEvery)
+		deleteKeys(rs.db, batch, legacyStorePrefix(name), rs.legacyOverlaps(name))
+		batch.Delete(legacyMigrationKey(name))
+		batch.Write()
+	}
+
+	// The renames into the store are only dropped once its data is gone, so
+	// a retry after a failure still finds the renamed data.
+	recorded := getRenames(rs.db)
+	var renames []storeRename
+	for _, rename := range recorded {
+		if rename.From != name && rename.To != name {
+			renames = append(renames, rename)
+		}
+	}
+	if len(renames) != len(recorded) {
+		batch := rs.db.NewBatch()
+		setRenames(batch, renames)
+		batch.Write()
+	}
+
+	delete(rs.storesParams, key)
+	delete(rs.keysByName, name)
+	delete(rs.stores, key)
+	delete(rs.listeners, key)
+	delete(rs.readOnly, key)
+	delete(rs.maxValueSizes, key)
+	if nsKey, ok := key.(sdk.NamespacedStoreKey); ok && rs.keyRegistry != nil {
+		if moduleID, ok := nsKey.ModuleID(); ok {
+			rs.keyRegistry.Release(moduleID)
+		}
+	}
+	return nil
+}
+
+// deleteAllKeys deletes all keys of db while iterating them, writing the
+// deletes every flushEvery keys so they are never all held in memory.
+func deleteAllKeys(db dbm.DB, flushEvery int) {
+	batch := newFlushingBatch(db, flushEvery)
+	iter := db.Iterator(nil, nil)
+	for ; iter.Valid(); iter.Next() {
+		batch.Delete(cp(iter.Key()))
+	}
+	iter.Close()
+	batch.Write()
+}
+
+// MountedStoreKeys returns the keys of all mounted stores sorted byte-wise
+// by name, so that the order is the same on every call and every node.
+func (rs *rootMultiStore) MountedStoreKeys() []StoreKey {
+	keys := make([]StoreKey, 0, len(rs.storesParams))
+	for key := range rs.storesParams {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Name() < keys[j].Name()
+	})
+
+	return keys
+}
+
+// StoreInfo returns a copy of the configured store type of every mounted
+// store, indexed by store name.
+func (rs *rootMultiStore) StoreInfo() map[string]StoreType {
+	infos := make(map[string]StoreType, len(rs.storesParams))
+	for key, params := range rs.storesParams {
+		infos[key.Name()] = params.typ
+	}
+	return infos
+}
+
+// IterateAllStores calls fn with a read-only view of the last committed state
+// of every mounted store, until fn returns true. Writes which are not
+// committed yet are not visible. The stores of a nested multistore are
+// visited in its place, named "<parent>/<name>". Transient stores hold no
+// committed state and are skipped. Stores are visited sorted byte-wise by
+// the full name passed to fn, so the order is the same on every call and
+// every node.
+func (rs *rootMultiStore) IterateAllStores(fn func(name string, store KVStore) (stop bool)) {
+	stores := rs.iavlStoresByName("", nil)
+	sort.Slice(stores, func(i, j int) bool {
+		return stores[i].name < stores[j].name
+	})
+
+	for _, ns := range stores {
+		view, err := ns.store.committedView()
+		if err != nil {
+			panic(err)
+		}
+		if fn(ns.name, view) {
+			return
+		}
+	}
+}
+
+type namedIAVLStore struct {
+	name  string
+	store *iavlStore
+}
+
+// iavlStoresByName appends the IAVL stores mounted in rs and its nested
+// multistores to stores, with their names prefixed by prefix.
+func (rs *rootMultiStore) iavlStoresByName(prefix string, stores []namedIAVLStore) []namedIAVLStore {
+	for key, store := range rs.stores {
+		name := prefix + key.Name()
+		switch store := store.(type) {
+		case *rootMultiStore:
+			stores = store.iavlStoresByName(name+"/", stores)
+		case *iavlStore:
+			stores = append(stores, namedIAVLStore{name, store})
+		}
+	}
+	return stores
+}
+
+// StoreDiff returns the sorted keys whose values differ between the two
+// committed versions of the store, including keys set or deleted in between,
+// e.g. to index changes incrementally. It fails if either version is not
+// available, and is unsupported for stores which don't keep versions.
+func (rs *rootMultiStore) StoreDiff(key StoreKey, fromVer, toVer int64) (changed [][]byte, err error) {
+	store, ok := rs.stores[key]
+	if !ok {
+		return nil, fmt.Errorf("store %v is not mounted", key)
+	}
+	iavlStore, ok := store.(*iavlStore)
+	if !ok {
+		return nil, fmt.Errorf("store %s of type %v is unsupported: it can't diff versions",
+			key.Name(), store.GetStoreType())
+	}
+
+	changed, err = iavlStore.diffVersions(fromVer, toVer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff store %s: %v", key.Name(), err)
+	}
+	return changed, nil
+}
+
+// ApproxKeyCount implements CommitMultiStore. Stores of nested multistores
+// are reported as "<parent>/<name>", transient stores are left out.
+func (rs *rootMultiStore) ApproxKeyCount() map[string]int64 {
+	counts := make(map[string]int64)
+	rs.approxKeyCount("", counts)
+	return counts
+}
+
+func (rs *rootMultiStore) approxKeyCount(prefix string, counts map[string]int64) {
+	for key, store := range rs.stores {
+		name := prefix + key.Name()
+		switch store := store.(type) {
+		case *rootMultiStore:
+			store.approxKeyCount(name+"/", counts)
+		case KeyCounter:
+			counts[name] = store.ApproxKeyCount()
+		default:
+			if store.GetStoreType() != sdk.StoreTypeTransient {
+				counts[name] = -1
+			}
+		}
+	}
+}
+
+// Implements CommitMultiStore.
+func (rs *rootMultiStore) GetCommitStore(key StoreKey) CommitStore {
+	return wrapReadOnlyCommit(rs.stores[key], key, rs.readOnly)
+}
+
+// Implements CommitMultiStore. It panics naming the key if the key isn't
+// mounted as a CommitKVStore.
+func (rs *rootMultiStore) GetCommitKVStore(key StoreKey) CommitKVStore {
+	store, ok := rs.GetCommitKVStoreSafe(key)
+	if !ok {
+		panic(rs.notKVStoreMsg(key))
+	}
+	return store
+}
+
+// GetCommitKVStoreSafe returns the CommitKVStore for the given key, and false
+// if the key isn't mounted or its store isn't a CommitKVStore, e.g. a nested
+// multistore.
+func (rs *rootMultiStore) GetCommitKVStoreSafe(key StoreKey) (CommitKVStore, bool) {
+	store, ok := rs.GetCommitStore(key).(CommitKVStore)
+	return store, ok
+}
+
+// kvStore returns the KVStore for the given key, panicking naming the key if
+// there is none.
+func (rs *rootMultiStore) kvStore(key StoreKey) KVStore {
+	store, ok := rs.stores[key].(KVStore)
+	if !ok {
+		panic(rs.notKVStoreMsg(key))
+	}
+	return store
+}
+
+func (rs *rootMultiStore) notKVStoreMsg(key StoreKey) string {
+	store, ok := rs.stores[key]
+	if !ok {
+		return fmt.Sprintf("rootMultiStore store key %v not mounted", key)
+	}
+	return fmt.Sprintf("rootMultiStore store %v of type %v is not a KVStore", key, store.GetStoreType())
+}
+
+// Implements CommitMultiStore.
+func (rs *rootMultiStore) LoadLatestVersion() error {
+	// The buffered versions aren't ahead of the latest one once written.
+	rs.FlushPending()
+
+	ver := getLatestVersion(rs.db)
+	if ver == 0 {
+		if err := rs.reconcileStoresAhead(commitInfo{}); err != nil {
+			return errors.Wrap(err, "failed to load rootMultiStore")
+		}
+		return rs.LoadVersion(ver)
+	}
+
+	// Check that the commit info of the latest version made it to the db.
+	cInfo, err := rs.getCommitInfo(ver)
+	if err == nil {
+		if err := rs.reconcileStoresAhead(cInfo); err != nil {
+			return errors.Wrap(err, "failed to load rootMultiStore")
+		}
+		return rs.LoadVersion(ver)
+	}
+	consistent := rs.latestConsistentVersion(ver - 1)
+	if rs.loadLogger != nil {
+		rs.loadLogger.Error("Latest version has no valid commit info",
+			"latest", ver, "consistent", consistent, "fallback", rs.loadFallback, "err", err)
+	}
+	if !rs.loadFallback {
+		return errors.Wrapf(err, "latest version %d has no valid commit info, the highest consistent version is %d",
+			ver, consistent)
+	}
+	return rs.LoadVersion(consistent)
+}
+
+// reconcileStoresAhead deletes the versions which the IAVL substores saved
+// beyond their version in cInfo, the commit info of the latest version, e.g.
+// within a commit batch window lost in a crash. This lets the blocks after
+// the latest version be replayed with different results.
+func (rs *rootMultiStore) reconcileStoresAhead(cInfo commitInfo) error {
+	// Move the stores to the prefixes storeDB reads first, so a store whose
+	// rename was interrupted isn't taken for one which is ahead.
+	rs.resumeRenames()
+	rs.migrateLegacyPrefixes()
+
+	renames := getRenames(rs.db)
+	storeVersions := make(map[string]int64, len(cInfo.StoreInfos))
+	for _, si := range cInfo.StoreInfos {
+		storeVersions[rs.mountedName(si.Name, renames)] = si.Core.CommitID.Version
+	}
+
+	for key, params := range rs.storesParams {
+		if params.typ != sdk.StoreTypeIAVL {
+			continue
+		}
+		db := rs.storeDB(params)
+		storeVer := storeVersions[key.Name()]
+		if !hasIAVLVersionsAfter(db, storeVer) {
+			continue
+		}
+		if err := checkIAVLFormat(); err != nil {
+			return fmt.Errorf("store %s is ahead of version %d: %v", key.Name(), cInfo.Version, err)
+		}
+		if err := deleteIAVLVersionsAfter(db, storeVer); err != nil {
+			return fmt.Errorf("store %s is ahead of version %d: %v", key.Name(), cInfo.Version, err)
+		}
+	}
+	return nil
+}
+
+// latestConsistentVersion returns the highest version up to ver whose commit
+// info is valid, zero if there is none.
+func (rs *rootMultiStore) latestConsistentVersion(ver int64) int64 {
+	for ; ver > 0; ver-- {
+		if _, err := rs.getCommitInfo(ver); err == nil {
+			return ver
+		}
+	}
+	return 0
+}
+
+// LoadVersionWithRenames loads the given version like LoadVersion, with the
+// persisted stores named by the keys of renames loaded into the mounted
+// stores named by their values. The data of a renamed store is moved to the
+// prefix of its new name and the rename is persisted, so older versions keep
+// loading. The version's commit hash is not affected, it is computed over the
+// names the stores were committed under until the next commit.
+//
+// The data is moved here rather than on the first commit under the new
+// names, as the renamed stores load it from their new prefix right away.
+// It is moved in batches, so a marker is kept while a store is moved, and
+// deleted along with persisting the rename. A move interrupted before is
+// resumed by the next load, whether with renames or not.
+func (rs *rootMultiStore) LoadVersionWithRenames(ver int64, renames map[string]string) error {
+	cInfo, err := rs.getCommitInfo(ver)
+	if err != nil {
+		return err
+	}
+	persisted := make(map[string]bool, len(cInfo.StoreInfos))
+	for _, storeInfo := range cInfo.StoreInfos {
+		persisted[storeInfo.Name] = true
+	}
+
+	olds := make([]string, 0, len(renames))
+	for old := range renames {
+		olds = append(olds, old)
+	}
+	sort.Strings(olds)
+
+	for _, old := range olds {
+		name := renames[old]
+		key, ok := rs.keysByName[name]
+		switch {
+		case !ok:
+			return fmt.Errorf("cannot rename store %s: %s is not mounted", old, name)
+		case rs.keysByName[old] != nil:
+			return fmt.Errorf("cannot rename store %s: it is still mounted", old)
+		case !persisted[old]:
+			return fmt.Errorf("cannot rename store %s: it doesn't exist at version %d", old, ver)
+		case persisted[name]:
+			return fmt.Errorf("cannot rename store %s: %s already exists at version %d", old, name, ver)
+		case rs.storesParams[key].db != nil:
+			return fmt.Errorf("cannot rename store %s: %s uses its own db", old, name)
+		}
+	}
+
+	recorded := getRenames(rs.db)
+	for _, old := range olds {
+		// The data was moved already if the rename was applied before.
+		rename := storeRename{From: old, To: renames[old]}
+		if containsRename(recorded, rename) {
+			continue
+		}
+		rs.db.SetSync(renameMigrationKey(rename.To), []byte(rename.From))
+		rs.moveRenamedStore(rename)
+	}
+
+	return rs.LoadVersion(ver)
+}
+
+// moveRenamedStore moves the data of the renamed store to the prefix of its
+// new name in batches, then persists the rename and deletes its marker.
+func (rs *rootMultiStore) moveRenamedStore(rename storeRename) {
+	prefix := storePrefix(rename.To)
+	batch := newFlushingBatch(rs.db, defaultFlushEvery)
+	moveKeys(rs.db, batch, storePrefix(rename.From), prefix, nil)
+	moveKeys(rs.db, batch, legacyStorePrefix(rename.From), prefix, rs.legacyOverlaps(rename.From))
+
+	recorded := getRenames(rs.db)
+	if !containsRename(recorded, rename) {
+		recorded = append(recorded, rename)
+	}
+	setRenames(batch, recorded)
+	batch.Delete(renameMigrationKey(rename.To))
+	batch.WriteSync()
+}
+
+// resumeRenames completes the moves of renamed stores interrupted before.
+func (rs *rootMultiStore) resumeRenames() {
+	var pending []storeRename
+	iter := dbm.IteratePrefix(rs.db, []byte(renameMigrationKeyPrefix))
+	for ; iter.Valid(); iter.Next() {
+		pending = append(pending, storeRename{
+			From: string(iter.Value()),
+			To:   string(iter.Key()[len(renameMigrationKeyPrefix):]),
+		})
+	}
+	iter.Close()
+
+	for _, rename := range pending {
+		rs.moveRenamedStore(rename)
+	}
+}
+
+// renameMigrationKey returns the key marking that the data of the store
+// renamed to name is being moved. It holds the store's former name.
+func renameMigrationKey(name string) []byte {
+	return []byte(renameMigrationKeyPrefix + name)
+}
+
+// mountedName follows the persisted renames of the named store until it
+// reaches a mounted name, or there are no further renames.
+func (rs *rootMultiStore) mountedName(name string, renames []storeRename) string {
+	// A store can't be renamed more often than there are renames, which
+	// guards against cycles.
+	for i := 0; i <= len(renames); i++ {
+		if _, ok := rs.keysByName[name]; ok {
+			return name
+		}
+
+		next := ""
+		for _, rename := range renames {
+			if rename.From == name {
+				next = rename.To
+			}
+		}
+		if next == "" {
+			return name
+		}
+		name = next
+	}
+	return name
+}
+
+// Implements CommitMultiStore.
+func (rs *rootMultiStore) LoadVersion(ver int64) error {
+	// Don't lose versions committed before reloading.
+	rs.FlushPending()
+
+	// Move stores persisted by older releases, or renamed, to their current
+	// prefix.
+	rs.resumeRenames()
+	rs.migrateLegacyPrefixes()
+
+	// Special logic for version 0
+	if ver == 0 {
+		for key, storeParams := range rs.storesParams {
+			store, err := rs.loadCommitStoreFromParams(key, nil, storeParams)
+			if err != nil {
+				return errors.Wrap(err, "failed to load rootMultiStore")
+			}
+			rs.stores[key] = store
+		}
+
+		rs.lastCommitID = CommitID{}
+		rs.updateQueryHeight()
+		return nil
+	}
+	// Otherwise, version is 1 or greater
+
+	if rs.pruning == sdk.PruneEverything {
+		latest := getLatestVersion(rs.db)
+		if ver != latest {
+			return fmt.Errorf("cannot load version %d: pruning everything retains only the latest version %d", ver, latest)
+		}
+	}
+
+	// Get commitInfo
+	cInfo, err := rs.getCommitInfo(ver)
+	if err != nil {
+		return err
+	}
+	cInfo = cInfo.withHasher(rs.hasher)
+
+	// Convert StoreInfos slice to map, following renames and skipping
+	// stores which were deleted since.
+	renames := getRenames(rs.db)
+	infos := make(map[StoreKey]storeInfo)
+	for _, storeInfo := range cInfo.StoreInfos {
+		key, ok := rs.keysByName[rs.mountedName(storeInfo.Name, renames)]
+		if !ok {
+			continue
+		}
+		infos[key] = storeInfo
+	}
+
+	// Load each Store
+	var newStores = make(map[StoreKey]CommitStore)
+	for key, storeParams := range rs.storesParams {
+		var persisted *storeInfo
+		if info, ok := infos[key]; ok {
+			persisted = &info
+		}
+
+		store, err := rs.loadCommitStoreFromParams(key, persisted, storeParams)
+		if err != nil {
+			return errors.Wrap(err, "failed to load rootMultiStore")
+		}
+		newStores[key] = store
+	}
+
+	if rs.verifyOnLoad {
+		if err := rs.verifyLoadedStores(cInfo, newStores, renames); err != nil {
+			return fmt.Errorf("failed to verify rootMultiStore version %d: %v", ver, err)
+		}
+	}
+
+	// Success.
+	rs.lastCommitID = cInfo.CommitID()
+	rs.stores = newStores
+	rs.updateQueryHeight()
+	return nil
+}
+
+// verifyLoadedStores checks that the commit ID of every loaded store matches
+// the one recorded in cInfo, so that the loaded stores hash to the commit
+// hash of the version. Stores which are no longer mounted aren't checked.
+func (rs *rootMultiStore) verifyLoadedStores(cInfo commitInfo, stores map[StoreKey]CommitStore, renames []storeRename) error {
+	for _, persisted := range cInfo.StoreInfos {
+		key, ok := rs.keysByName[rs.mountedName(persisted.Name, renames)]
+		if !ok {
+			continue
+		}
+
+		loaded := stores[key].LastCommitID()
+		expected := persisted.Core.CommitID
+		if loaded.Version != expected.Version || !bytes.Equal(loaded.Hash, expected.Hash) {
+			return fmt.Errorf("store %s loaded as %v, expected %v; commit hash %X doesn't match",
+				persisted.Name, loaded, expected, cInfo.Hash())
+		}
+	}
+	return nil
+}
+
+// Implements CommitMultiStore.
+func (rs *rootMultiStore) RollbackToVersion(target int64) error {
+	rs.FlushPending()
+	latest := getLatestVersion(rs.db)
+	if target < 0 || target > latest {
+		return fmt.Errorf("cannot roll back to version %d: latest version is %d", target, latest)
+	}
+
+	if target > 0 && !rs.versionExists(target) {
+		return fmt.Errorf("cannot roll back to pruned version %d: earliest available version is %d",
+			target, rs.earliestVersion())
+	}
+
+	if err := checkIAVLFormat(); err != nil {
+		return fmt.Errorf("cannot roll back to version %d: %v", target, err)
+	}
+
+	// The substores can't save their rolled back versions again unless they
+	// are deleted first. If this is interrupted, the latest version no longer
+	// loads; loading the target and rolling back again completes it.
+	if err := rs.deleteStoreVersionsAfter(target); err != nil {
+		return err
+	}
+
+	// Need to update atomically.
+	rs.invalidateCommitInfos(target + 1)
+	batch := rs.db.NewBatch()
+	for ver := target + 1; ver <= latest; ver++ {
+		batch.Delete(commitInfoKey(ver))
+		batch.Delete(legacyCommitInfoKey(ver))
+		delete(rs.memCommitInfos, ver)
+	}
+	setLatestVersion(batch, target)
+	batch.Write()
+
+	return rs.LoadVersion(target)
+}
+
+// deleteStoreVersionsAfter deletes the versions of every persisted substore
+// above the one it had at the given version. Substores which weren't part
+// of the version lose all their versions.
+func (rs *rootMultiStore) deleteStoreVersionsAfter(ver int64) error {
+	storeVersions := make(map[string]int64)
+	if ver > 0 {
+		cInfo, err := rs.getCommitInfo(ver)
+		if err != nil {
+			return err
+		}
+		renames := getRenames(rs.db)
+		for _, si := range cInfo.StoreInfos {
+			storeVersions[rs.mountedName(si.Name, renames)] = si.Core.CommitID.Version
+		}
+	}
+
+	for key, params := range rs.storesParams {
+		storeVer := storeVersions[key.Name()]
+		switch params.typ {
+		case sdk.StoreTypeIAVL:
+			if err := deleteIAVLVersionsAfter(rs.storeDB(params), storeVer); err != nil {
+				return fmt.Errorf("cannot roll back store %s: %v", key.Name(), err)
+			}
+		case sdk.StoreTypeMulti:
+			nested, ok := rs.stores[key].(*rootMultiStore)
+			if !ok {
+				return fmt.Errorf("cannot roll back store %s: not loaded", key.Name())
+			}
+			if err := nested.RollbackToVersion(storeVer); err != nil {
+				return fmt.Errorf("cannot roll back store %s: %v", key.Name(), err)
+			}
+		}
+	}
+	return nil
 }
 
-// Implements CommitMultiStore.
-func (rs *rootMultiStore) GetCommitKVStore(key StoreKey) CommitKVStore {
-	return rs.stores[key].(CommitKVStore)
-}
+// versionExists returns whether the commitInfo and every loaded substore
+// still hold the given version.
+func (rs *rootMultiStore) versionExists(ver int64) bool {
+	cInfo, err := rs.getCommitInfo(ver)
+	if err != nil {
+		return false
+	}
 
-// Implements CommitMultiStore.
-func (rs *rootMultiStore) LoadLatestVersion() error {
-	ver := getLatestVersion(rs.db)
-	return rs.LoadVersion(ver)
-}
+	// Stores skipped by a commit lag behind the version they're part of.
+	storeVersions := make(map[string]int64, len(cInfo.StoreInfos))
+	for _, si := range cInfo.StoreInfos {
+		storeVersions[si.Name] = si.Core.CommitID.Version
+	}
 
-// Implements CommitMultiStore.
-func (rs *rootMultiStore) LoadVersion(ver int64) error {
+	for key, store := range rs.stores {
+		storeVer, ok := storeVersions[key.Name()]
+		if !ok {
+			storeVer = ver
+		}
+		if storeVer == 0 {
+			continue
+		}
 
-	// Special logic for version 0
-	if ver == 0 {
-		for key, storeParams := range rs.storesParams {
-			id := CommitID{}
-			store, err := rs.loadCommitStoreFromParams(key, id, storeParams)
-			if err != nil {
-				return fmt.Errorf("failed to load rootMultiStore: %v", err)
+		switch store := store.(type) {
+		case *iavlStore:
+			if !store.VersionExists(storeVer) {
+				return false
+			}
+		case *rootMultiStore:
+			if !store.versionExists(storeVer) {
+				return false
 			}
-			rs.stores[key] = store
 		}
-
-		rs.lastCommitID = CommitID{}
-		return nil
 	}
-	// Otherwise, version is 1 or greater
 
-	// Get commitInfo
-	cInfo, err := getCommitInfo(rs.db, ver)
-	if err != nil {
-		return err
+	return true
+}
+
+// earliestVersion returns the earliest version which has not been pruned,
+// or 0 if there is none.
+func (rs *rootMultiStore) earliestVersion() int64 {
+	versions := rs.AvailableVersions()
+	if len(versions) == 0 {
+		return 0
 	}
+	return versions[0]
+}
 
-	// Convert StoreInfos slice to map
-	infos := make(map[StoreKey]storeInfo)
-	for _, storeInfo := range cInfo.StoreInfos {
-		infos[rs.nameToKey(storeInfo.Name)] = storeInfo
+// AvailableVersions returns the sorted committed versions for which a
+// commitInfo is persisted and which have not been pruned from any of the
+// loaded substores.
+func (rs *rootMultiStore) AvailableVersions() []int64 {
+	stored := make(map[int64]bool)
+
+	prefix := []byte(commitInfoKeyPrefix)
+	iter := rs.db.Iterator(prefix, sdk.PrefixEndBytes(prefix))
+	for ; iter.Valid(); iter.Next() {
+		if key := iter.Key(); len(key) == len(prefix)+8 {
+			stored[int64(binary.BigEndian.Uint64(key[len(prefix):]))] = true
+		}
+	}
+	iter.Close()
+	iterateLegacyCommitInfos(rs.db, func(ver int64, _, _ []byte) {
+		stored[ver] = true
+	})
+	for _, ver := range rs.unserialized {
+		stored[ver] = true
 	}
 
-	// Load each Store
-	var newStores = make(map[StoreKey]CommitStore)
-	for key, storeParams := range rs.storesParams {
-		var id CommitID
-		info, ok := infos[key]
-		if ok {
-			id = info.Core.CommitID
+	var versions []int64
+	for ver := range stored {
+		if rs.versionExists(ver) {
+			versions = append(versions, ver)
 		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i] < versions[j]
+	})
+
+	return versions
+}
+
+// CommitIDHistory returns the commit IDs of the versions from to to, both
+// included, in version order, e.g. to audit the sequence of app hashes. It
+// fails if the commit info of any version in the range is missing, e.g. as
+// the version was rolled back or not committed yet. The commit info outlives
+// the pruning of the store data it commits to. Each version is read from
+// the DB separately, so large ranges are expensive.
+func (rs *rootMultiStore) CommitIDHistory(from, to int64) ([]CommitID, error) {
+	if from <= 0 || from > to {
+		return nil, fmt.Errorf("invalid version range [%d, %d]", from, to)
+	}
 
-		store, err := rs.loadCommitStoreFromParams(key, id, storeParams)
+	commitIDs := make([]CommitID, 0, to-from+1)
+	for ver := from; ver <= to; ver++ {
+		cInfo, err := rs.getCommitInfo(ver)
 		if err != nil {
-			return fmt.Errorf("failed to load rootMultiStore: %v", err)
+			return nil, fmt.Errorf("commit info of version %d is not available: %v", ver, err)
 		}
-		newStores[key] = store
+		commitIDs = append(commitIDs, cInfo.CommitID())
 	}
+	return commitIDs, nil
+}
 
-	// Success.
-	rs.lastCommitID = cInfo.CommitID()
-	rs.stores = newStores
-	return nil
+// MigrateCommitInfoKeys moves the commit infos stored under the legacy
+// decimal keys to the current keys in a single batch, and returns the number
+// of commit infos moved. Until they are moved, they are read from the legacy
+// keys.
+func (rs *rootMultiStore) MigrateCommitInfoKeys() int {
+	moved := 0
+	batch := rs.db.NewBatch()
+	iterateLegacyCommitInfos(rs.db, func(ver int64, key, value []byte) {
+		// A commit info under the current key takes precedence.
+		if !rs.db.Has(commitInfoKey(ver)) {
+			batch.Set(commitInfoKey(ver), cp(value))
+		}
+		batch.Delete(cp(key))
+		moved++
+	})
+	batch.Write()
+	return moved
 }
 
 // WithTracer sets the tracer for the MultiStore that the underlying
@@ -189,18 +1293,167 @@ func (rs *rootMultiStore) LastCommitID() CommitID {
 	return rs.lastCommitID
 }
 
-// Implements Committer/CommitStore.
+// Implements Committer/CommitStore. Panics with the error of TryCommit.
 func (rs *rootMultiStore) Commit() CommitID {
+	commitID, err := rs.TryCommit()
+	if err != nil {
+		panic(err)
+	}
+	return commitID
+}
+
+// TryCommit is like Commit, but returns an error instead of panicking if the
+// commit fails:
+//
+// If a write listener fails to flush its records, nothing is committed and
+// the version doesn't advance. The records of the other listeners may have
+// been flushed already; they describe writes which are still pending and
+// committed by the next successful commit.
+//
+// If a substore panics while committing, a *StoreCommitError is returned.
+// The commit is then aborted without advancing the version, while the
+// substores which did commit have persisted their next version. The
+// multistore must be reloaded before it is used again: either with
+// LoadLatestVersion, after which the same writes must be committed again so
+// that the substores save the same versions, or with RollbackToVersion at
+// LastCommitID().Version, which deletes the versions the substores saved.
+func (rs *rootMultiStore) TryCommit() (CommitID, error) {
+	return rs.commit(rs.readOnly)
+}
+
+// StoreCommitError is returned when a substore panics while committing.
+type StoreCommitError struct {
+	Store   string
+	Version int64
+
+	// Panic is the value the substore panicked with.
+	Panic interface{}
+}
+
+func (e *StoreCommitError) Error() string {
+	return fmt.Sprintf("failed to commit store %s at version %d: %v", e.Store, e.Version, e.Panic)
+}
+
+// kindError tags err with one of the sentinel errors above, keeping the
+// message of err.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e kindError) Error() string {
+	return e.err.Error()
+}
+
+// Cause returns the kind of the error, so that errors.Cause of an error
+// wrapping it is the sentinel error.
+func (e kindError) Cause() error {
+	return e.kind
+}
+
+// IsErrNoData returns whether err is or wraps ErrNoData.
+func IsErrNoData(err error) bool {
+	return errors.Cause(err) == ErrNoData
+}
+
+// IsErrCommitInfoDecode returns whether err is or wraps ErrCommitInfoDecode.
+func IsErrCommitInfoDecode(err error) bool {
+	return errors.Cause(err) == ErrCommitInfoDecode
+}
+
+// IsErrStoreLoad returns whether err is or wraps ErrStoreLoad.
+func IsErrStoreLoad(err error) bool {
+	return errors.Cause(err) == ErrStoreLoad
+}
+
+// CommitStores commits only the stores of the given keys, e.g. the stores
+// changed by an upgrade handler, and leaves the others untouched. The version
+// still advances by one, and the new commit info carries forward the last
+// commit ID of every store not committed, so the commit hash covers the
+// latest commit ID of all stores. Transient stores not given are not reset.
+//
+// This is an advanced API which breaks the assumption that every store
+// holds every version of the multistore: the stores not committed lag
+// behind, and uncommitted writes to them stay pending until they are
+// committed. Queries at the new version only see the data of such stores
+// when addressed at their own version. All nodes must commit the same
+// stores at the same version, or their commit hashes diverge. Panics if a
+// key isn't mounted.
+func (rs *rootMultiStore) CommitStores(keys []StoreKey) CommitID {
+	skip := make(map[StoreKey]bool, len(rs.stores))
+	for key := range rs.stores {
+		skip[key] = true
+	}
+	for _, key := range keys {
+		if _, ok := rs.stores[key]; !ok {
+			panic(fmt.Sprintf("cannot commit store %v: not mounted", key))
+		}
+		skip[key] = rs.readOnly[key]
+	}
+	commitID, err := rs.commit(skip)
+	if err != nil {
+		panic(err)
+	}
+	return commitID
+}
+
+// commit commits all stores except those in skip, whose last commit ID is
+// recorded in the commit info instead. Nothing is written if a store fails
+// to commit.
+func (rs *rootMultiStore) commit(skip map[StoreKey]bool) (CommitID, error) {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+
+	// Make the recorded writes durable before the state they lead to.
+	for key, listener := range rs.listeners {
+		if err := listener.flush(); err != nil {
+			return CommitID{}, fmt.Errorf("failed to flush write listener of store %s: %v", key.Name(), err)
+		}
+	}
 
 	// Commit stores.
 	version := rs.lastCommitID.Version + 1
-	commitInfo := commitStores(version, rs.stores)
 
-	// Need to update atomically.
-	batch := rs.db.NewBatch()
-	setCommitInfo(batch, version, commitInfo)
-	setLatestVersion(batch, version)
-	batch.Write()
+	start := time.Now()
+	commitInfo, err := commitStores(version, rs.stores, skip, rs.commitWorkers)
+	if err != nil {
+		return CommitID{}, err
+	}
+	if rs.metrics != nil {
+		rs.metrics.ObserveCommitDuration(time.Since(start))
+		rs.metrics.ObserveStoreCount(commitInfo.nonZeroCount())
+	}
+
+	commitInfo = commitInfo.withHasher(rs.hasher)
+
+	// A version committed before may be rewritten, e.g. after a fallback
+	// to an earlier version on load.
+	rs.invalidateCommitInfos(version)
+
+	if rs.strictLogger != nil {
+		if err := checkStoreInfosSorted(commitInfo.StoreInfos); err != nil {
+			rs.strictLogger.Error("NON-DETERMINISTIC COMMIT", "version", version, "err", err)
+		}
+	}
+
+	if rs.commitBatchWindow > 1 {
+		rs.pendingCommits = append(rs.pendingCommits, commitInfo)
+		if len(rs.pendingCommits) >= rs.commitBatchWindow {
+			rs.flushPending()
+		}
+	} else if rs.memCommitInfos != nil {
+		rs.memCommitInfos[version] = commitInfo
+		rs.unserialized = append(rs.unserialized, version)
+		batch := rs.db.NewBatch()
+		setLatestVersion(batch, version)
+		batch.Write()
+	} else {
+		// Need to update atomically.
+		batch := rs.db.NewBatch()
+		setCommitInfo(batch, version, commitInfo, rs.compressCommitInfo)
+		setLatestVersion(batch, version)
+		batch.Write()
+	}
 
 	// Prepare for next version.
 	commitID := CommitID{
@@ -208,7 +1461,49 @@ func (rs *rootMultiStore) Commit() CommitID {
 		Hash:    commitInfo.Hash(),
 	}
 	rs.lastCommitID = commitID
-	return commitID
+	rs.updateQueryHeight()
+	return commitID, nil
+}
+
+// ComputeCommitHash returns the hash the next Commit() would return given the
+// current state of the substores, without committing them. Transient stores
+// are skipped as in Commit(), every other substore must implement
+// CommitHasher.
+func (rs *rootMultiStore) ComputeCommitHash() ([]byte, error) {
+	storeInfos := make([]storeInfo, 0, len(rs.stores))
+	for key, store := range rs.stores {
+		if store.GetStoreType() == sdk.StoreTypeTransient {
+			continue
+		}
+
+		si := storeInfo{}
+		si.Name = key.Name()
+		si.Type = newStoreTypeTag(store.GetStoreType())
+		if rs.readOnly[key] {
+			// Read-only stores aren't committed.
+			si.Core.CommitID = store.LastCommitID()
+			storeInfos = append(storeInfos, si)
+			continue
+		}
+
+		hasher, ok := store.(CommitHasher)
+		if !ok {
+			return nil, fmt.Errorf("store %s cannot compute its commit hash", key.Name())
+		}
+		hash, err := hasher.ComputeCommitHash()
+		if err != nil {
+			return nil, err
+		}
+
+		si.Core.CommitID = CommitID{
+			Version: store.LastCommitID().Version + 1,
+			Hash:    hash,
+		}
+		storeInfos = append(storeInfos, si)
+	}
+
+	ci := newCommitInfo(rs.lastCommitID.Version+1, storeInfos).withHasher(rs.hasher)
+	return ci.Hash(), nil
 }
 
 // Implements CacheWrapper/Store/CommitStore.
@@ -231,77 +1526,406 @@ func (rs *rootMultiStore) CacheMultiStore() CacheMultiStore {
 
 // Implements MultiStore.
 func (rs *rootMultiStore) GetStore(key StoreKey) Store {
-	return rs.stores[key]
+	return rs.GetCommitStore(key)
 }
 
 // GetKVStore implements the MultiStore interface. If tracing is enabled on the
 // rootMultiStore, a wrapped TraceKVStore will be returned with the given
-// tracer, otherwise, the original KVStore will be returned.
+// tracer, otherwise, the original KVStore will be returned. It panics naming
+// the key if the key isn't mounted as a KVStore.
 func (rs *rootMultiStore) GetKVStore(key StoreKey) KVStore {
-	store := rs.stores[key].(KVStore)
+	store := rs.kvStore(key)
+	if listener, ok := rs.listeners[key]; ok {
+		store = listenKVStore{store, listener}
+	}
 
 	if rs.TracingEnabled() {
 		store = NewTraceKVStore(store, rs.traceWriter, rs.traceContext)
 	}
 
-	return store
+	store = wrapValueLimit(store, key, rs.maxValueSizes)
+	return wrapReadOnly(store, key, rs.readOnly)
+}
+
+// GetKVStoreTraced returns the KVStore for the given key wrapped in a
+// TraceKVStore writing to w with context tc, regardless of whether tracing is
+// enabled on the rootMultiStore. The rootMultiStore's tracer is not modified.
+func (rs *rootMultiStore) GetKVStoreTraced(key StoreKey, w io.Writer, tc TraceContext) KVStore {
+	return wrapReadOnly(NewTraceKVStore(rs.kvStore(key), w, tc), key, rs.readOnly)
+}
+
+// GetKVStoreWithGas returns the KVStore for the given key wrapped in a gas
+// metering store consuming gas from meter according to config. If tracing is
+// enabled, the tracing wrap sits beneath the gas metering, so only the
+// accesses which reach the store are traced.
+func (rs *rootMultiStore) GetKVStoreWithGas(key StoreKey, meter GasMeter, config GasConfig) KVStore {
+	return NewGasKVStore(meter, config, rs.GetKVStore(key))
 }
 
 // Implements MultiStore
 
-// getStoreByName will first convert the original name to
-// a special key, before looking up the CommitStore.
-// This is not exposed to the extensions (which will need the
-// StoreKey), but is useful in main, and particularly app.Query,
-// in order to convert human strings into CommitStores.
-func (rs *rootMultiStore) getStoreByName(name string) Store {
-	key := rs.keysByName[name]
-	if key == nil {
-		return nil
+// getStoreByName will first convert the original name to
+// a special key, before looking up the CommitStore.
+// This is not exposed to the extensions (which will need the
+// StoreKey), but is useful in main, and particularly app.Query,
+// in order to convert human strings into CommitStores.
+func (rs *rootMultiStore) getStoreByName(name string) Store {
+	key := rs.keysByName[name]
+	if key == nil {
+		return nil
+	}
+	return rs.stores[key]
+}
+
+//---------------------- Query ------------------
+
+// Query calls substore.Query with the same `req` where `req.Path` is
+// modified to remove the substore prefix.
+// Ie. `req.Path` here is `/<substore>/<path>`, and trimmed to `/<path>` for the substore.
+// If a proven key query finds no value, the response carries the substore's
+// absence proof linked to the app hash, like a value proof.
+// TODO: add proof for `multistore -> substore`.
+func (rs *rootMultiStore) Query(req abci.RequestQuery) abci.ResponseQuery {
+	rs.mtx.RLock()
+	defer rs.mtx.RUnlock()
+
+	if rs.queryTraceWriter == nil {
+		return rs.query(req, nil)
+	}
+
+	trace := &queryTrace{Path: req.Path, Prove: req.Prove, Metadata: rs.traceContext}
+	res := rs.query(req, trace)
+	trace.Code, trace.Log = res.Code, res.Log
+	if res.Height != 0 {
+		trace.Height = res.Height
+	}
+	writeQueryTrace(rs.queryTraceWriter, trace)
+	return res
+}
+
+// QueryWithProofOps answers the query like Query, but returns the ops of the
+// proof apart from the response instead of in res.Proof, which is cleared.
+// The ops are ordered from the innermost store to the multistore, the order
+// merkle.ProofRuntime verifies them in, so callers can verify each layer on
+// its own or with a custom verifier. They are nil if no proof was built. An
+// error is returned if the query fails.
+func (rs *rootMultiStore) QueryWithProofOps(req abci.RequestQuery) (abci.ResponseQuery, []merkle.ProofOp, error) {
+	res := rs.Query(req)
+	if !res.IsOK() {
+		return res, nil, fmt.Errorf("query %s failed with code %d: %s", req.Path, res.Code, res.Log)
+	}
+
+	var ops []merkle.ProofOp
+	if res.Proof != nil {
+		ops = res.Proof.Ops
+		res.Proof = nil
+	}
+	return res, ops, nil
+}
+
+// query answers the query, recording its routing in trace if not nil.
+func (rs *rootMultiStore) query(req abci.RequestQuery, trace *queryTrace) abci.ResponseQuery {
+	// Query just routes this to a substore.
+	path := req.Path
+	storeName, subpath, err := parsePath(path)
+	if err != nil {
+		return err.QueryResult()
+	}
+	if trace != nil {
+		trace.Store, trace.Subpath = storeName, subpath
+	}
+
+	if storeName == storeQueryRoute {
+		return rs.queryStore(subpath)
+	}
+
+	store, queryable, err := rs.queryableStore(storeName)
+	if err != nil {
+		return err.QueryResult()
+	}
+
+	// Pin the version up front so the data and the proof are drawn from the
+	// same commit even if another commit lands while querying.
+	if req.Height == 0 {
+		req.Height = rs.defaultQueryHeight()
+	}
+	if trace != nil {
+		trace.Height = req.Height
+	}
+
+	// Substores fail opaquely on pruned versions, so tell the client where
+	// to retry instead.
+	if req.Prove && req.Height > 0 && !rs.versionExists(req.Height) {
+		return rs.heightUnavailable(req.Height)
+	}
+
+	// trim the path and make the query
+	req.Path = subpath
+	res := queryable.Query(req)
+
+	if !req.Prove || !requireProof(store, subpath) {
+		return res
+	}
+
+	// Prove against the height the substore actually answered at.
+	height := res.Height
+	if height == 0 {
+		height = req.Height
+	}
+	commitInfo, err := rs.proofCommitInfo(height)
+	if err != nil {
+		return err.QueryResult()
+	}
+
+	if err := appendMultiStoreProof(&res, storeName, commitInfo); err != nil {
+		return err.QueryResult()
+	}
+	if trace != nil {
+		trace.Proven = true
+	}
+	return res
+}
+
+// queryTrace is the record of a query written to the query tracer, see
+// SetQueryTracer.
+type queryTrace struct {
+	Path string `json:"path"`
+
+	// Store and Subpath are the store the query was routed to and the path
+	// passed on to it.
+	Store   string `json:"store"`
+	Subpath string `json:"subpath"`
+
+	// Height is the height the query was answered at, if it got that far.
+	Height int64 `json:"height"`
+
+	// Prove is whether a proof was requested, Proven whether one was built.
+	Prove  bool `json:"prove"`
+	Proven bool `json:"proven"`
+
+	Code     uint32                 `json:"code"`
+	Log      string                 `json:"log,omitempty"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// SetQueryTracer makes Query write a JSON encoded record of every query to
+// w, one per line, holding how the query was routed, at which height it was
+// answered, whether a proof was built and the outcome, along with the trace
+// context. This is independent of the KVStore tracer set with WithTracer. A
+// nil w disables query tracing, which is the default.
+func (rs *rootMultiStore) SetQueryTracer(w io.Writer) {
+	rs.queryTraceWriter = w
+}
+
+// writeQueryTrace writes the trace to w as a line of JSON.
+// nolint: errcheck
+func writeQueryTrace(w io.Writer, trace *queryTrace) {
+	raw, err := json.Marshal(trace)
+	if err != nil {
+		panic(fmt.Sprintf("failed to serialize query trace: %v", err))
+	}
+
+	if _, err := w.Write(raw); err != nil {
+		panic(fmt.Sprintf("failed to write query trace: %v", err))
+	}
+
+	io.WriteString(w, "\n")
+}
+
+// HeightUnavailable describes a query height which can't be proven, e.g. as
+// it was pruned. It is JSON encoded into the Info of the query response.
+type HeightUnavailable struct {
+	Height int64 `json:"height"`
+
+	// NearestBelow and NearestAbove are the closest available versions
+	// below and above Height the store found, 0 if it found none.
+	NearestBelow int64 `json:"nearest_below"`
+	NearestAbove int64 `json:"nearest_above"`
+}
+
+// ParseHeightUnavailable returns the HeightUnavailable the query failed
+// with, or false if it failed for another reason.
+func ParseHeightUnavailable(res abci.ResponseQuery) (HeightUnavailable, bool) {
+	var hu HeightUnavailable
+	if res.IsOK() || json.Unmarshal([]byte(res.Info), &hu) != nil || hu.Height == 0 {
+		return HeightUnavailable{}, false
+	}
+	return hu, true
+}
+
+// heightUnavailable returns the response to a query at the unavailable
+// height. The nearest available versions are looked for among the versions
+// the pruning strategies keep around the height, so that the response takes
+// a bounded number of lookups however long the chain is. A version which
+// is available but not kept by any strategy, e.g. as the strategy was
+// changed, may be missed.
+func (rs *rootMultiStore) heightUnavailable(height int64) abci.ResponseQuery {
+	latest := rs.lastCommitID.Version
+	recent := latest - syncableKeepRecent
+	everyBelow := (height - 1) / syncableKeepEvery * syncableKeepEvery
+	everyAbove := (height/syncableKeepEvery + 1) * syncableKeepEvery
+
+	hu := HeightUnavailable{Height: height}
+	for _, ver := range []int64{height - 1, latest, everyBelow} {
+		if ver > hu.NearestBelow && ver < height && rs.versionExists(ver) {
+			hu.NearestBelow = ver
+		}
+	}
+	for _, ver := range []int64{height + 1, recent, recent + 1, everyAbove, latest} {
+		if ver > height && ver <= latest && (hu.NearestAbove == 0 || ver < hu.NearestAbove) && rs.versionExists(ver) {
+			hu.NearestAbove = ver
+		}
+	}
+
+	res := sdk.ErrUnknownRequest(fmt.Sprintf(
+		"height %d is not available, nearest available versions are %d and %d",
+		height, hu.NearestBelow, hu.NearestAbove)).QueryResult()
+	bz, err := json.Marshal(hu)
+	if err != nil {
+		panic(err)
+	}
+	res.Info = string(bz)
+	return res
+}
+
+// QueryBatch answers several substore queries at a single height, fetching
+// the commitInfo for their proofs only once. The responses are in the order
+// of reqs. The requests may leave Height at zero, all others must agree on
+// the height. If any request can't be routed to a queryable store, no
+// responses are returned, responses of the substores are returned as they
+// are.
+func (rs *rootMultiStore) QueryBatch(reqs []abci.RequestQuery) ([]abci.ResponseQuery, sdk.Error) {
+	rs.mtx.RLock()
+	defer rs.mtx.RUnlock()
+
+	var height int64
+	for _, req := range reqs {
+		if req.Height == 0 {
+			continue
+		}
+		if height != 0 && req.Height != height {
+			return nil, sdk.ErrUnknownRequest(
+				fmt.Sprintf("batched queries at different heights %d and %d", height, req.Height))
+		}
+		height = req.Height
+	}
+	if height == 0 {
+		height = rs.defaultQueryHeight()
+	}
+
+	// Route all requests before querying any store.
+	type route struct {
+		storeName, subpath string
+		store              Store
+		queryable          Queryable
+	}
+	routes := make([]route, len(reqs))
+	for i, req := range reqs {
+		storeName, subpath, err := parsePath(req.Path)
+		if err != nil {
+			return nil, err
+		}
+		store, queryable, err := rs.queryableStore(storeName)
+		if err != nil {
+			return nil, err
+		}
+		routes[i] = route{storeName, subpath, store, queryable}
+	}
+
+	var commitInfo *commitInfo
+	responses := make([]abci.ResponseQuery, len(reqs))
+	for i, req := range reqs {
+		r := routes[i]
+		req.Height = height
+		req.Path = r.subpath
+		res := r.queryable.Query(req)
+
+		if req.Prove && requireProof(r.store, r.subpath) {
+			if commitInfo == nil {
+				cInfo, err := rs.proofCommitInfo(height)
+				if err != nil {
+					return nil, err
+				}
+				commitInfo = &cInfo
+			}
+			if err := appendMultiStoreProof(&res, r.storeName, *commitInfo); err != nil {
+				return nil, err
+			}
+		}
+		responses[i] = res
 	}
-	return rs.stores[key]
+	return responses, nil
 }
 
-//---------------------- Query ------------------
-
-// Query calls substore.Query with the same `req` where `req.Path` is
-// modified to remove the substore prefix.
-// Ie. `req.Path` here is `/<substore>/<path>`, and trimmed to `/<path>` for the substore.
-// TODO: add proof for `multistore -> substore`.
-func (rs *rootMultiStore) Query(req abci.RequestQuery) abci.ResponseQuery {
-	// Query just routes this to a substore.
-	path := req.Path
-	storeName, subpath, err := parsePath(path)
+// proofCommitInfo returns the commitInfo to prove query results at the given
+// height against. Height zero means nothing has been committed yet, so there
+// is nothing to prove against.
+func (rs *rootMultiStore) proofCommitInfo(height int64) (commitInfo, sdk.Error) {
+	if height == 0 {
+		return commitInfo{}, sdk.ErrUnknownRequest("cannot prove query results before the first commit")
+	}
+	cInfo, err := rs.getCommitInfo(height)
 	if err != nil {
-		return err.QueryResult()
+		return commitInfo{}, sdk.ErrInternal(err.Error())
 	}
+	return cInfo, nil
+}
 
+// queryableStore returns the named substore which must support queries.
+func (rs *rootMultiStore) queryableStore(storeName string) (Store, Queryable, sdk.Error) {
 	store := rs.getStoreByName(storeName)
 	if store == nil {
 		msg := fmt.Sprintf("no such store: %s", storeName)
-		return sdk.ErrUnknownRequest(msg).QueryResult()
+		return nil, nil, sdk.ErrUnknownRequest(msg)
 	}
 	queryable, ok := store.(Queryable)
 	if !ok {
 		msg := fmt.Sprintf("store %s doesn't support queries", storeName)
-		return sdk.ErrUnknownRequest(msg).QueryResult()
+		return nil, nil, sdk.ErrUnknownRequest(msg)
 	}
+	return store, queryable, nil
+}
 
-	// trim the path and make the query
-	req.Path = subpath
-	res := queryable.Query(req)
+// maxProofStoreInfos is the maximum number of store infos a commitInfo may
+// hold to be proven against, far above the number of stores any app mounts.
+const maxProofStoreInfos = 1024
 
-	if !req.Prove || !RequireProof(subpath) {
-		return res
+// appendMultiStoreProof appends the proof op of the named store within the
+// multistore to the substore's proof in res. It fails if the store is not
+// part of commitInfo, or commitInfo holds more than maxProofStoreInfos
+// store infos.
+func appendMultiStoreProof(res *abci.ResponseQuery, storeName string, commitInfo commitInfo) sdk.Error {
+	if res.Proof == nil || len(res.Proof.Ops) == 0 {
+		if res.Log != "" {
+			return sdk.ErrInternal(fmt.Sprintf("store %s returned no proof: %s", storeName, res.Log))
+		}
+		return sdk.ErrInternal("substore proof was nil/empty when it should never be")
 	}
 
-	if res.Proof == nil || len(res.Proof.Ops) == 0 {
-		return sdk.ErrInternal("substore proof was nil/empty when it should never be").QueryResult()
+	// The leaf op must prove what the substore answered.
+	leafOp := res.Proof.Ops[0].Type
+	if res.Value == nil && leafOp != iavl.ProofOpIAVLAbsence {
+		return sdk.ErrInternal(fmt.Sprintf("store %s cannot prove absence: got a %s proof for a missing value", storeName, leafOp))
+	}
+	if res.Value != nil && leafOp == iavl.ProofOpIAVLAbsence {
+		return sdk.ErrInternal(fmt.Sprintf("store %s returned an absence proof for a present value", storeName))
 	}
 
-	commitInfo, errMsg := getCommitInfo(rs.db, res.Height)
-	if errMsg != nil {
-		return sdk.ErrInternal(errMsg.Error()).QueryResult()
+	// Don't let a corrupt commitInfo blow up the proof.
+	if len(commitInfo.StoreInfos) > maxProofStoreInfos {
+		return sdk.ErrInternal(fmt.Sprintf("commit info of version %d has %d store infos, more than the maximum of %d",
+			commitInfo.Version, len(commitInfo.StoreInfos), maxProofStoreInfos))
+	}
+	found := false
+	for _, si := range commitInfo.StoreInfos {
+		if si.Name == storeName {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return sdk.ErrInternal(fmt.Sprintf("store %s is not part of the commit info of version %d",
+			storeName, commitInfo.Version))
 	}
 
 	// Restore origin path and append proof op.
@@ -312,7 +1936,55 @@ func (rs *rootMultiStore) Query(req abci.RequestQuery) abci.ResponseQuery {
 
 	// TODO: handle in another TM v0.26 update PR
 	// res.Proof = buildMultiStoreProof(res.Proof, storeName, commitInfo.StoreInfos)
-	return res
+	return nil
+}
+
+// defaultQueryHeight returns the height queries without an explicit height
+// are answered at, as of the last commit or load.
+func (rs *rootMultiStore) defaultQueryHeight() int64 {
+	return rs.queryHeight
+}
+
+// updateQueryHeight updates the default query height after the latest
+// version changed. Like iavlStore, it picks the latest height - 1
+// when available, as merkle proofs are available immediately for it.
+func (rs *rootMultiStore) updateQueryHeight() {
+	latest := rs.latestVersion()
+	if latest > 1 && rs.versionExists(latest-1) {
+		rs.queryHeight = latest - 1
+		return
+	}
+	rs.queryHeight = latest
+}
+
+// queryStore answers queries about the mounted stores without touching any
+// substore data. The only supported path is `/<name>/type`, which returns
+// the amino encoded StoreType of the named store, so clients can tell up
+// front whether the store is able to produce proofs.
+func (rs *rootMultiStore) queryStore(path string) abci.ResponseQuery {
+	storeName, subpath, err := parsePath(path)
+	if err != nil {
+		return err.QueryResult()
+	}
+
+	key := rs.keysByName[storeName]
+	if key == nil {
+		msg := fmt.Sprintf("no such store: %s", storeName)
+		return sdk.ErrUnknownRequest(msg).QueryResult()
+	}
+
+	switch subpath {
+	case "/type":
+		return abci.ResponseQuery{
+			Key:    []byte(storeName),
+			Value:  cdc.MustMarshalBinaryLengthPrefixed(rs.storesParams[key].typ),
+			Height: rs.lastCommitID.Version,
+		}
+
+	default:
+		msg := fmt.Sprintf("unexpected store query path: %v", subpath)
+		return sdk.ErrUnknownRequest(msg).QueryResult()
+	}
 }
 
 // parsePath expects a format like /<storeName>[/<subpath>]
@@ -334,22 +2006,59 @@ func parsePath(path string) (storeName string, subpath string, err sdk.Error) {
 	return
 }
 
+// requireProof returns whether a query for subpath on the given store will
+// include a proof, descending into nested multistores to find the leaf path.
+func requireProof(store Store, subpath string) bool {
+	nested, ok := store.(*rootMultiStore)
+	if !ok {
+		return RequireProof(subpath)
+	}
+
+	storeName, subsubpath, err := parsePath(subpath)
+	if err != nil {
+		return false
+	}
+
+	substore := nested.getStoreByName(storeName)
+	if substore == nil {
+		return false
+	}
+
+	return requireProof(substore, subsubpath)
+}
+
 //----------------------------------------
 
-func (rs *rootMultiStore) loadCommitStoreFromParams(key sdk.StoreKey, id CommitID, params storeParams) (store CommitStore, err error) {
-	var db dbm.DB
-	if params.db != nil {
-		db = dbm.NewPrefixDB(params.db, []byte("s/_/"))
-	} else {
-		db = dbm.NewPrefixDB(rs.db, []byte("s/k:"+params.key.Name()+"/"))
+// loadCommitStoreFromParams loads the store described by params. If the store
+// was persisted in the loaded commitInfo, info holds its persisted core and the
+// persisted StoreType must match the mounted one, unless it is unknown.
+func (rs *rootMultiStore) loadCommitStoreFromParams(key sdk.StoreKey, info *storeInfo, params storeParams) (store CommitStore, err error) {
+	defer func() {
+		if err != nil {
+			err = kindError{ErrStoreLoad, err}
+		}
+	}()
+
+	var id CommitID
+	if info != nil {
+		if typ, ok := info.Type.storeType(); ok && typ != params.typ {
+			err = fmt.Errorf("store type mismatch for %s: persisted %v, mounted %v",
+				key.Name(), typ, params.typ)
+			return
+		}
+		id = info.Core.CommitID
 	}
+
+	db := rs.storeDB(params)
 	switch params.typ {
 	case sdk.StoreTypeMulti:
-		panic("recursive MultiStores not yet supported")
-		// TODO: id?
-		// return NewCommitMultiStore(db, id)
+		store, err = rs.loadCommitMultiStore(db, id, params)
+		return
 	case sdk.StoreTypeIAVL:
 		store, err = LoadIAVLStore(db, id, rs.pruning)
+		if err == nil {
+			store.(*iavlStore).name = key.Name()
+		}
 		return
 	case sdk.StoreTypeDB:
 		panic("dbm.DB is not a CommitStore")
@@ -359,20 +2068,198 @@ func (rs *rootMultiStore) loadCommitStoreFromParams(key sdk.StoreKey, id CommitI
 			err = fmt.Errorf("invalid StoreKey for StoreTypeTransient: %s", key.String())
 			return
 		}
-		store = newTransientStore()
+		transient := newTransientStore()
+		transient.name = key.Name()
+		store = transient
 		return
 	default:
 		panic(fmt.Sprintf("unrecognized store type %v", params.typ))
 	}
 }
 
-func (rs *rootMultiStore) nameToKey(name string) StoreKey {
-	for key := range rs.storesParams {
-		if key.Name() == name {
-			return key
+// loadCommitMultiStore constructs a nested rootMultiStore over the given
+// prefixed db, mounts its substores and loads it at the version of id.
+func (rs *rootMultiStore) loadCommitMultiStore(db dbm.DB, id CommitID, params storeParams) (CommitStore, error) {
+	nested := NewCommitMultiStore(db)
+	for _, sub := range params.substores {
+		nested.MountStoreWithDB(sub.key, sub.typ, nil)
+	}
+	nested.SetPruning(rs.pruning)
+	nested.SetHasher(rs.hasher)
+
+	err := nested.LoadVersion(id.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	return nested, nil
+}
+
+// storeDB returns the prefixed db a store described by params persists to.
+func (rs *rootMultiStore) storeDB(params storeParams) dbm.DB {
+	db := rs.db
+	if params.db != nil {
+		db = params.db
+	}
+	return dbm.NewPrefixDB(db, paramsStorePrefix(params))
+}
+
+// StorePrefix returns the prefix of the keys the store of key persists its
+// data under, e.g. for tools reading the db directly. The prefix is within
+// the root db, or within the db the store was mounted with by
+// MountStoreWithDB. The data of substores of a nested store is further
+// prefixed within the prefix of the nested store. Returns nil for
+// transient and unmounted stores, which persist nothing.
+func (rs *rootMultiStore) StorePrefix(key StoreKey) []byte {
+	params, ok := rs.storesParams[key]
+	if !ok || params.typ == sdk.StoreTypeTransient {
+		return nil
+	}
+	return paramsStorePrefix(params)
+}
+
+// paramsStorePrefix returns the prefix of the store described by params.
+func paramsStorePrefix(params storeParams) []byte {
+	if params.db != nil {
+		return []byte("s/_/")
+	}
+	return storePrefix(params.key.Name())
+}
+
+// Compact triggers compaction of the key range of every mounted store, e.g.
+// to reclaim the space freed by pruning. Compaction is expensive, so it's
+// best scheduled for periods of low traffic. Only GoLevelDB supports range
+// compaction, for other db backends Compact is a no-op returning nil.
+func (rs *rootMultiStore) Compact() error {
+	for _, key := range rs.MountedStoreKeys() {
+		params := rs.storesParams[key]
+		if params.typ == sdk.StoreTypeTransient {
+			continue
+		}
+
+		db, prefix := rs.db, paramsStorePrefix(params)
+		if params.db != nil {
+			db = params.db
+		}
+		if err := compactRange(db, prefix, cpIncr(prefix)); err != nil {
+			return fmt.Errorf("failed to compact store %s: %v", key.Name(), err)
+		}
+	}
+	return nil
+}
+
+// compactRange compacts the keys in [start, limit) if the db supports it.
+func compactRange(db dbm.DB, start, limit []byte) error {
+	ldb, ok := db.(*dbm.GoLevelDB)
+	if !ok {
+		return nil
+	}
+	return ldb.DB().CompactRange(util.Range{Start: start, Limit: limit})
+}
+
+// storePrefix returns the prefix of the named store's data in the root db.
+// The name is length-prefixed so that no two names map to overlapping
+// ranges, which "s/k:<name>/" does for names containing a "/".
+func storePrefix(name string) []byte {
+	return []byte(fmt.Sprintf("s/l:%d:%s/", len(name), name))
+}
+
+// legacyStorePrefix returns the prefix stores were persisted under before
+// storePrefix.
+func legacyStorePrefix(name string) []byte {
+	return []byte("s/k:" + name + "/")
+}
+
+// migrateLegacyPrefixes moves the data of every mounted store which only has
+// data under its legacy prefix to its current prefix. As the legacy prefixes
+// overlap, keys under the legacy prefix of another mounted store are left for
+// that store's migration. The keys are moved in batches, so a marker is kept
+// while a store is migrated, and deleted last. A migration interrupted before
+// is resumed.
+func (rs *rootMultiStore) migrateLegacyPrefixes() {
+	for key, params := range rs.storesParams {
+		if params.db != nil {
+			continue
 		}
+
+		name := key.Name()
+		legacy := legacyStorePrefix(name)
+		marker := legacyMigrationKey(name)
+		if !rs.db.Has(marker) && (hasPrefix(rs.db, storePrefix(name)) || !hasPrefix(rs.db, legacy)) {
+			continue
+		}
+
+		rs.db.SetSync(marker, []byte{})
+		batch := newFlushingBatch(rs.db, defaultFlushEvery)
+		moveKeys(rs.db, batch, legacy, storePrefix(name), rs.legacyOverlaps(name))
+		batch.Delete(marker)
+		batch.WriteSync()
+	}
+}
+
+// legacyMigrationKey returns the key marking that the data of the named store
+// is being moved from its legacy prefix.
+func legacyMigrationKey(name string) []byte {
+	return []byte(legacyMigrationKeyPrefix + name)
+}
+
+// legacyOverlaps returns the legacy prefixes of the other mounted stores
+// which lie within the legacy prefix of the named store.
+func (rs *rootMultiStore) legacyOverlaps(name string) [][]byte {
+	legacy := legacyStorePrefix(name)
+	var others [][]byte
+	for other := range rs.keysByName {
+		otherLegacy := legacyStorePrefix(other)
+		if other != name && bytes.HasPrefix(otherLegacy, legacy) {
+			others = append(others, otherLegacy)
+		}
+	}
+	return others
+}
+
+// moveKeys adds the operations to move all keys with prefix from to prefix
+// to to the batch, leaving out keys with any of the skip prefixes.
+func moveKeys(db dbm.DB, batch dbm.Batch, from, to []byte, skip [][]byte) {
+	iter := dbm.IteratePrefix(db, from)
+	defer iter.Close()
+keys:
+	for ; iter.Valid(); iter.Next() {
+		k := iter.Key()
+		for _, prefix := range skip {
+			if bytes.HasPrefix(k, prefix) {
+				continue keys
+			}
+		}
+
+		newKey := make([]byte, 0, len(to)+len(k)-len(from))
+		newKey = append(append(newKey, to...), k[len(from):]...)
+		batch.Set(newKey, append([]byte{}, iter.Value()...))
+		batch.Delete(append([]byte{}, k...))
 	}
-	panic("Unknown name " + name)
+}
+
+// deleteKeys adds the operations to delete all keys with the prefix to the
+// batch, leaving out keys with any of the skip prefixes.
+func deleteKeys(db dbm.DB, batch dbm.Batch, prefix []byte, skip [][]byte) {
+	iter := dbm.IteratePrefix(db, prefix)
+	defer iter.Close()
+keys:
+	for ; iter.Valid(); iter.Next() {
+		k := iter.Key()
+		for _, skipped := range skip {
+			if bytes.HasPrefix(k, skipped) {
+				continue keys
+			}
+		}
+		batch.Delete(append([]byte{}, k...))
+	}
+}
+
+// hasPrefix returns whether db holds any key with the given prefix.
+func hasPrefix(db dbm.DB, prefix []byte) bool {
+	iter := dbm.IteratePrefix(db, prefix)
+	defer iter.Close()
+	return iter.Valid()
 }
 
 //----------------------------------------
@@ -382,6 +2269,9 @@ type storeParams struct {
 	key StoreKey
 	db  dbm.DB
 	typ StoreType
+
+	// substores are mounted on the nested store when typ is StoreTypeMulti.
+	substores []storeParams
 }
 
 //----------------------------------------
@@ -395,17 +2285,72 @@ type commitInfo struct {
 
 	// Store info for
 	StoreInfos []storeInfo
+
+	// hash memoizes Hash(). It is shared by all copies of the commitInfo,
+	// which is only sound because commitInfo is never mutated. It is nil
+	// for commitInfos not built by newCommitInfo or getCommitInfo.
+	hash *hashMemo
+
+	// hasher computes Hash(), nil for DefaultHasher.
+	hasher Hasher
+}
+
+type hashMemo struct {
+	once sync.Once
+	hash []byte
+}
+
+func newCommitInfo(version int64, storeInfos []storeInfo) commitInfo {
+	return commitInfo{
+		Version:    version,
+		StoreInfos: storeInfos,
+		hash:       &hashMemo{},
+	}
+}
+
+// withHasher returns a copy of the commitInfo hashed by the given hasher.
+func (ci commitInfo) withHasher(hasher Hasher) commitInfo {
+	ci.hasher = hasher
+	ci.hash = &hashMemo{}
+	return ci
 }
 
-// Hash returns the simple merkle root hash of the stores sorted by name.
+// Hash returns the root hash of the stores computed by the commitInfo's
+// hasher, by default the simple merkle root hash of the stores sorted by
+// name.
 func (ci commitInfo) Hash() []byte {
-	// TODO: cache to ci.hash []byte
+	if ci.hash == nil {
+		return ci.computeHash()
+	}
+	ci.hash.once.Do(func() {
+		ci.hash.hash = ci.computeHash()
+	})
+	return ci.hash.hash
+}
+
+func (ci commitInfo) computeHash() []byte {
+	hasher := ci.hasher
+	if hasher == nil {
+		hasher = DefaultHasher
+	}
+
 	m := make(map[string][]byte, len(ci.StoreInfos))
 	for _, storeInfo := range ci.StoreInfos {
-		m[storeInfo.Name] = storeInfo.Hash()
+		m[storeInfo.Name] = storeInfo.hashWith(hasher)
 	}
 
-	return merkle.SimpleHashFromMap(m)
+	return hasher.HashStores(m)
+}
+
+// nonZeroCount returns the number of stores with a non-zero CommitID.
+func (ci commitInfo) nonZeroCount() int {
+	n := 0
+	for _, storeInfo := range ci.StoreInfos {
+		if !storeInfo.Core.CommitID.IsZero() {
+			n++
+		}
+	}
+	return n
 }
 
 func (ci commitInfo) CommitID() CommitID {
@@ -424,28 +2369,57 @@ func (ci commitInfo) CommitID() CommitID {
 type storeInfo struct {
 	Name string
 	Core storeCore
+
+	// Type is the StoreType of the store. It is left out of the hash, so
+	// recording it doesn't change the commit hash, and appended last so
+	// that store infos persisted before it was added still decode.
+	Type storeTypeTag
 }
 
 type storeCore struct {
-	// StoreType StoreType
 	CommitID CommitID
 	// ... maybe add more state
 }
 
+// storeTypeTag is a persisted StoreType, offset by one so that the zero
+// value decoded from store infos persisted before the StoreType was recorded
+// is unknownStoreType rather than StoreTypeMulti.
+type storeTypeTag uint8
+
+// unknownStoreType is the storeTypeTag of stores persisted before the
+// StoreType was recorded. Their type is not checked on load.
+const unknownStoreType storeTypeTag = 0
+
+func newStoreTypeTag(typ StoreType) storeTypeTag {
+	return storeTypeTag(typ) + 1
+}
+
+// storeType returns the tagged StoreType, and false if it is unknown.
+func (tag storeTypeTag) storeType() (StoreType, bool) {
+	if tag == unknownStoreType {
+		return 0, false
+	}
+	return StoreType(tag - 1), true
+}
+
+func (tag storeTypeTag) String() string {
+	typ, ok := tag.storeType()
+	if !ok {
+		return "unknown"
+	}
+	return typ.String()
+}
+
 // Implements merkle.Hasher.
 func (si storeInfo) Hash() []byte {
+	return si.hashWith(DefaultHasher)
+}
+
+func (si storeInfo) hashWith(hasher Hasher) []byte {
 	// Doesn't write Name, since merkle.SimpleHashFromMap() will
 	// include them via the keys.
 	bz, _ := cdc.MarshalBinaryLengthPrefixed(si.Core)
-	hasher := tmhash.New()
-
-	_, err := hasher.Write(bz)
-	if err != nil {
-		// TODO: Handle with #870
-		panic(err)
-	}
-
-	return hasher.Sum(nil)
+	return hasher.HashStore(bz)
 }
 
 //----------------------------------------
@@ -472,14 +2446,58 @@ func setLatestVersion(batch dbm.Batch, version int64) {
 	batch.Set([]byte(latestVersionKey), latestBytes)
 }
 
-// Commits each store and returns a new commitInfo.
-func commitStores(version int64, storeMap map[StoreKey]CommitStore) commitInfo {
-	storeInfos := make([]storeInfo, 0, len(storeMap))
+// Commits each store not in skip and returns a new commitInfo, which records
+// the last commit ID of the skipped stores. Up to workers stores are
+// committed concurrently, a workers value of zero or less uses
+// runtime.GOMAXPROCS(0). The store infos are sorted by name, so the result
+// doesn't depend on the commit order.
+func commitStores(version int64, storeMap map[StoreKey]CommitStore, skip map[StoreKey]bool, workers int) (commitInfo, error) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	keys := make([]StoreKey, 0, len(storeMap))
+	for key := range storeMap {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Name() < keys[j].Name()
+	})
+
+	// Each worker only writes its own slots of commitIDs and errs.
+	commitIDs := make([]CommitID, len(keys))
+	errs := make([]error, len(keys))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(keys); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				store := storeMap[keys[i]]
+				if skip[keys[i]] {
+					commitIDs[i] = store.LastCommitID()
+					continue
+				}
+				commitIDs[i], errs[i] = commitStore(keys[i], store, version)
+			}
+		}()
+	}
+	for i := range keys {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
 
-	for key, store := range storeMap {
-		// Commit
-		commitID := store.Commit()
+	for _, err := range errs {
+		if err != nil {
+			return commitInfo{}, err
+		}
+	}
 
+	storeInfos := make([]storeInfo, 0, len(keys))
+	for i, key := range keys {
+		store := storeMap[key]
 		if store.GetStoreType() == sdk.StoreTypeTransient {
 			continue
 		}
@@ -487,41 +2505,183 @@ func commitStores(version int64, storeMap map[StoreKey]CommitStore) commitInfo {
 		// Record CommitID
 		si := storeInfo{}
 		si.Name = key.Name()
-		si.Core.CommitID = commitID
-		// si.Core.StoreType = store.GetStoreType()
+		si.Core.CommitID = commitIDs[i]
+		si.Type = newStoreTypeTag(store.GetStoreType())
 		storeInfos = append(storeInfos, si)
 	}
 
-	ci := commitInfo{
-		Version:    version,
-		StoreInfos: storeInfos,
+	return newCommitInfo(version, storeInfos), nil
+}
+
+// commitStore commits the store, recovering a panic into a StoreCommitError.
+func commitStore(key StoreKey, store CommitStore, version int64) (commitID CommitID, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &StoreCommitError{Store: key.Name(), Version: version, Panic: r}
+		}
+	}()
+	return store.Commit(), nil
+}
+
+// checkStoreInfosSorted returns an error naming the first pair of store
+// infos which are not strictly ordered by name.
+func checkStoreInfosSorted(storeInfos []storeInfo) error {
+	for i := 1; i < len(storeInfos); i++ {
+		if storeInfos[i-1].Name >= storeInfos[i].Name {
+			return fmt.Errorf("store info %q at %d is not ordered before %q",
+				storeInfos[i-1].Name, i-1, storeInfos[i].Name)
+		}
 	}
-	return ci
+	return nil
 }
 
 // Gets commitInfo from disk.
 func getCommitInfo(db dbm.DB, ver int64) (commitInfo, error) {
 
-	// Get from DB.
-	cInfoKey := fmt.Sprintf(commitInfoKeyFmt, ver)
-	cInfoBytes := db.Get([]byte(cInfoKey))
+	// Get from DB, falling back to the legacy key.
+	cInfoBytes := db.Get(commitInfoKey(ver))
 	if cInfoBytes == nil {
-		return commitInfo{}, fmt.Errorf("failed to get rootMultiStore: no data")
+		cInfoBytes = db.Get(legacyCommitInfoKey(ver))
+	}
+	if cInfoBytes == nil {
+		return commitInfo{}, errors.Wrap(ErrNoData, "failed to get rootMultiStore")
+	}
+	if len(cInfoBytes) == 0 {
+		err := errors.New("empty commit info")
+		return commitInfo{}, errors.Wrap(kindError{ErrCommitInfoDecode, err}, "failed to get rootMultiStore")
+	}
+	if cInfoBytes[0] == compressedCommitInfoPrefix {
+		var err error
+		cInfoBytes, err = snappy.Decode(nil, cInfoBytes[1:])
+		if err != nil {
+			return commitInfo{}, errors.Wrap(kindError{ErrCommitInfoDecode, err}, "failed to get rootMultiStore")
+		}
 	}
 
 	var cInfo commitInfo
 
 	err := cdc.UnmarshalBinaryLengthPrefixed(cInfoBytes, &cInfo)
 	if err != nil {
-		return commitInfo{}, fmt.Errorf("failed to get rootMultiStore: %v", err)
+		return commitInfo{}, errors.Wrap(kindError{ErrCommitInfoDecode, err}, "failed to get rootMultiStore")
 	}
+	cInfo.hash = &hashMemo{}
 
 	return cInfo, nil
 }
 
-// Set a commitInfo for given version.
-func setCommitInfo(batch dbm.Batch, version int64, cInfo commitInfo) {
+// CommitInfoJSON is the JSON representation of the commit info persisted for
+// a version, see DumpCommitInfo.
+type CommitInfoJSON struct {
+	Version int64           `json:"version"`
+	Hash    cmn.HexBytes    `json:"hash"`
+	Stores  []StoreInfoJSON `json:"stores"`
+}
+
+// StoreInfoJSON is the JSON representation of the commit of a store.
+type StoreInfoJSON struct {
+	Name      string       `json:"name"`
+	StoreType string       `json:"store_type"`
+	Version   int64        `json:"version"`
+	Hash      cmn.HexBytes `json:"hash"`
+}
+
+// DumpCommitInfo returns the commit info persisted in db for the given
+// version in a form which can be marshalled to JSON, along with the commit
+// hash computed from it. Diffing the dumps of two nodes at the same height
+// shows which store diverged.
+func DumpCommitInfo(db dbm.DB, version int64) (CommitInfoJSON, error) {
+	cInfo, err := getCommitInfo(db, version)
+	if err != nil {
+		return CommitInfoJSON{}, err
+	}
+
+	dump := CommitInfoJSON{
+		Version: cInfo.Version,
+		Hash:    cInfo.Hash(),
+		Stores:  make([]StoreInfoJSON, len(cInfo.StoreInfos)),
+	}
+	for i, si := range cInfo.StoreInfos {
+		dump.Stores[i] = StoreInfoJSON{
+			Name:      si.Name,
+			StoreType: si.Type.String(),
+			Version:   si.Core.CommitID.Version,
+			Hash:      si.Core.CommitID.Hash,
+		}
+	}
+	return dump, nil
+}
+
+// storeRename records that the store persisted as From was renamed To.
+type storeRename struct {
+	From string
+	To   string
+}
+
+func containsRename(renames []storeRename, rename storeRename) bool {
+	for _, r := range renames {
+		if r == rename {
+			return true
+		}
+	}
+	return false
+}
+
+// Gets the persisted store renames, in the order they were made.
+func getRenames(db dbm.DB) []storeRename {
+	bz := db.Get([]byte(renamesKey))
+	if bz == nil {
+		return nil
+	}
+
+	var renames []storeRename
+	cdc.MustUnmarshalBinaryLengthPrefixed(bz, &renames)
+	return renames
+}
+
+// Set the store renames, deleting them if there are none.
+func setRenames(batch dbm.Batch, renames []storeRename) {
+	if len(renames) == 0 {
+		batch.Delete([]byte(renamesKey))
+		return
+	}
+	batch.Set([]byte(renamesKey), cdc.MustMarshalBinaryLengthPrefixed(renames))
+}
+
+// Set a commitInfo for given version, compressed if compress is set.
+func setCommitInfo(batch dbm.Batch, version int64, cInfo commitInfo, compress bool) {
 	cInfoBytes := cdc.MustMarshalBinaryLengthPrefixed(cInfo)
-	cInfoKey := fmt.Sprintf(commitInfoKeyFmt, version)
-	batch.Set([]byte(cInfoKey), cInfoBytes)
+	if compress {
+		cInfoBytes = append([]byte{compressedCommitInfoPrefix}, snappy.Encode(nil, cInfoBytes)...)
+	}
+	batch.Set(commitInfoKey(version), cInfoBytes)
+}
+
+// commitInfoKey returns the key of the commit info of the version, under
+// which versions sort in numeric order.
+func commitInfoKey(version int64) []byte {
+	key := make([]byte, len(commitInfoKeyPrefix)+8)
+	copy(key, commitInfoKeyPrefix)
+	binary.BigEndian.PutUint64(key[len(commitInfoKeyPrefix):], uint64(version))
+	return key
+}
+
+// legacyCommitInfoKey returns the former key of the commit info of the
+// version.
+func legacyCommitInfoKey(version int64) []byte {
+	return []byte(fmt.Sprintf(legacyCommitInfoKeyFmt, version))
+}
+
+// iterateLegacyCommitInfos calls fn with the version, key and value of every
+// commit info stored under a legacy key.
+func iterateLegacyCommitInfos(db dbm.DB, fn func(ver int64, key, value []byte)) {
+	// Only legacy version keys sort between "s/0" and "s/:".
+	iter := db.Iterator([]byte("s/0"), []byte("s/:"))
+	defer iter.Close()
+	for ; iter.Valid(); iter.Next() {
+		ver, err := strconv.ParseInt(string(iter.Key()[len("s/"):]), 10, 64)
+		if err != nil {
+			continue
+		}
+		fn(ver, iter.Key(), iter.Value())
+	}
 }
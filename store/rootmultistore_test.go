@@ -1,12 +1,24 @@
 package store
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	abci "github.com/tendermint/tendermint/abci/types"
 	"github.com/tendermint/tendermint/crypto/merkle"
 	dbm "github.com/tendermint/tendermint/libs/db"
+	"github.com/tendermint/tendermint/libs/log"
 
 	sdk "github.com/cosmos/cosmos-sdk/types"
 )
@@ -34,6 +46,40 @@ func TestStoreMount(t *testing.T) {
 
 	require.Panics(t, func() { store.MountStoreWithDB(key1, sdk.StoreTypeIAVL, db) })
 	require.Panics(t, func() { store.MountStoreWithDB(dup1, sdk.StoreTypeIAVL, db) })
+
+	reserved := sdk.NewKVStoreKey(storeQueryRoute)
+	require.Panics(t, func() { store.MountStoreWithDB(reserved, sdk.StoreTypeIAVL, db) })
+}
+
+func TestMountedStoreKeys(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := NewCommitMultiStore(db)
+	store.MountStoreWithDB(sdk.NewKVStoreKey("store2"), sdk.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(sdk.NewTransientStoreKey("transient"), sdk.StoreTypeTransient, nil)
+	store.MountStoreWithDB(sdk.NewKVStoreKey("store1"), sdk.StoreTypeIAVL, nil)
+
+	checkMounted := func() {
+		keys := store.MountedStoreKeys()
+		require.Len(t, keys, 3)
+		require.Equal(t, "store1", keys[0].Name())
+		require.Equal(t, "store2", keys[1].Name())
+		require.Equal(t, "transient", keys[2].Name())
+
+		infos := store.StoreInfo()
+		require.Equal(t, map[string]StoreType{
+			"store1":    sdk.StoreTypeIAVL,
+			"store2":    sdk.StoreTypeIAVL,
+			"transient": sdk.StoreTypeTransient,
+		}, infos)
+
+		// Mutating the result must not affect the store.
+		delete(infos, "store1")
+		require.Len(t, store.StoreInfo(), 3)
+	}
+
+	checkMounted()
+	require.Nil(t, store.LoadLatestVersion())
+	checkMounted()
 }
 
 func TestMultistoreCommitLoad(t *testing.T) {
@@ -99,105 +145,2475 @@ func TestMultistoreCommitLoad(t *testing.T) {
 	checkStore(t, store, commitID, commitID)
 }
 
-func TestParsePath(t *testing.T) {
-	_, _, err := parsePath("foo")
+func TestMultistoreNestedCommitLoad(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithNestedMounts(db)
+	err := store.LoadLatestVersion()
+	require.Nil(t, err)
+
+	nested, ok := store.getStoreByName("nested").(*rootMultiStore)
+	require.True(t, ok)
+	require.Equal(t, sdk.StoreTypeMulti, nested.GetStoreType())
+
+	k, v := []byte("wind"), []byte("blows")
+	nested.getStoreByName("inner1").(KVStore).Set(k, v)
+
+	// Nested store commits in lockstep with its parent.
+	nCommits := int64(3)
+	var commitID CommitID
+	for i := int64(0); i < nCommits; i++ {
+		commitID = store.Commit()
+		expectedCommitID := getExpectedCommitID(store, i+1)
+		checkStore(t, store, expectedCommitID, commitID)
+		require.Equal(t, i+1, nested.LastCommitID().Version)
+	}
+
+	// The nested hash participates in the parent hash.
+	prevHash := commitID.Hash
+	nested.getStoreByName("inner2").(KVStore).Set(k, v)
+	commitID = store.Commit()
+	checkStore(t, store, getExpectedCommitID(store, nCommits+1), commitID)
+	require.NotEqual(t, prevHash, commitID.Hash)
+
+	// Reload and check the nested data survived.
+	store = newMultiStoreWithNestedMounts(db)
+	err = store.LoadLatestVersion()
+	require.Nil(t, err)
+	checkStore(t, store, commitID, store.LastCommitID())
+
+	nested = store.getStoreByName("nested").(*rootMultiStore)
+	require.Equal(t, v, nested.getStoreByName("inner1").(KVStore).Get(k))
+	require.Equal(t, v, nested.getStoreByName("inner2").(KVStore).Get(k))
+
+	// Queries recurse into the nested store.
+	query := abci.RequestQuery{Path: "/nested/inner1/key", Data: k, Height: commitID.Version, Prove: true}
+	qres := store.Query(query)
+	require.Equal(t, sdk.ToABCICode(sdk.CodespaceRoot, sdk.CodeOK), sdk.ABCICodeType(qres.Code))
+	require.Equal(t, v, qres.Value)
+	require.Len(t, qres.Proof.Ops, 3)
+
+	query.Path = "/nested/garbage/key"
+	qres = store.Query(query)
+	require.Equal(t, sdk.ToABCICode(sdk.CodespaceRoot, sdk.CodeUnknownRequest), sdk.ABCICodeType(qres.Code))
+}
+
+func TestMountSubStore(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := NewCommitMultiStore(db)
+
+	parent := sdk.NewKVStoreKey("nested")
+	leaf := sdk.NewKVStoreKey("leaf")
+	inner := sdk.NewKVStoreKey("inner")
+
+	store.MountStoreWithDB(parent, sdk.StoreTypeMulti, nil)
+	store.MountStoreWithDB(leaf, sdk.StoreTypeIAVL, nil)
+
+	require.NotPanics(t, func() { store.MountSubStore(parent, inner, sdk.StoreTypeIAVL) })
+	require.Panics(t, func() { store.MountSubStore(parent, inner, sdk.StoreTypeIAVL) })
+	require.Panics(t, func() { store.MountSubStore(leaf, sdk.NewKVStoreKey("x"), sdk.StoreTypeIAVL) })
+	require.Panics(t, func() { store.MountSubStore(sdk.NewKVStoreKey("missing"), sdk.NewKVStoreKey("y"), sdk.StoreTypeIAVL) })
+}
+
+func TestMultistoreLoadStoreTypeMismatch(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	err := store.LoadLatestVersion()
+	require.Nil(t, err)
+	store.Commit()
+
+	// Remount store1 with a different type.
+	store = NewCommitMultiStore(db)
+	store.MountStoreWithDB(sdk.NewKVStoreKey("store1"), sdk.StoreTypeMulti, nil)
+	store.MountStoreWithDB(sdk.NewKVStoreKey("store2"), sdk.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(sdk.NewKVStoreKey("store3"), sdk.StoreTypeIAVL, nil)
+	err = store.LoadLatestVersion()
 	require.Error(t, err)
+	require.Contains(t, err.Error(), "store type mismatch for store1")
 
-	store, subpath, err := parsePath("/foo")
-	require.NoError(t, err)
-	require.Equal(t, store, "foo")
-	require.Equal(t, subpath, "")
+	// Multi stores are checked too.
+	db = dbm.NewMemDB()
+	store = newMultiStoreWithNestedMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	store.Commit()
+	store = newMultiStoreWithMounts(db)
+	store.MountStoreWithDB(sdk.NewKVStoreKey("nested"), sdk.StoreTypeIAVL, nil)
+	err = store.LoadLatestVersion()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "store type mismatch for nested")
+}
 
-	store, subpath, err = parsePath("/fizz/bang/baz")
-	require.NoError(t, err)
-	require.Equal(t, store, "fizz")
-	require.Equal(t, subpath, "/bang/baz")
+// legacyStoreInfo is the storeInfo as persisted before the StoreType was
+// recorded.
+type legacyStoreInfo struct {
+	Name string
+	Core storeCore
+}
 
-	substore, subsubpath, err := parsePath(subpath)
-	require.NoError(t, err)
-	require.Equal(t, substore, "bang")
-	require.Equal(t, subsubpath, "/baz")
+type legacyCommitInfo struct {
+	Version    int64
+	StoreInfos []legacyStoreInfo
+}
+
+func TestMultistoreLoadLegacyStoreInfo(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	store.getStoreByName("store1").(KVStore).Set([]byte("key"), []byte("value"))
+	commitID := store.Commit()
 
+	// Rewrite the commit info in the format without StoreType.
+	cInfo, err := getCommitInfo(db, commitID.Version)
+	require.Nil(t, err)
+	legacy := legacyCommitInfo{Version: cInfo.Version}
+	for _, si := range cInfo.StoreInfos {
+		require.Equal(t, newStoreTypeTag(sdk.StoreTypeIAVL), si.Type)
+		legacy.StoreInfos = append(legacy.StoreInfos, legacyStoreInfo{Name: si.Name, Core: si.Core})
+	}
+	db.Set(commitInfoKey(commitID.Version), cdc.MustMarshalBinaryLengthPrefixed(legacy))
+
+	// The StoreType isn't hashed, so the commit hash is unchanged.
+	decoded, err := getCommitInfo(db, commitID.Version)
+	require.Nil(t, err)
+	require.Equal(t, commitID, decoded.CommitID())
+	require.Equal(t, len(cInfo.StoreInfos), len(decoded.StoreInfos))
+	for i, si := range decoded.StoreInfos {
+		require.Equal(t, cInfo.StoreInfos[i].Name, si.Name)
+		require.Equal(t, cInfo.StoreInfos[i].Core, si.Core)
+		require.Equal(t, unknownStoreType, si.Type)
+	}
+
+	// The unknown store types are not checked against the mounted ones.
+	store = newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	require.Equal(t, commitID, store.LastCommitID())
+	require.Equal(t, []byte("value"), store.getStoreByName("store1").(KVStore).Get([]byte("key")))
 }
 
-func TestMultiStoreQuery(t *testing.T) {
+func TestStoreTypeTag(t *testing.T) {
+	for _, typ := range []StoreType{sdk.StoreTypeMulti, sdk.StoreTypeDB, sdk.StoreTypeIAVL, sdk.StoreTypeTransient} {
+		tag := newStoreTypeTag(typ)
+		require.NotEqual(t, unknownStoreType, tag)
+		decoded, ok := tag.storeType()
+		require.True(t, ok)
+		require.Equal(t, typ, decoded)
+	}
+	_, ok := unknownStoreType.storeType()
+	require.False(t, ok)
+	require.Equal(t, "unknown", unknownStoreType.String())
+}
+
+func TestMultistoreLoadErrorKinds(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	store.Commit()
+
+	// Missing commit info.
+	err := newMultiStoreWithMounts(db).LoadVersion(2)
+	require.True(t, IsErrNoData(err))
+	require.False(t, IsErrCommitInfoDecode(err))
+	require.Equal(t, "failed to get rootMultiStore: no data", err.Error())
+
+	// Corrupted commit info, empty, plain and compressed.
+	for _, corrupted := range [][]byte{{}, {0x05, 0xff}, {compressedCommitInfoPrefix, 0xff, 0xff}} {
+		db.Set(commitInfoKey(1), corrupted)
+		err = newMultiStoreWithMounts(db).LoadVersion(1)
+		require.True(t, IsErrCommitInfoDecode(err))
+		require.False(t, IsErrNoData(err))
+		require.False(t, IsErrStoreLoad(err))
+	}
+
+	// Substore failing to load.
+	db = dbm.NewMemDB()
+	store = newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	store.Commit()
+	store = NewCommitMultiStore(db)
+	store.MountStoreWithDB(sdk.NewKVStoreKey("store1"), sdk.StoreTypeMulti, nil)
+	store.MountStoreWithDB(sdk.NewKVStoreKey("store2"), sdk.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(sdk.NewKVStoreKey("store3"), sdk.StoreTypeIAVL, nil)
+	err = store.LoadLatestVersion()
+	require.True(t, IsErrStoreLoad(err))
+	require.False(t, IsErrNoData(err))
+	require.Equal(t, "failed to load rootMultiStore: store type mismatch for store1: persisted StoreTypeIAVL, mounted StoreTypeMulti", err.Error())
+}
+
+func TestMultistoreRollbackToVersion(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	store.SetPruning(sdk.PruneNothing)
+	err := store.LoadLatestVersion()
+	require.Nil(t, err)
+
+	k := []byte("wind")
+	commitIDs := make([]CommitID, 0, 5)
+	for i := 0; i < 5; i++ {
+		store.getStoreByName("store1").(KVStore).Set(k, []byte{byte(i)})
+		commitIDs = append(commitIDs, store.Commit())
+	}
+
+	// Cannot roll forward.
+	err = store.RollbackToVersion(6)
+	require.Error(t, err)
+
+	err = store.RollbackToVersion(3)
+	require.Nil(t, err)
+	checkStore(t, store, commitIDs[2], store.LastCommitID())
+	require.Equal(t, int64(3), getLatestVersion(db))
+	require.Equal(t, []byte{byte(2)}, store.getStoreByName("store1").(KVStore).Get(k))
+
+	_, err = getCommitInfo(db, 4)
+	require.Error(t, err)
+	_, err = getCommitInfo(db, 5)
+	require.Error(t, err)
+
+	// Reloading picks up the rolled back version.
+	store = newMultiStoreWithMounts(db)
+	err = store.LoadLatestVersion()
+	require.Nil(t, err)
+	checkStore(t, store, commitIDs[2], store.LastCommitID())
+
+	// The rolled back versions can be committed again with different data.
+	store.SetPruning(sdk.PruneNothing)
+	store.getStoreByName("store1").(KVStore).Set(k, []byte("other"))
+	commitID := store.Commit()
+	require.Equal(t, int64(4), commitID.Version)
+	require.NotEqual(t, commitIDs[3].Hash, commitID.Hash)
+
+	expected := newMultiStoreWithMounts(dbm.NewMemDB())
+	require.Nil(t, expected.LoadLatestVersion())
+	for i := 0; i < 3; i++ {
+		expected.getStoreByName("store1").(KVStore).Set(k, []byte{byte(i)})
+		expected.Commit()
+	}
+	expected.getStoreByName("store1").(KVStore).Set(k, []byte("other"))
+	require.Equal(t, expected.Commit(), commitID)
+
+	store.getStoreByName("store1").(KVStore).Set(k, []byte("next"))
+	require.Equal(t, int64(5), store.Commit().Version)
+
+	store = newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	require.Equal(t, []byte("next"), store.getStoreByName("store1").(KVStore).Get(k))
+	require.Nil(t, store.LoadVersion(4))
+	require.Equal(t, commitID, store.LastCommitID())
+	require.Equal(t, []byte("other"), store.getStoreByName("store1").(KVStore).Get(k))
+}
+
+func TestMultistoreRollbackNestedStores(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithNestedMounts(db)
+	store.SetPruning(sdk.PruneNothing)
+	require.Nil(t, store.LoadLatestVersion())
+
+	k := []byte("wind")
+	inner := func(s *rootMultiStore) KVStore {
+		return s.getStoreByName("nested").(*rootMultiStore).getStoreByName("inner1").(KVStore)
+	}
+	var rolledBack CommitID
+	for i := 0; i < 4; i++ {
+		inner(store).Set(k, []byte{byte(i)})
+		store.getStoreByName("store2").(KVStore).Set(k, []byte{byte(i)})
+		commitID := store.Commit()
+		if i == 1 {
+			rolledBack = commitID
+		}
+	}
+
+	require.Nil(t, store.RollbackToVersion(2))
+	require.Equal(t, rolledBack, store.LastCommitID())
+	require.Equal(t, []byte{byte(1)}, inner(store).Get(k))
+
+	inner(store).Set(k, []byte("other"))
+	commitID := store.Commit()
+	require.Equal(t, int64(3), commitID.Version)
+
+	expected := newMultiStoreWithNestedMounts(dbm.NewMemDB())
+	require.Nil(t, expected.LoadLatestVersion())
+	for i := 0; i < 2; i++ {
+		inner(expected).Set(k, []byte{byte(i)})
+		expected.getStoreByName("store2").(KVStore).Set(k, []byte{byte(i)})
+		expected.Commit()
+	}
+	inner(expected).Set(k, []byte("other"))
+	require.Equal(t, expected.Commit(), commitID)
+}
+
+func TestMultistoreRollbackPrunedVersion(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	store.SetPruning(sdk.PruneEverything)
+	err := store.LoadLatestVersion()
+	require.Nil(t, err)
+
+	for i := 0; i < 5; i++ {
+		store.getStoreByName("store1").(KVStore).Set([]byte("key"), []byte{byte(i)})
+		store.Commit()
+	}
+
+	err = store.RollbackToVersion(3)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "earliest available version is 5")
+	require.Equal(t, int64(5), getLatestVersion(db))
+}
+
+type mockMetrics struct {
+	durations []time.Duration
+	counts    []int
+}
+
+func (m *mockMetrics) ObserveCommitDuration(d time.Duration) { m.durations = append(m.durations, d) }
+func (m *mockMetrics) ObserveStoreCount(n int)               { m.counts = append(m.counts, n) }
+
+func TestMultistoreCommitMetrics(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	err := store.LoadLatestVersion()
+	require.Nil(t, err)
+
+	// No metrics set.
+	store.Commit()
+
+	metrics := &mockMetrics{}
+	store.SetMetrics(metrics)
+	store.getStoreByName("store1").(KVStore).Set([]byte("key"), []byte("value"))
+	store.Commit()
+	store.Commit()
+	require.Len(t, metrics.durations, 2)
+	require.Equal(t, []int{3, 3}, metrics.counts)
+
+	store.SetMetrics(nil)
+	store.Commit()
+	require.Len(t, metrics.durations, 2)
+}
+
+func TestMultiStoreQueryStoreType(t *testing.T) {
 	db := dbm.NewMemDB()
 	multi := newMultiStoreWithMounts(db)
+	multi.MountStoreWithDB(sdk.NewTransientStoreKey("transient"), sdk.StoreTypeTransient, nil)
 	err := multi.LoadLatestVersion()
 	require.Nil(t, err)
+	multi.Commit()
 
-	k, v := []byte("wind"), []byte("blows")
-	k2, v2 := []byte("water"), []byte("flows")
-	// v3 := []byte("is cold")
+	cases := []struct {
+		path string
+		typ  StoreType
+	}{
+		{"/store/store1/type", sdk.StoreTypeIAVL},
+		{"/store/transient/type", sdk.StoreTypeTransient},
+	}
+	for _, tc := range cases {
+		qres := multi.Query(abci.RequestQuery{Path: tc.path})
+		require.Equal(t, sdk.ToABCICode(sdk.CodespaceRoot, sdk.CodeOK), sdk.ABCICodeType(qres.Code), tc.path)
 
-	cid := multi.Commit()
+		var typ StoreType
+		cdc.MustUnmarshalBinaryLengthPrefixed(qres.Value, &typ)
+		require.Equal(t, tc.typ, typ, tc.path)
+	}
 
-	// Make sure we can get by name.
-	garbage := multi.getStoreByName("bad-name")
-	require.Nil(t, garbage)
+	for _, path := range []string{"/store/garbage/type", "/store/store1/foo", "/store"} {
+		qres := multi.Query(abci.RequestQuery{Path: path})
+		require.Equal(t, sdk.ToABCICode(sdk.CodespaceRoot, sdk.CodeUnknownRequest), sdk.ABCICodeType(qres.Code), path)
+	}
+}
 
-	// Set and commit data in one store.
-	store1 := multi.getStoreByName("store1").(KVStore)
-	store1.Set(k, v)
+func TestMultistoreAvailableVersions(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	store.SetPruning(sdk.PruneNothing)
+	err := store.LoadLatestVersion()
+	require.Nil(t, err)
+	require.Empty(t, store.AvailableVersions())
 
-	// ... and another.
-	store2 := multi.getStoreByName("store2").(KVStore)
-	store2.Set(k2, v2)
+	for i := 0; i < 11; i++ {
+		store.Commit()
+	}
+	require.Equal(t, []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}, store.AvailableVersions())
 
-	// Commit the multistore.
-	cid = multi.Commit()
-	ver := cid.Version
+	store = newMultiStoreWithMounts(db)
+	store.SetPruning(sdk.PruneEverything)
+	err = store.LoadLatestVersion()
+	require.Nil(t, err)
+	store.Commit()
+	store.Commit()
 
-	// Reload multistore from database
-	multi = newMultiStoreWithMounts(db)
-	err = multi.LoadLatestVersion()
+	// Versions 11 and 12 were pruned by the later commits.
+	require.Equal(t, []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 13}, store.AvailableVersions())
+
+	// Loading a non-latest version when pruning everything fails clearly.
+	store = newMultiStoreWithMounts(db)
+	store.SetPruning(sdk.PruneEverything)
+	err = store.LoadVersion(5)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "only the latest version 13")
+	require.Nil(t, store.LoadVersion(13))
+}
+
+func TestGetKVStoreTraced(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	err := store.LoadLatestVersion()
 	require.Nil(t, err)
 
-	// Test bad path.
-	query := abci.RequestQuery{Path: "/key", Data: k, Height: ver}
-	qres := multi.Query(query)
-	require.Equal(t, sdk.ToABCICode(sdk.CodespaceRoot, sdk.CodeUnknownRequest), sdk.ABCICodeType(qres.Code))
+	key := store.keysByName["store1"]
+	var buf bytes.Buffer
+	traced := store.GetKVStoreTraced(key, &buf, TraceContext{"blockHeight": 64})
+	traced.Set([]byte("key"), []byte("value"))
+	require.Contains(t, buf.String(), `"operation":"write"`)
+	require.Contains(t, buf.String(), `"blockHeight":64`)
 
-	query.Path = "h897fy32890rf63296r92"
-	qres = multi.Query(query)
-	require.Equal(t, sdk.ToABCICode(sdk.CodespaceRoot, sdk.CodeUnknownRequest), sdk.ABCICodeType(qres.Code))
+	// Global tracing is left untouched.
+	require.False(t, store.TracingEnabled())
+	_, ok := store.GetKVStore(key).(*TraceKVStore)
+	require.False(t, ok)
+	require.Equal(t, []byte("value"), store.GetKVStore(key).Get([]byte("key")))
+}
 
-	// Test invalid store name.
-	query.Path = "/garbage/key"
-	qres = multi.Query(query)
-	require.Equal(t, sdk.ToABCICode(sdk.CodespaceRoot, sdk.CodeUnknownRequest), sdk.ABCICodeType(qres.Code))
+// committingStore commits the rootMultiStore before answering a query.
+func TestGetKVStoreWithGas(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	key := store.keysByName["store1"]
 
-	// Test valid query with data.
-	query.Path = "/store1/key"
-	qres = multi.Query(query)
-	require.Equal(t, sdk.ToABCICode(sdk.CodespaceRoot, sdk.CodeOK), sdk.ABCICodeType(qres.Code))
-	require.Equal(t, v, qres.Value)
+	meter := sdk.NewGasMeter(1000)
+	kv := store.GetKVStoreWithGas(key, meter, sdk.KVGasConfig())
+	kv.Set(keyFmt(1), valFmt(1))
+	require.Equal(t, valFmt(1), kv.Get(keyFmt(1)))
+	kv.Delete(keyFmt(1))
+	require.Equal(t, sdk.Gas(193), meter.GasConsumed())
 
-	// Test valid but empty query.
-	query.Path = "/store2/key"
-	query.Prove = true
-	qres = multi.Query(query)
-	require.Equal(t, sdk.ToABCICode(sdk.CodespaceRoot, sdk.CodeOK), sdk.ABCICodeType(qres.Code))
-	require.Nil(t, qres.Value)
+	// composes with tracing
+	var buf bytes.Buffer
+	store.WithTracer(&buf)
+	kv = store.GetKVStoreWithGas(key, sdk.NewGasMeter(1000), sdk.KVGasConfig())
+	kv.Set(keyFmt(1), valFmt(1))
+	require.NotZero(t, buf.Len())
 
-	// Test store2 data.
-	query.Data = k2
-	qres = multi.Query(query)
+	// running out of gas panics before touching the store
+	kv = store.GetKVStoreWithGas(key, sdk.NewGasMeter(10), sdk.KVGasConfig())
+	require.Panics(t, func() { kv.Set(keyFmt(2), valFmt(2)) })
+	require.False(t, store.GetKVStore(key).Has(keyFmt(2)))
+}
+
+type committingStore struct {
+	*iavlStore
+	rs *rootMultiStore
+}
+
+func (cs committingStore) Query(req abci.RequestQuery) abci.ResponseQuery {
+	cs.rs.Commit()
+	return cs.iavlStore.Query(req)
+}
+
+func TestMultiStoreQueryConcurrentCommit(t *testing.T) {
+	db := dbm.NewMemDB()
+	multi := newMultiStoreWithMounts(db)
+	err := multi.LoadLatestVersion()
+	require.Nil(t, err)
+
+	k, v := []byte("wind"), []byte("blows")
+	key := multi.keysByName["store1"]
+	multi.GetKVStore(key).Set(k, v)
+	multi.Commit()
+	cid := multi.Commit()
+	multi.GetKVStore(key).Set(k, []byte("calm"))
+
+	// A commit lands between choosing the height and fetching the proof.
+	multi.stores[key] = committingStore{multi.stores[key].(*iavlStore), multi}
+
+	query := abci.RequestQuery{Path: "/store1/key", Data: k, Prove: true}
+	qres := multi.Query(query)
 	require.Equal(t, sdk.ToABCICode(sdk.CodespaceRoot, sdk.CodeOK), sdk.ABCICodeType(qres.Code))
-	require.Equal(t, v2, qres.Value)
+	require.Equal(t, cid.Version-1, qres.Height)
+	require.Equal(t, v, qres.Value)
+
+	cInfo, err := getCommitInfo(db, qres.Height)
+	require.Nil(t, err)
+	prt := DefaultProofRuntime()
+	err = prt.VerifyValue(qres.Proof, cInfo.Hash(), "/store1/wind", v)
+	require.Nil(t, err)
 }
 
-//-----------------------------------------------------------------------
-// utils
+func TestMultistoreDeleteStore(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	err := store.LoadLatestVersion()
+	require.Nil(t, err)
 
-func newMultiStoreWithMounts(db dbm.DB) *rootMultiStore {
-	store := NewCommitMultiStore(db)
-	store.MountStoreWithDB(
-		sdk.NewKVStoreKey("store1"), sdk.StoreTypeIAVL, nil)
-	store.MountStoreWithDB(
-		sdk.NewKVStoreKey("store2"), sdk.StoreTypeIAVL, nil)
-	store.MountStoreWithDB(
-		sdk.NewKVStoreKey("store3"), sdk.StoreTypeIAVL, nil)
+	key2 := store.keysByName["store2"]
+	store.GetKVStore(key2).Set([]byte("key"), []byte("value"))
+	store.Commit()
+	var buf bytes.Buffer
+	require.Nil(t, store.SetWriteListener(key2, &buf))
+	require.Nil(t, store.SetMaxValueSize(key2, 10))
+	store.SetReadOnly(key2)
+	// data left under the legacy prefix by an older release
+	db.Set(append(legacyStorePrefix("store2"), "key"...), []byte("value"))
+
+	err = store.DeleteStore(key2)
+	require.Nil(t, err)
+	requireStoreDeleted(t, store, key2)
+
+	// Deleting again is a no-op as the store is no longer mounted.
+	before := collectKVs(db.Iterator(nil, nil))
+	err = store.DeleteStore(key2)
+	require.Nil(t, err)
+	err = store.DeleteStore(sdk.NewKVStoreKey("store2"))
+	require.Nil(t, err)
+	require.Equal(t, before, collectKVs(db.Iterator(nil, nil)))
+	requireStoreDeleted(t, store, key2)
+
+	// The store's data is gone.
+	iter := dbm.IteratePrefix(db, storePrefix("store2"))
+	require.False(t, iter.Valid())
+	iter.Close()
+
+	// Commits no longer include the store.
+	commitID := store.Commit()
+	cInfo, err := getCommitInfo(db, commitID.Version)
+	require.Nil(t, err)
+	require.Len(t, cInfo.StoreInfos, 2)
+	for _, si := range cInfo.StoreInfos {
+		require.NotEqual(t, "store2", si.Name)
+	}
+	checkStore(t, store, getExpectedCommitID(store, commitID.Version), commitID)
+
+	// Older versions still including the store can be loaded without it.
+	store = NewCommitMultiStore(db)
+	store.MountStoreWithDB(sdk.NewKVStoreKey("store1"), sdk.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(sdk.NewKVStoreKey("store3"), sdk.StoreTypeIAVL, nil)
+	err = store.LoadVersion(commitID.Version - 1)
+	require.Nil(t, err)
+}
+
+func TestMultistoreDeleteStoreLegacyOverlap(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := NewCommitMultiStore(db)
+	keyA := sdk.NewKVStoreKey("a")
+	keyAB := sdk.NewKVStoreKey("a/b")
+	store.MountStoreWithDB(keyA, sdk.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(keyAB, sdk.StoreTypeIAVL, nil)
+	require.Nil(t, store.LoadLatestVersion())
+	db.Set(append(legacyStorePrefix("a"), "key"...), []byte("value"))
+	db.Set(append(legacyStorePrefix("a/b"), "key"...), []byte("value"))
+
+	// the legacy data of a/b lies within the legacy prefix of a, and stays
+	require.Nil(t, store.DeleteStore(keyA))
+	require.Nil(t, db.Get(append(legacyStorePrefix("a"), "key"...)))
+	require.Equal(t, []byte("value"), db.Get(append(legacyStorePrefix("a/b"), "key"...)))
+}
+
+func TestMultistoreDeleteRenamedStore(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	store.GetKVStore(store.keysByName["store2"]).Set([]byte("key"), []byte("value"))
+	store.Commit()
+
+	reg := sdk.NewStoreKeyRegistry()
+	store = NewCommitMultiStore(db)
+	store.SetKeyRegistry(reg)
+	key := sdk.NewNamespacedKVStoreKey("renamed", 0x01)
+	store.MountStoreWithDB(sdk.NewKVStoreKey("store1"), sdk.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(key, sdk.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(sdk.NewKVStoreKey("store3"), sdk.StoreTypeIAVL, nil)
+	require.Nil(t, store.LoadVersionWithRenames(1, map[string]string{"store2": "renamed"}))
+	require.NotNil(t, db.Get([]byte(renamesKey)))
+
+	require.Nil(t, store.DeleteStore(key))
+	requireStoreDeleted(t, store, key)
+	require.Nil(t, db.Get([]byte(renamesKey)))
+	_, claimed := reg.Owner(0x01)
+	require.False(t, claimed)
+
+	// another module may claim the freed module ID
+	store.MountStoreWithDB(sdk.NewNamespacedKVStoreKey("gov", 0x01), sdk.StoreTypeIAVL, nil)
+}
+
+func TestDeleteAllKeys(t *testing.T) {
+	for _, flushEvery := range []int{1, 7, 100, 1000} {
+		db := dbm.NewMemDB()
+		for i := 0; i < 100; i++ {
+			db.Set(keyFmt(i), valFmt(i))
+		}
+		other := dbm.NewPrefixDB(db, []byte("other/"))
+		other.Set([]byte("key"), []byte("value"))
+
+		deleteAllKeys(dbm.NewPrefixDB(db, []byte("key")), flushEvery)
+		iter := db.Iterator(nil, nil)
+		require.Equal(t, []byte("other/key"), iter.Key())
+		iter.Next()
+		require.False(t, iter.Valid())
+		iter.Close()
+	}
+}
+
+// requireStoreDeleted checks that nothing of the deleted store of key remains
+// in the multistore or its db.
+func requireStoreDeleted(t *testing.T, store *rootMultiStore, key StoreKey) {
+	require.NotContains(t, store.storesParams, key)
+	require.NotContains(t, store.stores, key)
+	require.NotContains(t, store.keysByName, key.Name())
+	require.NotContains(t, store.listeners, key)
+	require.NotContains(t, store.readOnly, key)
+	require.NotContains(t, store.maxValueSizes, key)
+	require.False(t, hasPrefix(store.db, storePrefix(key.Name())))
+	require.False(t, hasPrefix(store.db, legacyStorePrefix(key.Name())))
+	for _, rename := range getRenames(store.db) {
+		require.NotEqual(t, key.Name(), rename.From)
+		require.NotEqual(t, key.Name(), rename.To)
+	}
+}
+
+func TestMultistoreStorePrefixCollision(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := NewCommitMultiStore(db)
+	keyA := sdk.NewKVStoreKey("a")
+	keyAB := sdk.NewKVStoreKey("a/b")
+	store.MountStoreWithDB(keyA, sdk.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(keyAB, sdk.StoreTypeIAVL, nil)
+	require.Nil(t, store.LoadLatestVersion())
+
+	// the prefixes don't overlap
+	require.False(t, bytes.HasPrefix(storePrefix("a/b"), storePrefix("a")))
+
+	store.GetKVStore(keyA).Set([]byte("k"), []byte("a"))
+	store.GetKVStore(keyAB).Set([]byte("k"), []byte("ab"))
+	commitID := store.Commit()
+
+	// deleting one store leaves the other intact
+	require.Nil(t, store.DeleteStore(keyAB))
+	store = NewCommitMultiStore(db)
+	store.MountStoreWithDB(sdk.NewKVStoreKey("a"), sdk.StoreTypeIAVL, nil)
+	require.Nil(t, store.LoadVersion(commitID.Version))
+	require.Equal(t, []byte("a"), store.getStoreByName("a").(KVStore).Get([]byte("k")))
+}
+
+func TestMultistoreLegacyPrefixMigration(t *testing.T) {
+	db := dbm.NewMemDB()
+	newStore := func() *rootMultiStore {
+		store := NewCommitMultiStore(db)
+		store.MountStoreWithDB(sdk.NewKVStoreKey("a"), sdk.StoreTypeIAVL, nil)
+		store.MountStoreWithDB(sdk.NewKVStoreKey("a/b"), sdk.StoreTypeIAVL, nil)
+		return store
+	}
+	// Persist stores under the legacy prefixes.
+	var storeInfos []storeInfo
+	for _, name := range []string{"a", "a/b"} {
+		st, err := LoadIAVLStore(dbm.NewPrefixDB(db, legacyStorePrefix(name)), CommitID{}, sdk.PruneNothing)
+		require.Nil(t, err)
+		st.(KVStore).Set([]byte("k"), []byte(name))
+		si := storeInfo{Name: name}
+		si.Type = newStoreTypeTag(sdk.StoreTypeIAVL)
+		si.Core.CommitID = st.Commit()
+		storeInfos = append(storeInfos, si)
+	}
+	cInfo := newCommitInfo(1, storeInfos)
+	batch := db.NewBatch()
+	setCommitInfo(batch, 1, cInfo, false)
+	setLatestVersion(batch, 1)
+	batch.Write()
+	commitID := cInfo.CommitID()
+
+	// Interrupt the migration of a after moving one of its keys.
+	db.Set(legacyMigrationKey("a"), []byte{})
+	iter := dbm.IteratePrefix(db, legacyStorePrefix("a"))
+	for bytes.HasPrefix(iter.Key(), legacyStorePrefix("a/b")) {
+		iter.Next()
+	}
+	k, v := cp(iter.Key()), cp(iter.Value())
+	iter.Close()
+	db.Set(append(storePrefix("a"), k[len(legacyStorePrefix("a")):]...), v)
+	db.Delete(k)
+
+	// Loading migrates both stores to the new prefix, resuming that of a.
+	store := newStore()
+	require.Nil(t, store.LoadLatestVersion())
+	require.Equal(t, commitID, store.LastCommitID())
+	require.Equal(t, []byte("a"), store.getStoreByName("a").(KVStore).Get([]byte("k")))
+	require.Equal(t, []byte("a/b"), store.getStoreByName("a/b").(KVStore).Get([]byte("k")))
+	require.False(t, hasPrefix(db, []byte("s/k:")))
+	require.False(t, hasPrefix(db, []byte(legacyMigrationKeyPrefix)))
+
+	// Loading again is a no-op.
+	store = newStore()
+	require.Nil(t, store.LoadLatestVersion())
+	require.Equal(t, commitID, store.LastCommitID())
+}
+
+func TestMultistoreLoadVersionWithRenames(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	store.getStoreByName("store2").(KVStore).Set([]byte("key"), []byte("value"))
+	commitID := store.Commit()
+
+	newStore := func() *rootMultiStore {
+		store := NewCommitMultiStore(db)
+		store.MountStoreWithDB(sdk.NewKVStoreKey("store1"), sdk.StoreTypeIAVL, nil)
+		store.MountStoreWithDB(sdk.NewKVStoreKey("renamed"), sdk.StoreTypeIAVL, nil)
+		store.MountStoreWithDB(sdk.NewKVStoreKey("store3"), sdk.StoreTypeIAVL, nil)
+		return store
+	}
+
+	// invalid renames
+	store = newStore()
+	require.Error(t, store.LoadVersionWithRenames(1, map[string]string{"store2": "unmounted"}))
+	require.Error(t, store.LoadVersionWithRenames(1, map[string]string{"store1": "renamed"}))
+	require.Error(t, store.LoadVersionWithRenames(1, map[string]string{"unknown": "renamed"}))
+	require.Error(t, store.LoadVersionWithRenames(1, map[string]string{"store2": "store3"}))
+
+	// the renamed store holds the data, the commit hash is unchanged
+	require.Nil(t, store.LoadVersionWithRenames(1, map[string]string{"store2": "renamed"}))
+	require.Equal(t, commitID, store.LastCommitID())
+	renamed := store.getStoreByName("renamed").(KVStore)
+	require.Equal(t, []byte("value"), renamed.Get([]byte("key")))
+	require.False(t, hasPrefix(db, storePrefix("store2")))
+
+	// the next commit is under the new name
+	renamed.Set([]byte("key2"), []byte("value2"))
+	commitID = store.Commit()
+	cInfo, err := getCommitInfo(db, commitID.Version)
+	require.Nil(t, err)
+	require.Equal(t, "renamed", cInfo.StoreInfos[0].Name)
+
+	// the rename is persisted, so the old version still loads
+	store = newStore()
+	require.Nil(t, store.LoadVersion(1))
+	renamed = store.getStoreByName("renamed").(KVStore)
+	require.Equal(t, []byte("value"), renamed.Get([]byte("key")))
+	require.Nil(t, renamed.Get([]byte("key2")))
+
+	store = newStore()
+	require.Nil(t, store.LoadLatestVersion())
+	require.Equal(t, commitID, store.LastCommitID())
+}
+
+func TestMultistoreLoadVersionWithRenamesResumes(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	for i := 0; i < 10; i++ {
+		store.getStoreByName("store2").(KVStore).Set(keyFmt(i), valFmt(i))
+	}
+	commitID := store.Commit()
+
+	newStore := func() *rootMultiStore {
+		store := NewCommitMultiStore(db)
+		store.MountStoreWithDB(sdk.NewKVStoreKey("store1"), sdk.StoreTypeIAVL, nil)
+		store.MountStoreWithDB(sdk.NewKVStoreKey("renamed"), sdk.StoreTypeIAVL, nil)
+		store.MountStoreWithDB(sdk.NewKVStoreKey("store3"), sdk.StoreTypeIAVL, nil)
+		return store
+	}
+
+	// Interrupt the move after its first batch.
+	db.Set(renameMigrationKey("renamed"), []byte("store2"))
+	batch := db.NewBatch()
+	iter := dbm.IteratePrefix(db, storePrefix("store2"))
+	for i := 0; iter.Valid() && i < 3; iter.Next() {
+		batch.Set(append(storePrefix("renamed"), iter.Key()[len(storePrefix("store2")):]...), iter.Value())
+		batch.Delete(cp(iter.Key()))
+		i++
+	}
+	iter.Close()
+	batch.Write()
+	require.True(t, hasPrefix(db, storePrefix("store2")))
+
+	// Loading without renames completes the move and persists the rename.
+	store = newStore()
+	require.Nil(t, store.LoadLatestVersion())
+	require.Equal(t, commitID, store.LastCommitID())
+	require.False(t, hasPrefix(db, storePrefix("store2")))
+	require.False(t, hasPrefix(db, []byte(renameMigrationKeyPrefix)))
+	require.Equal(t, []storeRename{{From: "store2", To: "renamed"}}, getRenames(db))
+	for i := 0; i < 10; i++ {
+		require.Equal(t, valFmt(i), store.getStoreByName("renamed").(KVStore).Get(keyFmt(i)))
+	}
+
+	// Applying the rename again is a no-op.
+	store = newStore()
+	require.Nil(t, store.LoadVersionWithRenames(1, map[string]string{"store2": "renamed"}))
+	require.Equal(t, commitID, store.LastCommitID())
+	require.Equal(t, []storeRename{{From: "store2", To: "renamed"}}, getRenames(db))
+}
+
+func TestMultistoreIterateAllStores(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithNestedMounts(db)
+	store.MountStoreWithDB(sdk.NewTransientStoreKey("transient"), sdk.StoreTypeTransient, nil)
+	require.Nil(t, store.LoadLatestVersion())
+
+	store.getStoreByName("store2").(KVStore).Set([]byte("key"), []byte("value"))
+	nested := store.getStoreByName("nested").(*rootMultiStore)
+	nested.getStoreByName("inner1").(KVStore).Set([]byte("key"), []byte("inner"))
+	store.Commit()
+
+	// uncommitted writes are not visible
+	store.getStoreByName("store2").(KVStore).Set([]byte("key2"), []byte("value2"))
+
+	var names []string
+	values := make(map[string][]byte)
+	store.IterateAllStores(func(name string, kv KVStore) bool {
+		names = append(names, name)
+		iter := kv.Iterator(nil, nil)
+		for ; iter.Valid(); iter.Next() {
+			values[name+":"+string(iter.Key())] = iter.Value()
+		}
+		iter.Close()
+		require.Panics(t, func() { kv.Set([]byte("key"), []byte("value")) })
+		return false
+	})
+	require.Equal(t, []string{"nested/inner1", "nested/inner2", "store1", "store2", "store3"}, names)
+	require.Equal(t, map[string][]byte{
+		"nested/inner1:key": []byte("inner"),
+		"store2:key":        []byte("value"),
+	}, values)
+
+	// iteration stops when fn returns true
+	names = nil
+	store.IterateAllStores(func(name string, kv KVStore) bool {
+		names = append(names, name)
+		return name == "nested/inner2"
+	})
+	require.Equal(t, []string{"nested/inner1", "nested/inner2"}, names)
+}
+
+func TestMultistoreCommitConcurrency(t *testing.T) {
+	serial := newMultiStoreWithMounts(dbm.NewMemDB())
+	serial.SetCommitConcurrency(1)
+	require.Nil(t, serial.LoadLatestVersion())
+
+	parallel := newMultiStoreWithMounts(dbm.NewMemDB())
+	parallel.SetCommitConcurrency(3)
+	require.Nil(t, parallel.LoadLatestVersion())
+
+	for i := 0; i < 5; i++ {
+		for _, ms := range []*rootMultiStore{serial, parallel} {
+			for _, name := range []string{"store1", "store2", "store3"} {
+				ms.getStoreByName(name).(KVStore).Set(keyFmt(i), valFmt(i))
+			}
+		}
+		require.Equal(t, serial.Commit(), parallel.Commit())
+	}
+
+	// store infos are persisted in name order
+	cInfo, err := getCommitInfo(parallel.db, 5)
+	require.Nil(t, err)
+	require.Equal(t, "store1", cInfo.StoreInfos[0].Name)
+	require.Equal(t, "store2", cInfo.StoreInfos[1].Name)
+	require.Equal(t, "store3", cInfo.StoreInfos[2].Name)
+}
+
+func TestMultistoreComputeCommitHash(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithNestedMounts(db)
+	store.MountStoreWithDB(sdk.NewTransientStoreKey("transient"), sdk.StoreTypeTransient, nil)
+	require.Nil(t, store.LoadLatestVersion())
+
+	for i := 0; i < 3; i++ {
+		store.getStoreByName("store1").(KVStore).Set(keyFmt(i), valFmt(i))
+		store.getStoreByName("transient").(KVStore).Set(keyFmt(i), valFmt(i))
+		nested := store.getStoreByName("nested").(*rootMultiStore)
+		nested.getStoreByName("inner1").(KVStore).Set(keyFmt(i), valFmt(i))
+
+		lastCommitID := store.LastCommitID()
+		hash, err := store.ComputeCommitHash()
+		require.Nil(t, err)
+		require.Equal(t, lastCommitID, store.LastCommitID())
+
+		// computing again gives the same hash
+		hash2, err := store.ComputeCommitHash()
+		require.Nil(t, err)
+		require.Equal(t, hash, hash2)
+
+		commitID := store.Commit()
+		require.Equal(t, hash, commitID.Hash)
+	}
+
+	// a store without a working hash can't be computed
+	other, err := LoadIAVLStore(dbm.NewMemDB(), CommitID{}, sdk.PruneNothing)
+	require.Nil(t, err)
+	store.stores[sdk.NewKVStoreKey("other")] = struct{ CommitStore }{other}
+	_, err = store.ComputeCommitHash()
+	require.NotNil(t, err)
+}
+
+func TestCommitInfoHashMemo(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	store.getStoreByName("store1").(KVStore).Set([]byte("key"), []byte("value"))
+	commitID := store.Commit()
+
+	cInfo, err := getCommitInfo(db, commitID.Version)
+	require.Nil(t, err)
+	require.Equal(t, commitID.Hash, cInfo.Hash())
+	require.Equal(t, commitID.Hash, cInfo.Hash())
+	require.Equal(t, cInfo.computeHash(), cInfo.Hash())
+
+	// the memo isn't persisted
+	bz := cdc.MustMarshalBinaryLengthPrefixed(cInfo)
+	var decoded commitInfo
+	cdc.MustUnmarshalBinaryLengthPrefixed(bz, &decoded)
+	require.Nil(t, decoded.hash)
+	require.Equal(t, commitID.Hash, decoded.Hash())
+}
+
+func TestParsePath(t *testing.T) {
+	_, _, err := parsePath("foo")
+	require.Error(t, err)
+
+	store, subpath, err := parsePath("/foo")
+	require.NoError(t, err)
+	require.Equal(t, store, "foo")
+	require.Equal(t, subpath, "")
+
+	store, subpath, err = parsePath("/fizz/bang/baz")
+	require.NoError(t, err)
+	require.Equal(t, store, "fizz")
+	require.Equal(t, subpath, "/bang/baz")
+
+	substore, subsubpath, err := parsePath(subpath)
+	require.NoError(t, err)
+	require.Equal(t, substore, "bang")
+	require.Equal(t, subsubpath, "/baz")
+
+}
+
+func TestMultiStoreQuery(t *testing.T) {
+	db := dbm.NewMemDB()
+	multi := newMultiStoreWithMounts(db)
+	err := multi.LoadLatestVersion()
+	require.Nil(t, err)
+
+	k, v := []byte("wind"), []byte("blows")
+	k2, v2 := []byte("water"), []byte("flows")
+	// v3 := []byte("is cold")
+
+	cid := multi.Commit()
+
+	// Make sure we can get by name.
+	garbage := multi.getStoreByName("bad-name")
+	require.Nil(t, garbage)
+
+	// Set and commit data in one store.
+	store1 := multi.getStoreByName("store1").(KVStore)
+	store1.Set(k, v)
+
+	// ... and another.
+	store2 := multi.getStoreByName("store2").(KVStore)
+	store2.Set(k2, v2)
+
+	// Commit the multistore.
+	cid = multi.Commit()
+	ver := cid.Version
+
+	// Reload multistore from database
+	multi = newMultiStoreWithMounts(db)
+	err = multi.LoadLatestVersion()
+	require.Nil(t, err)
+
+	// Test bad path.
+	query := abci.RequestQuery{Path: "/key", Data: k, Height: ver}
+	qres := multi.Query(query)
+	require.Equal(t, sdk.ToABCICode(sdk.CodespaceRoot, sdk.CodeUnknownRequest), sdk.ABCICodeType(qres.Code))
+
+	query.Path = "h897fy32890rf63296r92"
+	qres = multi.Query(query)
+	require.Equal(t, sdk.ToABCICode(sdk.CodespaceRoot, sdk.CodeUnknownRequest), sdk.ABCICodeType(qres.Code))
+
+	// Test invalid store name.
+	query.Path = "/garbage/key"
+	qres = multi.Query(query)
+	require.Equal(t, sdk.ToABCICode(sdk.CodespaceRoot, sdk.CodeUnknownRequest), sdk.ABCICodeType(qres.Code))
+
+	// Test valid query with data.
+	query.Path = "/store1/key"
+	qres = multi.Query(query)
+	require.Equal(t, sdk.ToABCICode(sdk.CodespaceRoot, sdk.CodeOK), sdk.ABCICodeType(qres.Code))
+	require.Equal(t, v, qres.Value)
+
+	// Test valid but empty query.
+	query.Path = "/store2/key"
+	query.Prove = true
+	qres = multi.Query(query)
+	require.Equal(t, sdk.ToABCICode(sdk.CodespaceRoot, sdk.CodeOK), sdk.ABCICodeType(qres.Code))
+	require.Nil(t, qres.Value)
+
+	// Test store2 data.
+	query.Data = k2
+	qres = multi.Query(query)
+	require.Equal(t, sdk.ToABCICode(sdk.CodespaceRoot, sdk.CodeOK), sdk.ABCICodeType(qres.Code))
+	require.Equal(t, v2, qres.Value)
+}
+
+func TestMultistoreCommitBatchWindow(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	require.Nil(t, store.SetCommitBatchWindow(3))
+
+	commitIDs := make([]CommitID, 4)
+	for i := 0; i < 4; i++ {
+		store.getStoreByName("store1").(KVStore).Set(keyFmt(i), valFmt(i))
+		commitIDs[i] = store.Commit()
+		require.Equal(t, int64(i+1), store.LastCommitID().Version)
+
+		// the latest version only advances once the window is written
+		if i < 2 {
+			require.Equal(t, int64(0), getLatestVersion(db))
+		} else {
+			require.Equal(t, int64(3), getLatestVersion(db))
+		}
+	}
+
+	// the buffered version is served from memory, with proofs
+	cInfo, err := store.getCommitInfo(4)
+	require.Nil(t, err)
+	require.Equal(t, commitIDs[3], cInfo.CommitID())
+	query := abci.RequestQuery{Path: "/store1/key", Data: keyFmt(3), Height: 4, Prove: true}
+	qres := store.Query(query)
+	require.Equal(t, sdk.ToABCICode(sdk.CodespaceRoot, sdk.CodeOK), sdk.ABCICodeType(qres.Code))
+	require.Equal(t, valFmt(3), qres.Value)
+	prt := DefaultProofRuntime()
+	require.Nil(t, prt.VerifyValue(qres.Proof, cInfo.Hash(), "/store1/"+string(keyFmt(3)), valFmt(3)))
+	require.Equal(t, int64(3), store.defaultQueryHeight())
+
+	// a crash before the window is written recovers to the last written
+	// version, and replaying the block gives the same commit
+	recovered := newMultiStoreWithMounts(db)
+	require.Nil(t, recovered.LoadLatestVersion())
+	require.Equal(t, commitIDs[2], recovered.LastCommitID())
+	recovered.getStoreByName("store1").(KVStore).Set(keyFmt(3), valFmt(3))
+	require.Equal(t, commitIDs[3], recovered.Commit())
+
+	store.FlushPending()
+	require.Equal(t, int64(4), getLatestVersion(db))
+	cInfo, err = getCommitInfo(db, 4)
+	require.Nil(t, err)
+	require.Equal(t, commitIDs[3], cInfo.CommitID())
+
+	// disabling the window writes every commit right away
+	require.Nil(t, store.SetCommitBatchWindow(0))
+	store.Commit()
+	require.Equal(t, int64(5), getLatestVersion(db))
+}
+
+func TestMultistoreCommitBatchWindowReplayDiffers(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	require.Nil(t, store.SetCommitBatchWindow(3))
+	var lastWritten CommitID
+	for i := 0; i < 5; i++ {
+		store.getStoreByName("store1").(KVStore).Set(keyFmt(i), valFmt(i))
+		store.getStoreByName("store2").(KVStore).Set(keyFmt(i), valFmt(i))
+		cid := store.Commit()
+		if i == 2 {
+			lastWritten = cid
+		}
+	}
+	require.Equal(t, int64(3), getLatestVersion(db))
+
+	// After a crash, the substores are ahead of the last written version,
+	// and replaying the lost blocks with other results still commits.
+	recovered := newMultiStoreWithMounts(db)
+	require.Nil(t, recovered.LoadLatestVersion())
+	require.Equal(t, lastWritten, recovered.LastCommitID())
+	for i := 3; i < 5; i++ {
+		recovered.getStoreByName("store1").(KVStore).Set(keyFmt(i), valFmt(i*10))
+		cid := recovered.Commit()
+		require.Equal(t, int64(i+1), cid.Version)
+	}
+	require.Equal(t, valFmt(40), recovered.getStoreByName("store1").(KVStore).Get(keyFmt(4)))
+	require.Nil(t, recovered.getStoreByName("store2").(KVStore).Get(keyFmt(4)))
+
+	// the replayed versions reload
+	reloaded := newMultiStoreWithMounts(db)
+	require.Nil(t, reloaded.LoadLatestVersion())
+	require.Equal(t, recovered.LastCommitID(), reloaded.LastCommitID())
+	require.Equal(t, valFmt(40), reloaded.getStoreByName("store1").(KVStore).Get(keyFmt(4)))
+}
+
+func TestMultistoreCommitBatchWindowRejectsOtherStores(t *testing.T) {
+	store := newMultiStoreWithNestedMounts(dbm.NewMemDB())
+	require.NotNil(t, store.SetCommitBatchWindow(3))
+	require.Equal(t, 0, store.commitBatchWindow)
+	require.Nil(t, store.SetCommitBatchWindow(1))
+}
+
+func TestMultistoreLoadRecovery(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	var commitIDs []CommitID
+	for i := 0; i < 3; i++ {
+		store.getStoreByName("store1").(KVStore).Set(keyFmt(i), valFmt(i))
+		commitIDs = append(commitIDs, store.Commit())
+	}
+
+	// Lose the commit info of the latest version and corrupt the one before.
+	db.Delete(commitInfoKey(3))
+	db.Set(commitInfoKey(2), []byte{0x05, 0xff})
+	require.Equal(t, int64(3), getLatestVersion(db))
+
+	// Loading fails by default, naming the consistent version.
+	store = newMultiStoreWithMounts(db)
+	err := store.LoadLatestVersion()
+	require.True(t, IsErrNoData(err))
+	require.Contains(t, err.Error(), "the highest consistent version is 1")
+
+	var buf bytes.Buffer
+	store = newMultiStoreWithMounts(db)
+	store.SetLoadRecovery(log.NewTMLogger(&buf), false)
+	require.Error(t, store.LoadLatestVersion())
+	require.Contains(t, buf.String(), "consistent=1")
+
+	// With fallback, the consistent version is loaded and committing on
+	// top of it moves the latest version back.
+	store = newMultiStoreWithMounts(db)
+	store.SetLoadRecovery(nil, true)
+	require.Nil(t, store.LoadLatestVersion())
+	require.Equal(t, commitIDs[0], store.LastCommitID())
+	store.getStoreByName("store1").(KVStore).Set(keyFmt(1), valFmt(1))
+	require.Equal(t, commitIDs[1], store.Commit())
+	require.Equal(t, int64(2), getLatestVersion(db))
+}
+
+func TestMultistoreStrictDeterminism(t *testing.T) {
+	var buf bytes.Buffer
+	store := newMultiStoreWithNestedMounts(dbm.NewMemDB())
+	store.SetCommitConcurrency(4)
+	store.SetStrictDeterminism(log.NewTMLogger(&buf))
+	require.Nil(t, store.LoadLatestVersion())
+
+	for i := 0; i < 5; i++ {
+		store.getStoreByName("store1").(KVStore).Set(keyFmt(i), valFmt(i))
+		store.Commit()
+	}
+	require.Empty(t, buf.String())
+
+	infos := func(names ...string) []storeInfo {
+		storeInfos := make([]storeInfo, len(names))
+		for i, name := range names {
+			storeInfos[i].Name = name
+		}
+		return storeInfos
+	}
+	require.Nil(t, checkStoreInfosSorted(nil))
+	require.Nil(t, checkStoreInfosSorted(infos("a", "b", "c")))
+	require.NotNil(t, checkStoreInfosSorted(infos("a", "c", "b")))
+	require.NotNil(t, checkStoreInfosSorted(infos("a", "a")))
+}
+
+func TestMultistoreStoreNames(t *testing.T) {
+	store := newMultiStoreWithMounts(dbm.NewMemDB())
+	tkey := sdk.NewTransientStoreKey("transient")
+	store.MountStoreWithDB(tkey, sdk.StoreTypeTransient, nil)
+	require.Nil(t, store.LoadLatestVersion())
+	key1 := store.keysByName["store1"]
+	require.Nil(t, store.SetMaxValueSize(key1, 10))
+	store.SetReadOnly(key1)
+
+	requireName := func(kv KVStore, name string) {
+		named, ok := kv.(NamedStore)
+		require.True(t, ok)
+		require.Equal(t, name, named.StoreName())
+	}
+	requireName(store.GetKVStore(key1), "store1")
+	requireName(store.GetKVStore(tkey), "transient")
+	requireName(store.GetKVStore(key1).Prefix([]byte("p")), "store1")
+	requireName(NewTraceKVStore(store.GetKVStore(tkey), &bytes.Buffer{}, nil), "transient")
+
+	// cache-wraps find the name through the wrappers
+	requireName(store.CacheMultiStore().GetKVStore(key1), "store1")
+	name, ok := NewCacheKVStore(store.GetKVStore(tkey).Prefix([]byte("p"))).StoreName()
+	require.True(t, ok)
+	require.Equal(t, "transient", name)
+}
+
+func TestMultistoreMaxValueSize(t *testing.T) {
+	store := newMultiStoreWithMounts(dbm.NewMemDB())
+	require.Nil(t, store.LoadLatestVersion())
+	key1, key2 := store.keysByName["store1"], store.keysByName["store2"]
+	require.Nil(t, store.SetMaxValueSize(key1, 4))
+
+	kv := store.GetKVStore(key1)
+	kv.Set([]byte("key"), []byte("1234"))
+	require.Panics(t, func() { kv.Set([]byte("key"), []byte("12345")) })
+	require.Panics(t, func() { kv.Prefix([]byte("p")).Set([]byte("key"), []byte("12345")) })
+	require.NotNil(t, kv.(valueLimitKVStore).SetChecked([]byte("key"), []byte("12345")))
+	require.Equal(t, []byte("1234"), kv.Get([]byte("key")))
+
+	// the limit is per store
+	store.GetKVStore(key2).Set([]byte("key"), []byte("12345"))
+
+	// and applies to cache-wraps
+	cms := store.CacheMultiStore()
+	require.Panics(t, func() { cms.GetKVStore(key1).Set([]byte("key"), []byte("12345")) })
+	cms.GetKVStore(key2).Set([]byte("key"), []byte("12345"))
+
+	// a negative max is rejected, leaving the limit in place
+	require.NotNil(t, store.SetMaxValueSize(key1, -1))
+	require.Panics(t, func() { store.GetKVStore(key1).Set([]byte("key"), []byte("12345")) })
+
+	// zero removes the limit
+	require.Nil(t, store.SetMaxValueSize(key1, 0))
+	store.GetKVStore(key1).Set([]byte("key"), []byte("12345"))
+}
+
+func TestMultistoreLoadVerification(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	for i := 0; i < 2; i++ {
+		store.getStoreByName("store1").(KVStore).Set(keyFmt(i), valFmt(i))
+		store.Commit()
+	}
+
+	store = newMultiStoreWithMounts(db)
+	store.SetLoadVerification(true)
+	require.Nil(t, store.LoadLatestVersion())
+
+	// corrupt the store info of store1
+	cInfo, err := getCommitInfo(db, 2)
+	require.Nil(t, err)
+	for i, si := range cInfo.StoreInfos {
+		if si.Name == "store1" {
+			cInfo.StoreInfos[i].Core.CommitID.Hash = []byte("corrupted")
+		}
+	}
+	batch := db.NewBatch()
+	setCommitInfo(batch, 2, cInfo, false)
+	batch.Write()
+
+	// only detected with verification
+	store = newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	store = newMultiStoreWithMounts(db)
+	store.SetLoadVerification(true)
+	err = store.LoadLatestVersion()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "store1")
+}
+
+func TestMultistoreGetCommitKVStoreSafe(t *testing.T) {
+	store := newMultiStoreWithNestedMounts(dbm.NewMemDB())
+	require.Nil(t, store.LoadLatestVersion())
+
+	kv, ok := store.GetCommitKVStoreSafe(store.keysByName["store1"])
+	require.True(t, ok)
+	require.NotNil(t, kv)
+
+	nestedKey := store.keysByName["nested"]
+	_, ok = store.GetCommitKVStoreSafe(nestedKey)
+	require.False(t, ok)
+	_, ok = store.GetCommitKVStoreSafe(sdk.NewKVStoreKey("unmounted"))
+	require.False(t, ok)
+
+	// the panics name the offending key
+	requirePanicsContaining := func(msg string, f func()) {
+		defer func() {
+			r := recover()
+			require.NotNil(t, r)
+			require.Contains(t, fmt.Sprint(r), msg)
+		}()
+		f()
+	}
+	requirePanicsContaining("nested", func() { store.GetCommitKVStore(nestedKey) })
+	requirePanicsContaining("nested", func() { store.GetKVStore(nestedKey) })
+	requirePanicsContaining("unmounted", func() { store.GetKVStore(sdk.NewKVStoreKey("unmounted")) })
+}
+
+func TestMultistoreCompact(t *testing.T) {
+	// a no-op for dbs without range compaction
+	store := newMultiStoreWithMounts(dbm.NewMemDB())
+	require.Nil(t, store.LoadLatestVersion())
+	require.Nil(t, store.Compact())
+
+	dir, err := ioutil.TempDir("", "rootmultistore")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	db, err := dbm.NewGoLevelDB("compact", dir)
+	require.Nil(t, err)
+	defer db.Close()
+
+	store = newMultiStoreWithMounts(db)
+	store.SetPruning(sdk.PruneEverything)
+	require.Nil(t, store.LoadLatestVersion())
+	for i := 0; i < 10; i++ {
+		store.getStoreByName("store1").(KVStore).Set(keyFmt(i), valFmt(i))
+		store.Commit()
+	}
+	commitID := store.LastCommitID()
+	require.Nil(t, store.Compact())
+
+	store = newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	require.Equal(t, commitID, store.LastCommitID())
+	require.Equal(t, valFmt(9), store.getStoreByName("store1").(KVStore).Get(keyFmt(9)))
+}
+
+func TestMultistoreReadOnly(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	key2 := store.keysByName["store2"]
+	store.GetCommitKVStore(key2).Set([]byte("key"), []byte("value"))
+	store.Commit()
+
+	store.SetReadOnly(key2)
+	require.Panics(t, func() { store.SetReadOnly(sdk.NewKVStoreKey("unmounted")) })
+
+	kv := store.GetKVStore(key2)
+	require.Equal(t, []byte("value"), kv.Get([]byte("key")))
+	require.Panics(t, func() { kv.Set([]byte("key"), []byte("value2")) })
+	require.Panics(t, func() { kv.Delete([]byte("key")) })
+	require.Panics(t, func() { kv.Prefix([]byte("k")).Set([]byte("ey"), []byte("value2")) })
+	require.Panics(t, func() { store.CacheMultiStore().GetKVStore(key2).Delete([]byte("key")) })
+
+	// every way to get the store rejects writes
+	require.Panics(t, func() { store.GetStore(key2).(KVStore).Set([]byte("key"), []byte("value2")) })
+	require.Panics(t, func() { store.GetCommitStore(key2).(KVStore).Set([]byte("key"), []byte("value2")) })
+	require.Panics(t, func() { store.GetCommitKVStore(key2).Set([]byte("key"), []byte("value2")) })
+	require.Panics(t, func() { store.GetCommitKVStore(key2).Delete([]byte("key")) })
+	require.Panics(t, func() {
+		store.GetCommitKVStore(key2).Gas(sdk.NewInfiniteGasMeter(), sdk.KVGasConfig()).Set([]byte("key"), []byte("value2"))
+	})
+	require.Panics(t, func() {
+		wrap := store.GetCommitKVStore(key2).CacheWrap()
+		wrap.(KVStore).Set([]byte("key"), []byte("value2"))
+		wrap.Write()
+	})
+	require.Panics(t, func() {
+		store.CacheMultiStore().GetStore(key2).(KVStore).Set([]byte("key"), []byte("value2"))
+	})
+	require.Equal(t, []byte("value"), store.GetCommitKVStore(key2).Get([]byte("key")))
+
+	// read-only stores aren't committed
+	store.GetKVStore(store.keysByName["store1"]).Set([]byte("key"), []byte("value"))
+	hash, err := store.ComputeCommitHash()
+	require.Nil(t, err)
+	commitID := store.Commit()
+	require.Equal(t, hash, commitID.Hash)
+	require.Equal(t, int64(1), store.GetCommitKVStore(key2).LastCommitID().Version)
+
+	store = newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	require.Equal(t, commitID, store.LastCommitID())
+	require.Equal(t, []byte("value"), store.getStoreByName("store2").(KVStore).Get([]byte("key")))
+}
+
+func TestDumpCommitInfo(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	store.getStoreByName("store1").(KVStore).Set([]byte("key"), []byte("value"))
+	commitID := store.Commit()
+
+	dump, err := DumpCommitInfo(db, 1)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), dump.Version)
+	require.Equal(t, commitID.Hash, []byte(dump.Hash))
+	require.Len(t, dump.Stores, 3)
+	require.Equal(t, "store1", dump.Stores[0].Name)
+	require.Equal(t, "StoreTypeIAVL", dump.Stores[0].StoreType)
+	require.Equal(t, store.GetCommitKVStore(store.keysByName["store1"]).LastCommitID().Hash, []byte(dump.Stores[0].Hash))
+
+	bz, err := json.Marshal(dump)
+	require.Nil(t, err)
+	require.Contains(t, string(bz), fmt.Sprintf(`"hash":"%X"`, commitID.Hash))
+
+	_, err = DumpCommitInfo(db, 2)
+	require.NotNil(t, err)
+}
+
+func TestMultistoreApproxKeyCount(t *testing.T) {
+	store := newMultiStoreWithNestedMounts(dbm.NewMemDB())
+	store.MountStoreWithDB(sdk.NewTransientStoreKey("transient"), sdk.StoreTypeTransient, nil)
+	require.Nil(t, store.LoadLatestVersion())
+
+	for i := 0; i < 3; i++ {
+		store.getStoreByName("store1").(KVStore).Set(keyFmt(i), valFmt(i))
+	}
+	nested := store.getStoreByName("nested").(*rootMultiStore)
+	nested.getStoreByName("inner2").(KVStore).Set(keyFmt(0), valFmt(0))
+	store.Commit()
+
+	require.Equal(t, map[string]int64{
+		"store1":        3,
+		"store2":        0,
+		"store3":        0,
+		"nested/inner1": 0,
+		"nested/inner2": 1,
+	}, store.ApproxKeyCount())
+}
+
+// xorHasher is a (weak) test hasher.
+type xorHasher struct{}
+
+func (xorHasher) HashStore(core []byte) []byte {
+	hash := make([]byte, 4)
+	for i, b := range core {
+		hash[i%4] ^= b
+	}
+	return hash
+}
+
+func (xorHasher) HashStores(leaves map[string][]byte) []byte {
+	hash := make([]byte, 4)
+	for name, leaf := range leaves {
+		for i, b := range append([]byte(name), leaf...) {
+			hash[i%4] ^= b
+		}
+	}
+	return hash
+}
+
+func TestMultistoreHasher(t *testing.T) {
+	var commitIDs []CommitID
+	for _, hasher := range []Hasher{nil, DefaultHasher, xorHasher{}} {
+		db := dbm.NewMemDB()
+		store := newMultiStoreWithNestedMounts(db)
+		if hasher != nil {
+			store.SetHasher(hasher)
+		}
+		require.Nil(t, store.LoadLatestVersion())
+		store.getStoreByName("store1").(KVStore).Set([]byte("key"), []byte("value"))
+
+		hash, err := store.ComputeCommitHash()
+		require.Nil(t, err)
+		commitID := store.Commit()
+		require.Equal(t, hash, commitID.Hash)
+		commitIDs = append(commitIDs, commitID)
+
+		// reloading with the same hasher gives the same commit
+		store = newMultiStoreWithNestedMounts(db)
+		if hasher != nil {
+			store.SetHasher(hasher)
+		}
+		require.Nil(t, store.LoadLatestVersion())
+		require.Equal(t, commitID, store.LastCommitID())
+		nested := store.getStoreByName("nested").(*rootMultiStore)
+		require.Equal(t, hasher, nested.hasher)
+	}
+
+	// the default is unchanged, other hashers give other hashes
+	require.Equal(t, commitIDs[0], commitIDs[1])
+	require.Len(t, commitIDs[2].Hash, 4)
+}
+
+func TestMultistoreWriteListener(t *testing.T) {
+	store := newMultiStoreWithMounts(dbm.NewMemDB())
+	require.Nil(t, store.LoadLatestVersion())
+	key1 := store.keysByName["store1"]
+	var buf bytes.Buffer
+	require.Nil(t, store.SetWriteListener(key1, &buf))
+
+	kv := store.GetKVStore(key1)
+	kv.Set([]byte("key1"), []byte("value1"))
+	kv.Delete([]byte("key1"))
+	store.GetKVStore(store.keysByName["store2"]).Set([]byte("key"), []byte("value"))
+
+	// writes to cache-wraps are recorded once written
+	cms := store.CacheMultiStore()
+	cms.GetKVStore(key1).Set([]byte("key2"), []byte("value2"))
+	discarded := store.CacheMultiStore()
+	discarded.GetKVStore(key1).Set([]byte("key3"), []byte("value3"))
+	cms.Write()
+
+	// the records are flushed on commit
+	require.Zero(t, buf.Len())
+	store.Commit()
+
+	r := bufio.NewReader(&buf)
+	var writes []StoreWrite
+	for {
+		write, err := ReadStoreWrite(r, 1024)
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err)
+		writes = append(writes, write)
+	}
+	require.Equal(t, []StoreWrite{
+		{WriteOpSet, []byte("key1"), []byte("value1")},
+		{WriteOpDelete, []byte("key1"), nil},
+		{WriteOpSet, []byte("key2"), []byte("value2")},
+	}, writes)
+}
+
+func TestReadStoreWriteLimit(t *testing.T) {
+	var buf bytes.Buffer
+	wl := newWriteListener(&buf)
+	wl.record(WriteOpSet, []byte("key"), []byte("value"))
+	require.Nil(t, wl.flush())
+	record := buf.Bytes()
+
+	// The record holds the op, the key length, the key and the value.
+	write, err := ReadStoreWrite(bufio.NewReader(bytes.NewReader(record)), 10)
+	require.Nil(t, err)
+	require.Equal(t, StoreWrite{WriteOpSet, []byte("key"), []byte("value")}, write)
+
+	_, err = ReadStoreWrite(bufio.NewReader(bytes.NewReader(record)), 9)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "exceeds the limit of 9 bytes")
+
+	// A huge length is rejected without reading or allocating the record.
+	var huge [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(huge[:], 1<<62)
+	_, err = ReadStoreWrite(bufio.NewReader(bytes.NewReader(huge[:n])), 1<<20)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "exceeds the limit")
+}
+
+func TestMultistoreWriteListenerRejectsNonKVStores(t *testing.T) {
+	store := newMultiStoreWithNestedMounts(dbm.NewMemDB())
+	require.Nil(t, store.LoadLatestVersion())
+	var buf bytes.Buffer
+
+	err := store.SetWriteListener(store.keysByName["nested"], &buf)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is not a KVStore")
+
+	err = store.SetWriteListener(sdk.NewKVStoreKey("unmounted"), &buf)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not mounted")
+
+	// removing a listener never fails
+	require.Nil(t, store.SetWriteListener(store.keysByName["nested"], nil))
+}
+
+func TestMultistoreSnapshotView(t *testing.T) {
+	store := newMultiStoreWithNestedMounts(dbm.NewMemDB())
+	require.Nil(t, store.LoadLatestVersion())
+	key1 := store.keysByName["store1"]
+	nestedKey := store.keysByName["nested"]
+	nested := store.GetStore(nestedKey).(*rootMultiStore)
+	innerKey := nested.keysByName["inner1"]
+
+	k, v := []byte("key"), []byte("value1")
+	store.GetKVStore(key1).Set(k, v)
+	nested.GetKVStore(innerKey).Set(k, v)
+	store.Commit()
+
+	view := store.SnapshotView()
+
+	// neither uncommitted writes nor later commits are seen
+	store.GetKVStore(key1).Set(k, []byte("value2"))
+	nested.GetKVStore(innerKey).Set(k, []byte("value2"))
+	require.Equal(t, v, view.GetKVStore(key1).Get(k))
+	store.Commit()
+	require.Equal(t, v, view.GetKVStore(key1).Get(k))
+	require.Equal(t, v, view.GetStore(nestedKey).(MultiStore).GetKVStore(innerKey).Get(k))
+	require.Equal(t, []byte("value2"), store.GetKVStore(key1).Get(k))
+
+	require.Panics(t, func() { view.GetKVStore(key1).Set(k, v) })
+	cms := view.CacheMultiStore()
+	cms.GetKVStore(key1).Set(k, []byte("value3"))
+	require.Equal(t, []byte("value3"), cms.GetKVStore(key1).Get(k))
+	require.Panics(t, func() { cms.Write() })
+}
+
+func TestMultistoreQueryPrunedHeight(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	store.SetPruning(sdk.PruneNothing)
+	require.Nil(t, store.LoadLatestVersion())
+	k, v := []byte("key"), []byte("value")
+	store.GetKVStore(store.keysByName["store1"]).Set(k, v)
+	for i := 0; i < 3; i++ {
+		store.Commit()
+	}
+
+	store = newMultiStoreWithMounts(db)
+	store.SetPruning(sdk.PruneEverything)
+	require.Nil(t, store.LoadLatestVersion())
+	store.Commit()
+	store.Commit()
+	require.Equal(t, []int64{1, 2, 5}, store.AvailableVersions())
+
+	query := abci.RequestQuery{Path: "/store1/key", Data: k, Height: 3, Prove: true}
+	qres := store.Query(query)
+	require.Equal(t, sdk.ToABCICode(sdk.CodespaceRoot, sdk.CodeUnknownRequest), sdk.ABCICodeType(qres.Code))
+	require.Contains(t, qres.Log, "height 3 is not available")
+	hu, ok := ParseHeightUnavailable(qres)
+	require.True(t, ok)
+	require.Equal(t, HeightUnavailable{Height: 3, NearestBelow: 2, NearestAbove: 5}, hu)
+
+	// retrying at an available height succeeds
+	query.Height = hu.NearestBelow
+	qres = store.Query(query)
+	require.True(t, qres.IsOK(), qres.Log)
+	require.Equal(t, v, qres.Value)
+	_, ok = ParseHeightUnavailable(qres)
+	require.False(t, ok)
+
+	// heights beyond the latest version have no version above
+	query.Height = 6
+	hu, ok = ParseHeightUnavailable(store.Query(query))
+	require.True(t, ok)
+	require.Equal(t, HeightUnavailable{Height: 6, NearestBelow: 5}, hu)
+}
+
+type latestCountingDB struct {
+	dbm.DB
+	latestReads int
+}
+
+func (db *latestCountingDB) Get(key []byte) []byte {
+	if string(key) == latestVersionKey {
+		db.latestReads++
+	}
+	return db.DB.Get(key)
+}
+
+func TestMultistoreDefaultQueryHeight(t *testing.T) {
+	db := &latestCountingDB{DB: dbm.NewMemDB()}
+	store := newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	k := []byte("key")
+	for i := 1; i <= 3; i++ {
+		store.GetKVStore(store.keysByName["store1"]).Set(k, valFmt(i))
+		store.Commit()
+	}
+
+	// Queries without a height are answered at latest - 1, without reading
+	// the latest version from the db.
+	db.latestReads = 0
+	qres := store.Query(abci.RequestQuery{Path: "/store1/key", Data: k})
+	require.True(t, qres.IsOK(), qres.Log)
+	require.Equal(t, int64(2), qres.Height)
+	require.Equal(t, valFmt(2), qres.Value)
+	require.Zero(t, db.latestReads)
+
+	// The height follows commits and loads.
+	store.Commit()
+	require.Equal(t, int64(3), store.defaultQueryHeight())
+	require.Nil(t, store.RollbackToVersion(1))
+	require.Equal(t, int64(1), store.defaultQueryHeight())
+}
+
+func TestMultistoreQueryDuringCommit(t *testing.T) {
+	store := newMultiStoreWithMounts(dbm.NewMemDB())
+	require.True(t, store.EnableMemoryCommitCache())
+	require.Nil(t, store.LoadLatestVersion())
+	k := []byte("key")
+	store.GetKVStore(store.keysByName["store1"]).Set(k, valFmt(0))
+	store.Commit()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				store.Query(abci.RequestQuery{Path: "/store1/key", Data: k, Prove: true})
+			}
+		}()
+	}
+	for i := 1; i <= 20; i++ {
+		store.GetKVStore(store.keysByName["store1"]).Set(k, valFmt(i))
+		store.Commit()
+	}
+	close(done)
+	wg.Wait()
+}
+
+type iteratorCountingDB struct {
+	dbm.DB
+	iterators int
+}
+
+func (db *iteratorCountingDB) Iterator(start, end []byte) dbm.Iterator {
+	db.iterators++
+	return db.DB.Iterator(start, end)
+}
+
+func TestMultistoreQueryPrunedHeightBounded(t *testing.T) {
+	db := &iteratorCountingDB{DB: dbm.NewMemDB()}
+	store := newMultiStoreWithMounts(db)
+	store.SetPruning(sdk.PruneSyncable)
+	require.Nil(t, store.LoadLatestVersion())
+	k := []byte("key")
+	for i := 0; i < 150; i++ {
+		store.GetKVStore(store.keysByName["store1"]).Set(k, valFmt(i))
+		store.Commit()
+	}
+
+	// The nearest versions are found without scanning the commit infos.
+	db.iterators = 0
+	qres := store.Query(abci.RequestQuery{Path: "/store1/key", Data: k, Height: 20, Prove: true})
+	require.Zero(t, db.iterators)
+	hu, ok := ParseHeightUnavailable(qres)
+	require.True(t, ok)
+	require.Equal(t, HeightUnavailable{Height: 20, NearestAbove: store.AvailableVersions()[0]}, hu)
+}
+
+func TestMultistoreEnumerationOrder(t *testing.T) {
+	// "a/x" sorts after "a-b" although "a" sorts before "a-b".
+	names := []string{"b", "a-b", "a", "c"}
+	enumerate := func(perm []int) (mounted, iterated []string) {
+		store := NewCommitMultiStore(dbm.NewMemDB())
+		for _, i := range perm {
+			key := sdk.NewKVStoreKey(names[i])
+			if names[i] == "a" {
+				store.MountStoreWithDB(key, sdk.StoreTypeMulti, nil)
+				store.MountSubStore(key, sdk.NewKVStoreKey("x"), sdk.StoreTypeIAVL)
+				continue
+			}
+			store.MountStoreWithDB(key, sdk.StoreTypeIAVL, nil)
+		}
+		require.Nil(t, store.LoadLatestVersion())
+
+		for _, key := range store.MountedStoreKeys() {
+			mounted = append(mounted, key.Name())
+		}
+		store.IterateAllStores(func(name string, _ KVStore) bool {
+			iterated = append(iterated, name)
+			return false
+		})
+		return mounted, iterated
+	}
+
+	for _, perm := range [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}, {2, 0, 3, 1}, {1, 3, 0, 2}} {
+		for i := 0; i < 5; i++ {
+			mounted, iterated := enumerate(perm)
+			require.Equal(t, []string{"a", "a-b", "b", "c"}, mounted)
+			require.Equal(t, []string{"a-b", "a/x", "b", "c"}, iterated)
+		}
+	}
+}
+
+func TestMultistoreMemoryCommitCache(t *testing.T) {
+	require.False(t, NewCommitMultiStore(dbm.NewPrefixDB(dbm.NewMemDB(), []byte("p"))).EnableMemoryCommitCache())
+
+	plainDB, cachedDB := dbm.NewMemDB(), dbm.NewMemDB()
+	plain := newMultiStoreWithMounts(plainDB)
+	plain.SetPruning(sdk.PruneNothing)
+	require.Nil(t, plain.LoadLatestVersion())
+	cached := newMultiStoreWithMounts(cachedDB)
+	cached.SetPruning(sdk.PruneNothing)
+	require.True(t, cached.EnableMemoryCommitCache())
+	require.Nil(t, cached.LoadLatestVersion())
+
+	k := []byte("key")
+	for i := 0; i < 20; i++ {
+		plain.GetKVStore(plain.keysByName["store1"]).Set(k, valFmt(i))
+		cached.GetKVStore(cached.keysByName["store1"]).Set(k, valFmt(i))
+		require.Equal(t, plain.Commit(), cached.Commit())
+	}
+	require.Equal(t, plain.AvailableVersions(), cached.AvailableVersions())
+
+	// the commit info isn't encoded until needed
+	require.Nil(t, cachedDB.Get(commitInfoKey(5)))
+	query := abci.RequestQuery{Path: "/store1/key", Data: k, Height: 5, Prove: true}
+	require.Equal(t, plain.Query(query), cached.Query(query))
+
+	cached.FlushPending()
+	for ver := 1; ver <= 20; ver++ {
+		key := commitInfoKey(int64(ver))
+		require.Equal(t, plainDB.Get(key), cachedDB.Get(key))
+	}
+
+	// rolled back versions are dropped from the cache
+	require.Nil(t, cached.RollbackToVersion(10))
+	_, err := cached.getCommitInfo(11)
+	require.NotNil(t, err)
+
+	reloaded := newMultiStoreWithMounts(cachedDB)
+	require.Nil(t, reloaded.LoadLatestVersion())
+	require.Equal(t, cached.LastCommitID(), reloaded.LastCommitID())
+}
+
+func TestMultistoreCommitStores(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	store.SetPruning(sdk.PruneNothing)
+	require.Nil(t, store.LoadLatestVersion())
+	key1, key2 := store.keysByName["store1"], store.keysByName["store2"]
+	store.Commit()
+	store2ID := store.GetCommitKVStore(key2).LastCommitID()
+
+	k, v := []byte("key"), []byte("value")
+	store.GetKVStore(key1).Set(k, v)
+	store.GetKVStore(key2).Set(k, v)
+	commitID := store.CommitStores([]StoreKey{key1})
+	require.Equal(t, int64(2), commitID.Version)
+	require.Equal(t, int64(2), store.GetCommitKVStore(key1).LastCommitID().Version)
+	require.Equal(t, store2ID, store.GetCommitKVStore(key2).LastCommitID())
+
+	// the commit info carries the skipped store forward
+	cInfo, err := getCommitInfo(db, 2)
+	require.Nil(t, err)
+	require.Equal(t, commitID.Hash, cInfo.Hash())
+	for _, si := range cInfo.StoreInfos {
+		require.Equal(t, store.getStoreByName(si.Name).(CommitStore).LastCommitID(), si.Core.CommitID)
+	}
+	require.Equal(t, []int64{1, 2}, store.AvailableVersions())
+
+	reloaded := newMultiStoreWithMounts(db)
+	require.Nil(t, reloaded.LoadLatestVersion())
+	require.Equal(t, commitID, reloaded.LastCommitID())
+	require.Equal(t, v, reloaded.GetKVStore(key1).Get(k))
+	require.Nil(t, reloaded.GetKVStore(key2).Get(k))
+
+	// the pending write is committed with the skipped store
+	commitID = store.Commit()
+	require.Equal(t, int64(3), commitID.Version)
+	require.Equal(t, int64(2), store.GetCommitKVStore(key2).LastCommitID().Version)
+	reloaded = newMultiStoreWithMounts(db)
+	require.Nil(t, reloaded.LoadLatestVersion())
+	require.Equal(t, v, reloaded.GetKVStore(key2).Get(k))
+
+	require.Panics(t, func() { store.CommitStores([]StoreKey{sdk.NewKVStoreKey("unknown")}) })
+}
+
+func TestMultistoreStoreDiff(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithNestedMounts(db)
+	store.SetPruning(sdk.PruneNothing)
+	require.Nil(t, store.LoadLatestVersion())
+	key := store.keysByName["store1"]
+	kv := store.GetKVStore(key)
+
+	kv.Set([]byte("a"), []byte("1"))
+	kv.Set([]byte("b"), []byte("1"))
+	kv.Set([]byte("c"), []byte("1"))
+	store.Commit()
+
+	kv.Set([]byte("a"), []byte("2")) // changed
+	kv.Set([]byte("b"), []byte("1")) // rewritten with the same value
+	kv.Delete([]byte("c"))
+	kv.Set([]byte("d"), []byte("1"))
+	store.Commit()
+	store.Commit()
+
+	changed, err := store.StoreDiff(key, 1, 2)
+	require.Nil(t, err)
+	require.Equal(t, [][]byte{[]byte("a"), []byte("c"), []byte("d")}, changed)
+
+	changed, err = store.StoreDiff(key, 2, 1)
+	require.Nil(t, err)
+	require.Equal(t, [][]byte{[]byte("a"), []byte("c"), []byte("d")}, changed)
+
+	changed, err = store.StoreDiff(key, 0, 1)
+	require.Nil(t, err)
+	require.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("c")}, changed)
+
+	changed, err = store.StoreDiff(key, 2, 3)
+	require.Nil(t, err)
+	require.Empty(t, changed)
+
+	_, err = store.StoreDiff(key, 1, 4)
+	require.NotNil(t, err)
+	_, err = store.StoreDiff(sdk.NewKVStoreKey("unknown"), 1, 2)
+	require.NotNil(t, err)
+	_, err = store.StoreDiff(store.keysByName["nested"], 1, 2)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "unsupported")
+}
+
+// panickingCommitStore panics when committed.
+type panickingCommitStore struct {
+	CommitStore
+}
+
+func (panickingCommitStore) Commit() CommitID {
+	panic("bad node")
+}
+
+func TestMultistoreCommitRecoversStorePanic(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	commitID := store.Commit()
+
+	key := store.keysByName["store2"]
+	store.stores[key] = panickingCommitStore{store.stores[key]}
+
+	_, err := store.TryCommit()
+	require.NotNil(t, err)
+	commitErr, ok := err.(*StoreCommitError)
+	require.True(t, ok)
+	require.Equal(t, "store2", commitErr.Store)
+	require.Equal(t, int64(2), commitErr.Version)
+	require.Equal(t, "bad node", commitErr.Panic)
+
+	// the version didn't advance
+	require.Equal(t, commitID, store.LastCommitID())
+	require.Equal(t, int64(1), getLatestVersion(db))
+	_, err = getCommitInfo(db, 2)
+	require.NotNil(t, err)
+
+	require.Panics(t, func() { store.Commit() })
+
+	reloaded := newMultiStoreWithMounts(db)
+	require.Nil(t, reloaded.LoadLatestVersion())
+	require.Equal(t, commitID, reloaded.LastCommitID())
+
+	// rolling back deletes the versions the other substores saved, so that
+	// different writes can be committed
+	store.stores[key] = store.stores[key].(panickingCommitStore).CommitStore
+	require.Nil(t, store.RollbackToVersion(store.LastCommitID().Version))
+	store.getStoreByName("store1").(KVStore).Set([]byte("key"), []byte("other"))
+	require.Equal(t, int64(2), store.Commit().Version)
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("disk full")
+}
+
+func TestMultistoreCommitListenerFlushError(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	commitID := store.Commit()
+
+	key := store.keysByName["store2"]
+	require.Nil(t, store.SetWriteListener(key, failingWriter{}))
+	store.GetKVStore(key).Set([]byte("key"), []byte("value"))
+
+	_, err := store.TryCommit()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to flush write listener of store store2: disk full")
+
+	// nothing was committed
+	require.Equal(t, commitID, store.LastCommitID())
+	require.Equal(t, int64(1), getLatestVersion(db))
+	require.Equal(t, int64(1), store.GetCommitKVStore(key).LastCommitID().Version)
+	require.Panics(t, func() { store.Commit() })
+
+	// the pending writes are committed once the listener is removed
+	require.Nil(t, store.SetWriteListener(key, nil))
+	commitID, err = store.TryCommit()
+	require.Nil(t, err)
+	require.Equal(t, int64(2), commitID.Version)
+	require.Equal(t, []byte("value"), store.GetKVStore(key).Get([]byte("key")))
+}
+
+// mockCommitStore is a CommitStore without data whose commit IDs only
+// depend on its name and version, for testing the commit path without IAVL.
+type mockCommitStore struct {
+	name     string
+	commitID CommitID
+}
+
+var _ CommitStore = (*mockCommitStore)(nil)
+var _ CommitHasher = (*mockCommitStore)(nil)
+
+func newMockCommitStore(name string) *mockCommitStore {
+	return &mockCommitStore{name: name}
+}
+
+func (ms *mockCommitStore) hashAt(version int64) []byte {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s/%d", ms.name, version)))
+	return hash[:]
+}
+
+func (ms *mockCommitStore) Commit() CommitID {
+	version := ms.commitID.Version + 1
+	ms.commitID = CommitID{Version: version, Hash: ms.hashAt(version)}
+	return ms.commitID
+}
+
+func (ms *mockCommitStore) ComputeCommitHash() ([]byte, error) {
+	return ms.hashAt(ms.commitID.Version + 1), nil
+}
+
+func (ms *mockCommitStore) LastCommitID() CommitID {
+	return ms.commitID
+}
+
+func (ms *mockCommitStore) SetPruning(sdk.PruningStrategy) {}
+
+func (ms *mockCommitStore) GetStoreType() StoreType {
+	return sdk.StoreTypeIAVL
+}
+
+func (ms *mockCommitStore) CacheWrap() CacheWrap {
+	panic("mockCommitStore can't be cache-wrapped")
+}
+
+func (ms *mockCommitStore) CacheWrapWithTrace(_ io.Writer, _ TraceContext) CacheWrap {
+	panic("mockCommitStore can't be cache-wrapped")
+}
+
+// newMultiStoreWithMockStores returns a rootMultiStore holding a
+// mockCommitStore for each name, added in the given order.
+func newMultiStoreWithMockStores(db dbm.DB, names ...string) *rootMultiStore {
+	store := NewCommitMultiStore(db)
+	for _, name := range names {
+		key := sdk.NewKVStoreKey(name)
+		store.keysByName[name] = key
+		store.stores[key] = newMockCommitStore(name)
+	}
+	return store
+}
+
+func TestMultistoreMockStoresHashDeterminism(t *testing.T) {
+	names := []string{"acc", "bank", "gov", "params", "stake", "upgrade"}
+	reversed := make([]string, len(names))
+	for i, name := range names {
+		reversed[len(names)-1-i] = name
+	}
+
+	stores := []*rootMultiStore{
+		newMultiStoreWithMockStores(dbm.NewMemDB(), names...),
+		newMultiStoreWithMockStores(dbm.NewMemDB(), reversed...),
+		newMultiStoreWithMockStores(dbm.NewMemDB(), reversed...),
+	}
+	stores[0].SetCommitConcurrency(1)
+	stores[2].SetCommitConcurrency(len(names))
+
+	for i := 0; i < 5; i++ {
+		expected, err := stores[0].ComputeCommitHash()
+		require.Nil(t, err)
+		for _, store := range stores {
+			commitID := store.Commit()
+			require.Equal(t, int64(i+1), commitID.Version)
+			require.Equal(t, expected, commitID.Hash)
+		}
+	}
+
+	// The persisted store infos are sorted by name.
+	cInfo, err := getCommitInfo(stores[1].db, 5)
+	require.Nil(t, err)
+	require.Nil(t, checkStoreInfosSorted(cInfo.StoreInfos))
+	require.Len(t, cInfo.StoreInfos, len(names))
+}
+
+func TestCommitInfoHashOrdering(t *testing.T) {
+	infos := make([]storeInfo, 4)
+	for i := range infos {
+		name := fmt.Sprintf("store%d", i)
+		infos[i].Name = name
+		infos[i].Type = newStoreTypeTag(sdk.StoreTypeIAVL)
+		infos[i].Core.CommitID = CommitID{Version: 1, Hash: newMockCommitStore(name).hashAt(1)}
+	}
+	hash := newCommitInfo(1, infos).Hash()
+
+	// The order of the store infos doesn't matter.
+	permuted := []storeInfo{infos[2], infos[0], infos[3], infos[1]}
+	require.Equal(t, hash, newCommitInfo(1, permuted).Hash())
+
+	// Their content does.
+	changed := append([]storeInfo{}, infos...)
+	changed[1].Core.CommitID.Hash = newMockCommitStore("store1").hashAt(2)
+	require.NotEqual(t, hash, newCommitInfo(1, changed).Hash())
+	require.NotEqual(t, hash, newCommitInfo(1, infos[:3]).Hash())
+}
+
+func TestCommitStoresSkip(t *testing.T) {
+	store := newMultiStoreWithMockStores(dbm.NewMemDB(), "a", "b", "c")
+	store.Commit()
+
+	skipped := store.keysByName["b"]
+	cInfo, err := commitStores(2, store.stores, map[StoreKey]bool{skipped: true}, 2)
+	require.Nil(t, err)
+	require.Equal(t, []string{"a", "b", "c"}, []string{
+		cInfo.StoreInfos[0].Name, cInfo.StoreInfos[1].Name, cInfo.StoreInfos[2].Name})
+	require.Equal(t, int64(2), cInfo.StoreInfos[0].Core.CommitID.Version)
+	require.Equal(t, int64(1), cInfo.StoreInfos[1].Core.CommitID.Version)
+	require.Equal(t, int64(2), cInfo.StoreInfos[2].Core.CommitID.Version)
+}
+
+func TestMultistoreCommitIDHistory(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	store.SetPruning(sdk.PruneNothing)
+	require.Nil(t, store.LoadLatestVersion())
+
+	var commitIDs []CommitID
+	for i := 0; i < 4; i++ {
+		store.GetKVStore(store.keysByName["store1"]).Set([]byte("key"), []byte{byte(i)})
+		commitIDs = append(commitIDs, store.Commit())
+	}
+
+	history, err := store.CommitIDHistory(1, 4)
+	require.Nil(t, err)
+	require.Equal(t, commitIDs, history)
+
+	history, err = store.CommitIDHistory(2, 3)
+	require.Nil(t, err)
+	require.Equal(t, commitIDs[1:3], history)
+
+	_, err = store.CommitIDHistory(3, 5)
+	require.NotNil(t, err)
+	_, err = store.CommitIDHistory(0, 2)
+	require.NotNil(t, err)
+	_, err = store.CommitIDHistory(3, 2)
+	require.NotNil(t, err)
+}
+
+func TestMultistoreCommitInfoCompression(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	require.Nil(t, store.LoadLatestVersion())
+	legacyID := store.Commit()
+	legacy := db.Get(commitInfoKey(1))
+
+	store.SetCommitInfoCompression(true)
+	commitID := store.Commit()
+	compressed := db.Get(commitInfoKey(2))
+	require.Equal(t, compressedCommitInfoPrefix, compressed[0])
+	require.NotEqual(t, compressedCommitInfoPrefix, legacy[0])
+
+	// both formats load
+	for _, id := range []CommitID{legacyID, commitID} {
+		cInfo, err := getCommitInfo(db, id.Version)
+		require.Nil(t, err)
+		require.Equal(t, id, cInfo.CommitID())
+	}
+	reloaded := newMultiStoreWithMounts(db)
+	require.Nil(t, reloaded.LoadLatestVersion())
+	require.Equal(t, commitID, reloaded.LastCommitID())
+
+	db.Set(commitInfoKey(2), append([]byte{compressedCommitInfoPrefix}, 0xff))
+	_, err := getCommitInfo(db, 2)
+	require.NotNil(t, err)
+}
+
+func TestCommitInfoCompressionSavesSpace(t *testing.T) {
+	for _, n := range []int{100, 500} {
+		cInfo := manyStoresCommitInfo(n)
+		plainDB, compressedDB := dbm.NewMemDB(), dbm.NewMemDB()
+		plainBatch, compressedBatch := plainDB.NewBatch(), compressedDB.NewBatch()
+		setCommitInfo(plainBatch, 1, cInfo, false)
+		setCommitInfo(compressedBatch, 1, cInfo, true)
+		plainBatch.Write()
+		compressedBatch.Write()
+
+		plain, compressed := plainDB.Get(commitInfoKey(1)), compressedDB.Get(commitInfoKey(1))
+		require.True(t, len(compressed) < len(plain))
+		t.Logf("%d stores: %d bytes, %d bytes compressed", n, len(plain), len(compressed))
+	}
+}
+
+func TestMultistoreMountKeyRegistry(t *testing.T) {
+	store := NewCommitMultiStore(dbm.NewMemDB())
+	reg := sdk.NewStoreKeyRegistry()
+	store.SetKeyRegistry(reg)
+
+	store.MountStoreWithDB(sdk.NewNamespacedKVStoreKey("bank", 0x01), sdk.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(sdk.NewKVStoreKey("plain"), sdk.StoreTypeIAVL, nil)
+	owner, ok := reg.Owner(0x01)
+	require.True(t, ok)
+	require.Equal(t, "bank", owner)
+
+	require.Panics(t, func() {
+		store.MountStoreWithDB(sdk.NewNamespacedKVStoreKey("gov", 0x01), sdk.StoreTypeIAVL, nil)
+	})
+	store.MountStoreWithDB(sdk.NewNamespacedKVStoreKey("staking", 0x02), sdk.StoreTypeIAVL, nil)
+	require.Nil(t, store.LoadLatestVersion())
+}
+
+func TestMultistoreCommitInfoKeyMigration(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	store.SetPruning(sdk.PruneNothing)
+	require.Nil(t, store.LoadLatestVersion())
+	var commitIDs []CommitID
+	for i := 0; i < 12; i++ {
+		store.GetKVStore(store.keysByName["store1"]).Set(keyFmt(i), valFmt(i))
+		commitIDs = append(commitIDs, store.Commit())
+	}
+
+	// keys sort in numeric order
+	require.True(t, bytes.Compare(commitInfoKey(9), commitInfoKey(10)) < 0)
+	require.True(t, bytes.Compare(commitInfoKey(255), commitInfoKey(256)) < 0)
+
+	// move the odd versions to legacy keys
+	for ver := int64(1); ver <= 12; ver += 2 {
+		db.Set(legacyCommitInfoKey(ver), db.Get(commitInfoKey(ver)))
+		db.Delete(commitInfoKey(ver))
+	}
+
+	check := func() {
+		reloaded := newMultiStoreWithMounts(db)
+		reloaded.SetPruning(sdk.PruneNothing)
+		require.Nil(t, reloaded.LoadLatestVersion())
+		require.Equal(t, commitIDs[11], reloaded.LastCommitID())
+		history, err := reloaded.CommitIDHistory(1, 12)
+		require.Nil(t, err)
+		require.Equal(t, commitIDs, history)
+		require.Equal(t, []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}, reloaded.AvailableVersions())
+	}
+	check()
+
+	reloaded := newMultiStoreWithMounts(db)
+	require.Nil(t, reloaded.LoadLatestVersion())
+	require.Equal(t, 6, reloaded.MigrateCommitInfoKeys())
+	for ver := int64(1); ver <= 12; ver++ {
+		require.Nil(t, db.Get(legacyCommitInfoKey(ver)))
+		require.NotNil(t, db.Get(commitInfoKey(ver)))
+	}
+	require.Equal(t, 0, reloaded.MigrateCommitInfoKeys())
+	check()
+
+	// rolling back drops both kinds of keys
+	db.Set(legacyCommitInfoKey(12), db.Get(commitInfoKey(12)))
+	require.Nil(t, reloaded.RollbackToVersion(10))
+	require.Nil(t, db.Get(legacyCommitInfoKey(12)))
+	require.Nil(t, db.Get(commitInfoKey(12)))
+}
+
+func TestMultistoreQueryTracer(t *testing.T) {
+	store := newMultiStoreWithMounts(dbm.NewMemDB())
+	require.Nil(t, store.LoadLatestVersion())
+	k, v := []byte("key"), []byte("value")
+	store.GetKVStore(store.keysByName["store1"]).Set(k, v)
+	commitID := store.Commit()
+
+	var buf bytes.Buffer
+	store.SetQueryTracer(&buf)
+	store.WithTracingContext(TraceContext{"block": "1"})
+
+	res := store.Query(abci.RequestQuery{Path: "/store1/key", Data: k, Prove: true})
+	require.Equal(t, v, res.Value)
+	res = store.Query(abci.RequestQuery{Path: "/unknown/key", Data: k})
+	require.False(t, res.IsOK())
+
+	var traces []queryTrace
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var trace queryTrace
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &trace))
+		traces = append(traces, trace)
+	}
+	require.Len(t, traces, 2)
+
+	require.Equal(t, "store1", traces[0].Store)
+	require.Equal(t, "/key", traces[0].Subpath)
+	require.Equal(t, commitID.Version, traces[0].Height)
+	require.True(t, traces[0].Prove)
+	require.True(t, traces[0].Proven)
+	require.Equal(t, uint32(0), traces[0].Code)
+	require.Equal(t, "1", traces[0].Metadata["block"])
+
+	require.Equal(t, "unknown", traces[1].Store)
+	require.False(t, traces[1].Proven)
+	require.NotEqual(t, uint32(0), traces[1].Code)
+	require.NotEmpty(t, traces[1].Log)
+
+	store.SetQueryTracer(nil)
+	store.Query(abci.RequestQuery{Path: "/store1/key", Data: k})
+	require.Zero(t, buf.Len())
+}
+
+func TestMultistoreStorePrefix(t *testing.T) {
+	db, storeDB := dbm.NewMemDB(), dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	ownKey, transientKey := sdk.NewKVStoreKey("own"), sdk.NewTransientStoreKey("transient")
+	store.MountStoreWithDB(ownKey, sdk.StoreTypeIAVL, storeDB)
+	store.MountStoreWithDB(transientKey, sdk.StoreTypeTransient, nil)
+	require.Nil(t, store.LoadLatestVersion())
+	key1 := store.keysByName["store1"]
+	store.GetKVStore(key1).Set([]byte("key"), []byte("value"))
+	store.GetKVStore(ownKey).Set([]byte("key"), []byte("value"))
+	store.Commit()
+
+	prefix := store.StorePrefix(key1)
+	require.Equal(t, storePrefix("store1"), prefix)
+	require.True(t, hasPrefix(db, prefix))
+
+	require.True(t, hasPrefix(storeDB, store.StorePrefix(ownKey)))
+	require.Nil(t, store.StorePrefix(transientKey))
+	require.Nil(t, store.StorePrefix(sdk.NewKVStoreKey("unknown")))
+}
+
+func TestMultistoreCommitInfoCache(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db)
+	store.SetPruning(sdk.PruneNothing)
+	require.Nil(t, store.LoadLatestVersion())
+	var commitIDs []CommitID
+	for i := 0; i < 3; i++ {
+		store.getStoreByName("store1").(KVStore).Set(keyFmt(i), valFmt(i))
+		commitIDs = append(commitIDs, store.Commit())
+	}
+	require.Equal(t, 0, store.commitInfoCache.len())
+
+	// Proved queries populate the cache and are then served from it.
+	query := abci.RequestQuery{Path: "/store1/key", Data: keyFmt(0), Height: 2, Prove: true}
+	res := store.Query(query)
+	require.True(t, res.IsOK())
+	require.Equal(t, 1, store.commitInfoCache.len())
+	persisted := db.Get(commitInfoKey(2))
+	db.Delete(commitInfoKey(2))
+	require.Equal(t, res, store.Query(query))
+	db.Set(commitInfoKey(2), persisted)
+
+	// Rolled back versions are dropped.
+	require.Nil(t, store.RollbackToVersion(1))
+	_, ok := store.commitInfoCache.get(2)
+	require.False(t, ok)
+
+	// Committing a version drops what was cached for it before.
+	stale := manyStoresCommitInfo(1)
+	stale.Version = 2
+	store.commitInfoCache.add(stale)
+	store.getStoreByName("store1").(KVStore).Set(keyFmt(1), valFmt(1))
+	require.Equal(t, commitIDs[1], store.Commit())
+	cInfo, err := store.getCommitInfo(2)
+	require.Nil(t, err)
+	require.Equal(t, commitIDs[1], cInfo.withHasher(store.hasher).CommitID())
+
+	// The least recently used versions are evicted.
+	store.SetCommitInfoCacheSize(2)
+	for ver := int64(1); ver <= 2; ver++ {
+		_, err := store.getCommitInfo(ver)
+		require.Nil(t, err)
+	}
+	_, err = store.getCommitInfo(1)
+	require.Nil(t, err)
+	store.commitInfoCache.add(manyStoresCommitInfo(1))
+	require.Equal(t, 2, store.commitInfoCache.len())
+	_, ok = store.commitInfoCache.get(2)
+	require.False(t, ok)
+	_, ok = store.commitInfoCache.get(1)
+	require.True(t, ok)
+
+	store.SetCommitInfoCacheSize(0)
+	require.Nil(t, store.commitInfoCache)
+	_, err = store.getCommitInfo(1)
+	require.Nil(t, err)
+}
+
+func benchmarkMultistoreCommit(b *testing.B, workers int) {
+	ms := NewCommitMultiStore(dbm.NewMemDB())
+	ms.SetCommitConcurrency(workers)
+	keys := make([]StoreKey, 12)
+	for i := range keys {
+		keys[i] = sdk.NewKVStoreKey(fmt.Sprintf("store%d", i))
+		ms.MountStoreWithDB(keys[i], sdk.StoreTypeIAVL, nil)
+	}
+	require.Nil(b, ms.LoadLatestVersion())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for _, key := range keys {
+			kv := ms.GetKVStore(key)
+			for j := 0; j < 100; j++ {
+				kv.Set(keyFmt(i*100+j), valFmt(j))
+			}
+		}
+		b.StartTimer()
+		ms.Commit()
+	}
+}
+
+func BenchmarkMultistoreCommitSerial(b *testing.B)   { benchmarkMultistoreCommit(b, 1) }
+func BenchmarkMultistoreCommitParallel(b *testing.B) { benchmarkMultistoreCommit(b, 0) }
+
+func benchmarkCommitInfoHash(b *testing.B, memoized bool) {
+	storeInfos := make([]storeInfo, 12)
+	for i := range storeInfos {
+		storeInfos[i].Name = fmt.Sprintf("store%d", i)
+		storeInfos[i].Type = newStoreTypeTag(sdk.StoreTypeIAVL)
+		storeInfos[i].Core.CommitID = CommitID{Version: 1, Hash: valFmt(i)}
+	}
+	cInfo := commitInfo{Version: 1, StoreInfos: storeInfos}
+	if memoized {
+		cInfo = newCommitInfo(1, storeInfos)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cInfo.Hash()
+	}
+}
+
+func BenchmarkCommitInfoHash(b *testing.B)         { benchmarkCommitInfoHash(b, false) }
+func BenchmarkCommitInfoHashMemoized(b *testing.B) { benchmarkCommitInfoHash(b, true) }
+
+func benchmarkGetCommitInfo(b *testing.B, compress bool) {
+	db := dbm.NewMemDB()
+	batch := db.NewBatch()
+	setCommitInfo(batch, 1, manyStoresCommitInfo(500), compress)
+	batch.Write()
+	b.SetBytes(int64(len(db.Get(commitInfoKey(1)))))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := getCommitInfo(db, 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetCommitInfo(b *testing.B)           { benchmarkGetCommitInfo(b, false) }
+func BenchmarkGetCommitInfoCompressed(b *testing.B) { benchmarkGetCommitInfo(b, true) }
+
+func benchmarkProvedQuery(b *testing.B, cacheSize int) {
+	db := dbm.NewMemDB()
+	store := NewCommitMultiStore(db)
+	for i := 0; i < 100; i++ {
+		store.MountStoreWithDB(sdk.NewKVStoreKey(fmt.Sprintf("store%03d", i)), sdk.StoreTypeIAVL, nil)
+	}
+	store.SetCommitInfoCacheSize(cacheSize)
+	require.Nil(b, store.LoadLatestVersion())
+	store.getStoreByName("store000").(KVStore).Set(keyFmt(1), valFmt(1))
+	commitID := store.Commit()
+	query := abci.RequestQuery{Path: "/store000/key", Data: keyFmt(1), Height: commitID.Version, Prove: true}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if res := store.Query(query); !res.IsOK() {
+			b.Fatal(res.Log)
+		}
+	}
+}
+
+func BenchmarkProvedQueryUncached(b *testing.B) { benchmarkProvedQuery(b, 0) }
+func BenchmarkProvedQueryCached(b *testing.B) {
+	benchmarkProvedQuery(b, DefaultCommitInfoCacheSize)
+}
+
+// manyStoresCommitInfo returns a commit info of n IAVL stores with distinct
+// hashes.
+func manyStoresCommitInfo(n int) commitInfo {
+	storeInfos := make([]storeInfo, n)
+	for i := range storeInfos {
+		hash := sha256.Sum256(valFmt(i))
+		storeInfos[i].Name = fmt.Sprintf("store%04d", i)
+		storeInfos[i].Type = newStoreTypeTag(sdk.StoreTypeIAVL)
+		storeInfos[i].Core.CommitID = CommitID{Version: 1000, Hash: hash[:]}
+	}
+	return newCommitInfo(1000, storeInfos)
+}
+
+//-----------------------------------------------------------------------
+// utils
+
+func newMultiStoreWithMounts(db dbm.DB) *rootMultiStore {
+	store := NewCommitMultiStore(db)
+	store.MountStoreWithDB(
+		sdk.NewKVStoreKey("store1"), sdk.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(
+		sdk.NewKVStoreKey("store2"), sdk.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(
+		sdk.NewKVStoreKey("store3"), sdk.StoreTypeIAVL, nil)
+	return store
+}
+
+func newMultiStoreWithNestedMounts(db dbm.DB) *rootMultiStore {
+	store := newMultiStoreWithMounts(db)
+	nestedKey := sdk.NewKVStoreKey("nested")
+	store.MountStoreWithDB(nestedKey, sdk.StoreTypeMulti, nil)
+	store.MountSubStore(nestedKey, sdk.NewKVStoreKey("inner1"), sdk.StoreTypeIAVL)
+	store.MountSubStore(nestedKey, sdk.NewKVStoreKey("inner2"), sdk.StoreTypeIAVL)
 	return store
 }
 
@@ -221,8 +2637,8 @@ func hashStores(stores map[StoreKey]CommitStore) []byte {
 		m[name] = storeInfo{
 			Name: name,
 			Core: storeCore{
-				CommitID: store.LastCommitID(),
-				// StoreType: store.GetStoreType(),
+				CommitID:  store.LastCommitID(),
+				StoreType: store.GetStoreType(),
 			},
 		}.Hash()
 	}
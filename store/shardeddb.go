@@ -0,0 +1,233 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+
+	dbm "github.com/tendermint/tendermint/libs/db"
+)
+
+// ShardedDB spreads the keys of a single logical db over several physical
+// dbs by a hash of the key, e.g. to mount a store with MountStoreWithDB
+// whose writes would otherwise contend on a single db. Every key is held by
+// exactly one shard, so the shards and their order must stay the same for
+// the lifetime of the data.
+//
+// Batches are split into one batch per shard, which are written one after
+// the other. Each shard applies its part atomically, but the batch as a
+// whole is not atomic: a crash while writing leaves the shards written so
+// far updated and the others not, which may leave a store referencing data
+// that was never written. Only use it with backends and setups where
+// partial writes can be recovered from, e.g. by restoring from a snapshot.
+// Implements dbm.DB.
+type ShardedDB struct {
+	shards []dbm.DB
+}
+
+var _ dbm.DB = (*ShardedDB)(nil)
+
+// NewShardedDB returns a ShardedDB over the given shards. Panics if there
+// are none.
+func NewShardedDB(shards ...dbm.DB) *ShardedDB {
+	if len(shards) == 0 {
+		panic("ShardedDB needs at least one shard")
+	}
+	return &ShardedDB{shards: shards}
+}
+
+// shard returns the shard holding key.
+func (sdb *ShardedDB) shard(key []byte) dbm.DB {
+	return sdb.shards[sdb.shardIndex(key)]
+}
+
+func (sdb *ShardedDB) shardIndex(key []byte) int {
+	h := fnv.New32a()
+	h.Write(key) // nolint: errcheck
+	return int(h.Sum32() % uint32(len(sdb.shards)))
+}
+
+// Implements dbm.DB.
+func (sdb *ShardedDB) Get(key []byte) []byte {
+	return sdb.shard(key).Get(key)
+}
+
+// Implements dbm.DB.
+func (sdb *ShardedDB) Has(key []byte) bool {
+	return sdb.shard(key).Has(key)
+}
+
+// Implements dbm.DB.
+func (sdb *ShardedDB) Set(key, value []byte) {
+	sdb.shard(key).Set(key, value)
+}
+
+// Implements dbm.DB.
+func (sdb *ShardedDB) SetSync(key, value []byte) {
+	sdb.shard(key).SetSync(key, value)
+}
+
+// Implements dbm.DB.
+func (sdb *ShardedDB) Delete(key []byte) {
+	sdb.shard(key).Delete(key)
+}
+
+// Implements dbm.DB.
+func (sdb *ShardedDB) DeleteSync(key []byte) {
+	sdb.shard(key).DeleteSync(key)
+}
+
+// Implements dbm.DB. The iterator merges the iterators of all shards.
+func (sdb *ShardedDB) Iterator(start, end []byte) dbm.Iterator {
+	iters := make([]dbm.Iterator, len(sdb.shards))
+	for i, shard := range sdb.shards {
+		iters[i] = shard.Iterator(start, end)
+	}
+	return newShardedIterator(start, end, iters, true)
+}
+
+// Implements dbm.DB. The iterator merges the iterators of all shards.
+func (sdb *ShardedDB) ReverseIterator(start, end []byte) dbm.Iterator {
+	iters := make([]dbm.Iterator, len(sdb.shards))
+	for i, shard := range sdb.shards {
+		iters[i] = shard.ReverseIterator(start, end)
+	}
+	return newShardedIterator(start, end, iters, false)
+}
+
+// Implements dbm.DB.
+func (sdb *ShardedDB) Close() {
+	for _, shard := range sdb.shards {
+		shard.Close()
+	}
+}
+
+// Implements dbm.DB. See ShardedDB for the atomicity of the batch.
+func (sdb *ShardedDB) NewBatch() dbm.Batch {
+	batches := make([]dbm.Batch, len(sdb.shards))
+	for i, shard := range sdb.shards {
+		batches[i] = shard.NewBatch()
+	}
+	return &shardedBatch{db: sdb, batches: batches}
+}
+
+// Implements dbm.DB.
+func (sdb *ShardedDB) Print() {
+	for i, shard := range sdb.shards {
+		fmt.Printf("shard %d:\n", i)
+		shard.Print()
+	}
+}
+
+// Implements dbm.DB. The stats of each shard are prefixed with its index.
+func (sdb *ShardedDB) Stats() map[string]string {
+	stats := make(map[string]string)
+	for i, shard := range sdb.shards {
+		for k, v := range shard.Stats() {
+			stats[fmt.Sprintf("shard%d.%s", i, k)] = v
+		}
+	}
+	return stats
+}
+
+// shardedBatch splits a batch into one batch per shard.
+// Implements dbm.Batch.
+type shardedBatch struct {
+	db      *ShardedDB
+	batches []dbm.Batch
+}
+
+func (sb *shardedBatch) Set(key, value []byte) {
+	sb.batches[sb.db.shardIndex(key)].Set(key, value)
+}
+
+func (sb *shardedBatch) Delete(key []byte) {
+	sb.batches[sb.db.shardIndex(key)].Delete(key)
+}
+
+// Write writes the batch of each shard in shard order.
+func (sb *shardedBatch) Write() {
+	for _, batch := range sb.batches {
+		batch.Write()
+	}
+}
+
+// WriteSync writes the batch of each shard in shard order, syncing each.
+func (sb *shardedBatch) WriteSync() {
+	for _, batch := range sb.batches {
+		batch.WriteSync()
+	}
+}
+
+// shardedIterator merges the iterators of the shards, which hold disjoint
+// keys, into a single ordered iteration.
+// Implements dbm.Iterator.
+type shardedIterator struct {
+	start, end []byte
+	iters      []dbm.Iterator
+	ascending  bool
+
+	// cur is the index of the iterator at the current key, -1 once all
+	// iterators are exhausted.
+	cur int
+}
+
+func newShardedIterator(start, end []byte, iters []dbm.Iterator, ascending bool) *shardedIterator {
+	si := &shardedIterator{start: start, end: end, iters: iters, ascending: ascending}
+	si.pick()
+	return si
+}
+
+// pick moves cur to the iterator at the next key in iteration order.
+func (si *shardedIterator) pick() {
+	si.cur = -1
+	for i, iter := range si.iters {
+		if !iter.Valid() {
+			continue
+		}
+		if si.cur < 0 {
+			si.cur = i
+			continue
+		}
+		cmp := bytes.Compare(iter.Key(), si.iters[si.cur].Key())
+		if (si.ascending && cmp < 0) || (!si.ascending && cmp > 0) {
+			si.cur = i
+		}
+	}
+}
+
+func (si *shardedIterator) Domain() ([]byte, []byte) {
+	return si.start, si.end
+}
+
+func (si *shardedIterator) Valid() bool {
+	return si.cur >= 0
+}
+
+func (si *shardedIterator) assertValid() {
+	if !si.Valid() {
+		panic("shardedIterator is invalid")
+	}
+}
+
+func (si *shardedIterator) Next() {
+	si.assertValid()
+	si.iters[si.cur].Next()
+	si.pick()
+}
+
+func (si *shardedIterator) Key() []byte {
+	si.assertValid()
+	return si.iters[si.cur].Key()
+}
+
+func (si *shardedIterator) Value() []byte {
+	si.assertValid()
+	return si.iters[si.cur].Value()
+}
+
+func (si *shardedIterator) Close() {
+	for _, iter := range si.iters {
+		iter.Close()
+	}
+}
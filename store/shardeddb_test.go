@@ -0,0 +1,78 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	dbm "github.com/tendermint/tendermint/libs/db"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+)
+
+func TestShardedDB(t *testing.T) {
+	shards := []dbm.DB{dbm.NewMemDB(), dbm.NewMemDB(), dbm.NewMemDB()}
+	db := NewShardedDB(shards...)
+	truth := dbm.NewMemDB()
+
+	for i := 0; i < 100; i++ {
+		db.Set(keyFmt(i), valFmt(i))
+		truth.Set(keyFmt(i), valFmt(i))
+	}
+	batch := db.NewBatch()
+	for i := 0; i < 100; i += 3 {
+		batch.Delete(keyFmt(i))
+		truth.Delete(keyFmt(i))
+	}
+	batch.Set(keyFmt(200), valFmt(200))
+	truth.Set(keyFmt(200), valFmt(200))
+	batch.Write()
+
+	// every key is held by a single shard, and all shards are used
+	for i := 0; i < 100; i++ {
+		held := 0
+		for _, shard := range shards {
+			if shard.Has(keyFmt(i)) {
+				held++
+			}
+		}
+		require.Equal(t, truth.Has(keyFmt(i)), held == 1)
+		require.Equal(t, truth.Get(keyFmt(i)), db.Get(keyFmt(i)))
+	}
+	for _, shard := range shards {
+		require.NotEmpty(t, collectKVs(shard.Iterator(nil, nil)))
+	}
+
+	require.Equal(t, collectKVs(truth.Iterator(nil, nil)), collectKVs(db.Iterator(nil, nil)))
+	require.Equal(t, collectKVs(truth.Iterator(keyFmt(10), keyFmt(50))),
+		collectKVs(db.Iterator(keyFmt(10), keyFmt(50))))
+	require.Equal(t, collectKVs(truth.ReverseIterator(nil, nil)), collectKVs(db.ReverseIterator(nil, nil)))
+	require.Equal(t, collectKVs(truth.ReverseIterator(keyFmt(50), keyFmt(10))),
+		collectKVs(db.ReverseIterator(keyFmt(50), keyFmt(10))))
+
+	require.Panics(t, func() { NewShardedDB() })
+}
+
+func TestShardedDBMounted(t *testing.T) {
+	shards := []dbm.DB{dbm.NewMemDB(), dbm.NewMemDB()}
+	plain := NewCommitMultiStore(dbm.NewMemDB())
+	sharded := NewCommitMultiStore(dbm.NewMemDB())
+	plainKey, shardedKey := sdk.NewKVStoreKey("store"), sdk.NewKVStoreKey("store")
+	plain.MountStoreWithDB(plainKey, sdk.StoreTypeIAVL, nil)
+	sharded.MountStoreWithDB(shardedKey, sdk.StoreTypeIAVL, NewShardedDB(shards...))
+	require.Nil(t, plain.LoadLatestVersion())
+	require.Nil(t, sharded.LoadLatestVersion())
+
+	for i := 0; i < 50; i++ {
+		plain.GetKVStore(plainKey).Set(keyFmt(i), valFmt(i))
+		sharded.GetKVStore(shardedKey).Set(keyFmt(i), valFmt(i))
+	}
+	commitID := sharded.Commit()
+	require.Equal(t, plain.Commit(), commitID)
+
+	db := sharded.db
+	reloaded := NewCommitMultiStore(db)
+	reloaded.MountStoreWithDB(shardedKey, sdk.StoreTypeIAVL, NewShardedDB(shards...))
+	require.Nil(t, reloaded.LoadLatestVersion())
+	require.Equal(t, commitID, reloaded.LastCommitID())
+	require.Equal(t, valFmt(7), reloaded.GetKVStore(shardedKey).Get(keyFmt(7)))
+}
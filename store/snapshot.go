@@ -0,0 +1,358 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/tendermint/iavl"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+)
+
+// Snapshots are a stream of amino length-prefixed items: a snapshotHeader
+// followed by the snapshotItems of every non-empty store, sorted by store
+// name. The items of a store hold its key/value pairs in key order, one per
+// item, and are terminated by an end marker. Both export and import handle
+// one item at a time, so the memory used doesn't grow with the size of the
+// stores.
+
+// maxSnapshotValueSize bounds the size of a value imported from a snapshot.
+const maxSnapshotValueSize = 1 << 26
+
+// maxSnapshotItemSize bounds the size of a single decoded snapshot item, ie.
+// a value along with its key and proof.
+const maxSnapshotItemSize = maxSnapshotValueSize + 1<<20
+
+// snapshotHeader describes the commit a snapshot was taken at.
+type snapshotHeader struct {
+	Version    int64
+	StoreInfos []storeInfo
+}
+
+// snapshotItem holds a key/value pair of a store along with a proof against
+// the store's root hash at the snapshot version that the key directly
+// follows the key of the previous item of the store, or is the first key of
+// the store. If End is set, the item holds no pair and the proof shows that
+// the previous item holds the last key of the store.
+type snapshotItem struct {
+	StoreName string
+	Key       []byte
+	Value     []byte
+	End       bool
+	Proof     *iavl.RangeProof
+}
+
+// ExportSnapshot writes all the key/value pairs of the stores committed at
+// version to w. Only IAVL stores can be exported; transient stores are not
+// committed and hence skipped. The pairs are streamed from the stores to w
+// one at a time.
+func (rs *rootMultiStore) ExportSnapshot(version int64, w io.Writer) error {
+	cInfo, err := rs.getCommitInfo(version)
+	if err != nil {
+		return err
+	}
+
+	infos := make([]storeInfo, len(cInfo.StoreInfos))
+	copy(infos, cInfo.StoreInfos)
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	header := snapshotHeader{Version: version, StoreInfos: infos}
+	if _, err := cdc.MarshalBinaryLengthPrefixedWriter(w, header); err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		store, ok := rs.getStoreByName(info.Name).(*iavlStore)
+		if !ok {
+			return fmt.Errorf("cannot export store %s of type %v", info.Name, info.Type)
+		}
+
+		// Empty trees have no root to prove against.
+		if len(info.Core.CommitID.Hash) == 0 {
+			continue
+		}
+
+		if err := exportSnapshotItems(w, info.Name, store.tree, version); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// exportSnapshotItems writes the items of the tree at version to w, reading
+// each pair along with the previous one, which the proof has to cover.
+func exportSnapshotItems(w io.Writer, name string, tree *iavl.MutableTree, version int64) error {
+	var prev []byte
+	for first := true; ; first = false {
+		var (
+			keys, values [][]byte
+			proof        *iavl.RangeProof
+			err          error
+		)
+		if first {
+			keys, values, proof, err = tree.GetVersionedRangeWithProof(nil, nil, 1, version)
+		} else {
+			keys, values, proof, err = tree.GetVersionedRangeWithProof(prev, nil, 2, version)
+			if err != nil {
+				return err
+			}
+			if len(keys) == 0 || !bytes.Equal(keys[0], prev) {
+				return fmt.Errorf("key %X of store %s disappeared while exporting", prev, name)
+			}
+			keys, values = keys[1:], values[1:]
+		}
+		if err != nil {
+			return err
+		}
+
+		item := snapshotItem{StoreName: name, Proof: proof}
+		if len(keys) == 0 {
+			item.End = true
+		} else {
+			item.Key, item.Value = keys[0], values[0]
+		}
+		if _, err := cdc.MarshalBinaryLengthPrefixedWriter(w, item); err != nil {
+			return err
+		}
+		if item.End {
+			return nil
+		}
+		prev = item.Key
+	}
+}
+
+// ImportSnapshot reads a snapshot written by ExportSnapshot into the mounted
+// stores and loads them at the snapshot version. The rootMultiStore must be
+// loaded and empty.
+//
+// The snapshot must commit to trusted, the CommitID of a trusted header at
+// the snapshot version; its header is rejected otherwise, before anything
+// is written. Every imported key/value pair is then verified against the
+// header's store hashes. Values larger than maxSnapshotValueSize, or than
+// the limit set with SetMaxValueSize, are rejected without reading them
+// into memory whole.
+//
+// IAVL node hashes depend on the version history of the tree, so the stores
+// can't be rebuilt by setting the pairs. Instead, the nodes are rebuilt from
+// the verified proofs and persisted as iavl does, see checkIAVLFormat. Each
+// rebuilt tree is loaded again through iavl and verified against its store
+// hash before the snapshot's commitInfo and latest version are written, so
+// the stores continue from the snapshot version with the snapshot's root
+// hashes. On any error, all data written to the stores is deleted again.
+func (rs *rootMultiStore) ImportSnapshot(r io.Reader, trusted CommitID) error {
+	if !rs.lastCommitID.IsZero() {
+		return fmt.Errorf("cannot import snapshot into non-empty store at version %d", rs.lastCommitID.Version)
+	}
+	if err := checkIAVLFormat(); err != nil {
+		return err
+	}
+
+	var header snapshotHeader
+	if _, err := cdc.UnmarshalBinaryLengthPrefixedReader(r, &header, maxSnapshotItemSize); err != nil {
+		return fmt.Errorf("failed to read snapshot header: %v", err)
+	}
+	cInfo := newCommitInfo(header.Version, header.StoreInfos).withHasher(rs.hasher)
+	if id := cInfo.CommitID(); id.Version != trusted.Version || !bytes.Equal(id.Hash, trusted.Hash) {
+		return fmt.Errorf("snapshot commits to %v, expected %v", id, trusted)
+	}
+	if header.Version <= 0 {
+		return fmt.Errorf("invalid snapshot version %d", header.Version)
+	}
+
+	infos := make(map[string]storeInfo, len(header.StoreInfos))
+	for _, info := range header.StoreInfos {
+		key := rs.keysByName[info.Name]
+		if key == nil {
+			return fmt.Errorf("snapshot store %s is not mounted", info.Name)
+		}
+		typ := rs.storesParams[key].typ
+		if snapshotTyp, ok := info.Type.storeType(); ok && typ != snapshotTyp {
+			return fmt.Errorf("store type mismatch for %s: snapshot %v, mounted %v",
+				info.Name, snapshotTyp, typ)
+		}
+		if typ != sdk.StoreTypeIAVL {
+			return fmt.Errorf("cannot import store %s of type %v", info.Name, typ)
+		}
+		infos[info.Name] = info
+	}
+
+	if err := rs.importSnapshotStores(r, infos); err != nil {
+		for name := range infos {
+			deleteAllKeys(rs.storeDB(rs.storesParams[rs.keysByName[name]]), defaultFlushEvery)
+		}
+		return err
+	}
+
+	// Need to update atomically.
+	batch := rs.db.NewBatch()
+	setCommitInfo(batch, header.Version, cInfo, rs.compressCommitInfo)
+	setLatestVersion(batch, header.Version)
+	batch.Write()
+
+	return rs.LoadVersion(header.Version)
+}
+
+// importSnapshotStores reads the snapshot items following the header into
+// the stores of infos, and verifies the rebuilt trees.
+func (rs *rootMultiStore) importSnapshotStores(r io.Reader, infos map[string]storeInfo) error {
+	// The store being imported, the tree of its nodes, and the last pair
+	// imported into it if any.
+	var (
+		current   string
+		tree      *snapshotTreeWriter
+		prev      []byte
+		prevValue []byte
+		hasPrev   bool
+	)
+	// The number of pairs imported per store.
+	imported := make(map[string]int64, len(infos))
+	for {
+		var item snapshotItem
+		_, err := cdc.UnmarshalBinaryLengthPrefixedReader(r, &item, rs.snapshotItemLimit(current))
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read snapshot item: %v", err)
+		}
+
+		if current == "" {
+			if err := startSnapshotStore(item.StoreName, infos, imported); err != nil {
+				return err
+			}
+			current, prev, prevValue, hasPrev = item.StoreName, nil, nil, false
+			tree = newSnapshotTreeWriter(rs.storeDB(rs.storesParams[rs.keysByName[current]]))
+		} else if item.StoreName != current {
+			return fmt.Errorf("snapshot is missing the end of store %s", current)
+		}
+
+		info := infos[current]
+		if err := verifySnapshotItem(item, info.Core.CommitID.Hash, prev, hasPrev); err != nil {
+			return err
+		}
+
+		// Each item proves the path to the previous pair, the first item the
+		// path to its own pair, which the next item proves again.
+		if hasPrev {
+			if err := tree.writeLeaf(item.Proof, prev, prevValue); err != nil {
+				return fmt.Errorf("invalid snapshot item in store %s: %v", current, err)
+			}
+			imported[current]++
+		}
+		if item.End {
+			tree.writeRoot(info.Core.CommitID)
+			current = ""
+			continue
+		}
+
+		if max, ok := rs.maxValueSizes[rs.keysByName[current]]; ok && len(item.Value) > max {
+			return fmt.Errorf("snapshot value of %X in store %s exceeds the limit of %d bytes",
+				item.Key, current, max)
+		}
+		value := item.Value
+		if value == nil {
+			// Empty values decode as nil.
+			value = []byte{}
+		}
+		prev, prevValue, hasPrev = item.Key, value, true
+	}
+
+	if current != "" {
+		return fmt.Errorf("snapshot is missing the end of store %s", current)
+	}
+	for name, info := range infos {
+		db := rs.storeDB(rs.storesParams[rs.keysByName[name]])
+		if len(info.Core.CommitID.Hash) == 0 {
+			newSnapshotTreeWriter(db).writeRoot(info.Core.CommitID)
+			continue
+		}
+		if _, ok := imported[name]; !ok {
+			return fmt.Errorf("snapshot is missing data for store %s", name)
+		}
+		if err := verifyIAVLTree(db, info.Core.CommitID, imported[name]); err != nil {
+			return fmt.Errorf("imported store %s doesn't verify: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// snapshotItemLimit returns the size limit of the next snapshot item of the
+// given store, which is empty before the first item of a store.
+func (rs *rootMultiStore) snapshotItemLimit(current string) int64 {
+	max, ok := rs.maxValueSizes[rs.keysByName[current]]
+	if !ok || max >= maxSnapshotValueSize {
+		return maxSnapshotItemSize
+	}
+	return int64(max) + maxSnapshotItemSize - maxSnapshotValueSize
+}
+
+// startSnapshotStore checks that the items of the named store may start and
+// marks the store as imported.
+func startSnapshotStore(name string, infos map[string]storeInfo, imported map[string]int64) error {
+	info, ok := infos[name]
+	if !ok {
+		return fmt.Errorf("snapshot item for unknown store %s", name)
+	}
+	if len(info.Core.CommitID.Hash) == 0 {
+		return fmt.Errorf("snapshot item for empty store %s", name)
+	}
+	if _, ok := imported[name]; ok {
+		return fmt.Errorf("duplicate snapshot items for store %s", name)
+	}
+	imported[name] = 0
+	return nil
+}
+
+// verifySnapshotItem verifies the item against the root hash of its store,
+// and that its key is the first key of the store following prev, or the
+// first key of the store at all if there is no prev. For an end marker it
+// verifies that no key follows prev.
+func verifySnapshotItem(item snapshotItem, root []byte, prev []byte, hasPrev bool) error {
+	name := item.StoreName
+	if item.Proof == nil {
+		return fmt.Errorf("snapshot item for store %s has no proof", name)
+	}
+	if err := item.Proof.Verify(root); err != nil {
+		return fmt.Errorf("invalid snapshot proof for store %s: %v", name, err)
+	}
+
+	// The first leaf of the proof beyond prev must be the item's key. An
+	// absence proof of the smallest key beyond prev shows that no key of the
+	// store lies in between.
+	var next []byte
+	hasNext := false
+	for _, leaf := range item.Proof.Leaves {
+		if !hasPrev || bytes.Compare(leaf.Key, prev) > 0 {
+			next, hasNext = leaf.Key, true
+			break
+		}
+	}
+	if hasPrev {
+		if err := item.Proof.VerifyAbsence(append(cp(prev), 0)); err != nil {
+			return fmt.Errorf("snapshot item for store %s doesn't follow key %X: %v", name, prev, err)
+		}
+	} else if hasNext && len(next) > 0 {
+		if err := item.Proof.VerifyAbsence([]byte{}); err != nil {
+			return fmt.Errorf("snapshot item for store %s doesn't hold its first key: %v", name, err)
+		}
+	}
+
+	if item.End {
+		if hasNext || !hasPrev {
+			return fmt.Errorf("snapshot items of store %s end early", name)
+		}
+		return nil
+	}
+	if !hasNext || !bytes.Equal(next, item.Key) {
+		return fmt.Errorf("snapshot item %X of store %s is out of order", item.Key, name)
+	}
+	if err := item.Proof.VerifyItem(item.Key, item.Value); err != nil {
+		return fmt.Errorf("invalid snapshot item in store %s: %v", name, err)
+	}
+	return nil
+}
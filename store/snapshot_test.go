@@ -0,0 +1,220 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	dbm "github.com/tendermint/tendermint/libs/db"
+)
+
+func TestSnapshotExportImport(t *testing.T) {
+	source := newMultiStoreWithMounts(dbm.NewMemDB())
+	require.Nil(t, source.LoadLatestVersion())
+
+	store1 := source.getStoreByName("store1").(KVStore)
+	store2 := source.getStoreByName("store2").(KVStore)
+	for i := 0; i < 10; i++ {
+		store1.Set(keyFmt(i), valFmt(i))
+	}
+	source.Commit()
+	store2.Set(keyFmt(1), valFmt(1))
+	store1.Delete(keyFmt(0))
+	commitID := source.Commit()
+	store1.Set(keyFmt(0), valFmt(100))
+	nextID := source.Commit()
+
+	var buf bytes.Buffer
+	require.Nil(t, source.ExportSnapshot(commitID.Version, &buf))
+
+	target := newMultiStoreWithMounts(dbm.NewMemDB())
+	require.Nil(t, target.LoadLatestVersion())
+	require.Nil(t, target.ImportSnapshot(&buf, commitID))
+	require.Equal(t, commitID, target.LastCommitID())
+	require.Equal(t, commitID.Version, getLatestVersion(target.db))
+
+	// The snapshot holds the state as of the exported version.
+	store1 = target.getStoreByName("store1").(KVStore)
+	require.Nil(t, store1.Get(keyFmt(0)))
+	for i := 1; i < 10; i++ {
+		require.Equal(t, valFmt(i), store1.Get(keyFmt(i)))
+	}
+	require.Equal(t, valFmt(1), target.getStoreByName("store2").(KVStore).Get(keyFmt(1)))
+
+	// Cannot import twice.
+	require.Error(t, target.ImportSnapshot(&buf, commitID))
+
+	// The chain continues from the snapshot version with the same hashes.
+	target.getStoreByName("store1").(KVStore).Set(keyFmt(0), valFmt(100))
+	require.Equal(t, nextID, target.Commit())
+
+	// The imported version reloads.
+	db := target.db
+	target = newMultiStoreWithMounts(db)
+	require.Nil(t, target.LoadVersion(commitID.Version))
+	require.Equal(t, commitID, target.LastCommitID())
+	require.Equal(t, valFmt(5), target.getStoreByName("store1").(KVStore).Get(keyFmt(5)))
+}
+
+func TestSnapshotImportTampered(t *testing.T) {
+	source := newMultiStoreWithMounts(dbm.NewMemDB())
+	require.Nil(t, source.LoadLatestVersion())
+	store1 := source.getStoreByName("store1").(KVStore)
+	for i := 0; i < 10; i++ {
+		store1.Set(keyFmt(i), valFmt(i))
+	}
+	commitID := source.Commit()
+
+	var buf bytes.Buffer
+	require.Nil(t, source.ExportSnapshot(commitID.Version, &buf))
+
+	var header snapshotHeader
+	_, err := cdc.UnmarshalBinaryLengthPrefixedReader(&buf, &header, maxSnapshotItemSize)
+	require.Nil(t, err)
+	var items []snapshotItem
+	for {
+		var item snapshotItem
+		_, err = cdc.UnmarshalBinaryLengthPrefixedReader(&buf, &item, maxSnapshotItemSize)
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err)
+		items = append(items, item)
+	}
+	require.Len(t, items, 11)
+	require.True(t, items[10].End)
+
+	encode := func(header snapshotHeader, items []snapshotItem) io.Reader {
+		var out bytes.Buffer
+		_, err := cdc.MarshalBinaryLengthPrefixedWriter(&out, header)
+		require.Nil(t, err)
+		for _, item := range items {
+			_, err = cdc.MarshalBinaryLengthPrefixedWriter(&out, item)
+			require.Nil(t, err)
+		}
+		return &out
+	}
+	without := func(i int) []snapshotItem {
+		return append(append([]snapshotItem{}, items[:i]...), items[i+1:]...)
+	}
+	// Failed imports leave no data behind.
+	importFails := func(r io.Reader, trusted CommitID) {
+		db := dbm.NewMemDB()
+		target := newMultiStoreWithMounts(db)
+		require.Nil(t, target.LoadLatestVersion())
+		before := collectKVs(db.Iterator(nil, nil))
+		require.Error(t, target.ImportSnapshot(r, trusted))
+		require.Equal(t, before, collectKVs(db.Iterator(nil, nil)))
+		require.True(t, target.LastCommitID().IsZero())
+	}
+
+	// Tampered value.
+	tampered := append([]snapshotItem{}, items...)
+	tampered[3].Value = valFmt(42)
+	importFails(encode(header, tampered), commitID)
+
+	// Dropped items, at the start, in the middle and at the end.
+	importFails(encode(header, without(0)), commitID)
+	importFails(encode(header, without(5)), commitID)
+	importFails(encode(header, without(9)), commitID)
+
+	// Dropped end marker, or all items.
+	importFails(encode(header, items[:10]), commitID)
+	importFails(encode(header, nil), commitID)
+
+	// Swapped items.
+	swapped := append([]snapshotItem{}, items...)
+	swapped[4], swapped[5] = swapped[5], swapped[4]
+	importFails(encode(header, swapped), commitID)
+
+	// Untrusted version or hash.
+	importFails(encode(header, items), CommitID{Version: commitID.Version + 1, Hash: commitID.Hash})
+	importFails(encode(header, items), CommitID{Version: commitID.Version, Hash: valFmt(1)})
+
+	// A header with other store hashes, consistent with its items but not
+	// with the trusted commit.
+	other := newMultiStoreWithMounts(dbm.NewMemDB())
+	require.Nil(t, other.LoadLatestVersion())
+	other.getStoreByName("store1").(KVStore).Set(keyFmt(1), valFmt(2))
+	otherID := other.Commit()
+	require.Equal(t, commitID.Version, otherID.Version)
+	var otherBuf bytes.Buffer
+	require.Nil(t, other.ExportSnapshot(otherID.Version, &otherBuf))
+	importFails(&otherBuf, commitID)
+
+	// Untampered stream still imports.
+	target := newMultiStoreWithMounts(dbm.NewMemDB())
+	require.Nil(t, target.LoadLatestVersion())
+	require.Nil(t, target.ImportSnapshot(encode(header, items), commitID))
+	require.Equal(t, commitID, target.LastCommitID())
+}
+
+// heapWatchWriter records the peak of the live heap at the time of each
+// write above its base.
+type heapWatchWriter struct {
+	w    io.Writer
+	base uint64
+	peak uint64
+}
+
+func (hw *heapWatchWriter) Write(p []byte) (int, error) {
+	if inUse := liveHeap(); inUse > hw.base && inUse-hw.base > hw.peak {
+		hw.peak = inUse - hw.base
+	}
+	return hw.w.Write(p)
+}
+
+func liveHeap() uint64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+func TestSnapshotStreamsLargeValues(t *testing.T) {
+	const valueSize, numValues = 1 << 20, 16
+
+	source := newMultiStoreWithMounts(dbm.NewMemDB())
+	require.Nil(t, source.LoadLatestVersion())
+	store1 := source.getStoreByName("store1").(KVStore)
+	for i := 0; i < numValues; i++ {
+		store1.Set(keyFmt(i), bytes.Repeat([]byte{byte(i)}, valueSize))
+		store1.Set(keyFmt(numValues+i), valFmt(i))
+	}
+	commitID := source.Commit()
+
+	// Export to a file so the snapshot itself doesn't occupy the heap.
+	file, err := ioutil.TempFile("", "snapshot")
+	require.Nil(t, err)
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	watch := &heapWatchWriter{w: file, base: liveHeap()}
+	require.Nil(t, source.ExportSnapshot(commitID.Version, watch))
+	// Only a few values are held at a time, never the whole store.
+	require.True(t, watch.peak < 6*valueSize, "export used %d bytes", watch.peak)
+
+	_, err = file.Seek(0, io.SeekStart)
+	require.Nil(t, err)
+	target := newMultiStoreWithMounts(dbm.NewMemDB())
+	require.Nil(t, target.LoadLatestVersion())
+	require.Nil(t, target.ImportSnapshot(bufio.NewReader(file), commitID))
+	require.Equal(t, commitID, target.LastCommitID())
+	for i := 0; i < numValues; i++ {
+		value := target.getStoreByName("store1").(KVStore).Get(keyFmt(i))
+		require.Equal(t, bytes.Repeat([]byte{byte(i)}, valueSize), value)
+	}
+
+	// Values beyond the store's limit are rejected.
+	_, err = file.Seek(0, io.SeekStart)
+	require.Nil(t, err)
+	target = newMultiStoreWithMounts(dbm.NewMemDB())
+	require.Nil(t, target.SetMaxValueSize(target.keysByName["store1"], valueSize-1))
+	require.Nil(t, target.LoadLatestVersion())
+	require.Error(t, target.ImportSnapshot(bufio.NewReader(file), commitID))
+}
@@ -0,0 +1,162 @@
+package store
+
+import (
+	"fmt"
+	"io"
+
+	dbm "github.com/tendermint/tendermint/libs/db"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+)
+
+// snapshotView is a read-only MultiStore over the committed version of the
+// stores of a rootMultiStore at the time it was taken, see SnapshotView.
+// Implements MultiStore.
+type snapshotView struct {
+	version    int64
+	stores     map[StoreKey]CacheWrapper
+	keysByName map[string]StoreKey
+
+	traceWriter  io.Writer
+	traceContext TraceContext
+}
+
+var _ MultiStore = (*snapshotView)(nil)
+
+// SnapshotView returns a read-only view of the last committed version of all
+// IAVL and nested stores, which is safe to read from concurrently with
+// Commit. The view reflects the version committed at the time of the call
+// and doesn't see subsequent commits, nor uncommitted writes. Writing to its
+// stores panics. Stores of other types are not part of the view.
+//
+// The view pins the versions of the underlying trees, so reads fail once
+// the pruning strategy deletes the pinned version. Panics if a committed
+// version can't be pinned.
+func (rs *rootMultiStore) SnapshotView() MultiStore {
+	rs.mtx.RLock()
+	defer rs.mtx.RUnlock()
+
+	view, err := rs.snapshotView()
+	if err != nil {
+		panic(err)
+	}
+	return view
+}
+
+func (rs *rootMultiStore) snapshotView() (*snapshotView, error) {
+	view := &snapshotView{
+		version:    rs.lastCommitID.Version,
+		stores:     make(map[StoreKey]CacheWrapper, len(rs.stores)),
+		keysByName: make(map[string]StoreKey, len(rs.stores)),
+	}
+	for key, store := range rs.stores {
+		switch store := store.(type) {
+		case *iavlStore:
+			committed, err := store.committedView()
+			if err != nil {
+				return nil, fmt.Errorf("failed to pin store %s: %v", key.Name(), err)
+			}
+			view.stores[key] = committed
+		case *rootMultiStore:
+			nested, err := store.snapshotView()
+			if err != nil {
+				return nil, fmt.Errorf("failed to pin store %s: %v", key.Name(), err)
+			}
+			view.stores[key] = nested
+		default:
+			continue
+		}
+		view.keysByName[key.Name()] = key
+	}
+	return view, nil
+}
+
+// Version returns the committed version the view reflects.
+func (sv *snapshotView) Version() int64 {
+	return sv.version
+}
+
+// Implements Store.
+func (sv *snapshotView) GetStoreType() StoreType {
+	return sdk.StoreTypeMulti
+}
+
+// Implements CacheWrapper. Writing the cache back panics.
+func (sv *snapshotView) CacheWrap() CacheWrap {
+	return sv.CacheMultiStore().(CacheWrap)
+}
+
+// Implements CacheWrapper. Writing the cache back panics.
+func (sv *snapshotView) CacheWrapWithTrace(_ io.Writer, _ TraceContext) CacheWrap {
+	return sv.CacheWrap()
+}
+
+// Implements MultiStore. Reads of the returned store see the view, writes
+// stay in the cache since writing them back panics.
+func (sv *snapshotView) CacheMultiStore() CacheMultiStore {
+	cms := cacheMultiStore{
+		db:           NewCacheKVStore(dbStoreAdapter{dbm.NewMemDB()}),
+		stores:       make(map[StoreKey]CacheWrap, len(sv.stores)),
+		keysByName:   sv.keysByName,
+		traceWriter:  sv.traceWriter,
+		traceContext: sv.traceContext,
+	}
+	for key, store := range sv.stores {
+		if cms.TracingEnabled() {
+			cms.stores[key] = store.CacheWrapWithTrace(cms.traceWriter, cms.traceContext)
+		} else {
+			cms.stores[key] = store.CacheWrap()
+		}
+	}
+	return cms
+}
+
+// Implements MultiStore.
+func (sv *snapshotView) GetStore(key StoreKey) Store {
+	store, ok := sv.stores[key]
+	if !ok {
+		return nil
+	}
+	return store.(Store)
+}
+
+// Implements MultiStore. Panics if the store is not part of the view.
+func (sv *snapshotView) GetKVStore(key StoreKey) KVStore {
+	store, ok := sv.stores[key].(KVStore)
+	if !ok {
+		panic(fmt.Sprintf("store %s is not a KVStore of the snapshot view", key.Name()))
+	}
+	if sv.TracingEnabled() {
+		store = NewTraceKVStore(store, sv.traceWriter, sv.traceContext)
+	}
+	return store
+}
+
+// Implements MultiStore.
+func (sv *snapshotView) WithTracer(w io.Writer) MultiStore {
+	sv.traceWriter = w
+	return sv
+}
+
+// Implements MultiStore.
+func (sv *snapshotView) WithTracingContext(tc TraceContext) MultiStore {
+	if sv.traceContext != nil {
+		for k, v := range tc {
+			sv.traceContext[k] = v
+		}
+	} else {
+		sv.traceContext = tc
+	}
+	return sv
+}
+
+// Implements MultiStore.
+func (sv *snapshotView) TracingEnabled() bool {
+	return sv.traceWriter != nil
+}
+
+// Implements MultiStore.
+func (sv *snapshotView) ResetTraceContext() MultiStore {
+	sv.traceContext = nil
+	return sv
+}
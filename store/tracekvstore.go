@@ -28,6 +28,9 @@ type (
 		parent  sdk.KVStore
 		writer  io.Writer
 		context TraceContext
+
+		// stats, if set, aggregates the Get/Set/Delete operations.
+		stats *TraceStats
 	}
 
 	// operation represents an IO operation
@@ -48,11 +51,21 @@ func NewTraceKVStore(parent sdk.KVStore, writer io.Writer, tc TraceContext) *Tra
 	return &TraceKVStore{parent: parent, writer: writer, context: tc}
 }
 
+// WithStats sets the TraceStats the Get/Set/Delete operations are tallied
+// in, nil to stop tallying. A TraceKVStore with a nil writer only tallies.
+func (tkv *TraceKVStore) WithStats(stats *TraceStats) *TraceKVStore {
+	tkv.stats = stats
+	return tkv
+}
+
 // Get implements the KVStore interface. It traces a read operation and
 // delegates a Get call to the parent KVStore.
 func (tkv *TraceKVStore) Get(key []byte) []byte {
 	value := tkv.parent.Get(key)
 
+	if tkv.stats != nil {
+		tkv.stats.record(readOp, key)
+	}
 	writeOperation(tkv.writer, readOp, tkv.context, key, value)
 	return value
 }
@@ -60,6 +73,9 @@ func (tkv *TraceKVStore) Get(key []byte) []byte {
 // Set implements the KVStore interface. It traces a write operation and
 // delegates the Set call to the parent KVStore.
 func (tkv *TraceKVStore) Set(key []byte, value []byte) {
+	if tkv.stats != nil {
+		tkv.stats.record(writeOp, key)
+	}
 	writeOperation(tkv.writer, writeOp, tkv.context, key, value)
 	tkv.parent.Set(key, value)
 }
@@ -67,6 +83,9 @@ func (tkv *TraceKVStore) Set(key []byte, value []byte) {
 // Delete implements the KVStore interface. It traces a write operation and
 // delegates the Delete call to the parent KVStore.
 func (tkv *TraceKVStore) Delete(key []byte) {
+	if tkv.stats != nil {
+		tkv.stats.record(deleteOp, key)
+	}
 	writeOperation(tkv.writer, deleteOp, tkv.context, key, nil)
 	tkv.parent.Delete(key)
 }
@@ -165,6 +184,21 @@ func (tkv *TraceKVStore) GetStoreType() sdk.StoreType {
 	return tkv.parent.GetStoreType()
 }
 
+// StoreName implements NamedStore.
+func (tkv *TraceKVStore) StoreName() string {
+	return storeName(tkv.parent)
+}
+
+// cacheDepth implements cacheDepthStore.
+func (tkv *TraceKVStore) cacheDepth() (int, int, bool) {
+	return storeCacheDepth(tkv.parent)
+}
+
+// cacheKeyValidator implements keyValidatorStore.
+func (tkv *TraceKVStore) cacheKeyValidator() func(key []byte) error {
+	return storeKeyValidator(tkv.parent)
+}
+
 // CacheWrap implements the KVStore interface. It panics as a TraceKVStore
 // cannot be cache wrapped.
 func (tkv *TraceKVStore) CacheWrap() sdk.CacheWrap {
@@ -178,9 +212,14 @@ func (tkv *TraceKVStore) CacheWrapWithTrace(_ io.Writer, _ TraceContext) CacheWr
 }
 
 // writeOperation writes a KVStore operation to the underlying io.Writer as
-// JSON-encoded data where the key/value pair is base64 encoded.
+// JSON-encoded data where the key/value pair is base64 encoded. Nothing is
+// written if w is nil.
 // nolint: errcheck
 func writeOperation(w io.Writer, op operation, tc TraceContext, key, value []byte) {
+	if w == nil {
+		return
+	}
+
 	traceOp := traceOperation{
 		Operation: op,
 		Key:       base64.StdEncoding.EncodeToString(key),
@@ -261,6 +261,32 @@ func TestTestTraceKVStoreReverseIterator(t *testing.T) {
 	require.NotPanics(t, iterator.Close)
 }
 
+func TestTraceKVStoreStats(t *testing.T) {
+	var buf bytes.Buffer
+	stats := NewTraceStats(3)
+	store := newEmptyTraceKVStore(&buf).WithStats(stats)
+
+	store.Set([]byte("abc1"), []byte("v"))
+	store.Set([]byte("abc2"), []byte("v"))
+	store.Get([]byte("abc1"))
+	store.Get([]byte("ab"))
+	store.Delete([]byte("xyz"))
+	require.Equal(t, map[string]OpCounts{
+		"abc": {Get: 1, Set: 2},
+		"ab":  {Get: 1},
+		"xyz": {Delete: 1},
+	}, stats.Stats())
+	require.NotZero(t, buf.Len())
+
+	// without a writer, only the stats are kept
+	store = NewTraceKVStore(dbStoreAdapter{dbm.NewMemDB()}, nil, nil).WithStats(stats)
+	store.Get([]byte("abc3"))
+	require.Equal(t, OpCounts{Get: 2, Set: 2}, stats.Stats()["abc"])
+
+	stats.Reset()
+	require.Empty(t, stats.Stats())
+}
+
 func TestTraceKVStorePrefix(t *testing.T) {
 	store := newEmptyTraceKVStore(nil)
 	pStore := store.Prefix([]byte("trace_prefix"))
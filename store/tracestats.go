@@ -0,0 +1,77 @@
+package store
+
+import (
+	"sync"
+)
+
+// OpCounts holds the number of operations on the keys sharing a prefix.
+type OpCounts struct {
+	Get    int64
+	Set    int64
+	Delete int64
+}
+
+// TraceStats aggregates the Get/Set/Delete operations of TraceKVStores per
+// key prefix, to find the most accessed keys. A TraceStats is safe to share
+// between stores and goroutines. Use TraceKVStore.WithStats to enable it.
+type TraceStats struct {
+	mtx       sync.Mutex
+	prefixLen int
+	counts    map[string]*OpCounts
+}
+
+// NewTraceStats returns a TraceStats aggregating the operations per key
+// prefix of prefixLen bytes. Shorter keys are counted as a whole, a
+// prefixLen of zero or less counts every key separately.
+func NewTraceStats(prefixLen int) *TraceStats {
+	return &TraceStats{
+		prefixLen: prefixLen,
+		counts:    make(map[string]*OpCounts),
+	}
+}
+
+// Stats returns a snapshot of the operation counts, keyed by the raw key
+// prefix.
+func (ts *TraceStats) Stats() map[string]OpCounts {
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+
+	stats := make(map[string]OpCounts, len(ts.counts))
+	for prefix, counts := range ts.counts {
+		stats[prefix] = *counts
+	}
+	return stats
+}
+
+// Reset clears all counts, e.g. at the start of each block.
+func (ts *TraceStats) Reset() {
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+
+	ts.counts = make(map[string]*OpCounts)
+}
+
+// record counts an operation on key.
+func (ts *TraceStats) record(op operation, key []byte) {
+	if ts.prefixLen > 0 && len(key) > ts.prefixLen {
+		key = key[:ts.prefixLen]
+	}
+
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+
+	counts, ok := ts.counts[string(key)]
+	if !ok {
+		counts = &OpCounts{}
+		ts.counts[string(key)] = counts
+	}
+
+	switch op {
+	case readOp:
+		counts.Get++
+	case writeOp:
+		counts.Set++
+	case deleteOp:
+		counts.Delete++
+	}
+}
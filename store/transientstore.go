@@ -10,6 +10,9 @@ var _ KVStore = (*transientStore)(nil)
 // transientStore is a wrapper for a MemDB with Commiter implementation
 type transientStore struct {
 	dbStoreAdapter
+
+	// The name the store is mounted under, if any.
+	name string
 }
 
 // Constructs new MemDB adapter
@@ -47,3 +50,8 @@ func (ts *transientStore) Gas(meter GasMeter, config GasConfig) KVStore {
 func (ts *transientStore) GetStoreType() StoreType {
 	return sdk.StoreTypeTransient
 }
+
+// StoreName implements NamedStore.
+func (ts *transientStore) StoreName() string {
+	return ts.name
+}
@@ -0,0 +1,37 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/cosmos/cosmos-sdk/codec"
+)
+
+// IterateTyped iterates over the keys in [start, end) in ascending order and
+// decodes each value, as encoded with MarshalBinaryLengthPrefixed, into out,
+// which must be a non-nil pointer. out is reset to the zero value of its type
+// before each value is decoded, so no fields leak from previous values. fn is
+// called with the key of each value decoded into out and stops the iteration
+// by returning false. Values which can't be decoded stop the iteration with
+// an error naming the key.
+func IterateTyped(store KVStore, start, end []byte, cdc *codec.Codec, out interface{}, fn func(key []byte) bool) error {
+	ptr := reflect.ValueOf(out)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() {
+		return fmt.Errorf("out must be a non-nil pointer, got %T", out)
+	}
+	elem := ptr.Elem()
+	zero := reflect.Zero(elem.Type())
+
+	iter := store.Iterator(start, end)
+	defer iter.Close()
+	for ; iter.Valid(); iter.Next() {
+		elem.Set(zero)
+		if err := cdc.UnmarshalBinaryLengthPrefixed(iter.Value(), out); err != nil {
+			return fmt.Errorf("failed to decode value of key %X: %v", iter.Key(), err)
+		}
+		if !fn(iter.Key()) {
+			return nil
+		}
+	}
+	return nil
+}
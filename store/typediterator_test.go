@@ -0,0 +1,49 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+)
+
+func TestIterateTyped(t *testing.T) {
+	key := sdk.NewKVStoreKey("test")
+	ctx, cdc := defaultComponents(key)
+	store := ctx.KVStore(key)
+	for i := 0; i < 5; i++ {
+		store.Set(keyFmt(i), cdc.MustMarshalBinaryLengthPrefixed(S{uint64(i), i%2 == 0}))
+	}
+
+	var vals []S
+	var val S
+	err := IterateTyped(store, keyFmt(1), keyFmt(4), cdc, &val, func(key []byte) bool {
+		vals = append(vals, val)
+		return true
+	})
+	require.Nil(t, err)
+	require.Equal(t, []S{{1, false}, {2, true}, {3, false}}, vals)
+
+	// iteration stops when fn returns false
+	var keys [][]byte
+	err = IterateTyped(store, nil, nil, cdc, &val, func(key []byte) bool {
+		keys = append(keys, key)
+		return len(keys) < 2
+	})
+	require.Nil(t, err)
+	require.Equal(t, [][]byte{keyFmt(0), keyFmt(1)}, keys)
+
+	// decode errors are returned
+	store.Set(keyFmt(2), []byte("garbage"))
+	vals = nil
+	err = IterateTyped(store, nil, nil, cdc, &val, func(key []byte) bool {
+		vals = append(vals, val)
+		return true
+	})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "key 6B65793030303030303032")
+	require.Len(t, vals, 2)
+
+	require.NotNil(t, IterateTyped(store, nil, nil, cdc, val, func([]byte) bool { return true }))
+}
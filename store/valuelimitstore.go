@@ -0,0 +1,116 @@
+package store
+
+import (
+	"fmt"
+	"io"
+)
+
+var _ KVStore = valueLimitKVStore{}
+
+// valueLimitKVStore rejects values larger than a maximum size. It implements
+// the KVStore interface.
+type valueLimitKVStore struct {
+	parent  KVStore
+	maxSize int
+}
+
+// NewValueLimitKVStore returns a KVStore whose Set panics on values longer
+// than maxSize bytes.
+// nolint
+func NewValueLimitKVStore(parent KVStore, maxSize int) valueLimitKVStore {
+	return valueLimitKVStore{parent: parent, maxSize: maxSize}
+}
+
+// Implements Store.
+func (vs valueLimitKVStore) GetStoreType() StoreType {
+	return vs.parent.GetStoreType()
+}
+
+// StoreName implements NamedStore.
+func (vs valueLimitKVStore) StoreName() string {
+	return storeName(vs.parent)
+}
+
+// cacheDepth implements cacheDepthStore.
+func (vs valueLimitKVStore) cacheDepth() (int, int, bool) {
+	return storeCacheDepth(vs.parent)
+}
+
+// cacheKeyValidator implements keyValidatorStore.
+func (vs valueLimitKVStore) cacheKeyValidator() func(key []byte) error {
+	return storeKeyValidator(vs.parent)
+}
+
+// Implements KVStore.
+func (vs valueLimitKVStore) Get(key []byte) []byte {
+	return vs.parent.Get(key)
+}
+
+// Implements KVStore.
+func (vs valueLimitKVStore) Has(key []byte) bool {
+	return vs.parent.Has(key)
+}
+
+// Set implements KVStore. It panics if the value exceeds the maximum size.
+func (vs valueLimitKVStore) Set(key, value []byte) {
+	if err := vs.SetChecked(key, value); err != nil {
+		panic(err)
+	}
+}
+
+// SetChecked sets the value like Set, but returns an error instead of
+// panicking if the value exceeds the maximum size.
+func (vs valueLimitKVStore) SetChecked(key, value []byte) error {
+	if len(value) > vs.maxSize {
+		return fmt.Errorf("value of %d bytes for key %X exceeds the maximum of %d bytes",
+			len(value), key, vs.maxSize)
+	}
+	vs.parent.Set(key, value)
+	return nil
+}
+
+// Implements KVStore.
+func (vs valueLimitKVStore) Delete(key []byte) {
+	vs.parent.Delete(key)
+}
+
+// Implements KVStore.
+func (vs valueLimitKVStore) Prefix(prefix []byte) KVStore {
+	// Keep the limit at the top
+	return valueLimitKVStore{prefixStore{vs.parent, prefix}, vs.maxSize}
+}
+
+// Implements KVStore.
+func (vs valueLimitKVStore) Gas(meter GasMeter, config GasConfig) KVStore {
+	return NewGasKVStore(meter, config, vs)
+}
+
+// Implements KVStore.
+func (vs valueLimitKVStore) Iterator(start, end []byte) Iterator {
+	return vs.parent.Iterator(start, end)
+}
+
+// Implements KVStore.
+func (vs valueLimitKVStore) ReverseIterator(start, end []byte) Iterator {
+	return vs.parent.ReverseIterator(start, end)
+}
+
+// CacheWrap implements KVStore. The limit is enforced when the cache is
+// written.
+func (vs valueLimitKVStore) CacheWrap() CacheWrap {
+	return NewCacheKVStore(vs)
+}
+
+// CacheWrapWithTrace implements the KVStore interface.
+func (vs valueLimitKVStore) CacheWrapWithTrace(w io.Writer, tc TraceContext) CacheWrap {
+	return NewCacheKVStore(NewTraceKVStore(vs, w, tc))
+}
+
+// wrapValueLimit wraps store in a valueLimitKVStore if a maximum value size
+// is configured for key in maxValueSizes.
+func wrapValueLimit(store KVStore, key StoreKey, maxValueSizes map[StoreKey]int) KVStore {
+	if max, ok := maxValueSizes[key]; ok {
+		return NewValueLimitKVStore(store, max)
+	}
+	return store
+}
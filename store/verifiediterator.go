@@ -0,0 +1,95 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	cmn "github.com/tendermint/tendermint/libs/common"
+	dbm "github.com/tendermint/tendermint/libs/db"
+)
+
+// expectedRange returns the items an iterator over the domain must return,
+// computed by reading the parent range into a map and applying the dirty
+// entries of the cache to it.
+func (ci *cacheKVStore) expectedRange(start, end []byte, ascending bool) []cmn.KVPair {
+	var parent Iterator
+	if ascending {
+		parent = ci.parent.Iterator(start, end)
+	} else {
+		parent = ci.parent.ReverseIterator(start, end)
+	}
+	values := make(map[string][]byte)
+	ci.mtx.RLock()
+	for ; parent.Valid(); parent.Next() {
+		if !ci.inDeletedRange(parent.Key()) {
+			values[string(parent.Key())] = parent.Value()
+		}
+	}
+	parent.Close()
+
+	for key, cacheValue := range ci.cache {
+		if !cacheValue.dirty || !dbm.IsKeyInDomain([]byte(key), start, end, !ascending) {
+			continue
+		}
+		if cacheValue.deleted {
+			delete(values, key)
+		} else {
+			values[key] = cacheValue.value
+		}
+	}
+	ci.mtx.RUnlock()
+
+	items := make([]cmn.KVPair, 0, len(values))
+	for key, value := range values {
+		items = append(items, cmn.KVPair{Key: []byte(key), Value: value})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		cmp := bytes.Compare(items[i].Key, items[j].Key)
+		if ascending {
+			return cmp < 0
+		}
+		return cmp > 0
+	})
+	return items
+}
+
+// verifiedIterator panics as soon as the wrapped iterator diverges from the
+// expected items, see NewCacheKVStoreVerified.
+// Implements Iterator.
+type verifiedIterator struct {
+	Iterator
+	expected []cmn.KVPair
+}
+
+func newVerifiedIterator(iter Iterator, expected []cmn.KVPair) *verifiedIterator {
+	return &verifiedIterator{Iterator: iter, expected: expected}
+}
+
+// Valid panics if the wrapped iterator ends early, or its current item is
+// not the expected one.
+func (vi *verifiedIterator) Valid() bool {
+	valid := vi.Iterator.Valid()
+	switch {
+	case !valid && len(vi.expected) > 0:
+		panic(fmt.Sprintf("cache merge iterator ended early, missing key %X", vi.expected[0].Key))
+	case valid && len(vi.expected) == 0:
+		panic(fmt.Sprintf("cache merge iterator returned unexpected key %X past the end", vi.Iterator.Key()))
+	case valid:
+		key, value := vi.Iterator.Key(), vi.Iterator.Value()
+		want := vi.expected[0]
+		if !bytes.Equal(key, want.Key) {
+			panic(fmt.Sprintf("cache merge iterator returned key %X, expected key %X", key, want.Key))
+		}
+		if !bytes.Equal(value, want.Value) {
+			panic(fmt.Sprintf("cache merge iterator returned value %X for key %X, expected %X", value, key, want.Value))
+		}
+	}
+	return valid
+}
+
+func (vi *verifiedIterator) Next() {
+	vi.Valid()
+	vi.Iterator.Next()
+	vi.expected = vi.expected[1:]
+}
@@ -0,0 +1,182 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Operations recorded by write listeners.
+const (
+	WriteOpSet    byte = 1
+	WriteOpDelete byte = 2
+)
+
+// StoreWrite is a single write recorded by a write listener, see
+// rootMultiStore.SetWriteListener.
+type StoreWrite struct {
+	Op    byte
+	Key   []byte
+	Value []byte
+}
+
+// writeListener encodes the writes to a store into a buffered stream of
+// records. Each record is the uvarint length of its payload followed by the
+// payload: the operation byte, the uvarint length of the key, the key and,
+// for sets, the value.
+type writeListener struct {
+	mtx sync.Mutex
+	w   *bufio.Writer
+}
+
+func newWriteListener(w io.Writer) *writeListener {
+	return &writeListener{w: bufio.NewWriter(w)}
+}
+
+// record buffers a record of the write. Write errors are reported by flush.
+// nolint: errcheck
+func (wl *writeListener) record(op byte, key, value []byte) {
+	var keyLen [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(keyLen[:], uint64(len(key)))
+
+	var recordLen [binary.MaxVarintLen64]byte
+	m := binary.PutUvarint(recordLen[:], uint64(1+n+len(key)+len(value)))
+
+	wl.mtx.Lock()
+	defer wl.mtx.Unlock()
+	wl.w.Write(recordLen[:m])
+	wl.w.WriteByte(op)
+	wl.w.Write(keyLen[:n])
+	wl.w.Write(key)
+	wl.w.Write(value)
+}
+
+// flush writes the buffered records to the underlying writer.
+func (wl *writeListener) flush() error {
+	wl.mtx.Lock()
+	defer wl.mtx.Unlock()
+	return wl.w.Flush()
+}
+
+// ReadStoreWrite reads the next record written by a write listener. It
+// returns io.EOF if there are no more records. Records longer than maxSize
+// bytes, ie. the operation byte, the key with its length and the value, are
+// rejected with an error before they are read, so a corrupt length can't
+// make the reader allocate an arbitrary amount of memory.
+func ReadStoreWrite(r *bufio.Reader, maxSize int) (StoreWrite, error) {
+	recordLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return StoreWrite{}, err
+	}
+	if maxSize < 0 || recordLen > uint64(maxSize) {
+		return StoreWrite{}, fmt.Errorf("store write record of %d bytes exceeds the limit of %d bytes",
+			recordLen, maxSize)
+	}
+	record := make([]byte, recordLen)
+	if _, err := io.ReadFull(r, record); err != nil {
+		return StoreWrite{}, fmt.Errorf("failed to read store write: %v", err)
+	}
+
+	if len(record) == 0 {
+		return StoreWrite{}, fmt.Errorf("empty store write record")
+	}
+	write := StoreWrite{Op: record[0]}
+	keyLen, n := binary.Uvarint(record[1:])
+	if n <= 0 || uint64(len(record)-1-n) < keyLen {
+		return StoreWrite{}, fmt.Errorf("malformed store write record")
+	}
+	write.Key = record[1+n : 1+n+int(keyLen)]
+	switch write.Op {
+	case WriteOpSet:
+		write.Value = record[1+n+int(keyLen):]
+	case WriteOpDelete:
+	default:
+		return StoreWrite{}, fmt.Errorf("unknown store write operation %d", write.Op)
+	}
+	return write, nil
+}
+
+//----------------------------------------
+
+var _ KVStore = listenKVStore{}
+
+// listenKVStore records all writes to the underlying KVStore with a
+// writeListener. It implements the KVStore interface.
+type listenKVStore struct {
+	parent   KVStore
+	listener *writeListener
+}
+
+// Implements Store.
+func (ls listenKVStore) GetStoreType() StoreType {
+	return ls.parent.GetStoreType()
+}
+
+// StoreName implements NamedStore.
+func (ls listenKVStore) StoreName() string {
+	return storeName(ls.parent)
+}
+
+// cacheDepth implements cacheDepthStore.
+func (ls listenKVStore) cacheDepth() (int, int, bool) {
+	return storeCacheDepth(ls.parent)
+}
+
+// cacheKeyValidator implements keyValidatorStore.
+func (ls listenKVStore) cacheKeyValidator() func(key []byte) error {
+	return storeKeyValidator(ls.parent)
+}
+
+// Implements KVStore.
+func (ls listenKVStore) Get(key []byte) []byte {
+	return ls.parent.Get(key)
+}
+
+// Implements KVStore.
+func (ls listenKVStore) Has(key []byte) bool {
+	return ls.parent.Has(key)
+}
+
+// Implements KVStore.
+func (ls listenKVStore) Set(key, value []byte) {
+	ls.parent.Set(key, value)
+	ls.listener.record(WriteOpSet, key, value)
+}
+
+// Implements KVStore.
+func (ls listenKVStore) Delete(key []byte) {
+	ls.parent.Delete(key)
+	ls.listener.record(WriteOpDelete, key, nil)
+}
+
+// Implements KVStore.
+func (ls listenKVStore) Prefix(prefix []byte) KVStore {
+	return prefixStore{ls, prefix}
+}
+
+// Implements KVStore.
+func (ls listenKVStore) Gas(meter GasMeter, config GasConfig) KVStore {
+	return NewGasKVStore(meter, config, ls)
+}
+
+// Implements KVStore.
+func (ls listenKVStore) Iterator(start, end []byte) Iterator {
+	return ls.parent.Iterator(start, end)
+}
+
+// Implements KVStore.
+func (ls listenKVStore) ReverseIterator(start, end []byte) Iterator {
+	return ls.parent.ReverseIterator(start, end)
+}
+
+// Implements KVStore.
+func (ls listenKVStore) CacheWrap() CacheWrap {
+	return NewCacheKVStore(ls)
+}
+
+// CacheWrapWithTrace implements the KVStore interface.
+func (ls listenKVStore) CacheWrapWithTrace(w io.Writer, tc TraceContext) CacheWrap {
+	return NewCacheKVStore(NewTraceKVStore(ls, w, tc))
+}
@@ -1,5 +1,7 @@
 package types
 
+import "fmt"
+
 // Gas consumption descriptors.
 const (
 	GasIterNextCostFlatDesc = "IterNextFlat"
@@ -100,6 +102,30 @@ func KVGasConfig() GasConfig {
 	}
 }
 
+// Validate returns an error naming the first negative cost of the config,
+// which would credit gas instead of consuming it.
+func (cfg GasConfig) Validate() error {
+	costs := []struct {
+		name string
+		cost Gas
+	}{
+		{"HasCost", cfg.HasCost},
+		{"DeleteCost", cfg.DeleteCost},
+		{"ReadCostFlat", cfg.ReadCostFlat},
+		{"ReadCostPerByte", cfg.ReadCostPerByte},
+		{"WriteCostFlat", cfg.WriteCostFlat},
+		{"WriteCostPerByte", cfg.WriteCostPerByte},
+		{"ValueCostPerByte", cfg.ValueCostPerByte},
+		{"IterNextCostFlat", cfg.IterNextCostFlat},
+	}
+	for _, c := range costs {
+		if c.cost < 0 {
+			return fmt.Errorf("negative gas cost %s: %d", c.name, c.cost)
+		}
+	}
+	return nil
+}
+
 // TransientGasConfig returns a default gas config for TransientStores.
 func TransientGasConfig() GasConfig {
 	// TODO: define gasconfig for transient stores
@@ -34,3 +34,15 @@ func TestGasMeter(t *testing.T) {
 
 	}
 }
+
+func TestGasConfigValidate(t *testing.T) {
+	require.Nil(t, KVGasConfig().Validate())
+	require.Nil(t, TransientGasConfig().Validate())
+	require.Nil(t, GasConfig{}.Validate())
+
+	config := KVGasConfig()
+	config.ReadCostPerByte = -1
+	err := config.Validate()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "ReadCostPerByte")
+}
@@ -113,6 +113,16 @@ type CommitMultiStore interface {
 	// the next commit after loading must be idempotent (return the
 	// same commit id).  Otherwise the behavior is undefined.
 	LoadVersion(ver int64) error
+
+	// Roll back to a persisted version, deleting all later commit
+	// information and reloading the substores at that version.  Returns
+	// an error if the version is newer than the latest one or was pruned,
+	// or if the linked iavl stores trees in an unsupported format.
+	RollbackToVersion(ver int64) error
+
+	// Returns the approximate number of keys of each store by name, or -1
+	// for stores which can't tell without iterating all keys.
+	ApproxKeyCount() map[string]int64
 }
 
 //---------subsp-------------------------------
@@ -287,6 +297,20 @@ const (
 	StoreTypeTransient
 )
 
+func (st StoreType) String() string {
+	switch st {
+	case StoreTypeMulti:
+		return "StoreTypeMulti"
+	case StoreTypeDB:
+		return "StoreTypeDB"
+	case StoreTypeIAVL:
+		return "StoreTypeIAVL"
+	case StoreTypeTransient:
+		return "StoreTypeTransient"
+	}
+	return fmt.Sprintf("StoreType(%d)", int(st))
+}
+
 //----------------------------------------
 // Keys for accessing substores
 
@@ -300,8 +324,15 @@ type StoreKey interface {
 // Only the pointer value should ever be used - it functions as a capabilities key.
 type KVStoreKey struct {
 	name string
+
+	// The module ID the module owning the store namespaces its keys under,
+	// if namespaced is set, see NewNamespacedKVStoreKey.
+	moduleID   byte
+	namespaced bool
 }
 
+var _ NamespacedStoreKey = (*KVStoreKey)(nil)
+
 // NewKVStoreKey returns a new pointer to a KVStoreKey.
 // Use a pointer so keys don't collide.
 func NewKVStoreKey(name string) *KVStoreKey {
@@ -310,14 +341,97 @@ func NewKVStoreKey(name string) *KVStoreKey {
 	}
 }
 
+// NewNamespacedKVStoreKey returns a new pointer to a KVStoreKey of a module
+// which namespaces its keys under its module ID, see NamespacedKey.
+func NewNamespacedKVStoreKey(name string, moduleID byte) *KVStoreKey {
+	return &KVStoreKey{
+		name:       name,
+		moduleID:   moduleID,
+		namespaced: true,
+	}
+}
+
 func (key *KVStoreKey) Name() string {
 	return key.name
 }
 
+// Implements NamespacedStoreKey.
+func (key *KVStoreKey) ModuleID() (byte, bool) {
+	return key.moduleID, key.namespaced
+}
+
+// Key returns subKey namespaced under the module ID of the key. It panics if
+// the key has no module ID.
+func (key *KVStoreKey) Key(subKey []byte) []byte {
+	if !key.namespaced {
+		panic(fmt.Sprintf("store key %s has no module ID", key.name))
+	}
+	return NamespacedKey(key.moduleID, subKey)
+}
+
 func (key *KVStoreKey) String() string {
+	if key.namespaced {
+		return fmt.Sprintf("KVStoreKey{%p, %s, 0x%02X}", key, key.name, key.moduleID)
+	}
 	return fmt.Sprintf("KVStoreKey{%p, %s}", key, key.name)
 }
 
+// NamespacedStoreKey is implemented by store keys of modules which may
+// namespace their keys under a module ID.
+type NamespacedStoreKey interface {
+	StoreKey
+
+	// ModuleID returns the module ID, or false if the keys aren't
+	// namespaced.
+	ModuleID() (byte, bool)
+}
+
+// NamespacedKey returns subKey prefixed with the module ID, so that keys of
+// modules sharing a store never overlap as long as every module has its own
+// ID. Use a StoreKeyRegistry to enforce that.
+func NamespacedKey(moduleID byte, subKey []byte) []byte {
+	key := make([]byte, 1+len(subKey))
+	key[0] = moduleID
+	copy(key[1:], subKey)
+	return key
+}
+
+// StoreKeyRegistry tracks the module IDs claimed by modules, to catch two
+// modules namespacing their keys under the same ID at startup rather than
+// through corrupted state later on.
+type StoreKeyRegistry struct {
+	owners map[byte]string
+}
+
+// NewStoreKeyRegistry returns an empty StoreKeyRegistry.
+func NewStoreKeyRegistry() *StoreKeyRegistry {
+	return &StoreKeyRegistry{
+		owners: make(map[byte]string),
+	}
+}
+
+// Claim assigns the module ID to the module. It panics if the ID is already
+// claimed by another module.
+func (reg *StoreKeyRegistry) Claim(moduleID byte, module string) {
+	if owner, ok := reg.owners[moduleID]; ok && owner != module {
+		panic(fmt.Sprintf("module ID 0x%02X claimed by both %s and %s", moduleID, owner, module))
+	}
+	reg.owners[moduleID] = module
+}
+
+// Release frees the module ID, e.g. once the store of the module claiming it
+// is deleted.
+func (reg *StoreKeyRegistry) Release(moduleID byte) {
+	delete(reg.owners, moduleID)
+}
+
+// Owner returns the module which claimed the module ID, or false if none
+// did.
+func (reg *StoreKeyRegistry) Owner(moduleID byte) (string, bool) {
+	owner, ok := reg.owners[moduleID]
+	return owner, ok
+}
+
 // PrefixEndBytes returns the []byte that would end a
 // range query for all []byte with a certain prefix
 // Deals with last byte of prefix being FF without overflowing
@@ -37,3 +37,36 @@ func TestCommitID(t *testing.T) {
 	}
 	require.False(t, nonempty.IsZero())
 }
+
+func TestNamespacedKey(t *testing.T) {
+	require.Equal(t, []byte{0x01, 'a', 'b'}, NamespacedKey(0x01, []byte("ab")))
+	require.Equal(t, []byte{0x02}, NamespacedKey(0x02, nil))
+
+	key := NewNamespacedKVStoreKey("bank", 0x03)
+	require.Equal(t, "bank", key.Name())
+	moduleID, ok := key.ModuleID()
+	require.True(t, ok)
+	require.Equal(t, byte(0x03), moduleID)
+	require.Equal(t, []byte{0x03, 'a'}, key.Key([]byte("a")))
+
+	// plain keys have no module ID
+	plain := NewKVStoreKey("bank")
+	_, ok = plain.ModuleID()
+	require.False(t, ok)
+	require.Panics(t, func() { plain.Key([]byte("a")) })
+}
+
+func TestStoreKeyRegistry(t *testing.T) {
+	reg := NewStoreKeyRegistry()
+	reg.Claim(0x01, "bank")
+	reg.Claim(0x01, "bank")
+	reg.Claim(0x02, "staking")
+
+	owner, ok := reg.Owner(0x01)
+	require.True(t, ok)
+	require.Equal(t, "bank", owner)
+	_, ok = reg.Owner(0x03)
+	require.False(t, ok)
+
+	require.Panics(t, func() { reg.Claim(0x01, "gov") })
+}
@@ -36,7 +36,7 @@ func SendTxCmd(cdc *codec.Codec) *cobra.Command {
 
 			toStr := viper.GetString(flagTo)
 
-			to, err := sdk.AccAddressFromBech32(toStr)
+			to, err := client.ParseRecipient(toStr)
 			if err != nil {
 				return err
 			}
@@ -64,7 +64,11 @@ func SendTxCmd(cdc *codec.Codec) *cobra.Command {
 			}
 
 			// build and sign the transaction, then broadcast to Tendermint
-			msg := client.CreateMsg(from, to, coins)
+			msg, err := client.CreateMsg(from, to, coins)
+			if err != nil {
+				return err
+			}
+
 			if cliCtx.GenerateOnly {
 				return utils.PrintUnsignedStdTx(txBldr, cliCtx, []sdk.Msg{msg}, false)
 			}
@@ -73,7 +77,7 @@ func SendTxCmd(cdc *codec.Codec) *cobra.Command {
 		},
 	}
 
-	cmd.Flags().String(flagTo, "", "Address to send coins")
+	cmd.Flags().String(flagTo, "", "Address to send coins, or module:<name> for a registered module account")
 	cmd.Flags().String(flagAmount, "", "Amount of coins to send")
 	cmd.MarkFlagRequired(flagTo)
 	cmd.MarkFlagRequired(flagAmount)
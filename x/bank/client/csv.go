@@ -0,0 +1,78 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	bank "github.com/cosmos/cosmos-sdk/x/bank"
+)
+
+// ParsePayoutsCSV reads payouts from rows of `address,amount,denom`, e.g. as
+// exported from a spreadsheet, and returns one output per recipient ready to
+// be passed to CreateFanOutMsg. Amounts paid to the same recipient are added
+// up, and the outputs are ordered by recipient address. Blank lines are
+// skipped. Errors name the offending line.
+func ParsePayoutsCSV(r io.Reader) ([]bank.Output, error) {
+	payouts := make(map[string][]sdk.Coins)
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		row := strings.TrimSpace(scanner.Text())
+		if row == "" {
+			continue
+		}
+
+		fields := strings.Split(row, ",")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected address,amount,denom but got %d fields", line, len(fields))
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+
+		addr, err := sdk.AccAddressFromBech32(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid address %q: %v", line, fields[0], err)
+		}
+		amount, ok := sdk.NewIntFromString(fields[1])
+		if !ok {
+			return nil, fmt.Errorf("line %d: invalid amount %q", line, fields[1])
+		}
+		if amount.Sign() <= 0 {
+			return nil, fmt.Errorf("line %d: amount %s is not positive", line, amount)
+		}
+		if !reDenom.MatchString(fields[2]) {
+			return nil, fmt.Errorf("line %d: invalid denom %q", line, fields[2])
+		}
+
+		coins := sdk.Coins{sdk.NewCoin(fields[2], amount)}
+		payouts[addr.String()] = append(payouts[addr.String()], coins)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, 0, len(payouts))
+	for addr := range payouts {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	outputs := make([]bank.Output, 0, len(addrs))
+	for _, addr := range addrs {
+		total, err := safeSum(payouts[addr])
+		if err != nil {
+			return nil, fmt.Errorf("payouts to %s: %v", addr, err)
+		}
+		to, err := sdk.AccAddressFromBech32(addr)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, bank.NewOutput(to, total))
+	}
+	return outputs, nil
+}
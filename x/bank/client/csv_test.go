@@ -0,0 +1,52 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	bank "github.com/cosmos/cosmos-sdk/x/bank"
+)
+
+func TestParsePayoutsCSV(t *testing.T) {
+	alice, bob := testAddr("alice"), testAddr("bob")
+
+	cases := []struct {
+		name    string
+		csv     string
+		want    []bank.Output
+		wantErr string
+	}{
+		{"empty", "", []bank.Output{}, ""},
+		{"blank lines only", "\n  \n", []bank.Output{}, ""},
+		{"single payout", fmt.Sprintf("%s,10,atom\n", alice),
+			[]bank.Output{bank.NewOutput(alice, testCoins(10, "atom"))}, ""},
+		{"spaces and blank lines", fmt.Sprintf("\n %s , 10 , atom \n\n", alice),
+			[]bank.Output{bank.NewOutput(alice, testCoins(10, "atom"))}, ""},
+		{"duplicate recipients summed", fmt.Sprintf("%s,10,atom\n%s,5,btc\n%s,7,atom", alice, alice, alice),
+			[]bank.Output{bank.NewOutput(alice, sdk.Coins{sdk.NewInt64Coin("atom", 17), sdk.NewInt64Coin("btc", 5)})}, ""},
+		{"ordered by address", fmt.Sprintf("%s,1,atom\n%s,2,atom", bob, alice),
+			sortedOutputs(bank.NewOutput(alice, testCoins(2, "atom")), bank.NewOutput(bob, testCoins(1, "atom"))), ""},
+		{"too few fields", fmt.Sprintf("%s,10,atom\n%s,10", alice, bob), nil, "line 2: expected address,amount,denom"},
+		{"too many fields", fmt.Sprintf("%s,10,atom,extra", alice), nil, "line 1: expected address,amount,denom"},
+		{"invalid address", "cosmos1invalid,10,atom", nil, "line 1: invalid address"},
+		{"invalid amount", fmt.Sprintf("%s,ten,atom", alice), nil, "line 1: invalid amount"},
+		{"zero amount", fmt.Sprintf("%s,0,atom", alice), nil, "line 1: amount 0 is not positive"},
+		{"negative amount", fmt.Sprintf("%s,-5,atom", alice), nil, "line 1: amount -5 is not positive"},
+		{"invalid denom", fmt.Sprintf("%s,10,a", alice), nil, "line 1: invalid denom"},
+		{"overflowing sum", fmt.Sprintf("%s,%s,atom\n%s,1,atom", alice, maxAmount, alice), nil, "overflows"},
+	}
+	for _, tc := range cases {
+		outputs, err := ParsePayoutsCSV(strings.NewReader(tc.csv))
+		if tc.wantErr != "" {
+			require.Error(t, err, tc.name)
+			require.Contains(t, err.Error(), tc.wantErr, tc.name)
+			continue
+		}
+		require.Nil(t, err, tc.name)
+		require.Equal(t, tc.want, outputs, tc.name)
+	}
+}
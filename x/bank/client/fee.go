@@ -0,0 +1,50 @@
+package client
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/cosmos/cosmos-sdk/codec"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	bank "github.com/cosmos/cosmos-sdk/x/bank"
+)
+
+// msgCdc encodes msgs the way they are encoded within a tx.
+var msgCdc = codec.New()
+
+func init() {
+	sdk.RegisterCodec(msgCdc)
+	bank.RegisterCodec(msgCdc)
+}
+
+// EstimateSendSize returns the size in bytes of the amino encoding of the
+// given msg, which grows with its number of inputs and outputs.
+func EstimateSendSize(msg sdk.Msg) (int, error) {
+	bz, err := msgCdc.MarshalBinaryBare(msg)
+	if err != nil {
+		return 0, err
+	}
+	return len(bz), nil
+}
+
+// EstimateFee returns the size based fee of the given msg, charging gasPrice
+// per byte of its encoding as returned by EstimateSendSize.
+func EstimateFee(msg sdk.Msg, gasPrice sdk.Coins) (sdk.Coins, error) {
+	size, err := EstimateSendSize(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var fee sdk.Coins
+	for _, price := range gasPrice {
+		amount := new(big.Int).Mul(price.Amount.BigInt(), big.NewInt(int64(size)))
+		if amount.BitLen() > maxIntBitLen {
+			return nil, fmt.Errorf("fee in %s overflows", price.Denom)
+		}
+		if amount.Sign() == 0 {
+			continue
+		}
+		fee = append(fee, sdk.NewCoin(price.Denom, sdk.NewIntFromBigInt(amount)))
+	}
+	return fee, nil
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	bank "github.com/cosmos/cosmos-sdk/x/bank"
+)
+
+// unregisteredMsg is a msg whose type is not registered with the codec.
+type unregisteredMsg struct {
+	bank.MsgSend
+}
+
+func TestEstimateFee(t *testing.T) {
+	alice, bob, carol := testAddr("alice"), testAddr("bob"), testAddr("carol")
+	single := bank.NewMsgSend(
+		[]bank.Input{bank.NewInput(alice, testCoins(10, "atom"))},
+		[]bank.Output{bank.NewOutput(bob, testCoins(10, "atom"))})
+	multi := bank.NewMsgSend(
+		[]bank.Input{bank.NewInput(alice, testCoins(10, "atom"))},
+		[]bank.Output{bank.NewOutput(bob, testCoins(5, "atom")), bank.NewOutput(carol, testCoins(5, "atom"))})
+
+	size, err := EstimateSendSize(single)
+	require.Nil(t, err)
+	multiSize, err := EstimateSendSize(multi)
+	require.Nil(t, err)
+	require.True(t, multiSize > size)
+
+	cases := []struct {
+		name     string
+		msg      sdk.Msg
+		gasPrice sdk.Coins
+		want     sdk.Coins
+		wantErr  bool
+	}{
+		{"charged per byte", single, testCoins(2, "atom"), testCoins(2*int64(size), "atom"), false},
+		{"grows with outputs", multi, testCoins(2, "atom"), testCoins(2*int64(multiSize), "atom"), false},
+		{"several denoms", single,
+			sdk.Coins{sdk.NewInt64Coin("atom", 1), sdk.NewInt64Coin("btc", 3)},
+			sdk.Coins{sdk.NewInt64Coin("atom", int64(size)), sdk.NewInt64Coin("btc", 3*int64(size))}, false},
+		{"zero price", single, testCoins(0, "atom"), nil, false},
+		{"no price", single, nil, nil, false},
+		{"overflow", single, sdk.Coins{sdk.NewCoin("atom", maxAmount)}, nil, true},
+		{"unencodable msg", unregisteredMsg{single}, testCoins(1, "atom"), nil, true},
+	}
+	for _, tc := range cases {
+		fee, err := EstimateFee(tc.msg, tc.gasPrice)
+		if tc.wantErr {
+			require.Error(t, err, tc.name)
+			continue
+		}
+		require.Nil(t, err, tc.name)
+		require.Equal(t, tc.want, fee, tc.name)
+	}
+}
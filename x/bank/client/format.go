@@ -0,0 +1,78 @@
+package client
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+)
+
+// DenomUnit describes how amounts of a base denom are displayed.
+type DenomUnit struct {
+	// Display is the denom amounts are displayed in, e.g. "atom" for "uatom".
+	Display string
+
+	// Exponent is the power of ten of base units per display unit, e.g. 6
+	// for "uatom".
+	Exponent uint32
+
+	// Precision is the number of fractional digits displayed, at most
+	// Exponent. Amounts are rounded half away from zero to it, and trailing
+	// zeros are trimmed.
+	Precision uint32
+}
+
+// FormatCoinsHuman formats the coins for display to users, converting the
+// amounts of every denom found in metadata, which is keyed by base denom, to
+// its display denom, e.g. "1.5 atom" for 1500000uatom given an exponent of
+// 6. Coins without metadata are printed in base units. Coins are separated
+// by commas and keep their order.
+func FormatCoinsHuman(coins sdk.Coins, metadata map[string]DenomUnit) string {
+	parts := make([]string, len(coins))
+	for i, coin := range coins {
+		unit, ok := metadata[coin.Denom]
+		if !ok {
+			parts[i] = coin.String()
+			continue
+		}
+		parts[i] = fmt.Sprintf("%s %s", formatDisplayAmount(coin.Amount, unit), unit.Display)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatDisplayAmount converts the base amount to the display unit as a
+// decimal string.
+func formatDisplayAmount(amount sdk.Int, unit DenomUnit) string {
+	precision := unit.Precision
+	if precision > unit.Exponent {
+		precision = unit.Exponent
+	}
+
+	// Drop the digits beyond the precision, rounding half away from zero.
+	abs := new(big.Int).Abs(amount.BigInt())
+	scale := pow10(unit.Exponent - precision)
+	scaled, rem := new(big.Int).QuoRem(abs, scale, new(big.Int))
+	if rem.Lsh(rem, 1).Cmp(scale) >= 0 {
+		scaled.Add(scaled, big.NewInt(1))
+	}
+
+	whole, frac := new(big.Int).QuoRem(scaled, pow10(precision), new(big.Int))
+	str := whole.String()
+	if precision > 0 {
+		digits := frac.String()
+		digits = strings.Repeat("0", int(precision)-len(digits)) + digits
+		digits = strings.TrimRight(digits, "0")
+		if digits != "" {
+			str += "." + digits
+		}
+	}
+	if amount.Sign() < 0 && scaled.Sign() != 0 {
+		str = "-" + str
+	}
+	return str
+}
+
+func pow10(exp uint32) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exp)), nil)
+}
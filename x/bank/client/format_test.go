@@ -0,0 +1,43 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+)
+
+func TestFormatCoinsHuman(t *testing.T) {
+	metadata := map[string]DenomUnit{
+		"uatom": {Display: "atom", Exponent: 6, Precision: 6},
+		"ustar": {Display: "star", Exponent: 6, Precision: 2},
+		"token": {Display: "tok", Exponent: 0, Precision: 3},
+		"nwide": {Display: "wide", Exponent: 2, Precision: 9},
+	}
+
+	cases := []struct {
+		name  string
+		coins sdk.Coins
+		want  string
+	}{
+		{"display denom", testCoins(1500000, "uatom"), "1.5 atom"},
+		{"whole amount", testCoins(2000000, "uatom"), "2 atom"},
+		{"smallest unit", testCoins(1, "uatom"), "0.000001 atom"},
+		{"zero", testCoins(0, "uatom"), "0 atom"},
+		{"rounded down", testCoins(1234567, "ustar"), "1.23 star"},
+		{"rounded half away from zero", testCoins(1235000, "ustar"), "1.24 star"},
+		{"rounded up to whole", testCoins(1999999, "ustar"), "2 star"},
+		{"negative", testCoins(-1500000, "ustar"), "-1.5 star"},
+		{"negative rounded to zero", testCoins(-1, "ustar"), "0 star"},
+		{"no exponent", testCoins(42, "token"), "42 tok"},
+		{"precision beyond exponent", testCoins(123, "nwide"), "1.23 wide"},
+		{"no metadata", testCoins(5, "btc"), "5btc"},
+		{"several coins", sdk.Coins{sdk.NewInt64Coin("btc", 5), sdk.NewInt64Coin("uatom", 1500000)}, "5btc, 1.5 atom"},
+		{"no coins", nil, ""},
+		{"largest amount", sdk.Coins{sdk.NewCoin("token", maxAmount)}, maxAmount.String() + " tok"},
+	}
+	for _, tc := range cases {
+		require.Equal(t, tc.want, FormatCoinsHuman(tc.coins, metadata), tc.name)
+	}
+}
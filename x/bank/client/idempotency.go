@@ -0,0 +1,106 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	rpcclient "github.com/tendermint/tendermint/rpc/client"
+
+	"github.com/cosmos/cosmos-sdk/client/context"
+	"github.com/cosmos/cosmos-sdk/client/tx"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/cosmos/cosmos-sdk/x/auth"
+)
+
+// idempotencyMemoPrefix marks memos derived by DeriveIdempotencyMemo.
+const idempotencyMemoPrefix = "payout:"
+
+// DeriveIdempotencyMemo returns the memo to send the payout with the given
+// caller-supplied ID under, so that a resend of the payout can be detected
+// with IsDuplicateSend. The memo is a hash of the ID, so it is the same on
+// every call, distinct payout IDs practically never share a memo, and the ID
+// itself is not disclosed on chain.
+func DeriveIdempotencyMemo(payoutID string) string {
+	hash := sha256.Sum256([]byte(payoutID))
+	return idempotencyMemoPrefix + hex.EncodeToString(hash[:])
+}
+
+// IsDuplicateSend returns whether a tx with the given memo was already
+// committed successfully by the context's from address, e.g. before a
+// broadcast timed out. Txs which failed to deliver don't count, as they
+// didn't send anything.
+//
+// It searches the txs the node indexed as sent by the address at or above
+// minHeight, so the node must index the sender tag. The search reads at most
+// maxPages pages of txs, and fails if they don't cover every matching tx, as
+// a send beyond them can't be ruled out; callers should pass a minHeight no
+// older than the first broadcast of the payout. Unless the context trusts
+// the node, the results are verified.
+func IsDuplicateSend(cliCtx context.CLIContext, memo string, minHeight int64, maxPages int) (bool, error) {
+	if cliCtx.Codec == nil {
+		return false, errors.New("no codec defined")
+	}
+	from, err := cliCtx.GetFromAddress()
+	if err != nil {
+		return false, err
+	}
+	if from.Empty() {
+		return false, errors.New("no from address defined")
+	}
+	if maxPages <= 0 {
+		return false, fmt.Errorf("invalid max pages %d", maxPages)
+	}
+	node, err := cliCtx.GetNode()
+	if err != nil {
+		return false, err
+	}
+	return searchSend(cliCtx, node, from, memo, minHeight, maxPages)
+}
+
+// searchSend implements IsDuplicateSend against the given node.
+func searchSend(cliCtx context.CLIContext, node rpcclient.Client, from sdk.AccAddress, memo string,
+	minHeight int64, maxPages int) (bool, error) {
+
+	query := fmt.Sprintf("sender='%s'", from)
+	if minHeight > 0 {
+		query += fmt.Sprintf(" AND tx.height>=%d", minHeight)
+	}
+	prove := !cliCtx.TrustNode
+	perPage := 100
+	for page, seen := 1, 0; ; page++ {
+		if page > maxPages {
+			return false, fmt.Errorf("memo not found in the first %d txs sent by %s, the search exceeds %d pages",
+				seen, from, maxPages)
+		}
+		res, err := node.TxSearch(query, prove, page, perPage)
+		if err != nil {
+			return false, err
+		}
+
+		for _, txRes := range res.Txs {
+			if prove {
+				if err := tx.ValidateTxResult(cliCtx, txRes); err != nil {
+					return false, err
+				}
+			}
+			if txRes.TxResult.Code != 0 {
+				continue
+			}
+
+			var stdTx auth.StdTx
+			if err := cliCtx.Codec.UnmarshalBinaryLengthPrefixed(txRes.Tx, &stdTx); err != nil {
+				return false, err
+			}
+			if stdTx.Memo == memo {
+				return true, nil
+			}
+		}
+
+		seen += len(res.Txs)
+		if len(res.Txs) == 0 || seen >= res.TotalCount {
+			return false, nil
+		}
+	}
+}
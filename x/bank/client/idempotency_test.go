@@ -0,0 +1,117 @@
+package client
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	rpcclient "github.com/tendermint/tendermint/rpc/client"
+	ctypes "github.com/tendermint/tendermint/rpc/core/types"
+
+	"github.com/cosmos/cosmos-sdk/client/context"
+	"github.com/cosmos/cosmos-sdk/codec"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/cosmos/cosmos-sdk/x/auth"
+)
+
+func TestDeriveIdempotencyMemo(t *testing.T) {
+	memo := DeriveIdempotencyMemo("payout-1")
+	require.True(t, strings.HasPrefix(memo, idempotencyMemoPrefix))
+	require.Len(t, memo, len(idempotencyMemoPrefix)+64)
+	require.NotContains(t, memo, "payout-1")
+
+	cases := []struct {
+		name  string
+		other string
+		same  bool
+	}{
+		{"same id", "payout-1", true},
+		{"other id", "payout-2", false},
+		{"empty id", "", false},
+		{"id with trailing space", "payout-1 ", false},
+	}
+	for _, tc := range cases {
+		require.Equal(t, tc.same, DeriveIdempotencyMemo(tc.other) == memo, tc.name)
+	}
+}
+
+func TestIsDuplicateSendRequiresContext(t *testing.T) {
+	cases := []struct {
+		name    string
+		cliCtx  context.CLIContext
+		wantErr string
+	}{
+		{"no codec", context.CLIContext{}, "no codec defined"},
+		{"no from address", context.CLIContext{Codec: codec.New()}, "no from address defined"},
+	}
+	for _, tc := range cases {
+		_, err := IsDuplicateSend(tc.cliCtx, DeriveIdempotencyMemo("payout-1"), 0, 1)
+		require.Error(t, err, tc.name)
+		require.Contains(t, err.Error(), tc.wantErr, tc.name)
+	}
+}
+
+// searchNode is a node answering tx searches from a list of txs, ignoring
+// the query. All other calls panic.
+type searchNode struct {
+	rpcclient.Client
+	txs     []*ctypes.ResultTx
+	queries []string
+}
+
+func (n *searchNode) TxSearch(query string, prove bool, page, perPage int) (*ctypes.ResultTxSearch, error) {
+	n.queries = append(n.queries, query)
+	start := (page - 1) * perPage
+	if start > len(n.txs) {
+		start = len(n.txs)
+	}
+	end := start + perPage
+	if end > len(n.txs) {
+		end = len(n.txs)
+	}
+	return &ctypes.ResultTxSearch{Txs: n.txs[start:end], TotalCount: len(n.txs)}, nil
+}
+
+func TestSearchSend(t *testing.T) {
+	cdc := codec.New()
+	auth.RegisterCodec(cdc)
+	cliCtx := context.CLIContext{Codec: cdc, TrustNode: true}
+	from := sdk.AccAddress([]byte("from"))
+
+	newTx := func(memo string, code uint32) *ctypes.ResultTx {
+		bz, err := cdc.MarshalBinaryLengthPrefixed(auth.NewStdTx(nil, auth.StdFee{}, nil, memo))
+		require.Nil(t, err)
+		return &ctypes.ResultTx{Tx: bz, TxResult: abci.ResponseDeliverTx{Code: code}}
+	}
+	memo := DeriveIdempotencyMemo("payout-1")
+
+	// Txs which failed to deliver aren't duplicates.
+	node := &searchNode{txs: []*ctypes.ResultTx{newTx("other", 0), newTx(memo, 5)}}
+	dup, err := searchSend(cliCtx, node, from, memo, 0, 1)
+	require.Nil(t, err)
+	require.False(t, dup)
+	require.Equal(t, []string{"sender='" + from.String() + "'"}, node.queries)
+
+	node.txs = append(node.txs, newTx(memo, 0))
+	dup, err = searchSend(cliCtx, node, from, memo, 10, 1)
+	require.Nil(t, err)
+	require.True(t, dup)
+	require.Equal(t, "sender='"+from.String()+"' AND tx.height>=10", node.queries[1])
+
+	// The search stops after the given number of pages.
+	node = &searchNode{}
+	for i := 0; i < 250; i++ {
+		node.txs = append(node.txs, newTx("other", 0))
+	}
+	_, err = searchSend(cliCtx, node, from, memo, 0, 2)
+	require.Error(t, err)
+	require.Len(t, node.queries, 2)
+
+	node.queries = nil
+	dup, err = searchSend(cliCtx, node, from, memo, 0, 3)
+	require.Nil(t, err)
+	require.False(t, dup)
+	require.Len(t, node.queries, 3)
+}
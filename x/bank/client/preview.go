@@ -0,0 +1,63 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	bank "github.com/cosmos/cosmos-sdk/x/bank"
+)
+
+// PreviewSend returns the net change in coins of every address taking part
+// in the given sendTx msg, keyed by bech32 address. Coins lost have negative
+// amounts, and addresses whose balance doesn't change are left out. The coins
+// of each address are sorted by denom. Use FormatPreview to display the
+// result. The msg is validated, but no chain state is consulted.
+func PreviewSend(msg sdk.Msg) (map[string]sdk.Coins, error) {
+	var send bank.MsgSend
+	switch msg := msg.(type) {
+	case bank.MsgSend:
+		send = msg
+	case *bank.MsgSend:
+		send = *msg
+	default:
+		return nil, fmt.Errorf("unrecognized bank msg type %T", msg)
+	}
+	if err := send.ValidateBasic(); err != nil {
+		return nil, err
+	}
+
+	deltas := make(map[string]sdk.Coins)
+	for _, in := range send.Inputs {
+		addr := in.Address.String()
+		deltas[addr] = deltas[addr].Minus(in.Coins)
+	}
+	for _, out := range send.Outputs {
+		addr := out.Address.String()
+		deltas[addr] = deltas[addr].Plus(out.Coins)
+	}
+
+	for addr, coins := range deltas {
+		if coins.IsZero() {
+			delete(deltas, addr)
+		}
+	}
+	return deltas, nil
+}
+
+// FormatPreview formats the result of PreviewSend for display, one address
+// per line in address order.
+func FormatPreview(deltas map[string]sdk.Coins) string {
+	addrs := make([]string, 0, len(deltas))
+	for addr := range deltas {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	lines := make([]string, len(addrs))
+	for i, addr := range addrs {
+		lines[i] = fmt.Sprintf("%s: %s", addr, deltas[addr])
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	bank "github.com/cosmos/cosmos-sdk/x/bank"
+)
+
+func TestPreviewSend(t *testing.T) {
+	alice, bob, carol := testAddr("alice"), testAddr("bob"), testAddr("carol")
+	send := func(inputs []bank.Input, outputs []bank.Output) bank.MsgSend {
+		return bank.NewMsgSend(inputs, outputs)
+	}
+	simple := send(
+		[]bank.Input{bank.NewInput(alice, testCoins(10, "atom"))},
+		[]bank.Output{bank.NewOutput(bob, testCoins(10, "atom"))})
+
+	cases := []struct {
+		name     string
+		msg      sdk.Msg
+		want     map[string]sdk.Coins
+		selfSend bool
+		wantErr  bool
+	}{
+		{"simple send", simple,
+			map[string]sdk.Coins{alice.String(): testCoins(-10, "atom"), bob.String(): testCoins(10, "atom")},
+			false, false},
+		{"pointer msg", &simple,
+			map[string]sdk.Coins{alice.String(): testCoins(-10, "atom"), bob.String(): testCoins(10, "atom")},
+			false, false},
+		{"self-send", send(
+			[]bank.Input{bank.NewInput(alice, testCoins(10, "atom"))},
+			[]bank.Output{bank.NewOutput(alice, testCoins(10, "atom"))}),
+			map[string]sdk.Coins{}, true, false},
+		{"partial self-send", send(
+			[]bank.Input{bank.NewInput(alice, testCoins(10, "atom"))},
+			[]bank.Output{bank.NewOutput(alice, testCoins(4, "atom")), bank.NewOutput(carol, testCoins(6, "atom"))}),
+			map[string]sdk.Coins{alice.String(): testCoins(-6, "atom"), carol.String(): testCoins(6, "atom")},
+			false, false},
+		{"duplicate recipients", send(
+			[]bank.Input{bank.NewInput(alice, testCoins(10, "atom"))},
+			[]bank.Output{bank.NewOutput(bob, testCoins(4, "atom")), bank.NewOutput(bob, testCoins(6, "atom"))}),
+			map[string]sdk.Coins{alice.String(): testCoins(-10, "atom"), bob.String(): testCoins(10, "atom")},
+			false, false},
+		{"invalid msg", send(
+			[]bank.Input{bank.NewInput(alice, testCoins(10, "atom"))},
+			[]bank.Output{bank.NewOutput(bob, testCoins(9, "atom"))}),
+			nil, false, true},
+		{"other msg", unregisteredMsg{simple}, nil, false, true},
+	}
+	for _, tc := range cases {
+		require.Equal(t, tc.selfSend, IsSelfSend(tc.msg), tc.name)
+		deltas, err := PreviewSend(tc.msg)
+		if tc.wantErr {
+			require.Error(t, err, tc.name)
+			continue
+		}
+		require.Nil(t, err, tc.name)
+		require.Equal(t, tc.want, deltas, tc.name)
+	}
+}
+
+func TestFormatPreview(t *testing.T) {
+	alice, bob := testAddr("alice"), testAddr("bob")
+	deltas := map[string]sdk.Coins{alice.String(): testCoins(-10, "atom"), bob.String(): testCoins(10, "atom")}
+
+	first, second := alice.String(), bob.String()
+	if second < first {
+		first, second = second, first
+	}
+	want := fmt.Sprintf("%s: %s\n%s: %s", first, deltas[first], second, deltas[second])
+	require.Equal(t, want, FormatPreview(deltas))
+	require.Equal(t, "", FormatPreview(nil))
+}
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/cosmos/cosmos-sdk/client/context"
+	"github.com/cosmos/cosmos-sdk/store"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/cosmos/cosmos-sdk/x/auth"
+)
+
+// QueryBalanceAtHeight returns the coins held by addr as of the given block
+// height, a height of zero queries the latest state. The context must have an
+// account decoder set. An error is returned if the state at height has been
+// pruned by the node.
+func QueryBalanceAtHeight(cliCtx context.CLIContext, addr sdk.AccAddress, height int64) (sdk.Coins, error) {
+	if height < 0 {
+		return nil, fmt.Errorf("invalid height %d", height)
+	}
+
+	cliCtx.Height = height
+	account, err := cliCtx.GetAccount(addr)
+	if err != nil {
+		if isPrunedHeightErr(err) {
+			return nil, fmt.Errorf("state at height %d is not available, it has likely been pruned by the node", height)
+		}
+		return nil, err
+	}
+	if account == nil {
+		return nil, context.ErrInvalidAccount(addr)
+	}
+
+	return account.GetCoins(), nil
+}
+
+// QueryBalances returns the coins held by each of the given addresses, keyed
+// by bech32 address. Addresses without an account hold empty coins. The
+// context must have an account decoder set. It fails if any query fails or
+// an account can't be decoded. See QueryBalancesInOrder for the balances in
+// the order of addrs, and for the accounts which can't be decoded.
+func QueryBalances(cliCtx context.CLIContext, addrs []sdk.AccAddress) (map[string]sdk.Coins, error) {
+	balances, decodeErrs, err := QueryBalancesInOrder(cliCtx, addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	byAddr := make(map[string]sdk.Coins, len(addrs))
+	for i, addr := range addrs {
+		if decodeErrs[i] != nil {
+			return nil, decodeErrs[i]
+		}
+		byAddr[addr.String()] = balances[i]
+	}
+	return byAddr, nil
+}
+
+// QueryBalancesInOrder is like QueryBalances, but returns the balances in a
+// slice parallel to addrs. Accounts which can't be decoded don't fail the
+// call, their errors are returned in a second slice parallel to addrs, with
+// nil balances. Only a failing query fails the call.
+func QueryBalancesInOrder(cliCtx context.CLIContext, addrs []sdk.AccAddress) ([]sdk.Coins, []error, error) {
+	if cliCtx.AccDecoder == nil {
+		return nil, nil, errors.New("account decoder required but not provided")
+	}
+
+	balances := make([]sdk.Coins, len(addrs))
+	decodeErrs := make([]error, len(addrs))
+	for i, addr := range addrs {
+		res, err := cliCtx.QueryStore(auth.AddressStoreKey(addr), cliCtx.AccountStore)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(res) == 0 {
+			balances[i] = sdk.Coins{}
+			continue
+		}
+
+		account, err := cliCtx.AccDecoder(res)
+		if err != nil {
+			decodeErrs[i] = fmt.Errorf("failed to decode account %s: %v", addr, err)
+			continue
+		}
+		balances[i] = account.GetCoins()
+	}
+	return balances, decodeErrs, nil
+}
+
+// LockedCoinsAccount is implemented by accounts holding coins which can't be
+// spent yet.
+type LockedCoinsAccount interface {
+	auth.Account
+
+	// GetLockedCoins returns the coins which can't be spent at the moment.
+	GetLockedCoins() sdk.Coins
+}
+
+// SpendableCoins returns the coins of the account at addr which can be spent
+// right now, ie. its coins minus any locked ones. The context must have an
+// account decoder set.
+func SpendableCoins(cliCtx context.CLIContext, addr sdk.AccAddress) (sdk.Coins, error) {
+	account, err := cliCtx.GetAccount(addr)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, context.ErrInvalidAccount(addr)
+	}
+
+	coins := account.GetCoins()
+	locked, ok := account.(LockedCoinsAccount)
+	if !ok {
+		return coins, nil
+	}
+
+	var spendable sdk.Coins
+	for _, coin := range coins.Minus(locked.GetLockedCoins()) {
+		if coin.IsPositive() {
+			spendable = append(spendable, coin)
+		}
+	}
+	return spendable, nil
+}
+
+// isPrunedHeightErr returns whether err is the store's error for querying a
+// height which is not available, see store.HeightUnavailable.
+func isPrunedHeightErr(err error) bool {
+	qerr, ok := errors.Cause(err).(context.QueryError)
+	if !ok {
+		return false
+	}
+	_, ok = store.ParseHeightUnavailable(qerr.Response)
+	return ok
+}
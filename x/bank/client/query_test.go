@@ -0,0 +1,170 @@
+package client
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	cmn "github.com/tendermint/tendermint/libs/common"
+	dbm "github.com/tendermint/tendermint/libs/db"
+	"github.com/tendermint/tendermint/libs/log"
+	rpcclient "github.com/tendermint/tendermint/rpc/client"
+	ctypes "github.com/tendermint/tendermint/rpc/core/types"
+
+	"github.com/cosmos/cosmos-sdk/client/context"
+	"github.com/cosmos/cosmos-sdk/codec"
+	"github.com/cosmos/cosmos-sdk/store"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/cosmos/cosmos-sdk/x/auth"
+	authcmd "github.com/cosmos/cosmos-sdk/x/auth/client/cli"
+)
+
+// storeNode is a node answering ABCI queries from a multistore, routing
+// them like baseapp does. All other calls panic.
+type storeNode struct {
+	rpcclient.Client
+	ms sdk.CommitMultiStore
+}
+
+func (n storeNode) ABCIQueryWithOptions(path string, data cmn.HexBytes, opts rpcclient.ABCIQueryOptions) (*ctypes.ResultABCIQuery, error) {
+	res := n.ms.(sdk.Queryable).Query(abci.RequestQuery{
+		Path:   strings.TrimPrefix(path, "/store"),
+		Data:   data,
+		Height: opts.Height,
+		Prove:  opts.Prove,
+	})
+	return &ctypes.ResultABCIQuery{Response: res}, nil
+}
+
+// setupAccountNode commits the balance of addr at versions 1 to 3, of which
+// only the latest is kept.
+func setupAccountNode(t *testing.T, addr sdk.AccAddress) context.CLIContext {
+	key := sdk.NewKVStoreKey("acc")
+	ms := store.NewCommitMultiStore(dbm.NewMemDB())
+	ms.MountStoreWithDB(key, sdk.StoreTypeIAVL, nil)
+	ms.SetPruning(sdk.PruneEverything)
+	require.Nil(t, ms.LoadLatestVersion())
+
+	cdc := codec.New()
+	auth.RegisterBaseAccount(cdc)
+	keeper := auth.NewAccountKeeper(cdc, key, auth.ProtoBaseAccount)
+	for i := int64(1); i <= 3; i++ {
+		ctx := sdk.NewContext(ms, abci.Header{}, false, log.NewNopLogger())
+		acc := keeper.GetAccount(ctx, addr)
+		if acc == nil {
+			acc = keeper.NewAccountWithAddress(ctx, addr)
+		}
+		require.Nil(t, acc.SetCoins(sdk.Coins{sdk.NewInt64Coin("foocoin", i)}))
+		keeper.SetAccount(ctx, acc)
+		ms.Commit()
+	}
+
+	return context.CLIContext{
+		Client:       storeNode{ms: ms},
+		AccountStore: "acc",
+		AccDecoder:   authcmd.GetAccountDecoder(cdc),
+	}
+}
+
+// setupAccounts commits an account holding the given coins for each address,
+// and returns a context trusting the node.
+func setupAccounts(t *testing.T, balances map[string]sdk.Coins) context.CLIContext {
+	key := sdk.NewKVStoreKey("acc")
+	ms := store.NewCommitMultiStore(dbm.NewMemDB())
+	ms.MountStoreWithDB(key, sdk.StoreTypeIAVL, nil)
+	require.Nil(t, ms.LoadLatestVersion())
+
+	cdc := codec.New()
+	auth.RegisterBaseAccount(cdc)
+	keeper := auth.NewAccountKeeper(cdc, key, auth.ProtoBaseAccount)
+	ctx := sdk.NewContext(ms, abci.Header{}, false, log.NewNopLogger())
+	for addr, coins := range balances {
+		acc := keeper.NewAccountWithAddress(ctx, sdk.AccAddress(addr))
+		require.Nil(t, acc.SetCoins(coins))
+		keeper.SetAccount(ctx, acc)
+	}
+	ms.Commit()
+
+	return context.CLIContext{
+		Client:       storeNode{ms: ms},
+		AccountStore: "acc",
+		AccDecoder:   authcmd.GetAccountDecoder(cdc),
+		TrustNode:    true,
+	}
+}
+
+func TestQueryBalanceAtPrunedHeight(t *testing.T) {
+	addr := sdk.AccAddress([]byte("addr1"))
+	cliCtx := setupAccountNode(t, addr)
+
+	// Proven queries at pruned heights fail with the pruned height error.
+	_, err := QueryBalanceAtHeight(cliCtx, addr, 1)
+	require.Error(t, err)
+	require.Equal(t, "state at height 1 is not available, it has likely been pruned by the node", err.Error())
+
+	// Available heights still answer.
+	cliCtx.TrustNode = true
+	coins, err := QueryBalanceAtHeight(cliCtx, addr, 3)
+	require.Nil(t, err)
+	require.Equal(t, sdk.Coins{sdk.NewInt64Coin("foocoin", 3)}, coins)
+
+	_, err = QueryBalanceAtHeight(cliCtx, addr, -1)
+	require.Error(t, err)
+	require.False(t, isPrunedHeightErr(err))
+}
+
+func TestIsPrunedHeightErr(t *testing.T) {
+	info, err := json.Marshal(store.HeightUnavailable{Height: 1, NearestAbove: 3})
+	require.Nil(t, err)
+	pruned := sdk.ErrUnknownRequest("height 1 is not available").QueryResult()
+	pruned.Info = string(info)
+
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"height unavailable", context.QueryError{Response: pruned}, true},
+		{"wrapped height unavailable", errors.Wrap(context.QueryError{Response: pruned}, "query"), true},
+		{"other query error", context.QueryError{Response: sdk.ErrUnknownRequest("no data").QueryResult()}, false},
+		{"info of another error", context.QueryError{Response: abci.ResponseQuery{Code: 1, Info: "{}"}}, false},
+		{"message only", errors.New("failed to get rootMultiStore: no data"), false},
+		{"iavl message", errors.New("version does not exist"), false},
+	}
+	for _, tc := range cases {
+		require.Equal(t, tc.want, isPrunedHeightErr(tc.err), tc.name)
+	}
+}
+
+func TestQueryBalances(t *testing.T) {
+	addr1, addr2, bad := sdk.AccAddress([]byte("addr1")), sdk.AccAddress([]byte("addr2")), sdk.AccAddress([]byte("bad"))
+	coins := sdk.Coins{sdk.NewInt64Coin("foocoin", 5)}
+	cliCtx := setupAccounts(t, map[string]sdk.Coins{string(addr1): coins, string(bad): coins})
+	decoder := cliCtx.AccDecoder
+	cliCtx.AccDecoder = func(bz []byte) (auth.Account, error) {
+		acc, err := decoder(bz)
+		if err == nil && acc.GetAddress().Equals(bad) {
+			return nil, errors.New("corrupted")
+		}
+		return acc, err
+	}
+
+	// Accounts which can't be decoded are reported per address.
+	addrs := []sdk.AccAddress{addr2, bad, addr1}
+	balances, decodeErrs, err := QueryBalancesInOrder(cliCtx, addrs)
+	require.Nil(t, err)
+	require.Equal(t, []sdk.Coins{{}, nil, coins}, balances)
+	require.Nil(t, decodeErrs[0])
+	require.Error(t, decodeErrs[1])
+	require.Nil(t, decodeErrs[2])
+
+	byAddr, err := QueryBalances(cliCtx, []sdk.AccAddress{addr1, addr2})
+	require.Nil(t, err)
+	require.Equal(t, map[string]sdk.Coins{addr1.String(): coins, addr2.String(): {}}, byAddr)
+	_, err = QueryBalances(cliCtx, addrs)
+	require.Error(t, err)
+}
@@ -1,14 +1,463 @@
 package client
 
 import (
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tendermint/tendermint/crypto"
+
+	"github.com/cosmos/cosmos-sdk/client/context"
 	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/cosmos/cosmos-sdk/x/auth"
 	bank "github.com/cosmos/cosmos-sdk/x/bank"
 )
 
+// ErrRecipientNotFound is returned by CreateMsgIfRecipientExists if the
+// recipient has no account.
+var ErrRecipientNotFound = errors.New("recipient account not found")
+
+// MsgOption configures optional behaviour of CreateMsg.
+type MsgOption func(*msgOptions)
+
+type msgOptions struct {
+	// minAmounts holds the per-denom dust thresholds, nil to disable.
+	minAmounts map[string]sdk.Int
+
+	// spendable holds the sender's spendable coins, nil to disable.
+	spendable sdk.Coins
+
+	// allowedDenoms holds the denoms which may be sent, nil to disable.
+	allowedDenoms map[string]bool
+
+	// rejectSelfSends rejects msgs which don't change any balance.
+	rejectSelfSends bool
+}
+
+// WithDustFilter drops coins below the given per-denom minimum amounts
+// before building the msg.
+func WithDustFilter(minAmounts map[string]sdk.Int) MsgOption {
+	return func(opts *msgOptions) {
+		opts.minAmounts = minAmounts
+	}
+}
+
+// WithSpendableGuard rejects sends of more than the given spendable coins,
+// e.g. as returned by SpendableCoins.
+func WithSpendableGuard(spendable sdk.Coins) MsgOption {
+	return func(opts *msgOptions) {
+		if spendable == nil {
+			spendable = sdk.Coins{}
+		}
+		opts.spendable = spendable
+	}
+}
+
+// WithDenomAllowlist rejects coins whose denom isn't in allowed. Unlike the
+// other options, it is also honoured by CreateMultiMsg.
+func WithDenomAllowlist(allowed map[string]bool) MsgOption {
+	return func(opts *msgOptions) {
+		if allowed == nil {
+			allowed = map[string]bool{}
+		}
+		opts.allowedDenoms = allowed
+	}
+}
+
+// WithSelfSendRejection rejects sends from an address to itself, which only
+// cost fees without changing any balance.
+func WithSelfSendRejection() MsgOption {
+	return func(opts *msgOptions) {
+		opts.rejectSelfSends = true
+	}
+}
+
 // create the sendTx msg
-func CreateMsg(from sdk.AccAddress, to sdk.AccAddress, coins sdk.Coins) sdk.Msg {
-	input := bank.NewInput(from, coins)
-	output := bank.NewOutput(to, coins)
-	msg := bank.NewMsgSend([]bank.Input{input}, []bank.Output{output})
-	return msg
+func CreateMsg(from sdk.AccAddress, to sdk.AccAddress, coins sdk.Coins, opts ...MsgOption) (sdk.Msg, error) {
+	var options msgOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if options.minAmounts != nil {
+		coins = FilterDust(coins, options.minAmounts)
+	}
+	if options.spendable != nil && !CanSend(options.spendable, coins) {
+		return nil, sdk.ErrInsufficientCoins(
+			fmt.Sprintf("%s is more than the spendable %s", coins, options.spendable))
+	}
+
+	input, err := bank.NewInputChecked(from, coins)
+	if err != nil {
+		return nil, err
+	}
+	output, err := bank.NewOutputChecked(to, coins)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := CreateMultiMsg([]bank.Input{input}, []bank.Output{output}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if options.rejectSelfSends && IsSelfSend(msg) {
+		return nil, fmt.Errorf("%s sends %s to itself", from, coins)
+	}
+	return msg, nil
+}
+
+// CreateMsgTo creates a sendTx msg like CreateMsg, with the destination
+// given as a bech32 address or as the name of a module account, see
+// ParseRecipient.
+func CreateMsgTo(from sdk.AccAddress, dest string, coins sdk.Coins, opts ...MsgOption) (sdk.Msg, error) {
+	to, err := ParseRecipient(dest)
+	if err != nil {
+		return nil, err
+	}
+	return CreateMsg(from, to, coins, opts...)
+}
+
+// moduleRecipientPrefix prefixes recipients given as the name of a module
+// account, e.g. "module:distribution".
+const moduleRecipientPrefix = "module:"
+
+// ParseRecipient returns the address of the given recipient, which is
+// either a bech32 address or "module:<name>" for the module account of the
+// given registered name, see ResolveModuleAccount.
+func ParseRecipient(dest string) (sdk.AccAddress, error) {
+	if strings.HasPrefix(dest, moduleRecipientPrefix) {
+		return ResolveModuleAccount(strings.TrimPrefix(dest, moduleRecipientPrefix))
+	}
+	return sdk.AccAddressFromBech32(dest)
+}
+
+// moduleAccounts holds the addresses of the module accounts registered with
+// RegisterModuleAccount, by name. It is guarded by moduleAccountsMtx.
+var (
+	moduleAccountsMtx sync.RWMutex
+	moduleAccounts    = make(map[string]sdk.AccAddress)
+)
+
+// RegisterModuleAccount registers the module account of the given name, so
+// that ResolveModuleAccount resolves it. Its address is derived from the name
+// alone like the addresses of the gov module accounts, so it is the same on
+// every chain using the derivation. Apps register their module accounts on
+// startup. Registering a name again is a no-op, as it derives the same
+// address. It is safe for concurrent use, and panics if the name is empty.
+func RegisterModuleAccount(name string) {
+	if strings.TrimSpace(name) == "" {
+		panic("empty module account name")
+	}
+	moduleAccountsMtx.Lock()
+	defer moduleAccountsMtx.Unlock()
+	moduleAccounts[name] = sdk.AccAddress(crypto.AddressHash([]byte(name)))
+}
+
+// ResolveModuleAccount returns the address of the registered module account
+// of the given name. Unknown names are rejected, as their derived address
+// would be valid but controlled by nobody, and coins sent to it lost.
+func ResolveModuleAccount(name string) (sdk.AccAddress, error) {
+	moduleAccountsMtx.RLock()
+	addr, ok := moduleAccounts[name]
+	moduleAccountsMtx.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown module account %q, known module accounts are %s",
+			name, strings.Join(registeredModuleAccounts(), ", "))
+	}
+	return addr, nil
+}
+
+// registeredModuleAccounts returns the sorted names of the registered module
+// accounts.
+func registeredModuleAccounts() []string {
+	moduleAccountsMtx.RLock()
+	defer moduleAccountsMtx.RUnlock()
+	names := make([]string, 0, len(moduleAccounts))
+	for name := range moduleAccounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SendAllMinusFee creates a sendTx msg of all spendable coins of from, as
+// returned by SpendableCoins, minus the given fee, so that the tx can still
+// pay its fee. Each denom is reduced by the fee in that denom on its own. It
+// fails if the fee exceeds the spendable amount in any denom, or nothing is
+// left to send.
+func SendAllMinusFee(cliCtx context.CLIContext, from, to sdk.AccAddress, fee sdk.Coins) (sdk.Msg, error) {
+	spendable, err := SpendableCoins(cliCtx, from)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, coin := range fee {
+		if available := spendable.AmountOf(coin.Denom); coin.Amount.GT(available) {
+			return nil, sdk.ErrInsufficientCoins(
+				fmt.Sprintf("fee of %s is more than the spendable %s%s", coin, available, coin.Denom))
+		}
+	}
+
+	var remainder sdk.Coins
+	for _, coin := range spendable {
+		amount := coin.Amount.Sub(fee.AmountOf(coin.Denom))
+		if amount.Sign() > 0 {
+			remainder = append(remainder, sdk.NewCoin(coin.Denom, amount))
+		}
+	}
+	if len(remainder) == 0 {
+		return nil, sdk.ErrInsufficientCoins(
+			fmt.Sprintf("nothing left of the spendable %s after the fee of %s", spendable, fee))
+	}
+	return CreateMsg(from, to, remainder)
+}
+
+// CreateMsgIfRecipientExists creates a sendTx msg like CreateMsg, but only if
+// an account exists for to, and returns ErrRecipientNotFound otherwise, so
+// that a mistyped address doesn't create a dust account.
+// NOTE: The check is advisory, it isn't enforced on chain. The account may
+// be created between the check and the inclusion of the tx.
+func CreateMsgIfRecipientExists(cliCtx context.CLIContext, from, to sdk.AccAddress, coins sdk.Coins) (sdk.Msg, error) {
+	res, err := cliCtx.QueryStore(auth.AddressStoreKey(to), cliCtx.AccountStore)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, ErrRecipientNotFound
+	}
+	return CreateMsg(from, to, coins)
+}
+
+// IsSelfSend returns whether the given sendTx msg leaves every balance
+// unchanged, i.e. the inputs and outputs of each address cancel out. A
+// multi-send in which only some addresses send to themselves is not a
+// self-send. Invalid msgs are not considered self-sends.
+func IsSelfSend(msg sdk.Msg) bool {
+	deltas, err := PreviewSend(msg)
+	return err == nil && len(deltas) == 0
+}
+
+// CreateMultiMsg creates a many-to-many sendTx msg from the given inputs and
+// outputs. Of the options, only WithDenomAllowlist applies.
+func CreateMultiMsg(inputs []bank.Input, outputs []bank.Output, opts ...MsgOption) (sdk.Msg, error) {
+	var options msgOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.allowedDenoms != nil {
+		for _, in := range inputs {
+			if err := ValidateDenoms(in.Coins, options.allowedDenoms); err != nil {
+				return nil, err
+			}
+		}
+		for _, out := range outputs {
+			if err := ValidateDenoms(out.Coins, options.allowedDenoms); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Reject sums the coin arithmetic of the validation would panic on.
+	inCoins := make([]sdk.Coins, len(inputs))
+	for i, in := range inputs {
+		inCoins[i] = in.Coins
+	}
+	if _, err := safeSum(inCoins); err != nil {
+		return nil, fmt.Errorf("invalid inputs: %v", err)
+	}
+	if _, err := SafeSum(outputs); err != nil {
+		return nil, fmt.Errorf("invalid outputs: %v", err)
+	}
+
+	if err := bank.ValidateInputsOutputs(inputs, outputs); err != nil {
+		return nil, err
+	}
+	msg := bank.NewMsgSend(inputs, outputs)
+	return msg, nil
+}
+
+// CreateFanOutMsg creates a sendTx msg paying out from a single sender to
+// many recipients, keyed by their bech32 address. Outputs are ordered by
+// recipient address so the resulting msg is deterministic.
+func CreateFanOutMsg(from sdk.AccAddress, recipients map[string]sdk.Coins) (sdk.Msg, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no recipients given")
+	}
+
+	addrs := make([]string, 0, len(recipients))
+	for addr := range recipients {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	outputs := make([]bank.Output, 0, len(addrs))
+	for _, addr := range addrs {
+		to, err := sdk.AccAddressFromBech32(addr)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, bank.NewOutput(to, recipients[addr]))
+	}
+
+	total, err := SafeSum(outputs)
+	if err != nil {
+		return nil, err
+	}
+
+	inputs := []bank.Input{bank.NewInput(from, total)}
+	return CreateMultiMsg(inputs, outputs)
+}
+
+// Payout is a single payment to a recipient. Tag is the reference the
+// payment is recorded under, e.g. used as the memo of its tx.
+type Payout struct {
+	Address sdk.AccAddress
+	Coins   sdk.Coins
+	Tag     string
+}
+
+// SplitIntoPerRecipientMsgs creates one sendTx msg per payout, so that each
+// payout can be placed in its own tx carrying the payout's tag as memo. The
+// i-th msg pays out payouts[i]. The msgs are not validated.
+func SplitIntoPerRecipientMsgs(from sdk.AccAddress, payouts []Payout) []sdk.Msg {
+	msgs := make([]sdk.Msg, len(payouts))
+	for i, payout := range payouts {
+		input := bank.NewInput(from, payout.Coins)
+		output := bank.NewOutput(payout.Address, payout.Coins)
+		msgs[i] = bank.NewMsgSend([]bank.Input{input}, []bank.Output{output})
+	}
+	return msgs
+}
+
+// EstimateTotalFees returns the fees of sending each of msgs in its own tx
+// paying feePerTx, so callers can check the sender can afford both the
+// payouts and the fees beforehand.
+func EstimateTotalFees(msgs []sdk.Msg, feePerTx sdk.Coins) (sdk.Coins, error) {
+	fees := make([]sdk.Coins, len(msgs))
+	for i := range msgs {
+		fees[i] = feePerTx
+	}
+	return safeSum(fees)
+}
+
+// SafeSum returns the sum of the coins of all outputs. Unlike adding up the
+// coins with sdk.Coins.Plus, it returns an error naming the denom if the sum
+// overflows sdk.Int instead of panicking.
+func SafeSum(outputs []bank.Output) (sdk.Coins, error) {
+	coins := make([]sdk.Coins, len(outputs))
+	for i, out := range outputs {
+		coins[i] = out.Coins
+	}
+	return safeSum(coins)
+}
+
+// AggregateOutputs merges the outputs to the same address into one, summing
+// their coins per denom. Coins summing to zero are dropped, as are addresses
+// left without coins, so the total of the outputs is preserved. The result is
+// sorted by address. It fails if an address is not a valid account address,
+// or a sum overflows.
+func AggregateOutputs(outputs []bank.Output) ([]bank.Output, error) {
+	coinsByAddr := make(map[string][]sdk.Coins)
+	for _, out := range outputs {
+		if len(out.Address) != sdk.AddrLen {
+			return nil, sdk.ErrInvalidAddress(fmt.Sprintf("invalid output address %q", out.Address.String()))
+		}
+		addr := string(out.Address)
+		coinsByAddr[addr] = append(coinsByAddr[addr], out.Coins)
+	}
+
+	addrs := make([]string, 0, len(coinsByAddr))
+	for addr := range coinsByAddr {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	aggregated := make([]bank.Output, 0, len(addrs))
+	for _, addr := range addrs {
+		sum, err := safeSum(coinsByAddr[addr])
+		if err != nil {
+			return nil, fmt.Errorf("invalid outputs to %s: %v", sdk.AccAddress(addr), err)
+		}
+		if len(sum) == 0 {
+			continue
+		}
+		aggregated = append(aggregated, bank.NewOutput(sdk.AccAddress(addr), sum))
+	}
+	return aggregated, nil
+}
+
+// maxIntBitLen is the bit length beyond which sdk.Int arithmetic panics.
+const maxIntBitLen = 255
+
+func safeSum(coinsList []sdk.Coins) (sdk.Coins, error) {
+	sums := make(map[string]*big.Int)
+	for _, coins := range coinsList {
+		for _, coin := range coins {
+			sum, ok := sums[coin.Denom]
+			if !ok {
+				sum = new(big.Int)
+				sums[coin.Denom] = sum
+			}
+			sum.Add(sum, coin.Amount.BigInt())
+			if sum.BitLen() > maxIntBitLen {
+				return nil, fmt.Errorf("sum of %s amounts overflows", coin.Denom)
+			}
+		}
+	}
+
+	denoms := make([]string, 0, len(sums))
+	for denom := range sums {
+		denoms = append(denoms, denom)
+	}
+	sort.Strings(denoms)
+
+	var total sdk.Coins
+	for _, denom := range denoms {
+		if sums[denom].Sign() == 0 {
+			continue
+		}
+		total = append(total, sdk.NewCoin(denom, sdk.NewIntFromBigInt(sums[denom])))
+	}
+	return total, nil
+}
+
+// FilterDust returns the coins without those whose amount is below the
+// minimum amount given for their denom. Denoms without a minimum are kept.
+// The result keeps the order of coins.
+func FilterDust(coins sdk.Coins, minAmounts map[string]sdk.Int) sdk.Coins {
+	filtered := make(sdk.Coins, 0, len(coins))
+	for _, coin := range coins {
+		min, ok := minAmounts[coin.Denom]
+		if ok && coin.Amount.LT(min) {
+			continue
+		}
+		filtered = append(filtered, coin)
+	}
+	return filtered
+}
+
+// reDenom matches the denoms accepted by sdk.ParseCoin.
+var reDenom = regexp.MustCompile(`^[[:alpha:]][[:alnum:]]{2,15}$`)
+
+// ValidateDenoms returns an error naming the first coin whose denom is
+// malformed or, if allowed is not nil, not in allowed. Denoms are compared
+// case-sensitively.
+func ValidateDenoms(coins sdk.Coins, allowed map[string]bool) error {
+	for _, coin := range coins {
+		if !reDenom.MatchString(coin.Denom) {
+			return sdk.ErrInvalidCoins(fmt.Sprintf("invalid denom %q", coin.Denom))
+		}
+		if allowed != nil && !allowed[coin.Denom] {
+			return sdk.ErrInvalidCoins(fmt.Sprintf("denom %q is not allowed", coin.Denom))
+		}
+	}
+	return nil
+}
+
+// CanSend returns whether amount can be sent out of the spendable coins.
+func CanSend(spendable, amount sdk.Coins) bool {
+	return spendable.IsAllGTE(amount)
 }
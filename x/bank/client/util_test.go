@@ -0,0 +1,342 @@
+package client
+
+import (
+	"math/big"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/tendermint/tendermint/crypto"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	bank "github.com/cosmos/cosmos-sdk/x/bank"
+)
+
+// testAddr returns an account address derived from name.
+func testAddr(name string) sdk.AccAddress {
+	return sdk.AccAddress(crypto.AddressHash([]byte(name)))
+}
+
+// maxAmount is the largest amount sdk.Int holds.
+var maxAmount = sdk.NewIntFromBigInt(new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), maxIntBitLen), big.NewInt(1)))
+
+func testCoins(amount int64, denom string) sdk.Coins {
+	return sdk.Coins{sdk.NewInt64Coin(denom, amount)}
+}
+
+func TestResolveModuleAccount(t *testing.T) {
+	RegisterModuleAccount("distribution")
+	defer delete(moduleAccounts, "distribution")
+	expected := sdk.AccAddress(crypto.AddressHash([]byte("distribution")))
+	bech32 := sdk.AccAddress([]byte("addr1")).String()
+
+	cases := []struct {
+		name    string
+		dest    string
+		want    sdk.AccAddress
+		wantErr bool
+	}{
+		{"known module account", "module:distribution", expected, false},
+		{"misspelled module account", "module:distributon", nil, true},
+		{"empty module account", "module:", nil, true},
+		{"bech32 address", bech32, sdk.AccAddress([]byte("addr1")), false},
+		{"invalid address", "distribution", nil, true},
+	}
+	for _, tc := range cases {
+		addr, err := ParseRecipient(tc.dest)
+		if tc.wantErr {
+			require.Error(t, err, tc.name)
+			continue
+		}
+		require.Nil(t, err, tc.name)
+		require.Equal(t, tc.want, addr, tc.name)
+	}
+
+	_, err := ResolveModuleAccount("distributon")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "known module accounts are distribution")
+
+	// registering again is a no-op
+	RegisterModuleAccount("distribution")
+	addr, err := ResolveModuleAccount("distribution")
+	require.Nil(t, err)
+	require.Equal(t, expected, addr)
+	require.Panics(t, func() { RegisterModuleAccount(" ") })
+}
+
+func TestRegisterModuleAccountConcurrently(t *testing.T) {
+	names := []string{"fee_collector", "mint", "fee_collector"}
+	defer func() {
+		for _, name := range names {
+			delete(moduleAccounts, name)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(2)
+		go func(name string) {
+			defer wg.Done()
+			RegisterModuleAccount(name)
+		}(name)
+		go func(name string) {
+			defer wg.Done()
+			ResolveModuleAccount(name) // nolint: errcheck
+		}(name)
+	}
+	wg.Wait()
+
+	require.Equal(t, []string{"fee_collector", "mint"}, registeredModuleAccounts())
+}
+
+func TestCreateMultiMsg(t *testing.T) {
+	alice, bob, carol := testAddr("alice"), testAddr("bob"), testAddr("carol")
+	huge := sdk.Coins{sdk.NewCoin("atom", maxAmount)}
+
+	cases := []struct {
+		name    string
+		inputs  []bank.Input
+		outputs []bank.Output
+		wantErr bool
+	}{
+		{"one to one",
+			[]bank.Input{bank.NewInput(alice, testCoins(10, "atom"))},
+			[]bank.Output{bank.NewOutput(bob, testCoins(10, "atom"))}, false},
+		{"many to many",
+			[]bank.Input{bank.NewInput(alice, testCoins(10, "atom")), bank.NewInput(bob, testCoins(5, "atom"))},
+			[]bank.Output{bank.NewOutput(carol, testCoins(12, "atom")), bank.NewOutput(alice, testCoins(3, "atom"))}, false},
+		{"duplicate recipients",
+			[]bank.Input{bank.NewInput(alice, testCoins(10, "atom"))},
+			[]bank.Output{bank.NewOutput(bob, testCoins(4, "atom")), bank.NewOutput(bob, testCoins(6, "atom"))}, false},
+		{"inputs and outputs differ",
+			[]bank.Input{bank.NewInput(alice, testCoins(10, "atom"))},
+			[]bank.Output{bank.NewOutput(bob, testCoins(9, "atom"))}, true},
+		{"no inputs", nil, []bank.Output{bank.NewOutput(bob, testCoins(1, "atom"))}, true},
+		{"no outputs", []bank.Input{bank.NewInput(alice, testCoins(1, "atom"))}, nil, true},
+		{"missing recipient address",
+			[]bank.Input{bank.NewInput(alice, testCoins(10, "atom"))},
+			[]bank.Output{bank.NewOutput(nil, testCoins(10, "atom"))}, true},
+		{"overflowing inputs",
+			[]bank.Input{bank.NewInput(alice, huge), bank.NewInput(bob, huge)},
+			[]bank.Output{bank.NewOutput(carol, huge)}, true},
+		{"overflowing outputs",
+			[]bank.Input{bank.NewInput(alice, huge)},
+			[]bank.Output{bank.NewOutput(bob, huge), bank.NewOutput(carol, huge)}, true},
+	}
+	for _, tc := range cases {
+		msg, err := CreateMultiMsg(tc.inputs, tc.outputs)
+		if tc.wantErr {
+			require.Error(t, err, tc.name)
+			continue
+		}
+		require.Nil(t, err, tc.name)
+		require.Equal(t, bank.NewMsgSend(tc.inputs, tc.outputs), msg, tc.name)
+	}
+}
+
+func TestCreateFanOutMsg(t *testing.T) {
+	alice, bob, carol := testAddr("alice"), testAddr("bob"), testAddr("carol")
+
+	cases := []struct {
+		name       string
+		recipients map[string]sdk.Coins
+		want       sdk.Msg
+		wantErr    bool
+	}{
+		{"recipients ordered by address",
+			map[string]sdk.Coins{carol.String(): testCoins(3, "atom"), bob.String(): testCoins(2, "atom")},
+			bank.NewMsgSend(
+				[]bank.Input{bank.NewInput(alice, testCoins(5, "atom"))},
+				sortedOutputs(bank.NewOutput(bob, testCoins(2, "atom")), bank.NewOutput(carol, testCoins(3, "atom")))),
+			false},
+		{"no recipients", map[string]sdk.Coins{}, nil, true},
+		{"invalid recipient", map[string]sdk.Coins{"cosmos1invalid": testCoins(1, "atom")}, nil, true},
+		{"empty amount", map[string]sdk.Coins{bob.String(): nil}, nil, true},
+		{"overflowing total",
+			map[string]sdk.Coins{
+				bob.String():   {sdk.NewCoin("atom", maxAmount)},
+				carol.String(): {sdk.NewCoin("atom", maxAmount)},
+			}, nil, true},
+	}
+	for _, tc := range cases {
+		msg, err := CreateFanOutMsg(alice, tc.recipients)
+		if tc.wantErr {
+			require.Error(t, err, tc.name)
+			continue
+		}
+		require.Nil(t, err, tc.name)
+		require.Equal(t, tc.want, msg, tc.name)
+	}
+}
+
+// sortedOutputs returns the outputs ordered by bech32 address, as
+// CreateFanOutMsg orders them.
+func sortedOutputs(outputs ...bank.Output) []bank.Output {
+	sort.Slice(outputs, func(i, j int) bool {
+		return outputs[i].Address.String() < outputs[j].Address.String()
+	})
+	return outputs
+}
+
+func TestSafeSum(t *testing.T) {
+	alice, bob := testAddr("alice"), testAddr("bob")
+	huge := sdk.Coins{sdk.NewCoin("atom", maxAmount)}
+
+	cases := []struct {
+		name    string
+		outputs []bank.Output
+		want    sdk.Coins
+		wantErr bool
+	}{
+		{"no outputs", nil, nil, false},
+		{"single output", []bank.Output{bank.NewOutput(alice, testCoins(3, "atom"))}, testCoins(3, "atom"), false},
+		{"duplicate recipients",
+			[]bank.Output{bank.NewOutput(alice, testCoins(3, "atom")), bank.NewOutput(alice, testCoins(4, "atom"))},
+			testCoins(7, "atom"), false},
+		{"denoms sorted",
+			[]bank.Output{bank.NewOutput(alice, testCoins(1, "btc")), bank.NewOutput(bob, testCoins(2, "atom"))},
+			sdk.Coins{sdk.NewInt64Coin("atom", 2), sdk.NewInt64Coin("btc", 1)}, false},
+		{"largest amount", []bank.Output{bank.NewOutput(alice, huge)}, huge, false},
+		{"overflow", []bank.Output{bank.NewOutput(alice, huge), bank.NewOutput(bob, testCoins(1, "atom"))}, nil, true},
+	}
+	for _, tc := range cases {
+		sum, err := SafeSum(tc.outputs)
+		if tc.wantErr {
+			require.Error(t, err, tc.name)
+			require.Contains(t, err.Error(), "atom", tc.name)
+			continue
+		}
+		require.Nil(t, err, tc.name)
+		require.Equal(t, tc.want, sum, tc.name)
+	}
+}
+
+func TestSendAllMinusFee(t *testing.T) {
+	alice, bob, carol := testAddr("alice"), testAddr("bob"), testAddr("carol")
+	cliCtx := setupAccounts(t, map[string]sdk.Coins{
+		string(alice): {sdk.NewInt64Coin("atom", 10), sdk.NewInt64Coin("btc", 5)},
+		string(bob):   testCoins(3, "atom"),
+	})
+
+	cases := []struct {
+		name    string
+		from    sdk.AccAddress
+		fee     sdk.Coins
+		want    sdk.Coins
+		wantErr string
+	}{
+		{"fee deducted", alice, testCoins(1, "atom"),
+			sdk.Coins{sdk.NewInt64Coin("atom", 9), sdk.NewInt64Coin("btc", 5)}, ""},
+		{"denom used up by fee", alice, testCoins(10, "atom"), testCoins(5, "btc"), ""},
+		{"no fee", alice, nil, sdk.Coins{sdk.NewInt64Coin("atom", 10), sdk.NewInt64Coin("btc", 5)}, ""},
+		{"fee larger than balance", alice, testCoins(11, "atom"), nil, "fee of 11atom is more than the spendable 10atom"},
+		{"fee in unheld denom", alice, testCoins(1, "eth"), nil, "fee of 1eth is more than the spendable 0eth"},
+		{"fee equal to balance", bob, testCoins(3, "atom"), nil, "nothing left"},
+		{"sender without account", carol, testCoins(1, "atom"), nil, "No account with address"},
+	}
+	for _, tc := range cases {
+		msg, err := SendAllMinusFee(cliCtx, tc.from, testAddr("dave"), tc.fee)
+		if tc.wantErr != "" {
+			require.Error(t, err, tc.name)
+			require.Contains(t, err.Error(), tc.wantErr, tc.name)
+			continue
+		}
+		require.Nil(t, err, tc.name)
+		require.Equal(t, bank.NewMsgSend(
+			[]bank.Input{bank.NewInput(tc.from, tc.want)},
+			[]bank.Output{bank.NewOutput(testAddr("dave"), tc.want)}), msg, tc.name)
+	}
+}
+
+func TestAggregateOutputs(t *testing.T) {
+	alice, bob := testAddr("alice"), testAddr("bob")
+	huge := sdk.Coins{sdk.NewCoin("atom", maxAmount)}
+	// The result is ordered by raw address bytes.
+	first, second := alice, bob
+	if string(bob) < string(alice) {
+		first, second = bob, alice
+	}
+
+	cases := []struct {
+		name    string
+		outputs []bank.Output
+		want    []bank.Output
+		wantErr bool
+	}{
+		{"no outputs", nil, []bank.Output{}, false},
+		{"duplicate recipients merged",
+			[]bank.Output{
+				bank.NewOutput(alice, testCoins(3, "atom")),
+				bank.NewOutput(alice, sdk.Coins{sdk.NewInt64Coin("atom", 4), sdk.NewInt64Coin("btc", 1)}),
+			},
+			[]bank.Output{bank.NewOutput(alice, sdk.Coins{sdk.NewInt64Coin("atom", 7), sdk.NewInt64Coin("btc", 1)})},
+			false},
+		{"sorted by address",
+			[]bank.Output{bank.NewOutput(second, testCoins(1, "atom")), bank.NewOutput(first, testCoins(2, "atom"))},
+			[]bank.Output{bank.NewOutput(first, testCoins(2, "atom")), bank.NewOutput(second, testCoins(1, "atom"))},
+			false},
+		{"zero sums dropped",
+			[]bank.Output{
+				bank.NewOutput(alice, testCoins(5, "atom")),
+				bank.NewOutput(alice, testCoins(-5, "atom")),
+				bank.NewOutput(bob, sdk.Coins{sdk.NewInt64Coin("atom", 2), sdk.NewInt64Coin("btc", 0)}),
+			},
+			[]bank.Output{bank.NewOutput(bob, testCoins(2, "atom"))},
+			false},
+		{"invalid address length",
+			[]bank.Output{bank.NewOutput(sdk.AccAddress([]byte("short")), testCoins(1, "atom"))}, nil, true},
+		{"missing address", []bank.Output{bank.NewOutput(nil, testCoins(1, "atom"))}, nil, true},
+		{"overflow",
+			[]bank.Output{bank.NewOutput(alice, huge), bank.NewOutput(alice, testCoins(1, "atom"))}, nil, true},
+		{"largest amount to distinct recipients",
+			[]bank.Output{bank.NewOutput(first, huge), bank.NewOutput(second, huge)},
+			[]bank.Output{bank.NewOutput(first, huge), bank.NewOutput(second, huge)},
+			false},
+	}
+	for _, tc := range cases {
+		aggregated, err := AggregateOutputs(tc.outputs)
+		if tc.wantErr {
+			require.Error(t, err, tc.name)
+			continue
+		}
+		require.Nil(t, err, tc.name)
+		require.Equal(t, tc.want, aggregated, tc.name)
+	}
+}
+
+func TestCreateMsgIfRecipientExists(t *testing.T) {
+	alice, bob, carol := testAddr("alice"), testAddr("bob"), testAddr("carol")
+	cliCtx := setupAccounts(t, map[string]sdk.Coins{
+		string(alice): testCoins(10, "atom"),
+		string(bob):   testCoins(1, "atom"),
+	})
+
+	cases := []struct {
+		name    string
+		to      sdk.AccAddress
+		coins   sdk.Coins
+		wantErr error
+	}{
+		{"existing recipient", bob, testCoins(5, "atom"), nil},
+		{"missing recipient", carol, testCoins(5, "atom"), ErrRecipientNotFound},
+	}
+	for _, tc := range cases {
+		msg, err := CreateMsgIfRecipientExists(cliCtx, alice, tc.to, tc.coins)
+		if tc.wantErr != nil {
+			require.Equal(t, tc.wantErr, err, tc.name)
+			require.Nil(t, msg, tc.name)
+			continue
+		}
+		require.Nil(t, err, tc.name)
+		require.Equal(t, bank.NewMsgSend(
+			[]bank.Input{bank.NewInput(alice, tc.coins)},
+			[]bank.Output{bank.NewOutput(tc.to, tc.coins)}), msg, tc.name)
+	}
+
+	// Invalid msgs are still rejected for existing recipients.
+	_, err := CreateMsgIfRecipientExists(cliCtx, alice, bob, nil)
+	require.Error(t, err)
+	require.NotEqual(t, ErrRecipientNotFound, err)
+}
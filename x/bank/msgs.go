@@ -2,6 +2,7 @@ package bank
 
 import (
 	"encoding/json"
+	"fmt"
 
 	sdk "github.com/cosmos/cosmos-sdk/types"
 )
@@ -28,31 +29,7 @@ func (msg MsgSend) Type() string  { return "send" }
 func (msg MsgSend) ValidateBasic() sdk.Error {
 	// this just makes sure all the inputs and outputs are properly formatted,
 	// not that they actually have the money inside
-	if len(msg.Inputs) == 0 {
-		return ErrNoInputs(DefaultCodespace).TraceSDK("")
-	}
-	if len(msg.Outputs) == 0 {
-		return ErrNoOutputs(DefaultCodespace).TraceSDK("")
-	}
-	// make sure all inputs and outputs are individually valid
-	var totalIn, totalOut sdk.Coins
-	for _, in := range msg.Inputs {
-		if err := in.ValidateBasic(); err != nil {
-			return err.TraceSDK("")
-		}
-		totalIn = totalIn.Plus(in.Coins)
-	}
-	for _, out := range msg.Outputs {
-		if err := out.ValidateBasic(); err != nil {
-			return err.TraceSDK("")
-		}
-		totalOut = totalOut.Plus(out.Coins)
-	}
-	// make sure inputs and outputs match
-	if !totalIn.IsEqual(totalOut) {
-		return sdk.ErrInvalidCoins(totalIn.String()).TraceSDK("inputs and outputs don't match")
-	}
-	return nil
+	return ValidateInputsOutputs(msg.Inputs, msg.Outputs)
 }
 
 // Implements Msg.
@@ -145,6 +122,37 @@ func (msg MsgIssue) GetSigners() []sdk.AccAddress {
 	return []sdk.AccAddress{msg.Banker}
 }
 
+// ValidateInputsOutputs validates that there is at least one input and one
+// output, that each of them carries only positive coins and that the total
+// input coins equal the total output coins for every denomination.
+func ValidateInputsOutputs(inputs []Input, outputs []Output) sdk.Error {
+	if len(inputs) == 0 {
+		return ErrNoInputs(DefaultCodespace).TraceSDK("")
+	}
+	if len(outputs) == 0 {
+		return ErrNoOutputs(DefaultCodespace).TraceSDK("")
+	}
+	// make sure all inputs and outputs are individually valid
+	var totalIn, totalOut sdk.Coins
+	for _, in := range inputs {
+		if err := in.ValidateBasic(); err != nil {
+			return err.TraceSDK("")
+		}
+		totalIn = totalIn.Plus(in.Coins)
+	}
+	for _, out := range outputs {
+		if err := out.ValidateBasic(); err != nil {
+			return err.TraceSDK("")
+		}
+		totalOut = totalOut.Plus(out.Coins)
+	}
+	// make sure inputs and outputs match per denomination
+	if !totalIn.IsEqual(totalOut) {
+		return sdk.ErrInvalidCoins(totalIn.String()).TraceSDK("inputs and outputs don't match")
+	}
+	return nil
+}
+
 //----------------------------------------
 // Input
 
@@ -186,6 +194,15 @@ func NewInput(addr sdk.AccAddress, coins sdk.Coins) Input {
 	return input
 }
 
+// NewInputChecked creates a transaction input like NewInput, but returns an
+// error describing the problem if coins are not a valid amount to send.
+func NewInputChecked(addr sdk.AccAddress, coins sdk.Coins) (Input, sdk.Error) {
+	if err := validateSendCoins(coins); err != nil {
+		return Input{}, err
+	}
+	return NewInput(addr, coins), nil
+}
+
 //----------------------------------------
 // Output
 
@@ -226,3 +243,37 @@ func NewOutput(addr sdk.AccAddress, coins sdk.Coins) Output {
 	}
 	return output
 }
+
+// NewOutputChecked creates a transaction output like NewOutput, but returns
+// an error describing the problem if coins are not a valid amount to send.
+func NewOutputChecked(addr sdk.AccAddress, coins sdk.Coins) (Output, sdk.Error) {
+	if err := validateSendCoins(coins); err != nil {
+		return Output{}, err
+	}
+	return NewOutput(addr, coins), nil
+}
+
+// validateSendCoins returns an error naming the first reason coins can't be
+// sent: no coins, a zero or negative amount, or denoms which are unsorted or
+// duplicate.
+func validateSendCoins(coins sdk.Coins) sdk.Error {
+	if len(coins) == 0 {
+		return sdk.ErrInvalidCoins("no coins")
+	}
+	for i, coin := range coins {
+		if coin.Amount.Sign() <= 0 {
+			return sdk.ErrInvalidCoins(fmt.Sprintf("amount of %s is not positive: %s", coin.Denom, coins))
+		}
+		if i == 0 {
+			continue
+		}
+		prev := coins[i-1].Denom
+		if coin.Denom == prev {
+			return sdk.ErrInvalidCoins(fmt.Sprintf("duplicate denom %s: %s", coin.Denom, coins))
+		}
+		if coin.Denom < prev {
+			return sdk.ErrInvalidCoins(fmt.Sprintf("denoms are not sorted: %s", coins))
+		}
+	}
+	return nil
+}
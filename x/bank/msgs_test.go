@@ -109,6 +109,40 @@ func TestOutputValidation(t *testing.T) {
 	}
 }
 
+func TestNewInputOutputChecked(t *testing.T) {
+	addr := sdk.AccAddress([]byte{1, 2})
+
+	cases := []struct {
+		coins  sdk.Coins
+		errMsg string
+	}{
+		{sdk.Coins{sdk.NewInt64Coin("atom", 123), sdk.NewInt64Coin("eth", 20)}, ""},
+		{nil, "no coins"},
+		{sdk.Coins{}, "no coins"},
+		{sdk.Coins{sdk.NewInt64Coin("atom", 0)}, "amount of atom is not positive"},
+		{sdk.Coins{sdk.NewInt64Coin("atom", 20), sdk.NewInt64Coin("eth", -34)}, "amount of eth is not positive"},
+		{sdk.Coins{sdk.NewInt64Coin("eth", 1), sdk.NewInt64Coin("atom", 1)}, "denoms are not sorted"},
+		{sdk.Coins{sdk.NewInt64Coin("atom", 1), sdk.NewInt64Coin("atom", 2)}, "duplicate denom atom"},
+	}
+
+	for i, tc := range cases {
+		in, inErr := NewInputChecked(addr, tc.coins)
+		out, outErr := NewOutputChecked(addr, tc.coins)
+		if tc.errMsg == "" {
+			require.Nil(t, inErr, "%d: %+v", i, inErr)
+			require.Nil(t, outErr, "%d: %+v", i, outErr)
+			require.Equal(t, NewInput(addr, tc.coins), in)
+			require.Equal(t, NewOutput(addr, tc.coins), out)
+			continue
+		}
+		require.NotNil(t, inErr, "%d", i)
+		require.NotNil(t, outErr, "%d", i)
+		require.Equal(t, sdk.CodeInvalidCoins, inErr.Code())
+		require.Contains(t, inErr.Error(), tc.errMsg, "%d", i)
+		require.Contains(t, outErr.Error(), tc.errMsg, "%d", i)
+	}
+}
+
 func TestMsgSendValidation(t *testing.T) {
 	addr1 := sdk.AccAddress([]byte{1, 2})
 	addr2 := sdk.AccAddress([]byte{7, 8})
@@ -177,6 +211,48 @@ func TestMsgSendValidation(t *testing.T) {
 	}
 }
 
+func TestValidateInputsOutputs(t *testing.T) {
+	addr1 := sdk.AccAddress([]byte{1, 2})
+	addr2 := sdk.AccAddress([]byte{7, 8})
+	atom100 := sdk.Coins{sdk.NewInt64Coin("atom", 100)}
+	atom50 := sdk.Coins{sdk.NewInt64Coin("atom", 50)}
+	eth50 := sdk.Coins{sdk.NewInt64Coin("eth", 50)}
+	atom50eth50 := sdk.Coins{sdk.NewInt64Coin("atom", 50), sdk.NewInt64Coin("eth", 50)}
+	atom0 := sdk.Coins{sdk.NewInt64Coin("atom", 0)}
+	atomMinus := sdk.Coins{sdk.NewInt64Coin("atom", -50)}
+
+	cases := []struct {
+		valid   bool
+		inputs  []Input
+		outputs []Output
+	}{
+		{false, nil, nil},
+		{false, []Input{NewInput(addr1, atom100)}, nil},
+		{false, nil, []Output{NewOutput(addr2, atom100)}},
+		{false, []Input{NewInput(addr1, atom0)}, []Output{NewOutput(addr2, atom0)}},
+		{false, []Input{NewInput(addr1, atomMinus)}, []Output{NewOutput(addr2, atomMinus)}},
+		// totals match in amount but not per denom
+		{false, []Input{NewInput(addr1, atom50), NewInput(addr2, atom50)},
+			[]Output{NewOutput(addr2, atom50), NewOutput(addr1, eth50)}},
+		{false, []Input{NewInput(addr1, atom100)},
+			[]Output{NewOutput(addr2, atom50)}},
+
+		{true, []Input{NewInput(addr1, atom50), NewInput(addr2, atom50)},
+			[]Output{NewOutput(addr2, atom100)}},
+		{true, []Input{NewInput(addr1, atom50), NewInput(addr2, eth50)},
+			[]Output{NewOutput(addr2, atom50eth50)}},
+	}
+
+	for i, tc := range cases {
+		err := ValidateInputsOutputs(tc.inputs, tc.outputs)
+		if tc.valid {
+			require.Nil(t, err, "%d: %+v", i, err)
+		} else {
+			require.NotNil(t, err, "%d", i)
+		}
+	}
+}
+
 func TestMsgSendGetSignBytes(t *testing.T) {
 	addr1 := sdk.AccAddress([]byte("input"))
 	addr2 := sdk.AccAddress([]byte("output"))